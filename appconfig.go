@@ -1,8 +1,11 @@
 package goatsms
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"strconv"
 	"strings"
 
@@ -12,8 +15,12 @@ import (
 /* ===== Application Configuration ===== */
 type setting []string
 
+// GetConfig loads the config file, checks the required settings are present,
+// and applies defaults to the optional settings.
+// The returned error describes the problem with the file, such as it being
+// missing, empty or malformed.
 func GetConfig(configFilePath string) (ini.File, error) {
-	appConfig, err := ini.LoadFile(configFilePath)
+	appConfig, err := loadConfig(configFilePath)
 	if err != nil {
 		return nil, err
 	}
@@ -21,6 +28,119 @@ func GetConfig(configFilePath string) (ini.File, error) {
 	if !ok {
 		return nil, err
 	}
+	applyDefaults(appConfig)
+	return appConfig, nil
+}
+
+// defaults are the values of optional settings that are not set in the config file.
+var defaults = map[string]map[string]string{
+	"SETTINGS": {
+		"READONLY":              "false",
+		"ORDERING":              "besteffort",
+		"FIREANDFORGET":         "false",
+		"MAXINFLIGHT":           "0",
+		"MAXCONCURRENTSENDS":    "0",
+		"POLLJITTER":            "10",
+		"STATUSHOOK":            "",
+		"STATUSHOOKTIMEOUT":     "10",
+		"STATUSHOOKCONCURRENCY": "4",
+		"STATUSHOOKQUEUE":       "100",
+		"STATUSHOOKOVERFLOW":    "dropoldest",
+		"STATUSHOOKWAIT":        "5",
+		"SMSMODE":               "pdu",
+		"CONCATREF":             "8",
+		"PARTDELAY":             "0",
+		"GSM7POLICY":            "transliterate",
+		"TRANSLITERATE":         "false",
+		"NORMALIZE":             "false",
+		"MINSIGNAL":             "0",
+		"FAILURELIMIT":          "0",
+		"IDLESLEEP":             "0",
+		"IDLESLEEPCMD":          "+CFUN=0",
+		"IDLEWAKECMD":           "+CFUN=1",
+		"HEALTHPOLL":            "60",
+		"DELIVERYREPORTS":       "false",
+		"SENTMODE":              "accepted",
+		"MODEMSOURCE":           "config",
+		"DELIVERYTIMEOUT":       "1440",
+		"OUTAGEGRACE":           "0",
+		"DEFAULTCC":             "",
+		"DEFAULTCCRULE":         "",
+		"VALIDATENUMBERS":       "false",
+		"DELETERECEIVED":        "false",
+		"IMPORTSTORED":          "false",
+		"REASSEMBLYTIMEOUT":     "60",
+		"REASSEMBLYEXPIRY":      "store",
+		"SIMSELECT":             "+QDSIM={slot}",
+		"SIMSLICE":              "300",
+		"DBMAXOPENCONNS":        "0",
+		"DBMAXIDLECONNS":        "2",
+		"DBCONNMAXLIFETIME":     "0",
+		"DBINTEGRITYCHECK":      "quick",
+		"RETENTIONDAYS":         "0",
+		"RETENTIONMODE":         "redact",
+		"LOGFORMAT":             "text",
+		"LOGLEVEL":              "info",
+		"LOGREPEATINTERVAL":     "60",
+		"SCHEDULELEAD":          "0",
+		"FETCHBATCH":            "0",
+		"SENDWINDOW":            "",
+		"SENDWINDOWTZ":          "",
+		"SENDWINDOWCLASSES":     "",
+		"RETRYAFTER":            "30",
+		"BACKLOGREJECT":         "false",
+		"IDEMPOTENCYTTL":        "24",
+		"PRICEPERSEGMENT":       "0",
+		"READTIMEOUT":           "30",
+		"WRITETIMEOUT":          "30",
+		"IDLETIMEOUT":           "120",
+		"READHEADERTIMEOUT":     "10",
+		"MAXHEADERBYTES":        "16384",
+		"MAXBODYSIZE":           "65536",
+	},
+	"SMPP": {
+		"DEVID":       "smpp",
+		"ENQUIRELINK": "30",
+	},
+}
+
+func applyDefaults(appConfig ini.File) {
+	for name, settings := range defaults {
+		section := appConfig.Section(name)
+		for k, v := range settings {
+			if _, ok := section[k]; !ok {
+				section[k] = v
+			}
+		}
+	}
+}
+
+// loadConfig reads and parses the config file.
+func loadConfig(configFilePath string) (ini.File, error) {
+	data, err := ioutil.ReadFile(configFilePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("config file %s not found", configFilePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s could not be read: %v", configFilePath, err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, fmt.Errorf("config file %s is empty", configFilePath)
+	}
+	appConfig, err := ini.Load(bytes.NewReader(data))
+	var se ini.ErrSyntax
+	if errors.As(err, &se) {
+		return nil, fmt.Errorf("config file %s is malformed: line %d: %s", configFilePath, se.Line, se.Source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s could not be parsed: %v", configFilePath, err)
+	}
+	if len(appConfig) == 0 {
+		return nil, fmt.Errorf("config file %s contains no settings", configFilePath)
+	}
+	if _, ok := appConfig["SETTINGS"]; !ok {
+		return nil, fmt.Errorf("config file %s has no [SETTINGS] section", configFilePath)
+	}
 	return appConfig, nil
 }
 
@@ -46,11 +166,17 @@ func testConfig(appConfig ini.File) (bool, error) {
 
 	//now make sure all the devices are have required settings
 	tno, _ := appConfig.Get("SETTINGS", "DEVICES")
-	noOfDevices, _ := strconv.Atoi(tno)
+	noOfDevices, err := strconv.Atoi(tno)
+	if err != nil || noOfDevices < 0 {
+		return false, errors.New("Fatal: DEVICES is not a valid number: " + tno)
+	}
 	requiredFields = []setting{}
 
 	for i := 0; i < noOfDevices; i++ {
 		d := fmt.Sprintf("DEVICE%v", i)
+		if _, ok := appConfig[d]; !ok {
+			return false, errors.New("Fatal: [" + d + "] section is missing")
+		}
 		sCom := setting{d, "COMPORT"}
 		sBaud := setting{d, "BAUDRATE"}
 		sDevid := setting{d, "DEVID"}
@@ -69,4 +195,38 @@ func testConfig(appConfig ini.File) (bool, error) {
 	return true, nil
 }
 
+// secretKeys are fragments of setting names that indicate the value is secret.
+var secretKeys = []string{"PASSWORD", "SECRET", "TOKEN", "APIKEY"}
+
+// Redacted returns a copy of the config with the values of secret settings,
+// such as passwords, PINs and API keys, replaced with "[redacted]".
+func Redacted(appConfig ini.File) map[string]map[string]string {
+	redacted := make(map[string]map[string]string)
+	for name, section := range appConfig {
+		rs := make(map[string]string)
+		for k, v := range section {
+			if v != "" && isSecret(k) {
+				v = "[redacted]"
+			}
+			rs[k] = v
+		}
+		redacted[name] = rs
+	}
+	return redacted
+}
+
+func isSecret(key string) bool {
+	key = strings.ToUpper(key)
+	// e.g. PIN or SIMPIN
+	if strings.HasSuffix(key, "PIN") {
+		return true
+	}
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
 /* ===== Application Configuration ===== */
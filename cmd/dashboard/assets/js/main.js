@@ -1,5 +1,5 @@
 $(function() {
-  var SMSStatus = ["Pending", "Processed", "Error"]
+  var SMSStatus = ["Pending", "Processed", "Error", "Canceled", "Accepted"]
 
   // SMS Log Table
   var logTable = $('#smsdata').dataTable({
@@ -5,13 +5,29 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/vaughan0/go-ini"
 	"github.com/warthog618/goatsms"
 	"github.com/warthog618/goatsms/internal/db"
+	"github.com/warthog618/goatsms/internal/filter"
+	"github.com/warthog618/goatsms/internal/hook"
+	"github.com/warthog618/goatsms/internal/logger"
 	"github.com/warthog618/goatsms/internal/modem"
 	"github.com/warthog618/goatsms/internal/sender"
+	"github.com/warthog618/goatsms/internal/smpp"
+	"github.com/warthog618/goatsms/internal/translit"
+)
+
+// The database used to store the messages and configuration.
+const (
+	dbDriver = "sqlite3"
+	dbPath   = "goatsms.sqlite"
 )
 
 func main() {
@@ -23,32 +39,240 @@ func main() {
 		log.Println("main: ", "Invalid config: ", err.Error(), " Aborting")
 		os.Exit(1)
 	}
+	if err := initLogger(appConfig); err != nil {
+		log.Println("main: ", "Invalid config: ", err.Error(), " Aborting")
+		os.Exit(1)
+	}
+
+	// a read-only instance shares the database of another instance, so must
+	// not send, or modify the database.
+	readOnly := false
+	if v, ok := appConfig.Get("SETTINGS", "READONLY"); ok && v == "true" {
+		readOnly = true
+		log.Println("main: read-only mode - sending and write endpoints disabled")
+	}
+
+	// a database corrupted by power loss would otherwise fail mysteriously,
+	// or be reinitialised, so check it before use.
+	if check, ok := appConfig.Get("SETTINGS", "DBINTEGRITYCHECK"); ok && check != "off" {
+		if _, err := os.Stat(dbPath); err == nil {
+			if err := db.CheckIntegrity(dbDriver, dbPath, check != "full"); err != nil {
+				log.Println("main: ", err, " Aborting")
+				os.Exit(1)
+			}
+		}
+	}
 
-	store, err := db.New("sqlite3", "goatsms.sqlite")
+	open := db.New
+	if readOnly {
+		open = db.Open
+	}
+	store, err := open(dbDriver, dbPath)
 	if err != nil {
 		log.Println("main: ", "Error initializing database: ", err, " Aborting")
 		os.Exit(1)
 	}
 	defer store.Close()
+	if _maxOpen, ok := appConfig.Get("SETTINGS", "DBMAXOPENCONNS"); ok && _maxOpen != "" {
+		maxOpen, _ := strconv.Atoi(_maxOpen)
+		store.SetMaxOpenConns(maxOpen)
+	}
+	if _maxIdle, ok := appConfig.Get("SETTINGS", "DBMAXIDLECONNS"); ok && _maxIdle != "" {
+		maxIdle, _ := strconv.Atoi(_maxIdle)
+		store.SetMaxIdleConns(maxIdle)
+	}
+	if _maxLifetime, ok := appConfig.Get("SETTINGS", "DBCONNMAXLIFETIME"); ok && _maxLifetime != "" {
+		maxLifetime, _ := time.ParseDuration(_maxLifetime + "m")
+		store.SetConnMaxLifetime(maxLifetime)
+	}
 
 	serverhost, _ := appConfig.Get("SETTINGS", "SERVERHOST")
 	serverport, _ := appConfig.Get("SETTINGS", "SERVERPORT")
 
-	_numDevices, _ := appConfig.Get("SETTINGS", "DEVICES")
-	numDevices, _ := strconv.Atoi(_numDevices)
-	log.Println("main: number of modems: ", numDevices)
+	modemSource, _ := appConfig.Get("SETTINGS", "MODEMSOURCE")
+	var defs []db.Modem
+	switch {
+	case readOnly:
+		// no modems
+	case modemSource == "db":
+		all, err := store.GetModems()
+		if err != nil {
+			log.Println("main: ", "Error reading modems: ", err, " Aborting")
+			os.Exit(1)
+		}
+		for _, m := range all {
+			if m.Enabled {
+				defs = append(defs, m)
+			}
+		}
+	default:
+		_numDevices, _ := appConfig.Get("SETTINGS", "DEVICES")
+		numDevices, _ := strconv.Atoi(_numDevices)
+		for i := 0; i < numDevices; i++ {
+			dev := fmt.Sprintf("DEVICE%v", i)
+			port, _ := appConfig.Get(dev, "COMPORT")
+			baud := 115200
+			_baud, ok := appConfig.Get(dev, "BAUDRATE")
+			if ok {
+				baud, _ = strconv.Atoi(_baud)
+			}
+			devid, _ := appConfig.Get(dev, "DEVID")
+			weight := 1
+			if _weight, ok := appConfig.Get(dev, "WEIGHT"); ok && _weight != "" {
+				var err error
+				weight, err = strconv.Atoi(_weight)
+				if err != nil || weight < 1 {
+					log.Println("main: ", "Invalid WEIGHT for ", dev, ": ", _weight, " Aborting")
+					os.Exit(1)
+				}
+			}
+			defs = append(defs, db.Modem{DevID: devid, Port: port, Baud: baud, Enabled: true, Weight: weight})
+		}
+	}
+	log.Println("main: number of modems: ", len(defs))
+
+	modemOpts := []modem.Option{modem.WithInbox(store)}
+	if deleteReceived, ok := appConfig.Get("SETTINGS", "DELETERECEIVED"); ok && deleteReceived == "true" {
+		modemOpts = append(modemOpts, modem.WithDeleteReceived)
+	}
+	if importStored, ok := appConfig.Get("SETTINGS", "IMPORTSTORED"); ok && importStored == "true" {
+		modemOpts = append(modemOpts, modem.WithImportStored)
+	}
+	if _reassemblyTimeout, ok := appConfig.Get("SETTINGS", "REASSEMBLYTIMEOUT"); ok && _reassemblyTimeout != "" {
+		if reassemblyTimeout, _ := strconv.Atoi(_reassemblyTimeout); reassemblyTimeout > 0 {
+			expiry, _ := appConfig.Get("SETTINGS", "REASSEMBLYEXPIRY")
+			modemOpts = append(modemOpts, modem.WithReassemblyTimeout(time.Duration(reassemblyTimeout)*time.Minute, expiry == "discard"))
+		}
+	}
+	if smsMode, ok := appConfig.Get("SETTINGS", "SMSMODE"); ok && smsMode == "text" {
+		log.Println("main: ", "Warning: SMSMODE is text, so only short ASCII messages can be sent, and messages are not received")
+		modemOpts = append(modemOpts, modem.WithTextMode)
+	}
+	if concatRef, ok := appConfig.Get("SETTINGS", "CONCATREF"); ok && concatRef == "16" {
+		modemOpts = append(modemOpts, modem.WithConcatRef16)
+	}
+	if _partDelay, ok := appConfig.Get("SETTINGS", "PARTDELAY"); ok && _partDelay != "" {
+		partDelay, _ := strconv.Atoi(_partDelay)
+		modemOpts = append(modemOpts, modem.WithPartDelay(time.Duration(partDelay)*time.Millisecond))
+	}
+	encodings, err := loadEncodings(appConfig)
+	if err != nil {
+		log.Println("main: ", "Error reading encodings: ", err, " Aborting")
+		os.Exit(1)
+	}
+	modemOpts = append(modemOpts, modem.WithEncodings(encodings))
+	if policy, ok := appConfig.Get("SETTINGS", "GSM7POLICY"); ok && policy == "replace" {
+		modemOpts = append(modemOpts, modem.WithGSM7Replace)
+	}
+	table, err := loadTransliterations(appConfig)
+	if err != nil {
+		log.Println("main: ", "Error reading transliterations: ", err, " Aborting")
+		os.Exit(1)
+	}
+	if transliterate, ok := appConfig.Get("SETTINGS", "TRANSLITERATE"); ok && transliterate == "true" {
+		modemOpts = append(modemOpts, modem.WithTransliteration(table))
+	} else {
+		modemOpts = append(modemOpts, modem.WithGSM7Table(table))
+	}
+	if _retries, ok := appConfig.Get("SETTINGS", "RETRIES"); ok && _retries != "" {
+		retries, _ := strconv.Atoi(_retries)
+		modemOpts = append(modemOpts, modem.WithRetryLimit(retries))
+	}
+	if _minSignal, ok := appConfig.Get("SETTINGS", "MINSIGNAL"); ok && _minSignal != "" {
+		minSignal, _ := strconv.Atoi(_minSignal)
+		modemOpts = append(modemOpts, modem.WithMinSignal(minSignal))
+	}
+	if _failureLimit, ok := appConfig.Get("SETTINGS", "FAILURELIMIT"); ok && _failureLimit != "" {
+		failureLimit, _ := strconv.Atoi(_failureLimit)
+		modemOpts = append(modemOpts, modem.WithFailureLimit(failureLimit))
+	}
+	_idleSleep, _ := appConfig.Get("SETTINGS", "IDLESLEEP")
+	if idleSleep := seconds(_idleSleep); idleSleep > 0 {
+		sleepCmd, _ := appConfig.Get("SETTINGS", "IDLESLEEPCMD")
+		wakeCmd, _ := appConfig.Get("SETTINGS", "IDLEWAKECMD")
+		modemOpts = append(modemOpts, modem.WithIdleSleep(idleSleep, sleepCmd, wakeCmd))
+	}
+	healthCmds, err := loadHealthCommands(appConfig)
+	if err != nil {
+		log.Println("main: ", "Error reading health commands: ", err, " Aborting")
+		os.Exit(1)
+	}
+	if len(healthCmds) > 0 {
+		healthPoll, _ := appConfig.Get("SETTINGS", "HEALTHPOLL")
+		modemOpts = append(modemOpts, modem.WithHealth(healthCmds, seconds(healthPoll)))
+	}
+	if _maxSends, ok := appConfig.Get("SETTINGS", "MAXCONCURRENTSENDS"); ok && _maxSends != "" {
+		maxSends, _ := strconv.Atoi(_maxSends)
+		if l := modem.NewSendLimit(maxSends); l != nil {
+			modemOpts = append(modemOpts, modem.WithSendLimit(l))
+		}
+	}
+	sentMode, _ := appConfig.Get("SETTINGS", "SENTMODE")
+	if sentMode == "delivered" {
+		modemOpts = append(modemOpts, modem.WithStatusReports)
+	}
+
+	modems := make([]*modem.GSMModem, len(defs))
+	weights := make(map[string]int)
+	weighted := false
+	for i, def := range defs {
+		opts := modemOpts
+		// the per-device settings only apply to modems defined in the config.
+		if modemSource != "db" {
+			dev := fmt.Sprintf("DEVICE%v", i)
+			if smscs, ok := appConfig.Get(dev, "SMSCS"); ok && smscs != "" {
+				opts = append(opts[:len(opts):len(opts)], modem.WithAltSMSCs(strings.Split(smscs, ",")))
+			}
+			if slot, ok := appConfig.Get(dev, "SIMSLOT"); ok && slot != "" {
+				if _, err := strconv.Atoi(slot); err != nil {
+					log.Println("main: ", "Invalid SIMSLOT for ", dev, ": ", slot, " Aborting")
+					os.Exit(1)
+				}
+				simSelect, _ := appConfig.Get("SETTINGS", "SIMSELECT")
+				simSlice, _ := appConfig.Get("SETTINGS", "SIMSLICE")
+				opts = append(opts[:len(opts):len(opts)],
+					modem.WithSIMSlot(strings.Replace(simSelect, "{slot}", slot, -1), seconds(simSlice)))
+			}
+		}
+		modems[i] = modem.New(def.Port, def.Baud, def.DevID, opts...)
+		if def.Weight > 0 {
+			weights[def.DevID] = def.Weight
+			weighted = weighted || def.Weight != 1
+		}
+	}
 
-	modems := make([]*modem.GSMModem, numDevices)
-	for i := 0; i < numDevices; i++ {
-		dev := fmt.Sprintf("DEVICE%v", i)
-		port, _ := appConfig.Get(dev, "COMPORT")
-		baud := 115200
-		_baud, ok := appConfig.Get(dev, "BAUDRATE")
-		if ok {
-			baud, _ = strconv.Atoi(_baud)
+	var upstream *smpp.Upstream
+	if address, _ := appConfig.Get("SMPP", "ADDRESS"); address != "" && !readOnly {
+		devid, _ := appConfig.Get("SMPP", "DEVID")
+		for _, def := range defs {
+			if def.DevID == devid {
+				log.Println("main: ", "SMPP DEVID ", devid, " is already used by a modem. Aborting")
+				os.Exit(1)
+			}
 		}
-		devid, _ := appConfig.Get(dev, "DEVID")
-		modems[i] = modem.New(port, baud, devid)
+		cfg := smpp.Config{Address: address}
+		cfg.SystemID, _ = appConfig.Get("SMPP", "SYSTEMID")
+		cfg.Password, _ = appConfig.Get("SMPP", "PASSWORD")
+		cfg.SystemType, _ = appConfig.Get("SMPP", "SYSTEMTYPE")
+		cfg.Source, _ = appConfig.Get("SMPP", "SOURCE")
+		enquireLink, _ := appConfig.Get("SMPP", "ENQUIRELINK")
+		cfg.EnquireLink = seconds(enquireLink)
+		var opts []smpp.Option
+		if _retries, ok := appConfig.Get("SETTINGS", "RETRIES"); ok && _retries != "" {
+			retries, _ := strconv.Atoi(_retries)
+			opts = append(opts, smpp.WithRetryLimit(retries))
+		}
+		upstream = smpp.New(devid, cfg, opts...)
+		if _weight, _ := appConfig.Get("SMPP", "WEIGHT"); _weight != "" {
+			weight, err := strconv.Atoi(_weight)
+			if err != nil || weight < 1 {
+				log.Println("main: ", "Invalid SMPP WEIGHT: ", _weight, " Aborting")
+				os.Exit(1)
+			}
+			weights[devid] = weight
+			weighted = weighted || weight != 1
+		}
+		log.Println("main: SMPP upstream: ", devid, " ", address)
 	}
 
 	_bufferSize, _ := appConfig.Get("SETTINGS", "BUFFERSIZE")
@@ -60,22 +284,449 @@ func main() {
 	_loaderTimeoutLong, _ := appConfig.Get("SETTINGS", "MSGTIMEOUTLONG")
 	loaderTimeoutLong, _ := time.ParseDuration(_loaderTimeoutLong + "m")
 
+	bl := filter.NewBlocklist(nil, nil)
+	if keywords, ok := appConfig.Get("FILTER", "BLOCKEDKEYWORDS"); ok {
+		bl.AddKeywords(strings.Split(keywords, ",")...)
+	}
+	if prefixes, ok := appConfig.Get("FILTER", "BLOCKEDPREFIXES"); ok {
+		bl.AddPrefixes(strings.Split(prefixes, ",")...)
+	}
+	keywords, prefixes, err := store.GetBlocklist()
+	if err != nil {
+		log.Println("main: ", "Error reading blocklist: ", err, " Aborting")
+		os.Exit(1)
+	}
+	bl.AddKeywords(keywords...)
+	bl.AddPrefixes(prefixes...)
+
+	var num *filter.Normalizer
+	cc, _ := appConfig.Get("SETTINGS", "DEFAULTCC")
+	validate, _ := appConfig.Get("SETTINGS", "VALIDATENUMBERS")
+	if cc != "" || validate == "true" {
+		var rule filter.Rule
+		if cc != "" {
+			if !countryCode.MatchString(cc) {
+				log.Println("main: ", "Invalid DEFAULTCC: ", cc, " Aborting")
+				os.Exit(1)
+			}
+			cc = strings.TrimPrefix(cc, "+")
+			ruleName, _ := appConfig.Get("SETTINGS", "DEFAULTCCRULE")
+			if ruleName == "" {
+				ruleName = filter.DefaultRule(cc)
+			}
+			var ok bool
+			if rule, ok = filter.LookupRule(ruleName); !ok {
+				log.Println("main: ", "Unknown DEFAULTCCRULE: ", ruleName, " Aborting")
+				os.Exit(1)
+			}
+		}
+		num = filter.NewNormalizer(cc, rule, validate == "true")
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		log.Println("main: ", "Received signal: ", <-sig, " Shutting down")
+		cancel()
+	}()
+
+	routeMap, err := store.GetRoutes()
+	if err != nil {
+		log.Println("main: ", "Error reading routes: ", err, " Aborting")
+		os.Exit(1)
+	}
+	// routes from the config override those from the db
+	for prefix, device := range appConfig.Section("ROUTES") {
+		routeMap[prefix] = device
+	}
+	var routes []sender.Route
+	for prefix, device := range routeMap {
+		routes = append(routes, sender.Route{Prefix: prefix, Device: device})
+	}
+
+	_retentionDays, _ := appConfig.Get("SETTINGS", "RETENTIONDAYS")
+	if retentionDays, _ := strconv.Atoi(_retentionDays); retentionDays > 0 && !readOnly {
+		retentionMode, _ := appConfig.Get("SETTINGS", "RETENTIONMODE")
+		retention := time.Duration(retentionDays) * 24 * time.Hour
+		go purgeBodies(ctx, store, retention, retentionMode == "hash")
+	}
 
 	log.Println("main: Initializing sender")
-	s := sender.New(bufferSize, bufferLow)
-	go s.Run(ctx, store, loaderTimeoutLong)
+	_scheduleLead, _ := appConfig.Get("SETTINGS", "SCHEDULELEAD")
+	scheduleLead, _ := time.ParseDuration(_scheduleLead + "s")
+	prices, err := loadPrices(appConfig)
+	if err != nil {
+		log.Println("main: ", "Error reading prices: ", err, " Aborting")
+		os.Exit(1)
+	}
+	senderOpts := []sender.Option{sender.WithRoutes(routes), sender.WithPrices(prices), sender.WithLeadTime(scheduleLead)}
+	if ordering, ok := appConfig.Get("SETTINGS", "ORDERING"); ok && ordering == "strict" {
+		senderOpts = append(senderOpts, sender.WithStrictOrdering)
+	}
+	if fireAndForget, _ := appConfig.Get("SETTINGS", "FIREANDFORGET"); fireAndForget == "true" {
+		senderOpts = append(senderOpts, sender.WithFireAndForget)
+	}
+	if sentMode == "delivered" {
+		_deliveryTimeout, _ := appConfig.Get("SETTINGS", "DELIVERYTIMEOUT")
+		deliveryTimeout, _ := strconv.Atoi(_deliveryTimeout)
+		senderOpts = append(senderOpts, sender.WithDeliveryConfirmation(time.Duration(deliveryTimeout)*time.Minute))
+	}
+	if _outageGrace, ok := appConfig.Get("SETTINGS", "OUTAGEGRACE"); ok && _outageGrace != "" {
+		if outageGrace, _ := strconv.Atoi(_outageGrace); outageGrace > 0 {
+			senderOpts = append(senderOpts, sender.WithOutageGrace(time.Duration(outageGrace)*time.Minute))
+		}
+	}
+	if _jitter, ok := appConfig.Get("SETTINGS", "POLLJITTER"); ok && _jitter != "" {
+		jitter, _ := strconv.Atoi(_jitter)
+		senderOpts = append(senderOpts, sender.WithPollJitter(float64(jitter)/100))
+	}
+	if statusHook, ok := appConfig.Get("SETTINGS", "STATUSHOOK"); ok && statusHook != "" {
+		_timeout, _ := appConfig.Get("SETTINGS", "STATUSHOOKTIMEOUT")
+		_concurrency, _ := appConfig.Get("SETTINGS", "STATUSHOOKCONCURRENCY")
+		concurrency, _ := strconv.Atoi(_concurrency)
+		var hookOpts []hook.Option
+		if _queue, _ := appConfig.Get("SETTINGS", "STATUSHOOKQUEUE"); _queue != "" {
+			queue, _ := strconv.Atoi(_queue)
+			hookOpts = append(hookOpts, hook.WithQueueSize(queue))
+		}
+		switch overflow, _ := appConfig.Get("SETTINGS", "STATUSHOOKOVERFLOW"); overflow {
+		case "block":
+			wait, _ := appConfig.Get("SETTINGS", "STATUSHOOKWAIT")
+			hookOpts = append(hookOpts, hook.WithBlock(seconds(wait)))
+		case "", "dropoldest":
+		default:
+			log.Println("main: ", "Unknown STATUSHOOKOVERFLOW: ", overflow, " Aborting")
+			os.Exit(1)
+		}
+		h := hook.New(statusHook, seconds(_timeout), concurrency, hookOpts...)
+		senderOpts = append(senderOpts, sender.WithStatusHook(h.Notify))
+	}
+	if _maxInFlight, ok := appConfig.Get("SETTINGS", "MAXINFLIGHT"); ok && _maxInFlight != "" {
+		maxInFlight, _ := strconv.Atoi(_maxInFlight)
+		senderOpts = append(senderOpts, sender.WithMaxInFlight(maxInFlight))
+	}
+	if _fetchBatch, ok := appConfig.Get("SETTINGS", "FETCHBATCH"); ok && _fetchBatch != "" {
+		fetchBatch, _ := strconv.Atoi(_fetchBatch)
+		senderOpts = append(senderOpts, sender.WithFetchBatch(fetchBatch))
+	}
+	if window, ok := appConfig.Get("SETTINGS", "SENDWINDOW"); ok && window != "" {
+		tz, _ := appConfig.Get("SETTINGS", "SENDWINDOWTZ")
+		w, err := sender.ParseWindow(window, tz)
+		if err != nil {
+			log.Println("main: ", "Invalid SENDWINDOW: ", err, " Aborting")
+			os.Exit(1)
+		}
+		var classes []string
+		if _classes, _ := appConfig.Get("SETTINGS", "SENDWINDOWCLASSES"); _classes != "" {
+			for _, c := range strings.Split(_classes, ",") {
+				classes = append(classes, strings.TrimSpace(c))
+			}
+		}
+		senderOpts = append(senderOpts, sender.WithSendWindow(w, classes))
+	}
+	if weighted {
+		senderOpts = append(senderOpts, sender.WithWeights(weights))
+	}
+	s := sender.New(bufferSize, bufferLow, senderOpts...)
+	senderDone := make(chan struct{})
+	if readOnly {
+		close(senderDone)
+	} else {
+		go func() {
+			s.Run(ctx, store, loaderTimeoutLong)
+			close(senderDone)
+		}()
+	}
 
 	log.Println("main: Initializing modems")
-	for _, m := range modems {
-		m.Connect(ctx, s)
+	modemSet := modem.NewSet(modems, modemOpts...)
+	modemSet.Connect(ctx, s)
+	if upstream != nil {
+		upstream.Connect(ctx, s)
 	}
 
 	log.Println("main: Initializing server")
-	err = InitServer(store, s, serverhost, serverport)
+	deliveryReports, _ := appConfig.Get("SETTINGS", "DELIVERYREPORTS")
+	normalize, _ := appConfig.Get("SETTINGS", "NORMALIZE")
+	apiKey, _ := appConfig.Get("SETTINGS", "APIKEY")
+	_retryAfter, _ := appConfig.Get("SETTINGS", "RETRYAFTER")
+	retryAfter, _ := strconv.Atoi(_retryAfter)
+	backlogReject, _ := appConfig.Get("SETTINGS", "BACKLOGREJECT")
+	_idempotencyTTL, _ := appConfig.Get("SETTINGS", "IDEMPOTENCYTTL")
+	idempotencyTTL, _ := strconv.Atoi(_idempotencyTTL)
+	readTimeout, _ := appConfig.Get("SETTINGS", "READTIMEOUT")
+	writeTimeout, _ := appConfig.Get("SETTINGS", "WRITETIMEOUT")
+	idleTimeout, _ := appConfig.Get("SETTINGS", "IDLETIMEOUT")
+	readHeaderTimeout, _ := appConfig.Get("SETTINGS", "READHEADERTIMEOUT")
+	_maxHeaderBytes, _ := appConfig.Get("SETTINGS", "MAXHEADERBYTES")
+	maxHeaderBytes, _ := strconv.Atoi(_maxHeaderBytes)
+	_maxBodySize, _ := appConfig.Get("SETTINGS", "MAXBODYSIZE")
+	maxBodySize, _ := strconv.ParseInt(_maxBodySize, 10, 64)
+	logStartupSummary(appConfig, startupSummary{
+		ReadOnly:    readOnly,
+		ModemSource: modemSource,
+		Modems:      defs,
+		Upstream:    upstream != nil,
+		BufferSize:  bufferSize,
+		BufferLow:   bufferLow,
+		PollPeriod:  loaderTimeoutLong,
+	})
+	err = InitServer(ctx, ServerConfig{
+		DB:                store,
+		Sender:            s,
+		Modems:            modemSet,
+		Blocklist:         bl,
+		Numbers:           num,
+		DeliveryReports:   deliveryReports == "true",
+		Normalize:         normalize == "true",
+		Config:            goatsms.Redacted(appConfig),
+		RetryAfter:        retryAfter,
+		BacklogReject:     backlogReject == "true",
+		IdempotencyTTL:    time.Duration(idempotencyTTL) * time.Hour,
+		ModemsFromDB:      modemSource == "db" && !readOnly,
+		ReadOnly:          readOnly,
+		MaxBodySize:       maxBodySize,
+		APIKey:            apiKey,
+		Host:              serverhost,
+		Port:              serverport,
+		ReadTimeout:       seconds(readTimeout),
+		WriteTimeout:      seconds(writeTimeout),
+		IdleTimeout:       seconds(idleTimeout),
+		ReadHeaderTimeout: seconds(readHeaderTimeout),
+		MaxHeaderBytes:    maxHeaderBytes,
+	})
 	if err != nil {
 		log.Println("main: ", "Error starting server: ", err.Error(), " Aborting")
 		os.Exit(1)
 	}
+	// let the sender record the outcome of the messages in progress.
+	<-senderDone
+	// and the upstream return the outcome of any submit in progress, and unbind.
+	if upstream != nil {
+		<-upstream.Stopped()
+	}
+	log.Println("main: ", "Shutdown complete")
+}
+
+// countryCode matches an ITU country code, optionally prefixed with '+'.
+var countryCode = regexp.MustCompile(`^\+?[1-9][0-9]{0,2}$`)
+
+// seconds converts a setting in seconds to a duration.
+// Invalid settings are treated as zero.
+func seconds(v string) time.Duration {
+	n, _ := strconv.Atoi(v)
+	return time.Duration(n) * time.Second
+}
+
+// startupSummary is the effective setup resolved from the config by main.
+type startupSummary struct {
+	ReadOnly    bool
+	ModemSource string
+	Modems      []db.Modem
+	Upstream    bool
+	BufferSize  int
+	BufferLow   int
+	PollPeriod  time.Duration
+}
+
+// logStartupSummary logs the effective setup as a single entry, so the
+// configuration a deployment is actually running with can be confirmed from
+// its logs.
+// Secrets, such as the API key and SMPP password, are not logged.
+func logStartupSummary(appConfig ini.File, s startupSummary) {
+	serverhost, _ := appConfig.Get("SETTINGS", "SERVERHOST")
+	serverport, _ := appConfig.Get("SETTINGS", "SERVERPORT")
+	bind, err := bindAddress(serverhost, serverport)
+	if err != nil {
+		bind = serverhost + ":" + serverport
+	}
+	modems := make([]string, len(s.Modems))
+	for i, m := range s.Modems {
+		modems[i] = fmt.Sprintf("%s:%s@%d", m.DevID, m.Port, m.Baud)
+	}
+	fields := []interface{}{
+		"db_driver", dbDriver,
+		"db_path", dbPath,
+		"bind", bind,
+		"read_only", s.ReadOnly,
+		"modem_source", s.ModemSource,
+		"modem_count", len(s.Modems),
+		"modems", modems,
+	}
+	if s.Upstream {
+		address, _ := appConfig.Get("SMPP", "ADDRESS")
+		devid, _ := appConfig.Get("SMPP", "DEVID")
+		fields = append(fields, "smpp_devid", devid, "smpp_address", address)
+	}
+	maxOpen, _ := appConfig.Get("SETTINGS", "DBMAXOPENCONNS")
+	maxIdle, _ := appConfig.Get("SETTINGS", "DBMAXIDLECONNS")
+	fields = append(fields,
+		"db_max_open_conns", maxOpen,
+		"db_max_idle_conns", maxIdle,
+		"buffer_size", s.BufferSize,
+		"buffer_low", s.BufferLow,
+		"poll_period", s.PollPeriod.String(),
+		"features", enabledFeatures(appConfig))
+	logger.Info("startup summary", fields...)
+}
+
+// enabledFeatures returns the names of the optional features enabled in the
+// config.
+func enabledFeatures(appConfig ini.File) []string {
+	get := func(key string) string {
+		v, _ := appConfig.Get("SETTINGS", key)
+		return v
+	}
+	// positive indicates a numeric setting that enables its feature when
+	// greater than zero.
+	positive := func(key string) bool {
+		n, _ := strconv.Atoi(get(key))
+		return n > 0
+	}
+	features := []struct {
+		name    string
+		enabled bool
+	}{
+		{"api_key", get("APIKEY") != ""},
+		{"delivery_reports", get("DELIVERYREPORTS") == "true"},
+		{"sent_on_delivery", get("SENTMODE") == "delivered"},
+		{"text_mode", get("SMSMODE") == "text"},
+		{"transliterate", get("TRANSLITERATE") == "true"},
+		{"normalize", get("NORMALIZE") == "true"},
+		{"strict_ordering", get("ORDERING") == "strict"},
+		{"fire_and_forget", get("FIREANDFORGET") == "true"},
+		{"status_hook", get("STATUSHOOK") != ""},
+		{"send_window", get("SENDWINDOW") != ""},
+		{"number_normalization", get("DEFAULTCC") != "" || get("VALIDATENUMBERS") == "true"},
+		{"delete_received", get("DELETERECEIVED") == "true"},
+		{"import_stored", get("IMPORTSTORED") == "true"},
+		{"idle_sleep", positive("IDLESLEEP")},
+		{"outage_grace", positive("OUTAGEGRACE")},
+		{"failure_limit", positive("FAILURELIMIT")},
+		{"min_signal", positive("MINSIGNAL")},
+		{"send_limit", positive("MAXCONCURRENTSENDS")},
+		{"retention", positive("RETENTIONDAYS")},
+		{"backlog_reject", get("BACKLOGREJECT") == "true"},
+	}
+	var enabled []string
+	for _, f := range features {
+		if f.enabled {
+			enabled = append(enabled, f.name)
+		}
+	}
+	return enabled
+}
+
+// initLogger configures the default logger from the LOGFORMAT and LOGLEVEL
+// settings, and redirects the standard log output through it.
+func initLogger(appConfig ini.File) error {
+	format := logger.Text
+	if f, ok := appConfig.Get("SETTINGS", "LOGFORMAT"); ok && f != "" {
+		var err error
+		if format, err = logger.ParseFormat(f); err != nil {
+			return err
+		}
+	}
+	level := logger.LevelInfo
+	if l, ok := appConfig.Get("SETTINGS", "LOGLEVEL"); ok && l != "" {
+		var err error
+		if level, err = logger.ParseLevel(l); err != nil {
+			return err
+		}
+	}
+	lg := logger.New(os.Stderr, format, level)
+	if v, ok := appConfig.Get("SETTINGS", "LOGREPEATINTERVAL"); ok && v != "" {
+		lg.SetRepeatInterval(seconds(v))
+	}
+	logger.SetDefault(lg)
+	log.SetFlags(0)
+	log.SetOutput(lg.Writer(logger.LevelInfo))
+	return nil
+}
+
+// loadPrices reads the default price per segment, and the prices for
+// particular destination prefixes, from the config.
+func loadPrices(appConfig ini.File) ([]sender.Price, error) {
+	var prices []sender.Price
+	if v, _ := appConfig.Get("SETTINGS", "PRICEPERSEGMENT"); v != "" {
+		price, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+		prices = append(prices, sender.Price{PerSegment: price})
+	}
+	for prefix, v := range appConfig.Section("PRICES") {
+		price, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", prefix, err)
+		}
+		prices = append(prices, sender.Price{Prefix: prefix, PerSegment: price})
+	}
+	return prices, nil
+}
+
+// loadEncodings reads the encodings forced for particular destination
+// prefixes from the config.
+func loadEncodings(appConfig ini.File) ([]modem.Encoding, error) {
+	var encodings []modem.Encoding
+	for prefix, v := range appConfig.Section("ENCODINGS") {
+		var charset modem.Charset
+		switch v {
+		case "gsm7":
+			charset = modem.CharsetGSM7
+		case "ucs2":
+			charset = modem.CharsetUCS2
+		default:
+			return nil, fmt.Errorf("%s: unknown encoding %q", prefix, v)
+		}
+		encodings = append(encodings, modem.Encoding{Prefix: prefix, Charset: charset})
+	}
+	return encodings, nil
+}
+
+// loadHealthCommands reads the commands that report the health of
+// particular modem models from the config.
+func loadHealthCommands(appConfig ini.File) ([]modem.HealthCommands, error) {
+	var cmds []modem.HealthCommands
+	for model, v := range appConfig.Section("HEALTH") {
+		hc, err := modem.ParseHealthCommands(model, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", model, err)
+		}
+		cmds = append(cmds, hc)
+	}
+	return cmds, nil
+}
+
+// loadTransliterations reads the additions and overrides to the default
+// transliteration table from the config.
+func loadTransliterations(appConfig ini.File) (translit.Table, error) {
+	table := translit.DefaultTable()
+	for k, v := range appConfig.Section("TRANSLITERATIONS") {
+		r, err := parseRune(k)
+		if err != nil {
+			return nil, err
+		}
+		table[r] = v
+	}
+	return table, nil
+}
+
+// parseRune parses a character given either directly or as its code point,
+// U+XXXX.
+func parseRune(v string) (rune, error) {
+	if strings.HasPrefix(v, "U+") && len(v) > 2 {
+		cp, err := strconv.ParseUint(v[2:], 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("%s: invalid code point", v)
+		}
+		return rune(cp), nil
+	}
+	rs := []rune(v)
+	if len(rs) != 1 {
+		return 0, fmt.Errorf("%s: expected a single character", v)
+	}
+	return rs[0], nil
 }
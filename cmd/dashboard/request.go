@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/warthog618/goatsms/internal/modem"
+)
+
+// FieldError describes a request field that failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationResponse is the response structure to requests that fail
+// validation.
+type ValidationResponse struct {
+	Status  int          `json:"status"`
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors"`
+}
+
+// writeValidationErrors responds to the client with a 400 listing the
+// invalid fields.
+func writeValidationErrors(w http.ResponseWriter, errs []FieldError) {
+	writeJSON(w, http.StatusBadRequest, ValidationResponse{
+		Status:  http.StatusBadRequest,
+		Message: "invalid request",
+		Errors:  errs,
+	})
+}
+
+// isJSON indicates if the request body is JSON, rather than form encoded.
+func isJSON(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/json"
+}
+
+// decodeJSON decodes the JSON object in the request body into v, which must
+// be a pointer to a struct.
+// Unlike json.Decoder, each field is decoded independently so that all unknown
+// fields and fields of the wrong type are reported, not just the first.
+// Returns an error if the body is not a JSON object.
+func decodeJSON(r *http.Request, v interface{}) ([]FieldError, error) {
+	var raw map[string]json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&raw)
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return nil, errors.New("invalid JSON: expected an object")
+	}
+	if err != nil {
+		return nil, errors.New("invalid JSON: " + err.Error())
+	}
+	if raw == nil {
+		return nil, errors.New("invalid JSON: expected an object")
+	}
+	rv := reflect.ValueOf(v).Elem()
+	fields := jsonFields(rv.Type())
+	var errs []FieldError
+	for name, val := range raw {
+		i, ok := fields[name]
+		if !ok {
+			errs = append(errs, FieldError{name, "unknown field"})
+			continue
+		}
+		if err := json.Unmarshal(val, rv.Field(i).Addr().Interface()); err != nil {
+			errs = append(errs, FieldError{name, typeErrorMessage(err)})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs, nil
+}
+
+// jsonFields maps the JSON names of the fields of a struct to their index.
+func jsonFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = i
+	}
+	return fields
+}
+
+// typeErrorMessage describes the error from decoding a field.
+func typeErrorMessage(err error) string {
+	var te *json.UnmarshalTypeError
+	if !errors.As(err, &te) {
+		return err.Error()
+	}
+	t := te.Type
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "must be a string"
+	case reflect.Bool:
+		return "must be a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "must be an integer"
+	case reflect.Float32, reflect.Float64:
+		return "must be a number"
+	case reflect.Slice, reflect.Array:
+		return "must be an array"
+	case reflect.Map, reflect.Struct:
+		return "must be an object"
+	}
+	return "invalid value"
+}
+
+// sendSMSRequest is the request structure for /sms/ requests.
+type sendSMSRequest struct {
+	Mobile         string            `json:"mobile"`
+	Mobiles        []string          `json:"mobiles"`
+	Group          string            `json:"group"`
+	Message        string            `json:"message"`
+	SendAt         string            `json:"send_at"`
+	DeliveryReport *bool             `json:"delivery_report"`
+	MaxRetries     *int              `json:"max_retries"`
+	TTL            *int              `json:"ttl"`
+	PID            int               `json:"pid"`
+	DryRun         bool              `json:"dry_run"`
+	Class          string            `json:"class"`
+	Metadata       map[string]string `json:"metadata"`
+	FireAndForget  bool              `json:"fire_and_forget"`
+	MessageClass   *int              `json:"message_class"`
+	Storage        string            `json:"storage"`
+}
+
+// storageClasses maps the storage preferences to the message classes that
+// request them.
+var storageClasses = map[string]int{
+	"me":  1,
+	"sim": 2,
+}
+
+// messageClass returns the message class requested, either directly or by
+// the storage preference, or nil if none is.
+func (req sendSMSRequest) messageClass() *int {
+	if req.MessageClass != nil {
+		return req.MessageClass
+	}
+	if c, ok := storageClasses[req.Storage]; ok {
+		return &c
+	}
+	return nil
+}
+
+// maxMetadataSize is the maximum size, in bytes, of the JSON encoded metadata
+// of an SMS, so clients cannot bloat the database with it.
+const maxMetadataSize = 1024
+
+// parseSendSMSRequest reads a /sms/ request from either a JSON or form
+// encoded body.
+// Returns the fields that could not be decoded, or an error if the body
+// could not be parsed at all.
+func parseSendSMSRequest(r *http.Request) (sendSMSRequest, []FieldError, error) {
+	var req sendSMSRequest
+	if isJSON(r) {
+		errs, err := decodeJSON(r, &req)
+		return req, errs, err
+	}
+	r.ParseForm()
+	var errs []FieldError
+	req.Mobile = r.FormValue("mobile")
+	if mobiles := formList(r, "mobile"); len(mobiles) > 1 {
+		req.Mobiles = mobiles
+	}
+	req.Group = r.FormValue("group")
+	req.Message = r.FormValue("message")
+	req.SendAt = r.FormValue("send_at")
+	req.Class = r.FormValue("class")
+	req.Storage = r.FormValue("storage")
+	if dr := r.FormValue("delivery_report"); dr != "" {
+		b, err := strconv.ParseBool(dr)
+		if err != nil {
+			errs = append(errs, FieldError{"delivery_report", "must be a boolean"})
+		}
+		req.DeliveryReport = &b
+	}
+	if mr := r.FormValue("max_retries"); mr != "" {
+		n, err := strconv.Atoi(mr)
+		if err != nil {
+			errs = append(errs, FieldError{"max_retries", "must be an integer"})
+		}
+		req.MaxRetries = &n
+	}
+	if ttl := r.FormValue("ttl"); ttl != "" {
+		n, err := strconv.Atoi(ttl)
+		if err != nil {
+			errs = append(errs, FieldError{"ttl", "must be an integer"})
+		}
+		req.TTL = &n
+	}
+	if dr := r.FormValue("dry_run"); dr != "" {
+		b, err := strconv.ParseBool(dr)
+		if err != nil {
+			errs = append(errs, FieldError{"dry_run", "must be a boolean"})
+		}
+		req.DryRun = b
+	}
+	if ff := r.FormValue("fire_and_forget"); ff != "" {
+		b, err := strconv.ParseBool(ff)
+		if err != nil {
+			errs = append(errs, FieldError{"fire_and_forget", "must be a boolean"})
+		}
+		req.FireAndForget = b
+	}
+	if md := r.FormValue("metadata"); md != "" {
+		if err := json.Unmarshal([]byte(md), &req.Metadata); err != nil {
+			errs = append(errs, FieldError{"metadata", "must be a JSON object with string values"})
+		}
+	}
+	if mc := r.FormValue("message_class"); mc != "" {
+		n, err := strconv.Atoi(mc)
+		if err != nil {
+			errs = append(errs, FieldError{"message_class", "must be an integer"})
+		}
+		req.MessageClass = &n
+	}
+	if pid := r.FormValue("pid"); pid != "" {
+		// either decimal or 0x prefixed hex.
+		n, err := strconv.ParseInt(pid, 0, 0)
+		if err != nil {
+			errs = append(errs, FieldError{"pid", "must be an integer"})
+		}
+		req.PID = int(n)
+	}
+	return req, errs, nil
+}
+
+// validate checks the values of the request fields.
+func (req sendSMSRequest) validate() []FieldError {
+	var errs []FieldError
+	if req.Mobile == "" && len(req.Mobiles) == 0 && req.Group == "" {
+		errs = append(errs, FieldError{"mobile", "is required, unless mobiles or group is provided"})
+	}
+	for _, m := range req.Mobiles {
+		if m == "" {
+			errs = append(errs, FieldError{"mobiles", "must not contain empty numbers"})
+			break
+		}
+	}
+	if req.Message == "" {
+		errs = append(errs, FieldError{"message", "is required"})
+	}
+	if _, err := parseTime(req.SendAt); err != nil {
+		errs = append(errs, FieldError{"send_at", "must be a date or RFC3339 timestamp"})
+	}
+	if req.MaxRetries != nil && *req.MaxRetries < 0 {
+		errs = append(errs, FieldError{"max_retries", "must not be negative"})
+	}
+	if req.TTL != nil && *req.TTL <= 0 {
+		errs = append(errs, FieldError{"ttl", "must be positive"})
+	}
+	if !modem.ValidPID(req.PID) {
+		errs = append(errs, FieldError{"pid", "is not a supported protocol identifier"})
+	}
+	if req.MessageClass != nil && (*req.MessageClass < 0 || *req.MessageClass > 3) {
+		errs = append(errs, FieldError{"message_class", "must be from 0 to 3"})
+	}
+	if req.Storage != "" {
+		c, ok := storageClasses[req.Storage]
+		switch {
+		case !ok:
+			errs = append(errs, FieldError{"storage", "must be sim or me"})
+		case req.MessageClass != nil && *req.MessageClass != c:
+			errs = append(errs, FieldError{"storage", "conflicts with message_class"})
+		}
+	}
+	if b, _ := json.Marshal(req.Metadata); len(req.Metadata) > 0 && len(b) > maxMetadataSize {
+		errs = append(errs, FieldError{"metadata", fmt.Sprintf("must not exceed %d bytes", maxMetadataSize)})
+	}
+	return errs
+}
+
+// templateSMSRequest is the request structure for /sms/template/ requests.
+type templateSMSRequest struct {
+	Mobile         string            `json:"mobile"`
+	Template       string            `json:"template"`
+	Vars           map[string]string `json:"vars"`
+	DeliveryReport *bool             `json:"delivery_report"`
+}
+
+// validate checks the values of the request fields.
+func (req templateSMSRequest) validate() []FieldError {
+	var errs []FieldError
+	if req.Mobile == "" {
+		errs = append(errs, FieldError{"mobile", "is required"})
+	}
+	if req.Template == "" {
+		errs = append(errs, FieldError{"template", "is required"})
+	}
+	return errs
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/warthog618/goatsms/internal/db"
+)
+
+// purgePeriod is the period between applications of the retention policy.
+const purgePeriod = time.Hour
+
+// purgeBodies periodically purges the bodies of SMSs older than the retention
+// period, until the context is done.
+func purgeBodies(ctx context.Context, store *db.DB, retention time.Duration, hash bool) {
+	t := time.NewTimer(0) // for an immediate purge
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := store.PurgeMessageBodies(time.Now().Add(-retention), hash)
+			if err != nil {
+				log.Println("retention: purge failed:", err)
+			} else if n > 0 {
+				log.Println("retention: purged bodies:", n)
+			}
+			t.Reset(purgePeriod)
+		}
+	}
+}
@@ -1,16 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	ttemplate "text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/warthog618/goatsms/internal/db"
+	"github.com/warthog618/goatsms/internal/filter"
+	"github.com/warthog618/goatsms/internal/modem"
 	"github.com/warthog618/goatsms/internal/sender"
 )
 
@@ -18,6 +36,8 @@ import (
 type SMSResponse struct {
 	Status  int    `json:"status"`
 	Message string `json:"message"`
+	// BatchID identifies the SMSs queued by a group send.
+	BatchID string `json:"batch_id,omitempty"`
 }
 
 // SMSDataResponse defines the response structure to /smsdata/ requests.
@@ -27,6 +47,140 @@ type SMSDataResponse struct {
 	Summary  []int          `json:"summary"`
 	DayCount map[string]int `json:"daycount"`
 	Messages []db.SMS       `json:"messages"`
+	// NextCursor is the after_id for the next page of messages, if any.
+	NextCursor int64 `json:"next_cursor,omitempty"`
+}
+
+// InboxResponse defines the response structure to /inbox/ requests.
+type InboxResponse struct {
+	Status   int             `json:"status"`
+	Message  string          `json:"message"`
+	Messages []db.InboundSMS `json:"messages"`
+}
+
+// ReviewResponse defines the response structure to /review/ requests.
+type ReviewResponse struct {
+	Status   int      `json:"status"`
+	Message  string   `json:"message"`
+	Messages []db.SMS `json:"messages"`
+}
+
+// ResendResponse defines the response structure to /review/{uuid}/resend
+// requests.
+type ResendResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	SMS     db.SMS `json:"sms"`
+}
+
+// GroupsResponse defines the response structure to /groups/ requests.
+type GroupsResponse struct {
+	Status  int                 `json:"status"`
+	Message string              `json:"message"`
+	Groups  map[string][]string `json:"groups"`
+}
+
+// BatchResponse defines the response structure to /batches/ requests.
+type BatchResponse struct {
+	Status  int            `json:"status"`
+	Message string         `json:"message"`
+	Batch   db.BatchStatus `json:"batch"`
+}
+
+// CancelBatchResponse defines the response structure to /batches/{id}/cancel
+// requests.
+type CancelBatchResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// Canceled is the number of SMSs canceled by the request.
+	Canceled int            `json:"canceled"`
+	Batch    db.BatchStatus `json:"batch"`
+}
+
+// ConfigResponse defines the response structure to /config/ requests.
+type ConfigResponse struct {
+	Status  int                          `json:"status"`
+	Message string                       `json:"message"`
+	Config  map[string]map[string]string `json:"config"`
+}
+
+// StatsResponse defines the response structure to /stats/ requests.
+type StatsResponse struct {
+	Status  int          `json:"status"`
+	Message string       `json:"message"`
+	Stats   sender.Stats `json:"stats"`
+	// Paused indicates sending has been paused by a /pause request.
+	Paused bool `json:"paused"`
+}
+
+// PauseResponse defines the response structure to /pause and /resume
+// requests.
+type PauseResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	Paused  bool   `json:"paused"`
+}
+
+// DBStatsResponse defines the response structure to /db/stats requests.
+type DBStatsResponse struct {
+	Status  int      `json:"status"`
+	Message string   `json:"message"`
+	Stats   db.Stats `json:"stats"`
+}
+
+// VacuumResponse defines the response structure to /db/vacuum requests.
+type VacuumResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// SizeBefore and SizeAfter are the size of the database, in bytes,
+	// before and after the vacuum.
+	SizeBefore int64 `json:"size_before"`
+	SizeAfter  int64 `json:"size_after"`
+}
+
+// QuoteResponse defines the response structure to /sms/quote requests.
+type QuoteResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	modem.Quote
+	Cost float64 `json:"cost"`
+	// Warning highlights aspects of the encoding that increase cost, such as
+	// the use of UCS2.
+	Warning string `json:"warning,omitempty"`
+	// RawLength and NormalizedLength are the lengths, in characters, of the
+	// message before and after normalization, if enabled.
+	RawLength        int `json:"raw_length,omitempty"`
+	NormalizedLength int `json:"normalized_length,omitempty"`
+}
+
+// DailyReportResponse defines the response structure to /reports/daily
+// requests.
+type DailyReportResponse struct {
+	Status  int           `json:"status"`
+	Message string        `json:"message"`
+	Days    []db.DayCount `json:"days"`
+}
+
+// UsageResponse defines the response structure to /usage/ requests.
+type UsageResponse struct {
+	Status  int      `json:"status"`
+	Message string   `json:"message"`
+	Usage   db.Usage `json:"usage"`
+}
+
+// ContactsResponse defines the response structure to /modems/{device}/contacts
+// requests.
+type ContactsResponse struct {
+	Status    int             `json:"status"`
+	Message   string          `json:"message"`
+	Phonebook modem.Phonebook `json:"phonebook"`
+}
+
+// StatusResponse defines the response structure to /status/ requests.
+type StatusResponse struct {
+	Status  int            `json:"status"`
+	Message string         `json:"message"`
+	Modems  []modem.Status `json:"modems"`
 }
 
 /* dashboard handlers */
@@ -51,80 +205,1843 @@ func staticHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, filepath.Join("./assets", static))
 }
 
+// notFoundPage is returned for requests for unknown pages.
+const notFoundPage = `<!DOCTYPE html>
+<html>
+<head><title>404 Not Found</title></head>
+<body>
+<h1>Not Found</h1>
+<p>The requested page does not exist. Return to the <a href="/">dashboard</a>.</p>
+</body>
+</html>
+`
+
+// notFoundHandler responds to requests for unknown pages.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- notFoundHandler", r.URL.Path)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	io.WriteString(w, notFoundPage)
+}
+
 /* end dashboard handlers */
 
+// apiNotFoundHandler responds to requests for unknown API endpoints, with
+// the same JSON structure as other API errors.
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- apiNotFoundHandler", r.URL.Path)
+	writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "unknown endpoint"})
+}
+
+// apiMethodNotAllowedHandler responds to requests for API endpoints that do
+// not support the request method, with the same JSON structure as other API
+// errors.
+func apiMethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- apiMethodNotAllowedHandler", r.Method, r.URL.Path)
+	writeJSON(w, http.StatusMethodNotAllowed, SMSResponse{Status: http.StatusMethodNotAllowed, Message: "method not allowed"})
+}
+
 /* API handlers */
 
+// writeJSON writes the response to the client as JSON, with the given HTTP status code.
+func writeJSON(w http.ResponseWriter, code int, resp interface{}) {
+	toWrite, err := json.Marshal(resp)
+	if err != nil {
+		log.Println(err)
+		//lets just depend on the server to raise 500
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(code)
+	w.Write(toWrite)
+}
+
+// newUUID returns a random, version 4, UUID for an SMS or batch.
+// Unlike version 1 UUIDs, these reveal nothing of the host, such as its MAC
+// address, or of when they were generated.
+func newUUID() string {
+	return uuid.New().String()
+}
+
+// screenSMS normalizes and validates the mobile, and screens the SMS.
+// Returns the response to be returned to the client if the SMS is not
+// acceptable.
+func screenSMS(bl *filter.Blocklist, num *filter.Normalizer, sms *db.SMS) (SMSResponse, bool) {
+	sms.Mobile = num.Normalize(sms.Mobile)
+	if err := num.Check(sms.Mobile); err != nil {
+		log.Println("rejected: ", sms.Mobile, err)
+		return SMSResponse{Status: http.StatusBadRequest, Message: "invalid mobile: " + err.Error()}, false
+	}
+	if err := bl.Check(sms.Mobile, sms.Body); err != nil {
+		log.Println("rejected: ", sms.Mobile, err)
+		return SMSResponse{Status: http.StatusForbidden, Message: err.Error()}, false
+	}
+	return SMSResponse{}, true
+}
+
+// rejectSMS records an SMS rejected by screenSMS, if it was blocked, rather
+// than just malformed, so the rejection can be audited.
+func rejectSMS(s *sender.Sender, rsp SMSResponse, sms db.SMS) {
+	if rsp.Status == http.StatusForbidden {
+		sms.UUID = newUUID()
+		s.RejectMessage(sms, rsp.Message)
+	}
+}
+
+// queueSMS screens the SMS and, if acceptable, assigns it a UUID and passes
+// it to the sender.
+// Blocked SMSs are recorded as errored.
+// Returns the response to be returned to the client.
+func queueSMS(s *sender.Sender, bl *filter.Blocklist, num *filter.Normalizer, sms db.SMS) SMSResponse {
+	if rsp, ok := screenSMS(bl, num, &sms); !ok {
+		rejectSMS(s, rsp, sms)
+		return rsp
+	}
+	sms.UUID = newUUID()
+	s.AddMessage(sms)
+	return SMSResponse{Status: 200, Message: "ok"}
+}
+
+// DryRunResult is the outcome of a dry run send to one recipient.
+type DryRunResult struct {
+	// Status and Message are as would be returned had the SMS been sent
+	// to the recipient alone.
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// Mobile is the normalized mobile.
+	Mobile string `json:"mobile"`
+	// UUID is the UUID the SMS would have been assigned, if accepted.
+	UUID string `json:"uuid,omitempty"`
+	*modem.Quote
+	Cost float64 `json:"cost,omitempty"`
+}
+
+// DryRunResponse defines the response structure to dry run /sms/ requests.
+type DryRunResponse struct {
+	Status  int            `json:"status"`
+	Message string         `json:"message"`
+	Results []DryRunResult `json:"results"`
+}
+
+// dryRunSMS screens and quotes a copy of the SMS to each of the mobiles,
+// without queueing them.
+// The quotes are omitted if there are no modems.
+func dryRunSMS(modems []*modem.GSMModem, s *sender.Sender, bl *filter.Blocklist, num *filter.Normalizer, mobiles []string, sms db.SMS) DryRunResponse {
+	rsp := DryRunResponse{Status: http.StatusOK, Message: "dry run", Results: []DryRunResult{}}
+	accepted := 0
+	for _, mobile := range mobiles {
+		sms.Mobile = mobile
+		res := DryRunResult{Status: http.StatusOK, Message: "ok"}
+		if srsp, ok := screenSMS(bl, num, &sms); !ok {
+			res.Status, res.Message = srsp.Status, srsp.Message
+		} else {
+			accepted++
+			res.UUID = newUUID()
+			if len(modems) > 0 {
+				// the modems share the same encoding configuration, so any will do.
+				q, err := modems[0].Quote(sms)
+				if err != nil {
+					res.Status, res.Message = http.StatusBadRequest, err.Error()
+				} else {
+					res.Quote = &q
+					res.Cost = s.Price(sms.Mobile) * float64(q.Segments)
+				}
+			}
+		}
+		res.Mobile = sms.Mobile
+		rsp.Results = append(rsp.Results, res)
+	}
+	if len(rsp.Results) == 1 {
+		rsp.Status = rsp.Results[0].Status
+	} else if accepted == 0 {
+		rsp.Status = http.StatusForbidden
+	}
+	return rsp
+}
+
+// queueGroupSMS queues a copy of the SMS for each member of the group.
+// Returns the response to be returned to the client.
+func queueGroupSMS(d *db.DB, s *sender.Sender, bl *filter.Blocklist, num *filter.Normalizer, group string, sms db.SMS) SMSResponse {
+	mobiles, err := d.GetGroupMembers(group)
+	if err == sql.ErrNoRows {
+		return SMSResponse{Status: http.StatusNotFound, Message: "unknown group"}
+	}
+	if err != nil {
+		log.Println(err)
+		return SMSResponse{Status: http.StatusInternalServerError, Message: "error reading group"}
+	}
+	if len(mobiles) == 0 {
+		return SMSResponse{Status: http.StatusBadRequest, Message: "group has no members"}
+	}
+	return queueBatchSMS(s, bl, num, mobiles, sms)
+}
+
+// queueBatchSMS queues a copy of the SMS for each of the mobiles, linked by a
+// common batch id.
+// Mobiles rejected by the blocklist are skipped.
+// Returns the response to be returned to the client.
+func queueBatchSMS(s *sender.Sender, bl *filter.Blocklist, num *filter.Normalizer, mobiles []string, sms db.SMS) SMSResponse {
+	sms.BatchID = newUUID()
+	queued := 0
+	for _, mobile := range mobiles {
+		sms.Mobile = mobile
+		if rsp := queueSMS(s, bl, num, sms); rsp.Status == 200 {
+			queued++
+		}
+	}
+	if queued == 0 {
+		return SMSResponse{Status: http.StatusForbidden, Message: "all recipients rejected"}
+	}
+	return SMSResponse{
+		Status:  200,
+		Message: fmt.Sprintf("queued %d of %d", queued, len(mobiles)),
+		BatchID: sms.BatchID,
+	}
+}
+
 // sendSMSHandler push sms, allowed methods: POST
-func sendSMSHandler(s *sender.Sender) func(w http.ResponseWriter, r *http.Request) {
+// The request may be either form or JSON encoded.
+// The SMS is sent to either the mobile, or each member of the group.
+// If several mobiles are provided, either as repeated parameters or a comma
+// separated list, the SMS is sent to each as a batch.
+// If dry_run is set the SMS is validated, screened and quoted for each
+// recipient, but not queued.
+func sendSMSHandler(d *db.DB, s *sender.Sender, modems *modem.Set, bl *filter.Blocklist, num *filter.Normalizer, deliveryReports, normalize bool) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("--- sendSMSHandler")
-		w.Header().Set("Content-type", "application/json")
 
-		//TODO: validation
+		req, errs, err := parseSendSMSRequest(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+		// normalized before validation, so a message that is only whitespace
+		// is rejected.
+		raw := req.Message
+		if normalize {
+			req.Message = filter.NormalizeText(req.Message)
+		}
+		if len(errs) == 0 {
+			errs = req.validate()
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		sms := db.SMS{
+			Mobile:         req.Mobile,
+			Body:           req.Message,
+			DeliveryReport: deliveryReports,
+			MaxRetries:     req.MaxRetries,
+			PID:            req.PID,
+			Class:          req.Class,
+			MessageClass:   req.messageClass(),
+			Metadata:       req.Metadata,
+			FireAndForget:  req.FireAndForget,
+		}
+		if normalize {
+			sms.RawLength = utf8.RuneCountInString(raw)
+			sms.NormalizedLength = utf8.RuneCountInString(sms.Body)
+		}
+		if req.DeliveryReport != nil {
+			sms.DeliveryReport = *req.DeliveryReport
+		}
+		// validated above
+		sendAt, _ := parseTime(req.SendAt)
+		if !sendAt.IsZero() {
+			sms.SendAt = sendAt.UTC().Format(db.TimestampFormat)
+		}
+		if req.TTL != nil {
+			// the TTL runs from when the SMS may be sent.
+			start := time.Now()
+			if sendAt.After(start) {
+				start = sendAt
+			}
+			sms.ExpiresAt = start.Add(time.Duration(*req.TTL) * time.Second).UTC().Format(db.TimestampFormat)
+		}
+		if req.DryRun {
+			mobiles := req.Mobiles
+			if req.Group != "" {
+				var err error
+				mobiles, err = d.GetGroupMembers(req.Group)
+				if err == sql.ErrNoRows {
+					writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "unknown group"})
+					return
+				}
+				if err != nil {
+					log.Println(err)
+					writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading group"})
+					return
+				}
+			} else if len(mobiles) == 0 {
+				mobiles = []string{req.Mobile}
+			}
+			rsp := dryRunSMS(modems.List(), s, bl, num, mobiles, sms)
+			writeJSON(w, rsp.Status, rsp)
+			return
+		}
+		var smsresp SMSResponse
+		if req.Group != "" {
+			smsresp = queueGroupSMS(d, s, bl, num, req.Group, sms)
+		} else if len(req.Mobiles) > 0 {
+			smsresp = queueBatchSMS(s, bl, num, req.Mobiles, sms)
+		} else {
+			smsresp = queueSMS(s, bl, num, sms)
+		}
+		writeJSON(w, smsresp.Status, smsresp)
+	}
+}
+
+// normalizeBody normalizes the body of a text SMS, recording its length
+// before and after.
+func normalizeBody(sms *db.SMS) {
+	sms.RawLength = utf8.RuneCountInString(sms.Body)
+	sms.Body = filter.NormalizeText(sms.Body)
+	sms.NormalizedLength = utf8.RuneCountInString(sms.Body)
+}
+
+// sendDataSMSHandler pushes a binary data sms, allowed methods: POST
+// The payload and optional UDH are hex encoded, and the payload is sent as is
+// using 8-bit encoding, split into several parts if necessary.
+func sendDataSMSHandler(s *sender.Sender, bl *filter.Blocklist, num *filter.Normalizer, deliveryReports bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- sendDataSMSHandler")
+
+		r.ParseForm()
+		sms := db.SMS{
+			Mobile:         r.FormValue("mobile"),
+			Body:           strings.ToUpper(r.FormValue("payload")),
+			UDH:            strings.ToUpper(r.FormValue("udh")),
+			Data:           true,
+			DeliveryReport: deliveryReports,
+		}
+		if dr := r.FormValue("delivery_report"); dr != "" {
+			sms.DeliveryReport = dr == "true"
+		}
+		if sms.Mobile == "" {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "mobile is required"})
+			return
+		}
+		if _, err := modem.ParseData(sms.Body, sms.UDH); err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+		smsresp := queueSMS(s, bl, num, sms)
+		writeJSON(w, smsresp.Status, smsresp)
+	}
+}
+
+// quoteSMSHandler determines the encoding, number of segments and cost of
+// sending an sms, without queueing it, allowed methods: POST
+// The mobile is normalized as per a send, so the quote matches it.
+func quoteSMSHandler(set *modem.Set, s *sender.Sender, num *filter.Normalizer, normalize bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- quoteSMSHandler")
+
 		r.ParseForm()
-		mobile := r.FormValue("mobile")
-		message := r.FormValue("message")
-		uuid := uuid.New()
-		s.AddMessage(db.SMS{UUID: uuid.String(), Mobile: mobile, Body: message})
+		modems := set.List()
+		if len(modems) == 0 {
+			writeJSON(w, http.StatusServiceUnavailable, SMSResponse{Status: http.StatusServiceUnavailable, Message: "no modems"})
+			return
+		}
+		sms := db.SMS{Mobile: num.Normalize(r.FormValue("mobile")), Body: r.FormValue("message")}
+		if normalize {
+			normalizeBody(&sms)
+		}
+		// the modems share the same encoding configuration, so any will do.
+		q, err := modems[0].Quote(sms)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+		rsp := QuoteResponse{
+			Status:           200,
+			Message:          "ok",
+			Quote:            q,
+			Cost:             s.Price(sms.Mobile) * float64(q.Segments),
+			RawLength:        sms.RawLength,
+			NormalizedLength: sms.NormalizedLength,
+		}
+		if q.Encoding == "ucs2" {
+			rsp.Warning = "message contains characters outside the GSM 7-bit alphabet so is sent as UCS-2, which holds 70 characters per segment rather than 160"
+			if t := q.UCS2Trigger; t != nil {
+				rsp.Warning = fmt.Sprintf("character %q at index %d forces UCS-2, which holds 70 characters per segment rather than 160", t.Char, t.Index)
+			}
+		}
+		writeJSON(w, http.StatusOK, rsp)
+	}
+}
+
+// sendTemplateSMSHandler renders a stored template and pushes the resulting sms,
+// allowed methods: POST
+func sendTemplateSMSHandler(d *db.DB, s *sender.Sender, bl *filter.Blocklist, num *filter.Normalizer, deliveryReports, normalize bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- sendTemplateSMSHandler")
 
-		smsresp := SMSResponse{Status: 200, Message: "ok"}
-		toWrite, err := json.Marshal(smsresp)
+		var req templateSMSRequest
+		errs, err := decodeJSON(r, &req)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+		if len(errs) == 0 {
+			errs = req.validate()
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		body, err := d.GetTemplate(req.Template)
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "unknown template"})
+			return
+		}
 		if err != nil {
 			log.Println(err)
-			//lets just depend on the server to raise 500
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading template"})
+			return
+		}
+		message, err := renderTemplate(req.Template, body, req.Vars)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+		sms := db.SMS{Mobile: req.Mobile, Body: message, DeliveryReport: deliveryReports}
+		if normalize {
+			normalizeBody(&sms)
+		}
+		if sms.Body == "" {
+			writeValidationErrors(w, []FieldError{{"vars", "render an empty message"}})
+			return
+		}
+		if req.DeliveryReport != nil {
+			sms.DeliveryReport = *req.DeliveryReport
+		}
+		smsresp := queueSMS(s, bl, num, sms)
+		writeJSON(w, smsresp.Status, smsresp)
+	}
+}
+
+// addTemplateHandler stores a message template, allowed methods: POST
+func addTemplateHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- addTemplateHandler")
+
+		r.ParseForm()
+		name := r.FormValue("name")
+		body := r.FormValue("body")
+		if name == "" {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "name is required"})
+			return
+		}
+		if strings.TrimSpace(body) == "" {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "body is required"})
+			return
+		}
+		if _, err := parseTemplate(name, body); err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: err.Error()})
+			return
 		}
-		w.Write(toWrite)
+		if err := d.InsertTemplate(name, body); err != nil {
+			writeJSON(w, http.StatusConflict, SMSResponse{Status: http.StatusConflict, Message: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, SMSResponse{Status: 200, Message: "ok"})
+	}
+}
+
+// parseTemplate parses a message template, which may only contain text and
+// references to variables, such as {{.name}}.
+// Functions, pipelines and control structures are rejected, as they could be
+// used to exhaust the memory or CPU of the server when rendered.
+func parseTemplate(name, body string) (*ttemplate.Template, error) {
+	t, err := ttemplate.New(name).Option("missingkey=error").Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Templates()) > 1 {
+		return nil, fmt.Errorf("template: %s: defining templates is not allowed", name)
+	}
+	if t.Tree == nil {
+		// an empty body.
+		return t, nil
+	}
+	for _, n := range t.Tree.Root.Nodes {
+		switch n := n.(type) {
+		case *parse.TextNode:
+			continue
+		case *parse.ActionNode:
+			if isVarRef(n.Pipe) {
+				continue
+			}
+		}
+		return nil, fmt.Errorf("template: %s: only text and variable references, such as {{.name}}, are allowed, not %s", name, n)
 	}
+	return t, nil
 }
 
-// getLogsHandler dumps JSON data, used by log view. Methods allowed: GET
+// isVarRef indicates the pipeline is a plain variable reference, such as
+// {{.name}}.
+func isVarRef(p *parse.PipeNode) bool {
+	if len(p.Decl) != 0 || len(p.Cmds) != 1 || len(p.Cmds[0].Args) != 1 {
+		return false
+	}
+	f, ok := p.Cmds[0].Args[0].(*parse.FieldNode)
+	return ok && len(f.Ident) == 1
+}
+
+// renderTemplate renders a message body from the template and variables.
+// All variables referenced by the template must be provided.
+// Templates stored before the restrictions of parseTemplate are subject to
+// them when rendered.
+func renderTemplate(name, body string, vars map[string]string) (string, error) {
+	t, err := parseTemplate(name, body)
+	if err != nil {
+		return "", err
+	}
+	var msg strings.Builder
+	if err := t.Execute(&msg, vars); err != nil {
+		return "", err
+	}
+	return msg.String(), nil
+}
+
+// defaultPageSize is the number of messages in a page of logs, if the limit
+// is not specified.
+const defaultPageSize = 50
+
+// getLogsHandler dumps JSON data, used by log view.
+// If either the after_id or limit parameters are provided then a page of
+// messages is returned, else all messages.
+// Methods allowed: GET
 func getLogsHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("--- getLogsHandler")
-		messages, _ := d.GetMessages("")
+		r.ParseForm()
+		var messages []db.SMS
+		var next int64
+		if r.FormValue("after_id") != "" || r.FormValue("limit") != "" {
+			afterID, err := parseInt(r.FormValue("after_id"))
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid after_id: " + err.Error()})
+				return
+			}
+			limit, err := parseInt(r.FormValue("limit"))
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid limit: " + err.Error()})
+				return
+			}
+			if limit <= 0 {
+				limit = defaultPageSize
+			}
+			messages, next, err = d.GetMessagesPage(int64(afterID), limit)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: err.Error()})
+				return
+			}
+		} else {
+			messages, _ = d.GetMessages("")
+		}
 		summary, _ := d.GetStatusSummary()
 		dayCount, _ := d.GetLast7DaysMessageCount()
 		logs := SMSDataResponse{
-			Status:   200,
-			Message:  "ok",
-			Summary:  summary,
-			DayCount: dayCount,
-			Messages: messages,
+			Status:     200,
+			Message:    "ok",
+			Summary:    summary,
+			DayCount:   dayCount,
+			Messages:   messages,
+			NextCursor: next,
+		}
+		writeJSON(w, http.StatusOK, logs)
+	}
+}
+
+// getInboxHandler dumps the received SMSs, optionally filtered by the mobile,
+// device, since, and until parameters, and paged by limit and offset.
+// Methods allowed: GET
+func getInboxHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getInboxHandler")
+		r.ParseForm()
+		filter := db.InboxFilter{
+			Mobile: r.FormValue("mobile"),
+			Device: r.FormValue("device"),
+			Unread: r.FormValue("unread") == "true",
 		}
-		toWrite, err := json.Marshal(logs)
+		var err error
+		if filter.Since, err = parseTime(r.FormValue("since")); err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid since: " + err.Error()})
+			return
+		}
+		if filter.Until, err = parseTime(r.FormValue("until")); err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid until: " + err.Error()})
+			return
+		}
+		if filter.Limit, err = parseInt(r.FormValue("limit")); err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid limit: " + err.Error()})
+			return
+		}
+		if filter.Offset, err = parseInt(r.FormValue("offset")); err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid offset: " + err.Error()})
+			return
+		}
+		messages, err := d.GetInboxMessages(filter)
 		if err != nil {
 			log.Println(err)
-			//lets just depend on the server to raise 500
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading inbox"})
+			return
 		}
-		w.Header().Set("Content-type", "application/json")
-		w.Write(toWrite)
+		writeJSON(w, http.StatusOK, InboxResponse{Status: 200, Message: "ok", Messages: messages})
 	}
 }
 
-/* end API handlers */
+// markInboxReadHandler sets the read state of a received SMS.
+// The optional read parameter may be set false to mark the SMS unread.
+// Methods allowed: POST
+func markInboxReadHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- markInboxReadHandler")
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid id"})
+			return
+		}
+		r.ParseForm()
+		read := r.FormValue("read") != "false"
+		err = d.MarkInboxMessageRead(id, read)
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "unknown message"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error updating inbox"})
+			return
+		}
+		writeJSON(w, http.StatusOK, SMSResponse{Status: 200, Message: "ok"})
+	}
+}
 
-// InitServer runs a http server.
-func InitServer(d *db.DB, s *sender.Sender, host string, port string) error {
-	log.Println("--- InitServer ", host, port)
+// defaultReviewLimit is the number of errored SMSs returned by /review/ if no
+// limit is given.
+const defaultReviewLimit = 100
 
-	r := mux.NewRouter()
-	r.StrictSlash(true)
+// getReviewHandler dumps the errored SMSs awaiting review, most recently
+// failed first, paged by limit and offset. Methods allowed: GET
+func getReviewHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getReviewHandler")
+		r.ParseForm()
+		limit, err := parseInt(r.FormValue("limit"))
+		if err != nil || limit < 0 {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid limit"})
+			return
+		}
+		if limit == 0 {
+			limit = defaultReviewLimit
+		}
+		offset, err := parseInt(r.FormValue("offset"))
+		if err != nil || offset < 0 {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid offset"})
+			return
+		}
+		messages, err := d.GetErroredMessages(limit, offset)
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading messages"})
+			return
+		}
+		writeJSON(w, http.StatusOK, ReviewResponse{Status: 200, Message: "ok", Messages: messages})
+	}
+}
 
-	r.HandleFunc("/", indexHandler())
+// resendSMSHandler sends a copy of an SMS, optionally to a corrected number,
+// as a new SMS linked to the original, leaving the original unchanged.
+// Methods allowed: POST
+func resendSMSHandler(d *db.DB, s *sender.Sender, bl *filter.Blocklist, num *filter.Normalizer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- resendSMSHandler")
+		r.ParseForm()
+		orig, err := d.GetMessage(mux.Vars(r)["uuid"])
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "no message with that uuid"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading message"})
+			return
+		}
+		if orig.Purged {
+			writeJSON(w, http.StatusConflict, SMSResponse{Status: http.StatusConflict, Message: "message body has been purged"})
+			return
+		}
+		sms := db.SMS{
+			Mobile:           orig.Mobile,
+			Body:             orig.Body,
+			DeliveryReport:   orig.DeliveryReport,
+			MaxRetries:       orig.MaxRetries,
+			Data:             orig.Data,
+			UDH:              orig.UDH,
+			PID:              orig.PID,
+			Class:            orig.Class,
+			MessageClass:     orig.MessageClass,
+			Metadata:         orig.Metadata,
+			ResentFrom:       orig.UUID,
+			RawLength:        orig.RawLength,
+			NormalizedLength: orig.NormalizedLength,
+		}
+		if mobile := strings.TrimSpace(r.FormValue("mobile")); mobile != "" {
+			sms.Mobile = mobile
+		}
+		if rsp, ok := screenSMS(bl, num, &sms); !ok {
+			rejectSMS(s, rsp, sms)
+			writeJSON(w, rsp.Status, rsp)
+			return
+		}
+		sms.UUID = newUUID()
+		s.AddMessage(sms)
+		writeJSON(w, http.StatusOK, ResendResponse{Status: 200, Message: "ok", SMS: sms})
+	}
+}
 
-	// handle static files
-	r.HandleFunc(`/assets/{path:[a-zA-Z0-9=\-\/\.\_]+}`, staticHandler)
+// resendHandler requeues an errored SMS, optionally to the corrected number
+// given by the mobile parameter.
+// The retries are reset unless the reset_retries parameter is false.
+// Methods allowed: POST
+func resendHandler(d *db.DB, s *sender.Sender, bl *filter.Blocklist, num *filter.Normalizer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- resendHandler")
+		r.ParseForm()
+		mobile := strings.TrimSpace(r.FormValue("mobile"))
+		if mobile != "" {
+			mobile = num.Normalize(mobile)
+			if err := num.Check(mobile); err != nil {
+				writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid mobile: " + err.Error()})
+				return
+			}
+			if err := bl.Check(mobile, ""); err != nil {
+				log.Println("rejected: ", mobile, err)
+				writeJSON(w, http.StatusForbidden, SMSResponse{Status: http.StatusForbidden, Message: err.Error()})
+				return
+			}
+		}
+		resetRetries := true
+		if reset := r.FormValue("reset_retries"); reset != "" {
+			var err error
+			if resetRetries, err = strconv.ParseBool(reset); err != nil {
+				writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid reset_retries"})
+				return
+			}
+		}
+		sms, err := s.Resend(r.Context(), d, mux.Vars(r)["uuid"], mobile, resetRetries)
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "no errored message with that uuid"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error resending message"})
+			return
+		}
+		writeJSON(w, http.StatusOK, ResendResponse{Status: 200, Message: "ok", SMS: sms})
+	}
+}
 
-	// all API handlers
-	api := r.PathPrefix("/api").Subrouter()
+// getGroupsHandler dumps the groups and their members. Methods allowed: GET
+func getGroupsHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getGroupsHandler")
+		groups, err := d.GetGroups()
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading groups"})
+			return
+		}
+		writeJSON(w, http.StatusOK, GroupsResponse{Status: 200, Message: "ok", Groups: groups})
+	}
+}
 
-	api.Methods("GET").Path("/logs/").HandlerFunc(getLogsHandler(d))
-	api.Methods("POST").Path("/sms/").HandlerFunc(sendSMSHandler(s))
+// addGroupMembersHandler adds members to a group, creating the group if
+// necessary.
+// The members are provided as one or more mobile parameters, each of which
+// may be a comma separated list.
+// Methods allowed: POST
+func addGroupMembersHandler(d *db.DB, num *filter.Normalizer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- addGroupMembersHandler")
+		r.ParseForm()
+		name := r.FormValue("name")
+		if name == "" {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "name is required"})
+			return
+		}
+		mobiles := formList(r, "mobile")
+		for i, m := range mobiles {
+			mobiles[i] = num.Normalize(m)
+		}
+		if err := d.AddGroupMembers(name, mobiles); err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error updating group"})
+			return
+		}
+		writeJSON(w, http.StatusOK, SMSResponse{Status: 200, Message: "ok"})
+	}
+}
+
+// deleteGroupHandler deletes a group, or a member from a group if the mobile
+// is provided in the path.
+// Methods allowed: DELETE
+func deleteGroupHandler(d *db.DB, num *filter.Normalizer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- deleteGroupHandler")
+		vars := mux.Vars(r)
+		var err error
+		if mobile, ok := vars["mobile"]; ok {
+			err = d.RemoveGroupMember(vars["name"], num.Normalize(mobile))
+		} else {
+			err = d.DeleteGroup(vars["name"])
+		}
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "unknown group or member"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error updating group"})
+			return
+		}
+		writeJSON(w, http.StatusOK, SMSResponse{Status: 200, Message: "ok"})
+	}
+}
 
-	http.Handle("/", r)
+// getBatchHandler dumps the progress of a batch of SMSs. Methods allowed: GET
+func getBatchHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getBatchHandler")
+		bs, err := d.GetBatchStatus(mux.Vars(r)["id"])
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "unknown batch"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading batch"})
+			return
+		}
+		writeJSON(w, http.StatusOK, BatchResponse{Status: 200, Message: "ok", Batch: bs})
+	}
+}
 
-	bind := fmt.Sprintf("%s:%s", host, port)
-	log.Println("listening on: ", bind)
-	return http.ListenAndServe(bind, nil)
+// cancelBatchHandler cancels the SMSs in a batch that are yet to be sent.
+// Methods allowed: POST
+func cancelBatchHandler(d *db.DB, s *sender.Sender) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- cancelBatchHandler")
+		id := mux.Vars(r)["id"]
+		n, err := s.CancelBatch(r.Context(), d, id)
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "unknown batch"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error canceling batch"})
+			return
+		}
+		bs, err := d.GetBatchStatus(id)
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading batch"})
+			return
+		}
+		writeJSON(w, http.StatusOK, CancelBatchResponse{Status: 200, Message: "ok", Canceled: n, Batch: bs})
+	}
+}
+
+// maxReportDays is the maximum number of days covered by a daily report.
+const maxReportDays = 366
+
+// getDailyReportHandler dumps the number of SMSs created on each day in the
+// range bounded by the from and to parameters, inclusive.
+// Methods allowed: GET
+func getDailyReportHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getDailyReportHandler")
+		r.ParseForm()
+		from, err := parseTime(r.FormValue("from"))
+		if err != nil || from.IsZero() {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid from, expected a date"})
+			return
+		}
+		to, err := parseTime(r.FormValue("to"))
+		if err != nil || to.IsZero() {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid to, expected a date"})
+			return
+		}
+		if to.Before(from) {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "to is before from"})
+			return
+		}
+		if to.Sub(from) >= maxReportDays*24*time.Hour {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: fmt.Sprintf("range exceeds %d days", maxReportDays)})
+			return
+		}
+		days, err := d.GetMessageCountByDay(from, to)
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading report"})
+			return
+		}
+		writeJSON(w, http.StatusOK, DailyReportResponse{Status: 200, Message: "ok", Days: days})
+	}
+}
+
+// getUsageHandler dumps the number and cost of the SMSs sent, optionally
+// limited to the period bounded by the since and until parameters.
+// Methods allowed: GET
+func getUsageHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getUsageHandler")
+		r.ParseForm()
+		since, err := parseTime(r.FormValue("since"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid since: " + err.Error()})
+			return
+		}
+		until, err := parseTime(r.FormValue("until"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid until: " + err.Error()})
+			return
+		}
+		usage, err := d.GetUsage(since, until)
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading usage"})
+			return
+		}
+		writeJSON(w, http.StatusOK, UsageResponse{Status: 200, Message: "ok", Usage: usage})
+	}
+}
+
+// getDBStatsHandler dumps the size and content of the database.
+// Methods allowed: GET
+func getDBStatsHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getDBStatsHandler")
+		st, err := d.GetStats()
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading database stats"})
+			return
+		}
+		writeJSON(w, http.StatusOK, DBStatsResponse{Status: 200, Message: "ok", Stats: st})
+	}
+}
+
+// vacuumHandler compacts the database, reclaiming the space freed by deleted
+// messages.
+// The sender is paused while the database is compacted.
+// Methods allowed: POST
+func vacuumHandler(d *db.DB, s *sender.Sender) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- vacuumHandler")
+		var before, after db.Stats
+		err := s.Exclusive(r.Context(), func() (err error) {
+			if before, err = d.GetStats(); err != nil {
+				return err
+			}
+			if err = d.Vacuum(); err != nil {
+				return err
+			}
+			after, err = d.GetStats()
+			return err
+		})
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error compacting database: " + err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, VacuumResponse{Status: 200, Message: "ok", SizeBefore: before.Size, SizeAfter: after.Size})
+	}
+}
+
+// backupHandler downloads a consistent backup of the database, such as for
+// off-box backups.
+// The backup is written to a temporary file, which is then streamed, so the
+// database is not locked while the download is in progress.
+// Methods allowed: GET
+func backupHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- backupHandler")
+		fail := func(err error) {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error backing up database: " + err.Error()})
+		}
+		dir, err := ioutil.TempDir("", "goatsms-backup")
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer os.RemoveAll(dir)
+		name := "goatsms-" + time.Now().UTC().Format("20060102T150405Z") + ".sqlite"
+		path := filepath.Join(dir, name)
+		if err = d.Backup(path); err != nil {
+			fail(err)
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			fail(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		if _, err = io.Copy(w, f); err != nil {
+			log.Println("backup download failed:", err)
+		}
+	}
+}
+
+// formList returns the values of a parameter that may be repeated, each of
+// which may be a comma separated list.
+// The form must already have been parsed.
+func formList(r *http.Request, key string) []string {
+	var list []string
+	for _, v := range r.Form[key] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// parseTime parses a time parameter, which may be either a date or RFC3339 timestamp.
+// An empty parameter returns the zero time.
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// parseInt parses an optional integer parameter.
+// An empty parameter returns zero.
+func parseInt(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// getStatusHandler dumps the state of the modems. Methods allowed: GET
+func getStatusHandler(set *modem.Set, s *sender.Sender) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getStatusHandler")
+		modems := set.List()
+		status := StatusResponse{
+			Status:  200,
+			Message: "ok",
+			Modems:  make([]modem.Status, len(modems)),
+		}
+		inFlight := s.Stats().InFlight
+		for i, m := range modems {
+			status.Modems[i] = m.Status()
+			status.Modems[i].InFlight = inFlight[status.Modems[i].DeviceID]
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// ModemInfo is the operational view of a modem.
+// The remaining daily quota is not included, as daily caps are not yet
+// enforced by the sender, so it would not reflect what the modem may send.
+type ModemInfo struct {
+	modem.Status
+	// Uptime is the time, in seconds, the modem has been connected, or 0 if
+	// not connected.
+	Uptime int64 `json:"uptime"`
+}
+
+// ModemsResponse defines the response structure to /modems/
+type ModemsResponse struct {
+	Status  int         `json:"status"`
+	Message string      `json:"message"`
+	Modems  []ModemInfo `json:"modems"`
+}
+
+// getModemsHandler dumps the operational view of all the modems, including
+// those disabled in the database.
+// The status of each modem is a snapshot, so is consistent.
+// Methods allowed: GET
+func getModemsHandler(d *db.DB, set *modem.Set, s *sender.Sender, modemsFromDB bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getModemsHandler")
+		now := time.Now()
+		var defs []db.Modem
+		if modemsFromDB {
+			var err error
+			if defs, err = d.GetModems(); err != nil {
+				log.Println(err)
+				writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading modems"})
+				return
+			}
+		}
+		inFlight := s.Stats().InFlight
+		resp := ModemsResponse{Status: 200, Message: "ok", Modems: []ModemInfo{}}
+		listed := make(map[string]bool)
+		for _, m := range set.List() {
+			info := ModemInfo{Status: m.Status()}
+			info.InFlight = inFlight[info.DeviceID]
+			if info.Connected {
+				info.Uptime = int64(now.Sub(info.ConnectedSince).Seconds())
+			}
+			listed[info.DeviceID] = true
+			resp.Modems = append(resp.Modems, info)
+		}
+		for _, def := range defs {
+			if !def.Enabled && !listed[def.DevID] {
+				resp.Modems = append(resp.Modems, ModemInfo{
+					Status: modem.Status{DeviceID: def.DevID, Port: def.Port, State: "disabled"},
+				})
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// getContactsHandler dumps the contacts stored in a modem's phonebook,
+// optionally from the storage given by the storage parameter, such as SM for
+// the SIM. Methods allowed: GET
+func getContactsHandler(modems *modem.Set) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getContactsHandler")
+		r.ParseForm()
+		m := modems.Lookup(mux.Vars(r)["device"])
+		if m == nil {
+			writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "unknown device"})
+			return
+		}
+		pb, err := m.ListContacts(r.Context(), strings.ToUpper(r.FormValue("storage")))
+		if err == modem.ErrNotConnected {
+			writeJSON(w, http.StatusServiceUnavailable, SMSResponse{Status: http.StatusServiceUnavailable, Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusBadGateway, SMSResponse{Status: http.StatusBadGateway, Message: "error reading phonebook: " + err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, ContactsResponse{Status: 200, Message: "ok", Phonebook: pb})
+	}
+}
+
+// getStatsHandler dumps the counts of SMSs processed since startup.
+// Methods allowed: GET
+func getStatsHandler(s *sender.Sender) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getStatsHandler")
+		writeJSON(w, http.StatusOK, StatsResponse{Status: 200, Message: "ok", Stats: s.Stats(), Paused: s.Paused()})
+	}
+}
+
+// pauseHandler stops the sending of SMSs, which continue to be accepted and
+// remain pending until sending is resumed. Methods allowed: POST
+func pauseHandler(s *sender.Sender) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- pauseHandler")
+		s.Pause()
+		log.Println("sending paused")
+		writeJSON(w, http.StatusOK, PauseResponse{Status: 200, Message: "ok", Paused: true})
+	}
+}
+
+// resumeHandler restarts the sending of SMSs. Methods allowed: POST
+func resumeHandler(s *sender.Sender) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- resumeHandler")
+		s.Resume()
+		log.Println("sending resumed")
+		writeJSON(w, http.StatusOK, PauseResponse{Status: 200, Message: "ok", Paused: false})
+	}
+}
+
+// refillHandler has the sender check the database for pending SMSs now,
+// rather than at the next poll, such as after SMSs have been inserted by
+// another process. Methods allowed: POST
+func refillHandler(s *sender.Sender) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- refillHandler")
+		s.Refill()
+		writeJSON(w, http.StatusOK, SMSResponse{Status: 200, Message: "ok"})
+	}
+}
+
+// getConfigHandler dumps the effective configuration, with secrets redacted.
+// Methods allowed: GET
+func getConfigHandler(config map[string]map[string]string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getConfigHandler")
+		writeJSON(w, http.StatusOK, ConfigResponse{Status: 200, Message: "ok", Config: config})
+	}
+}
+
+// requireAPIKey wraps the handler so that requests must provide the API key
+// in the X-API-Key header.
+// If the key is empty then requests are not checked.
+func requireAPIKey(key string, h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	if key == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(key)) != 1 {
+			log.Println("unauthorized: ", r.URL.Path, r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized, SMSResponse{Status: http.StatusUnauthorized, Message: "unauthorized"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// requireConfiguredAPIKey wraps the handler, as per requireAPIKey, for
+// endpoints exposing sensitive data, such as the whole database, which must
+// never be open.
+// If the key is empty then all requests are refused.
+func requireConfiguredAPIKey(key string, h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	if key == "" {
+		return func(w http.ResponseWriter, r *http.Request) {
+			log.Println("forbidden, as no APIKEY is set: ", r.URL.Path, r.RemoteAddr)
+			writeJSON(w, http.StatusForbidden, SMSResponse{Status: http.StatusForbidden, Message: "forbidden, as no APIKEY is configured"})
+		}
+	}
+	return requireAPIKey(key, h)
+}
+
+// throttle wraps the send handler so that, while the sender is backlogged,
+// responses include a Retry-After header asking clients to slow down.
+// If reject is set then requests are refused with 429 Too Many Requests,
+// rather than being queued.
+func throttle(s *sender.Sender, retryAfter int, reject bool, h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Backlogged() {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			if reject {
+				log.Println("backlogged: ", r.URL.Path, r.RemoteAddr)
+				writeJSON(w, http.StatusTooManyRequests, SMSResponse{Status: http.StatusTooManyRequests, Message: "backlogged"})
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// maxIdempotencyKey is the maximum length of an Idempotency-Key.
+const maxIdempotencyKey = 255
+
+// defaultIdempotencyLease is the time allowed for a request with an
+// Idempotency-Key to complete if there is no write timeout.
+const defaultIdempotencyLease = 5 * time.Minute
+
+// idempotencyLease returns the time allowed for a request with an
+// Idempotency-Key to complete, after which it is assumed to have been
+// interrupted.
+// The request cannot outlast the write timeout, as the response could no
+// longer be written.
+func idempotencyLease(writeTimeout time.Duration) time.Duration {
+	if writeTimeout <= 0 {
+		return defaultIdempotencyLease
+	}
+	return writeTimeout
+}
+
+// idempotent records the responses to requests with an Idempotency-Key
+// header, so a client repeating a request, even after a restart, receives the
+// original response rather than the SMS being sent again.
+// Responses to requests that failed, or were throttled, are not recorded so
+// the request may be repeated.
+// Keys are recorded for the ttl, or not at all if the ttl is 0.
+// A request still without a response after the lease is assumed to have been
+// interrupted, such as by a restart, so may be repeated.
+func idempotent(d *db.DB, ttl, lease time.Duration, h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || ttl <= 0 {
+			h(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "Idempotency-Key too long"})
+			return
+		}
+		now := time.Now()
+		ok, rsp, err := d.ReserveIdempotencyKey(key, now.Add(-ttl), now.Add(-lease))
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error checking Idempotency-Key"})
+			return
+		}
+		if !ok {
+			if rsp.Code == 0 {
+				writeJSON(w, http.StatusConflict, SMSResponse{Status: http.StatusConflict, Message: "request with the same Idempotency-Key in progress"})
+				return
+			}
+			log.Println("replaying response: ", key)
+			w.Header().Set("Content-type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(rsp.Code)
+			w.Write(rsp.Body)
+			return
+		}
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		if rec.status >= http.StatusInternalServerError || rec.status == http.StatusTooManyRequests {
+			err = d.ReleaseIdempotencyKey(key)
+		} else {
+			err = d.SaveIdempotentResponse(key, db.IdempotentResponse{Code: rec.status, Body: rec.body.Bytes()})
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// responseRecorder passes a response through to the client, while recording
+// the status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	rr.body.Write(p)
+	return rr.ResponseWriter.Write(p)
+}
+
+// limitBody returns middleware that limits request bodies to maxBytes.
+// Larger requests are rejected with 413 Request Entity Too Large, rather than
+// being buffered by the handlers.
+func limitBody(maxBytes int64) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				writeJSON(w, http.StatusRequestEntityTooLarge, SMSResponse{Status: http.StatusRequestEntityTooLarge, Message: "request too large"})
+				return
+			}
+			// the handlers ignore errors parsing the body, so read it here
+			// to detect bodies that exceed the limit.
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+			if err != nil {
+				writeJSON(w, http.StatusRequestEntityTooLarge, SMSResponse{Status: http.StatusRequestEntityTooLarge, Message: "request too large"})
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// gzipMinSize is the minimum size, in bytes, of responses that are
+// compressed, as compressing smaller responses saves little.
+const gzipMinSize = 1024
+
+// compress is middleware that gzip compresses responses to clients that
+// accept it, unless the response is small or already compressed.
+func compress(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.Close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip determines if the Accept-Encoding of the request allows a gzip
+// compressed response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(enc, ";")
+		name := strings.TrimSpace(params[0])
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		for _, p := range params[1:] {
+			if q := strings.TrimSpace(p); strings.HasPrefix(q, "q=") {
+				if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter compresses the response written to it.
+// The response is buffered until it reaches gzipMinSize, so that smaller
+// responses may be written uncompressed.
+type gzipWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+	// passthrough indicates the response is being written uncompressed.
+	passthrough bool
+}
+
+// WriteHeader records the status, which is written with the first part of
+// the body, once it is known if the response is to be compressed.
+func (g *gzipWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(p)
+	case g.passthrough:
+		return g.ResponseWriter.Write(p)
+	}
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start writes the header and buffered body, compressed unless the response
+// is already compressed.
+func (g *gzipWriter) start() error {
+	h := g.Header()
+	if h.Get("Content-Type") == "" {
+		// as net/http would, had the body not been compressed.
+		h.Set("Content-Type", http.DetectContentType(g.buf))
+	}
+	buf := g.buf
+	g.buf = nil
+	if h.Get("Content-Encoding") != "" || compressedType(h.Get("Content-Type")) {
+		g.passthrough = true
+		g.ResponseWriter.WriteHeader(g.status)
+		_, err := g.ResponseWriter.Write(buf)
+		return err
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	_, err := g.gz.Write(buf)
+	return err
+}
+
+// Close completes the response, writing it uncompressed if it is smaller than
+// gzipMinSize.
+func (g *gzipWriter) Close() error {
+	switch {
+	case g.gz != nil:
+		return g.gz.Close()
+	case g.passthrough, g.status == 0:
+		return nil
+	}
+	g.passthrough = true
+	g.ResponseWriter.WriteHeader(g.status)
+	_, err := g.ResponseWriter.Write(g.buf)
+	return err
+}
+
+// compressedType determines if content of the type is already compressed, so
+// would not benefit from further compression.
+func compressedType(contentType string) bool {
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/gzip", "application/x-gzip", "application/zip"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/* end API handlers */
+
+// ModemResponse defines the response structure to /modems/ requests.
+type ModemResponse struct {
+	Status  int          `json:"status"`
+	Message string       `json:"message"`
+	Modem   modem.Status `json:"modem"`
+}
+
+// addModemHandler adds a modem, such as a USB modem that has just been
+// plugged in, which starts sending SMSs once it passes its self-test.
+// The modem is not added to the config so does not persist across restarts.
+// Methods allowed: POST
+func addModemHandler(modems *modem.Set) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- addModemHandler")
+		r.ParseForm()
+		port := r.FormValue("comport")
+		devid := r.FormValue("devid")
+		if port == "" || devid == "" {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "comport and devid are required"})
+			return
+		}
+		baud := 115200
+		if b := r.FormValue("baudrate"); b != "" {
+			var err error
+			if baud, err = strconv.Atoi(b); err != nil || baud <= 0 {
+				writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid baudrate"})
+				return
+			}
+		}
+		m, err := modems.Add(port, baud, devid)
+		if err == modem.ErrDuplicateDevice {
+			writeJSON(w, http.StatusConflict, SMSResponse{Status: http.StatusConflict, Message: "device already exists"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error adding modem: " + err.Error()})
+			return
+		}
+		log.Println("modem added:", devid, port)
+		writeJSON(w, http.StatusOK, ModemResponse{Status: 200, Message: "ok", Modem: m.Status()})
+	}
+}
+
+// removeModemHandler removes a modem, such as before it is unplugged.
+// SMSs waiting to be sent by the modem are passed to the other modems, and
+// the response is returned once any send in progress has completed.
+// Methods allowed: DELETE
+func removeModemHandler(modems *modem.Set) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- removeModemHandler")
+		devid := mux.Vars(r)["device"]
+		err := modems.Remove(r.Context(), devid)
+		if err == modem.ErrUnknownDevice {
+			writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "unknown device"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error removing modem: " + err.Error()})
+			return
+		}
+		log.Println("modem removed:", devid)
+		writeJSON(w, http.StatusOK, SMSResponse{Status: 200, Message: "ok"})
+	}
+}
+
+// enableModemHandler re-enables a modem disabled after repeated send
+// failures, such as once the cause has been resolved.
+// Methods allowed: POST
+func enableModemHandler(modems *modem.Set) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- enableModemHandler")
+		m := modems.Lookup(mux.Vars(r)["device"])
+		if m == nil {
+			writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "unknown device"})
+			return
+		}
+		if !m.Enable() {
+			writeJSON(w, http.StatusConflict, SMSResponse{Status: http.StatusConflict, Message: "modem is not disabled"})
+			return
+		}
+		writeJSON(w, http.StatusOK, ModemResponse{Status: 200, Message: "ok", Modem: m.Status()})
+	}
+}
+
+// ModemDefsResponse defines the response structure to /modems/config/
+// requests.
+type ModemDefsResponse struct {
+	Status  int        `json:"status"`
+	Message string     `json:"message"`
+	Modems  []db.Modem `json:"modems"`
+}
+
+// getModemDefsHandler dumps the modem definitions stored in the database.
+// Methods allowed: GET
+func getModemDefsHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- getModemDefsHandler")
+		modems, err := d.GetModems()
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error reading modems"})
+			return
+		}
+		if modems == nil {
+			modems = []db.Modem{}
+		}
+		writeJSON(w, http.StatusOK, ModemDefsResponse{Status: 200, Message: "ok", Modems: modems})
+	}
+}
+
+// saveModemDefHandler adds or replaces the definition of a modem stored in
+// the database.
+// The definition is used from the next start, if MODEMSOURCE is db.
+// Methods allowed: PUT
+func saveModemDefHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- saveModemDefHandler")
+		r.ParseForm()
+		m := db.Modem{
+			DevID:   mux.Vars(r)["device"],
+			Port:    r.FormValue("comport"),
+			Baud:    115200,
+			Enabled: r.FormValue("enabled") != "false",
+			Weight:  1,
+		}
+		if m.Port == "" {
+			writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "comport is required"})
+			return
+		}
+		for _, f := range []struct {
+			name string
+			v    *int
+			min  int
+		}{
+			{"baudrate", &m.Baud, 1},
+			{"weight", &m.Weight, 1},
+			{"daily_cap", &m.DailyCap, 0},
+		} {
+			if s := r.FormValue(f.name); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil || n < f.min {
+					writeJSON(w, http.StatusBadRequest, SMSResponse{Status: http.StatusBadRequest, Message: "invalid " + f.name})
+					return
+				}
+				*f.v = n
+			}
+		}
+		if err := d.SaveModem(m); err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error saving modem"})
+			return
+		}
+		writeJSON(w, http.StatusOK, SMSResponse{Status: 200, Message: "ok"})
+	}
+}
+
+// deleteModemDefHandler deletes the definition of a modem stored in the
+// database.
+// Methods allowed: DELETE
+func deleteModemDefHandler(d *db.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("--- deleteModemDefHandler")
+		err := d.DeleteModem(mux.Vars(r)["device"])
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, SMSResponse{Status: http.StatusNotFound, Message: "unknown device"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, SMSResponse{Status: http.StatusInternalServerError, Message: "error deleting modem"})
+			return
+		}
+		writeJSON(w, http.StatusOK, SMSResponse{Status: 200, Message: "ok"})
+	}
+}
+
+// ServerConfig contains the dependencies and settings of the http server.
+type ServerConfig struct {
+	DB        *db.DB
+	Sender    *sender.Sender
+	Modems    *modem.Set
+	Blocklist *filter.Blocklist
+	// Numbers, if set, normalizes destination numbers before they are
+	// stored.
+	Numbers *filter.Normalizer
+	// DeliveryReports is the default for requesting delivery reports,
+	// if not specified in the send request.
+	DeliveryReports bool
+	// Normalize indicates the text of SMSs is normalized, using
+	// filter.NormalizeText, before they are stored.
+	Normalize bool
+	// Config is the effective configuration, with secrets redacted.
+	Config map[string]map[string]string
+	// RetryAfter is the delay, in seconds, suggested to clients sending while
+	// the sender is backlogged.
+	RetryAfter int
+	// BacklogReject indicates send requests are rejected while the sender is
+	// backlogged.
+	BacklogReject bool
+	// IdempotencyTTL is the time the responses to requests with an
+	// Idempotency-Key are kept for replay, or 0 to ignore the keys.
+	IdempotencyTTL time.Duration
+	// MaxBodySize is the maximum size, in bytes, of request bodies.
+	MaxBodySize int64
+	// ModemsFromDB indicates the modems are defined in the database, so
+	// disabled modems and daily caps are reported.
+	ModemsFromDB bool
+	// ReadOnly disables the endpoints that send SMSs or modify the
+	// database.
+	ReadOnly bool
+	// APIKey, if set, is required to access authenticated endpoints.
+	APIKey string
+	Host   string
+	Port   string
+	// ReadTimeout, WriteTimeout and IdleTimeout bound the time spent on
+	// each request and idle connection. Zero means no timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ReadHeaderTimeout bounds the time spent reading request headers, so
+	// slow clients cannot tie up connections. Zero means ReadTimeout.
+	ReadHeaderTimeout time.Duration
+	// MaxHeaderBytes is the maximum size, in bytes, of request headers.
+	// Zero means the http package default.
+	MaxHeaderBytes int
+}
+
+// shutdownTimeout is the maximum time to wait for requests in progress to
+// complete when shutting down.
+const shutdownTimeout = 10 * time.Second
+
+// InitServer runs a http server.
+// When the context is done the server stops accepting requests, and returns
+// once the requests in progress have completed.
+func InitServer(ctx context.Context, cfg ServerConfig) error {
+	log.Println("--- InitServer ", cfg.Host, cfg.Port)
+	bind, err := bindAddress(cfg.Host, cfg.Port)
+	if err != nil {
+		return err
+	}
+	d, s, bl, num := cfg.DB, cfg.Sender, cfg.Blocklist, cfg.Numbers
+	send := func(h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+		// repeated requests are replayed even while backlogged.
+		return idempotent(d, cfg.IdempotencyTTL, idempotencyLease(cfg.WriteTimeout), throttle(s, cfg.RetryAfter, cfg.BacklogReject, h))
+	}
+
+	r := mux.NewRouter()
+	r.StrictSlash(true)
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+
+	r.HandleFunc("/", indexHandler())
+
+	// handle static files
+	r.HandleFunc(`/assets/{path:[a-zA-Z0-9=\-\/\.\_]+}`, staticHandler)
+
+	// all API handlers
+	// the prefix handler is only used when the method of an API request does
+	// not match, as the mux does not propagate the subrouter's
+	// MethodNotAllowedHandler.
+	api := r.PathPrefix("/api").HandlerFunc(apiMethodNotAllowedHandler).Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(apiNotFoundHandler)
+	api.MethodNotAllowedHandler = http.HandlerFunc(apiMethodNotAllowedHandler)
+	if cfg.MaxBodySize > 0 {
+		api.Use(limitBody(cfg.MaxBodySize))
+	}
+	api.Use(compress)
+
+	api.Methods("GET").Path("/logs/").HandlerFunc(getLogsHandler(d))
+	api.Methods("GET").Path("/review/").HandlerFunc(getReviewHandler(d))
+	api.Methods("GET").Path("/inbox/").HandlerFunc(getInboxHandler(d))
+	api.Methods("GET").Path("/groups/").HandlerFunc(getGroupsHandler(d))
+	api.Methods("GET").Path("/batches/{id}").HandlerFunc(getBatchHandler(d))
+	api.Methods("GET").Path("/status/").HandlerFunc(getStatusHandler(cfg.Modems, s))
+	api.Methods("GET").Path("/modems/").HandlerFunc(requireAPIKey(cfg.APIKey, getModemsHandler(d, cfg.Modems, s, cfg.ModemsFromDB)))
+	api.Methods("GET").Path("/modems/config/").HandlerFunc(requireAPIKey(cfg.APIKey, getModemDefsHandler(d)))
+	api.Methods("GET").Path("/modems/{device}/contacts").HandlerFunc(requireAPIKey(cfg.APIKey, getContactsHandler(cfg.Modems)))
+	api.Methods("GET").Path("/stats/").HandlerFunc(getStatsHandler(s))
+	api.Methods("GET").Path("/usage/").HandlerFunc(getUsageHandler(d))
+	api.Methods("GET").Path("/reports/daily").HandlerFunc(getDailyReportHandler(d))
+	api.Methods("GET").Path("/db/stats").HandlerFunc(requireConfiguredAPIKey(cfg.APIKey, getDBStatsHandler(d)))
+	api.Methods("GET").Path("/db/backup").HandlerFunc(requireConfiguredAPIKey(cfg.APIKey, backupHandler(d)))
+	api.Methods("GET").Path("/config/").HandlerFunc(requireConfiguredAPIKey(cfg.APIKey, getConfigHandler(cfg.Config)))
+	if !cfg.ReadOnly {
+		api.Methods("POST").Path("/sms/").HandlerFunc(send(sendSMSHandler(d, s, cfg.Modems, bl, num, cfg.DeliveryReports, cfg.Normalize)))
+		api.Methods("POST").Path("/sms/quote").HandlerFunc(quoteSMSHandler(cfg.Modems, s, num, cfg.Normalize))
+		api.Methods("POST").Path("/sms/data/").HandlerFunc(send(sendDataSMSHandler(s, bl, num, cfg.DeliveryReports)))
+		api.Methods("POST").Path("/sms/template/").HandlerFunc(send(sendTemplateSMSHandler(d, s, bl, num, cfg.DeliveryReports, cfg.Normalize)))
+		api.Methods("POST").Path("/templates/").HandlerFunc(requireAPIKey(cfg.APIKey, addTemplateHandler(d)))
+		api.Methods("POST").Path("/inbox/{id:[0-9]+}/read").HandlerFunc(markInboxReadHandler(d))
+		api.Methods("POST").Path("/groups/").HandlerFunc(addGroupMembersHandler(d, num))
+		api.Methods("DELETE").Path("/groups/{name}").HandlerFunc(deleteGroupHandler(d, num))
+		api.Methods("DELETE").Path("/groups/{name}/{mobile}").HandlerFunc(deleteGroupHandler(d, num))
+		api.Methods("POST").Path("/sms/{uuid}/resend").HandlerFunc(send(resendSMSHandler(d, s, bl, num)))
+		api.Methods("POST").Path("/review/{uuid}/resend").HandlerFunc(resendHandler(d, s, bl, num))
+		api.Methods("POST").Path("/batches/{id}/cancel").HandlerFunc(cancelBatchHandler(d, s))
+		api.Methods("POST").Path("/pause").HandlerFunc(requireAPIKey(cfg.APIKey, pauseHandler(s)))
+		api.Methods("POST").Path("/resume").HandlerFunc(requireAPIKey(cfg.APIKey, resumeHandler(s)))
+		api.Methods("POST").Path("/refill").HandlerFunc(requireAPIKey(cfg.APIKey, refillHandler(s)))
+		api.Methods("POST").Path("/modems/").HandlerFunc(requireAPIKey(cfg.APIKey, addModemHandler(cfg.Modems)))
+		api.Methods("DELETE").Path("/modems/{device}").HandlerFunc(requireAPIKey(cfg.APIKey, removeModemHandler(cfg.Modems)))
+		api.Methods("POST").Path("/modems/{device}/enable").HandlerFunc(requireAPIKey(cfg.APIKey, enableModemHandler(cfg.Modems)))
+		api.Methods("PUT").Path("/modems/config/{device}").HandlerFunc(requireAPIKey(cfg.APIKey, saveModemDefHandler(d)))
+		api.Methods("DELETE").Path("/modems/config/{device}").HandlerFunc(requireAPIKey(cfg.APIKey, deleteModemDefHandler(d)))
+		api.Methods("POST").Path("/db/vacuum").HandlerFunc(requireAPIKey(cfg.APIKey, vacuumHandler(d, s)))
+	}
+
+	srv := &http.Server{
+		Addr:              bind,
+		Handler:           r,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		log.Println("server shutting down")
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Println("server shutdown: ", err)
+		}
+	}()
+	log.Println("listening on: ", bind)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
+}
+
+// hostname matches valid DNS host names.
+var hostname = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+// bindAddress validates the host and port the server binds to, and combines
+// them into an address suitable for net.Listen.
+// The host may be an IPv4 or IPv6 address, with or without brackets, a host
+// name, or empty to bind to all interfaces.
+func bindAddress(host, port string) (string, error) {
+	host = strings.TrimSpace(host)
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if host != "" && net.ParseIP(host) == nil && !hostname.MatchString(host) {
+		return "", fmt.Errorf("invalid SERVERHOST %q: not an IP address or host name", host)
+	}
+	p, err := strconv.Atoi(strings.TrimSpace(port))
+	if err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("invalid SERVERPORT %q: not a port number from 1 to 65535", port)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p)), nil
 }
@@ -0,0 +1,118 @@
+// send queues SMSs via the goatsms API.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// number matches a valid destination number, optionally with a leading +.
+var number = regexp.MustCompile(`^\+?[0-9]{3,15}$`)
+
+func main() {
+	var server, to, toFile, msg, msgFile string
+	flag.StringVar(&server, "u", "http://localhost:8951", "URL of the goatsms server")
+	flag.StringVar(&to, "to", "", "comma separated list of numbers to send to")
+	flag.StringVar(&toFile, "to-file", "", "file containing numbers to send to, one per line")
+	flag.StringVar(&msg, "msg", "", "message to send")
+	flag.StringVar(&msgFile, "msg-file", "", "file containing the message to send")
+	flag.Parse()
+
+	var mobiles []string
+	for _, m := range strings.Split(to, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			mobiles = append(mobiles, m)
+		}
+	}
+	if toFile != "" {
+		m, err := readNumbers(toFile)
+		if err != nil {
+			fmt.Println("Reading numbers returned error: ", err)
+			os.Exit(1)
+		}
+		mobiles = append(mobiles, m...)
+	}
+	for _, m := range mobiles {
+		if !number.MatchString(m) {
+			fmt.Printf("Invalid number '%s'.\n", m)
+			os.Exit(1)
+		}
+	}
+	if len(mobiles) == 0 {
+		fmt.Println("No numbers to send to - use -to or -to-file.")
+		os.Exit(1)
+	}
+	if msgFile != "" {
+		if msg != "" {
+			fmt.Println("Only one of -msg and -msg-file may be used.")
+			os.Exit(1)
+		}
+		b, err := ioutil.ReadFile(msgFile)
+		if err != nil {
+			fmt.Println("Reading message returned error: ", err)
+			os.Exit(1)
+		}
+		msg = strings.TrimRight(string(b), "\r\n")
+	}
+	if msg == "" {
+		fmt.Println("No message to send - use -msg or -msg-file.")
+		os.Exit(1)
+	}
+
+	form := url.Values{"mobile": mobiles, "message": {msg}}
+	rsp, err := http.PostForm(strings.TrimRight(server, "/")+"/api/sms/", form)
+	if err != nil {
+		fmt.Println("Sending returned error: ", err)
+		os.Exit(1)
+	}
+	defer rsp.Body.Close()
+	var result struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+		BatchID string `json:"batch_id"`
+	}
+	if err = json.NewDecoder(rsp.Body).Decode(&result); err != nil {
+		fmt.Println("Reading response returned error: ", err)
+		os.Exit(1)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		fmt.Printf("Send failed: %d %s\n", result.Status, result.Message)
+		os.Exit(1)
+	}
+	if result.BatchID != "" {
+		fmt.Printf("Queued %d messages: %s, batch %s\n", len(mobiles), result.Message, result.BatchID)
+	} else {
+		fmt.Println("Queued 1 message.")
+	}
+}
+
+// readNumbers reads the numbers from a file, one per line.
+// Blank lines and lines starting with # are ignored.
+func readNumbers(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mobiles []string
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		m := strings.TrimSpace(s.Text())
+		if m == "" || strings.HasPrefix(m, "#") {
+			continue
+		}
+		if !number.MatchString(m) {
+			return nil, fmt.Errorf("line %d: invalid number '%s'", line, m)
+		}
+		mobiles = append(mobiles, m)
+	}
+	return mobiles, s.Err()
+}
@@ -6,19 +6,21 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	// cos its cgo...
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const latestVersion string = "goatsms v1"
+const latestVersion string = "goatsms v26"
 
 func main() {
 	var dbname, driver string
-	var fromGoSMS bool
+	var fromGoSMS, plan bool
 	flag.StringVar(&dbname, "d", "goatsms.sqlite", "path to database")
 	flag.StringVar(&driver, "t", "sqlite3", "database type")
 	flag.BoolVar(&fromGoSMS, "from_gosms", false, "convert a gosms database to goatsms")
+	flag.BoolVar(&plan, "plan", false, "print the updates that would be applied, without applying them")
 	flag.Parse()
 
 	db, err := sql.Open(driver, dbname)
@@ -37,35 +39,90 @@ func main() {
 			os.Exit(1)
 		}
 	}
-	switch version {
-	default:
+	if version == latestVersion {
+		fmt.Printf("Database '%s' schema '%s' is up to date.\n", dbname, version)
+		return
+	}
+	pending := stepsFrom(version)
+	if pending == nil {
 		fmt.Printf("Don't know how to update database schema '%s'.\n", version)
 		os.Exit(1)
-	case latestVersion:
-		fmt.Printf("Database '%s' schema '%s' is up to date.\n", dbname, version)
-	case "gosms":
-		if err := gosmsToV1(db); err != nil {
-			fmt.Println("Conversion from gosms schema returned error: ", err)
+	}
+	if plan {
+		names := make([]string, len(pending))
+		for i, st := range pending {
+			names[i] = st.String()
+		}
+		fmt.Printf("Database '%s' schema '%s' will apply %s, resulting in %s.\n",
+			dbname, version, strings.Join(names, ", "), latestVersion)
+		return
+	}
+	for _, st := range pending {
+		if err := update(db, st.cmds); err != nil {
+			fmt.Printf("Conversion from %s schema returned error: %v\n", st.from, err)
 			os.Exit(1)
 		}
-		fmt.Printf("Updated database '%s' schema to 'goatsms v1'.\n", dbname)
-		// to chain updates, fall through to subsequent versions as schema versions change.
+		fmt.Printf("Updated database '%s' schema to '%s'.\n", dbname, st.to)
 	}
 }
 
-// Conversion functions.
+// step is the conversion of a database from one schema version to the next.
+type step struct {
+	from, to string
+	cmds     []string
+}
 
-// gosmsToV1 converts a database from gosms to goatsms v1
-func gosmsToV1(db *sql.DB) error {
-	cmds := []string{
-		"CREATE INDEX messages_status ON messages (status)",
-		`CREATE TABLE schema_version (
-    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
-		version char(16) NOT NULL,
-		created_at TIMESTAMP default CURRENT_TIMESTAMP
-		);`,
-		"INSERT INTO schema_version(version) VALUES('goatsms v1')",
+// String returns the short form of the step, for ex. v1->v2.
+func (st step) String() string {
+	return strings.TrimPrefix(st.from, "goatsms ") + "->" + strings.TrimPrefix(st.to, "goatsms ")
+}
+
+// steps are the conversions, in order, so updates are chained by applying
+// the steps following the current version.
+var steps = []step{
+	{"gosms", "goatsms v1", gosmsToV1},
+	{"goatsms v1", "goatsms v2", v1ToV2},
+	{"goatsms v2", "goatsms v3", v2ToV3},
+	{"goatsms v3", "goatsms v4", v3ToV4},
+	{"goatsms v4", "goatsms v5", v4ToV5},
+	{"goatsms v5", "goatsms v6", v5ToV6},
+	{"goatsms v6", "goatsms v7", v6ToV7},
+	{"goatsms v7", "goatsms v8", v7ToV8},
+	{"goatsms v8", "goatsms v9", v8ToV9},
+	{"goatsms v9", "goatsms v10", v9ToV10},
+	{"goatsms v10", "goatsms v11", v10ToV11},
+	{"goatsms v11", "goatsms v12", v11ToV12},
+	{"goatsms v12", "goatsms v13", v12ToV13},
+	{"goatsms v13", "goatsms v14", v13ToV14},
+	{"goatsms v14", "goatsms v15", v14ToV15},
+	{"goatsms v15", "goatsms v16", v15ToV16},
+	{"goatsms v16", "goatsms v17", v16ToV17},
+	{"goatsms v17", "goatsms v18", v17ToV18},
+	{"goatsms v18", "goatsms v19", v18ToV19},
+	{"goatsms v19", "goatsms v20", v19ToV20},
+	{"goatsms v20", "goatsms v21", v20ToV21},
+	{"goatsms v21", "goatsms v22", v21ToV22},
+	{"goatsms v22", "goatsms v23", v22ToV23},
+	{"goatsms v23", "goatsms v24", v23ToV24},
+	{"goatsms v24", "goatsms v25", v24ToV25},
+	{"goatsms v25", "goatsms v26", v25ToV26},
+}
+
+// stepsFrom returns the steps that update a database from the version to the
+// latest version, or nil if the version is unknown.
+func stepsFrom(version string) []step {
+	for i, st := range steps {
+		if st.from == version {
+			return steps[i:]
+		}
 	}
+	return nil
+}
+
+// Conversion functions.
+
+// update applies the set of commands to the database within a transaction.
+func update(db *sql.DB, cmds []string) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -77,6 +134,243 @@ func gosmsToV1(db *sql.DB) error {
 			return err
 		}
 	}
-	err = tx.Commit()
-	return err
+	return tx.Commit()
+}
+
+// gosmsToV1 converts a database from gosms to goatsms v1.
+var gosmsToV1 = []string{
+	"CREATE INDEX messages_status ON messages (status)",
+	`CREATE TABLE schema_version (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		version char(16) NOT NULL,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP
+		);`,
+	"INSERT INTO schema_version(version) VALUES('goatsms v1')",
+}
+
+// v1ToV2 converts a database from goatsms v1 to goatsms v2.
+// Adds the blocklist table.
+var v1ToV2 = []string{
+	`CREATE TABLE blocklist (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		kind char(8) NOT NULL,
+		value TEXT NOT NULL
+		);`,
+	"INSERT INTO schema_version(version) VALUES('goatsms v2')",
+}
+
+// v2ToV3 converts a database from goatsms v2 to goatsms v3.
+// Adds the templates table.
+var v2ToV3 = []string{
+	`CREATE TABLE templates (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		name char(32) UNIQUE NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP
+		);`,
+	"INSERT INTO schema_version(version) VALUES('goatsms v3')",
+}
+
+// v3ToV4 converts a database from goatsms v3 to goatsms v4.
+// Adds the inbox table.
+var v3ToV4 = []string{
+	`CREATE TABLE inbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		mobile char(15) NOT NULL,
+		message TEXT NOT NULL,
+		device string NOT NULL,
+		segments INTEGER DEFAULT 1,
+		received_at TIMESTAMP default CURRENT_TIMESTAMP
+		);`,
+	"CREATE INDEX inbox_received_at ON inbox (received_at)",
+	"INSERT INTO schema_version(version) VALUES('goatsms v4')",
+}
+
+// v4ToV5 converts a database from goatsms v4 to goatsms v5.
+// Adds the read state to the inbox.
+var v4ToV5 = []string{
+	"ALTER TABLE inbox ADD COLUMN read INTEGER DEFAULT 0",
+	"INSERT INTO schema_version(version) VALUES('goatsms v5')",
+}
+
+// v5ToV6 converts a database from goatsms v5 to goatsms v6.
+// Adds the per message delivery report request.
+var v5ToV6 = []string{
+	"ALTER TABLE messages ADD COLUMN delivery_report INTEGER DEFAULT 0",
+	"INSERT INTO schema_version(version) VALUES('goatsms v6')",
+}
+
+// v6ToV7 converts a database from goatsms v6 to goatsms v7.
+// Adds the routes table.
+var v6ToV7 = []string{
+	`CREATE TABLE routes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		prefix char(15) UNIQUE NOT NULL,
+		device string NOT NULL
+		);`,
+	"INSERT INTO schema_version(version) VALUES('goatsms v7')",
+}
+
+// v7ToV8 converts a database from goatsms v7 to goatsms v8.
+// Adds the purged state of message bodies.
+var v7ToV8 = []string{
+	"ALTER TABLE messages ADD COLUMN purged INTEGER DEFAULT 0",
+	"INSERT INTO schema_version(version) VALUES('goatsms v8')",
+}
+
+// v8ToV9 converts a database from goatsms v8 to goatsms v9.
+// Adds recipient groups and the batch id of messages.
+var v8ToV9 = []string{
+	`CREATE TABLE groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		name char(32) UNIQUE NOT NULL,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP
+		);`,
+	`CREATE TABLE group_members (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		group_id INTEGER NOT NULL REFERENCES groups(id),
+		mobile char(15) NOT NULL,
+		UNIQUE(group_id, mobile)
+		);`,
+	"ALTER TABLE messages ADD COLUMN batch_id char(36) NULL",
+	"CREATE INDEX messages_batch_id ON messages (batch_id)",
+	"INSERT INTO schema_version(version) VALUES('goatsms v9')",
+}
+
+// v9ToV10 converts a database from goatsms v9 to goatsms v10.
+// Adds the scheduled send time of messages.
+var v9ToV10 = []string{
+	"ALTER TABLE messages ADD COLUMN send_at TIMESTAMP NULL",
+	"CREATE INDEX messages_send_at ON messages (send_at)",
+	"INSERT INTO schema_version(version) VALUES('goatsms v10')",
+}
+
+// v10ToV11 converts a database from goatsms v10 to goatsms v11.
+// Adds the per message retry limit.
+var v10ToV11 = []string{
+	"ALTER TABLE messages ADD COLUMN max_retries INTEGER NULL",
+	"INSERT INTO schema_version(version) VALUES('goatsms v11')",
+}
+
+// v11ToV12 converts a database from goatsms v11 to goatsms v12.
+// Adds binary data messages and their user data header.
+var v11ToV12 = []string{
+	"ALTER TABLE messages ADD COLUMN data INTEGER DEFAULT 0",
+	"ALTER TABLE messages ADD COLUMN udh TEXT NULL",
+	"INSERT INTO schema_version(version) VALUES('goatsms v12')",
+}
+
+// v12ToV13 converts a database from goatsms v12 to goatsms v13.
+// Adds the number of segments and cost of sent messages.
+var v12ToV13 = []string{
+	"ALTER TABLE messages ADD COLUMN segments INTEGER DEFAULT 0",
+	"ALTER TABLE messages ADD COLUMN cost REAL DEFAULT 0",
+	"INSERT INTO schema_version(version) VALUES('goatsms v13')",
+}
+
+// v13ToV14 converts a database from goatsms v13 to goatsms v14.
+// Adds the reason sending messages last failed.
+var v13ToV14 = []string{
+	"ALTER TABLE messages ADD COLUMN error_reason TEXT NULL",
+	"INSERT INTO schema_version(version) VALUES('goatsms v14')",
+}
+
+// v14ToV15 converts a database from goatsms v14 to goatsms v15.
+// Adds the pid column, for the TP-PID of SMSs.
+var v14ToV15 = []string{
+	"ALTER TABLE messages ADD COLUMN pid INTEGER DEFAULT 0",
+	"INSERT INTO schema_version(version) VALUES('goatsms v15')",
+}
+
+// v15ToV16 converts a database from goatsms v15 to goatsms v16.
+// Adds the class column, used to apply send windows to classes of SMSs.
+var v15ToV16 = []string{
+	"ALTER TABLE messages ADD COLUMN class TEXT NULL",
+	"INSERT INTO schema_version(version) VALUES('goatsms v16')",
+}
+
+// v16ToV17 converts a database from goatsms v16 to goatsms v17.
+// Adds the metadata column, holding the JSON encoded metadata supplied by the client.
+var v16ToV17 = []string{
+	"ALTER TABLE messages ADD COLUMN metadata TEXT NULL",
+	"INSERT INTO schema_version(version) VALUES('goatsms v17')",
+}
+
+// v17ToV18 converts a database from goatsms v17 to goatsms v18.
+// Adds the parts_sent and concat_ref columns, so a retry sends only the parts of a multi-part SMS not already sent.
+var v17ToV18 = []string{
+	"ALTER TABLE messages ADD COLUMN parts_sent INTEGER DEFAULT 0",
+	"ALTER TABLE messages ADD COLUMN concat_ref INTEGER DEFAULT 0",
+	"INSERT INTO schema_version(version) VALUES('goatsms v18')",
+}
+
+// v18ToV19 converts a database from goatsms v18 to goatsms v19.
+// Adds the mrs column, holding the message references used to match delivery reports.
+var v18ToV19 = []string{
+	"ALTER TABLE messages ADD COLUMN mrs TEXT NULL",
+	"INSERT INTO schema_version(version) VALUES('goatsms v19')",
+}
+
+// v19ToV20 converts a database from goatsms v19 to goatsms v20.
+// Adds the modems table, holding the modem definitions used when MODEMSOURCE is db.
+var v19ToV20 = []string{
+	`CREATE TABLE modems (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		devid char(32) UNIQUE NOT NULL,
+		port TEXT NOT NULL,
+		baud INTEGER DEFAULT 115200,
+		enabled INTEGER DEFAULT 1,
+		weight INTEGER DEFAULT 1,
+		daily_cap INTEGER DEFAULT 0
+		);`,
+	"INSERT INTO schema_version(version) VALUES('goatsms v20')",
+}
+
+// v20ToV21 converts a database from goatsms v20 to goatsms v21.
+// Adds the resent_from column, linking a message resent to another number to the original.
+var v20ToV21 = []string{
+	"ALTER TABLE messages ADD COLUMN resent_from TEXT NULL",
+	"INSERT INTO schema_version(version) VALUES('goatsms v21')",
+}
+
+// v21ToV22 converts a database from goatsms v21 to goatsms v22.
+// Adds the message_class column, holding the message class encoded into the DCS of outbound SMSs.
+var v21ToV22 = []string{
+	"ALTER TABLE messages ADD COLUMN message_class INTEGER NULL",
+	"INSERT INTO schema_version(version) VALUES('goatsms v22')",
+}
+
+// v22ToV23 converts a database from goatsms v22 to goatsms v23.
+// Adds the idempotency_keys table, holding the responses to send requests so repeats of a request are not sent again.
+var v22ToV23 = []string{
+	`CREATE TABLE idempotency_keys (
+		key TEXT PRIMARY KEY NOT NULL,
+		code INTEGER DEFAULT 0,
+		response TEXT NULL,
+		created_at TIMESTAMP NOT NULL
+		);`,
+	"CREATE INDEX idempotency_keys_created_at ON idempotency_keys (created_at)",
+	"INSERT INTO schema_version(version) VALUES('goatsms v23')",
+}
+
+// v23ToV24 converts a database from goatsms v23 to goatsms v24.
+// Adds the incomplete column to the inbox, flagging multi-part SMSs stored without all their parts.
+var v23ToV24 = []string{
+	"ALTER TABLE inbox ADD COLUMN incomplete INTEGER DEFAULT 0",
+	"INSERT INTO schema_version(version) VALUES('goatsms v24')",
+}
+
+// v24ToV25 converts a database from goatsms v24 to goatsms v25.
+// Adds the expires_at column, the time after which an SMS must not be sent.
+var v24ToV25 = []string{
+	"ALTER TABLE messages ADD COLUMN expires_at TIMESTAMP NULL",
+	"INSERT INTO schema_version(version) VALUES('goatsms v25')",
+}
+
+// v25ToV26 converts a database from goatsms v25 to goatsms v26.
+// Adds the raw_length and normalized_length columns to messages, recording the effect of message normalization.
+var v25ToV26 = []string{
+	"ALTER TABLE messages ADD COLUMN raw_length INTEGER DEFAULT 0",
+	"ALTER TABLE messages ADD COLUMN normalized_length INTEGER DEFAULT 0",
+	"INSERT INTO schema_version(version) VALUES('goatsms v26')",
 }
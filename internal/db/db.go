@@ -1,16 +1,27 @@
 package db
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
-	// cos its cgo...
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 // DB is a wrapper around sql.DB.
 type DB struct {
 	*sql.DB
+
+	mu sync.Mutex
+	// stmts caches the prepared statements for the frequently executed
+	// queries, so they are not parsed on every call.
+	stmts map[string]*sql.Stmt
 }
 
 // SMSStatus indicates the state of the SMS.
@@ -25,10 +36,14 @@ const (
 	SMSErrored // 2
 	// SMSCanceled indicates the SMS was canceled prior to being sent.
 	SMSCanceled // 3
+	// SMSAccepted indicates the SMS was accepted by the network, and is
+	// awaiting a delivery report before it is considered sent.
+	SMSAccepted // 4
 )
 
 // SMS represents an SMS, as stored in the db.
 type SMS struct {
+	ID        int64     `json:"id"`
 	UUID      string    `json:"uuid"`
 	Mobile    string    `json:"mobile"`
 	Body      string    `json:"body"`
@@ -37,37 +52,239 @@ type SMS struct {
 	Device    string    `json:"device"`
 	CreatedAt string    `json:"created_at"`
 	UpdatedAt string    `json:"updated_at"`
+	// DeliveryReport requests the network report the delivery of the SMS.
+	DeliveryReport bool `json:"delivery_report"`
+	// Purged indicates the body has been redacted or hashed by the retention
+	// policy.
+	Purged bool `json:"purged"`
+	// BatchID links the SMSs submitted together, such as those sent to a
+	// group.
+	BatchID string `json:"batch_id,omitempty"`
+	// SendAt is the time, in TimestampFormat, before which the SMS must not be
+	// sent.
+	// If empty the SMS may be sent immediately.
+	SendAt string `json:"send_at,omitempty"`
+	// MaxRetries overrides the default limit on the number of times sending
+	// the SMS is retried, if set.
+	// Zero means the SMS is not retried.
+	MaxRetries *int `json:"max_retries,omitempty"`
+	// Data indicates the SMS is an 8-bit data SMS, rather than text, in
+	// which case the Body contains the hex encoded payload.
+	Data bool `json:"data,omitempty"`
+	// UDH is the hex encoded user data header of a data SMS, not including
+	// any concatenation information element.
+	UDH string `json:"udh,omitempty"`
+	// Segments is the number of PDUs the SMS was sent in.
+	Segments int `json:"segments,omitempty"`
+	// Cost is the price of sending the SMS.
+	Cost float64 `json:"cost,omitempty"`
+	// ErrorReason describes why the last attempt to send the SMS failed, if
+	// it did.
+	ErrorReason string `json:"error_reason,omitempty"`
+	// PID is the TP-PID (protocol identifier) the SMS is sent with, such as
+	// 0x41 to replace an earlier SMS of "replace short message type 1".
+	// Zero is the default, a plain SMS.
+	PID int `json:"pid,omitempty"`
+	// Class categorises the SMS, such as "marketing", so that policies such
+	// as send windows may be applied to some SMSs and not others.
+	Class string `json:"class,omitempty"`
+	// Metadata is opaque data supplied by the client, such as an order ID,
+	// that is returned with the SMS so the client may correlate it.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// FireAndForget requests the SMS be passed to a modem before being
+	// recorded, to minimise latency at the expense of durability.
+	// It is not stored.
+	FireAndForget bool `json:"-"`
+	// PartsSent is the number of parts of a multi-part SMS sent by Device
+	// before an attempt to send the SMS failed, so that only the remaining
+	// parts are sent when it is retried.
+	PartsSent int `json:"parts_sent,omitempty"`
+	// ConcatRef is the concatenation reference of the parts already sent, which
+	// the remaining parts must share so the handset reassembles them.
+	ConcatRef int `json:"-"`
+	// MRs are the comma separated message references of the parts of an
+	// accepted SMS yet to be reported as delivered.
+	MRs string `json:"-"`
+	// ResentFrom is the UUID of the SMS this SMS was copied from, if it was
+	// created by resending another SMS.
+	ResentFrom string `json:"resent_from,omitempty"`
+	// MessageClass, if set, is the message class, from 0 to 3, encoded into
+	// the DCS, such as 2 for an SMS to be stored on the SIM.
+	MessageClass *int `json:"message_class,omitempty"`
+	// ExpiresAt is the time, in TimestampFormat, after which the SMS must
+	// not be sent, or delivered by the network.
+	// If empty the SMS does not expire.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// RawLength and NormalizedLength are the lengths, in characters, of the
+	// body as submitted and after normalization, or 0 if the body was not
+	// normalized.
+	RawLength        int `json:"raw_length,omitempty"`
+	NormalizedLength int `json:"normalized_length,omitempty"`
+}
+
+// CreateTime returns the time the SMS was added, or the zero time if it is
+// not known.
+func (sms SMS) CreateTime() time.Time {
+	// read from the database as RFC3339, though stored in TimestampFormat.
+	t, err := time.Parse(time.RFC3339, sms.CreatedAt)
+	if err != nil {
+		t, _ = time.ParseInLocation(TimestampFormat, sms.CreatedAt, time.UTC)
+	}
+	return t
+}
+
+// SendTime returns the time before which the SMS must not be sent, or the
+// zero time if it may be sent immediately.
+func (sms SMS) SendTime() time.Time {
+	if sms.SendAt == "" {
+		return time.Time{}
+	}
+	t, _ := time.ParseInLocation(TimestampFormat, sms.SendAt, time.UTC)
+	return t
+}
+
+// ExpiredReason is the ErrorReason of SMSs errored as they expired before
+// they could be sent.
+const ExpiredReason = "expired before it could be sent"
+
+// Expired indicates the SMS was errored as it expired before it could be
+// sent.
+func (sms SMS) Expired() bool {
+	return sms.Status == SMSErrored && sms.ErrorReason == ExpiredReason
+}
+
+// RejectedPrefix prefixes the ErrorReason of SMSs errored as they were
+// rejected by the blocklist, and so never queued for sending.
+const RejectedPrefix = "rejected: "
+
+// Rejected indicates the SMS was errored as it was rejected by the
+// blocklist.
+func (sms SMS) Rejected() bool {
+	return sms.Status == SMSErrored && strings.HasPrefix(sms.ErrorReason, RejectedPrefix)
+}
+
+// ExpiryTime returns the time after which the SMS must not be sent, or the
+// zero time if it does not expire.
+func (sms SMS) ExpiryTime() time.Time {
+	if sms.ExpiresAt == "" {
+		return time.Time{}
+	}
+	t, _ := time.ParseInLocation(TimestampFormat, sms.ExpiresAt, time.UTC)
+	return t
+}
+
+// Kinds of entries in the blocklist table.
+const (
+	// BlockKeyword blocks messages containing the value.
+	BlockKeyword = "keyword"
+	// BlockPrefix blocks messages to destinations starting with the value.
+	BlockPrefix = "prefix"
+)
+
+// InboundSMS represents an SMS received by a modem, as stored in the db.
+// Multi-part SMSs are reassembled before being stored.
+type InboundSMS struct {
+	ID         int64  `json:"id"`
+	Mobile     string `json:"mobile"`
+	Body       string `json:"body"`
+	Device     string `json:"device"`
+	Segments   int    `json:"segments"`
+	ReceivedAt string `json:"received_at"`
+	Read       bool   `json:"read"`
+	// Incomplete indicates a multi-part SMS whose remaining parts did not
+	// arrive in time, so Body contains only the parts received.
+	Incomplete bool `json:"incomplete"`
+}
+
+// BatchStatus summarises the progress of a batch of SMSs.
+type BatchStatus struct {
+	ID       string `json:"id"`
+	Total    int    `json:"total"`
+	Pending  int    `json:"pending"`
+	Sent     int    `json:"sent"`
+	Errored  int    `json:"errored"`
+	Canceled int    `json:"canceled"`
+	Accepted int    `json:"accepted"`
+	// Complete is the percentage of the SMSs in the batch that are no longer
+	// pending or awaiting delivery reports.
+	Complete float64 `json:"complete"`
 }
 
-// SMSRetryLimit specifies the number of attempts to send an SMS before
-// marking it as SMSErrored.
-//TODO: should be configurable (in the DB??  Per modem?  Modems in the DB??)
+// DayCount is the number of SMSs created on a day, in each state.
+type DayCount struct {
+	// Day is the UTC date, in YYYY-MM-DD format.
+	Day      string `json:"day"`
+	Total    int    `json:"total"`
+	Pending  int    `json:"pending"`
+	Sent     int    `json:"sent"`
+	Errored  int    `json:"errored"`
+	Canceled int    `json:"canceled"`
+	Accepted int    `json:"accepted"`
+}
+
+// Stats describes the size and content of the database.
+type Stats struct {
+	Messages int `json:"messages"`
+	Pending  int `json:"pending"`
+	Sent     int `json:"sent"`
+	Errored  int `json:"errored"`
+	Canceled int `json:"canceled"`
+	Accepted int `json:"accepted"`
+	// Oldest is the creation time of the oldest SMS, in TimestampFormat, or
+	// empty if there are none.
+	Oldest string `json:"oldest"`
+	// Size is the size of the database, in bytes.
+	Size int64 `json:"size"`
+}
+
+// Usage summarises the SMSs sent over a period.
+type Usage struct {
+	Messages int     `json:"messages"`
+	Segments int     `json:"segments"`
+	Cost     float64 `json:"cost"`
+}
+
+// InboxFilter selects a subset of the inbox.
+// Zero valued fields are ignored.
+type InboxFilter struct {
+	// Mobile is the number of the sender.
+	Mobile string
+	// Device is the modem that received the SMS.
+	Device string
+	// Unread selects only SMSs that have not been marked as read.
+	Unread bool
+	// Since and Until bound the time the SMS was received.
+	Since time.Time
+	Until time.Time
+	// Limit and Offset select the page of results.
+	Limit  int
+	Offset int
+}
+
+// SMSRetryLimit specifies the default number of attempts to send an SMS
+// before marking it as SMSErrored.
 const SMSRetryLimit = 3
 
-const schemaVersion string = "goatsms v1"
+// TimestampFormat is the format of TIMESTAMPs stored in the database, which
+// are in UTC.
+const TimestampFormat = "2006-01-02 15:04:05"
+
+const schemaVersion string = "goatsms v26"
+
+// ErrSchemaNotRecognized indicates the database does not have the goatsms
+// schema expected by this version.
+var ErrSchemaNotRecognized = errors.New("schema not recognized")
 
 // New creates a database client.
 // If it does not already exist then it is created and initialised.
 // If it does exist then it checks that it has the correct schema version.
 func New(driver, dbname string) (*DB, error) {
-	init := true
 	sqldb, err := sql.Open(driver, dbname)
 	if err != nil {
 		return nil, err
 	}
-	if rows, err := sqldb.Query("SELECT version FROM schema_version"); err == nil {
-		if rows.Next() {
-			var version string
-			if err = rows.Scan(&version); err == nil {
-				if version == schemaVersion {
-					init = false
-				}
-			}
-		}
-		rows.Close()
-	}
-	db := &DB{sqldb}
-	if init {
+	db := &DB{DB: sqldb}
+	if version(sqldb) != schemaVersion {
 		if err := db.init(); err != nil {
 			db.Close()
 			return nil, err
@@ -76,6 +293,77 @@ func New(driver, dbname string) (*DB, error) {
 	return db, nil
 }
 
+// Open creates a client for an existing database.
+// Unlike New, the database is never initialised, so Open is safe to use on
+// a database that may not belong to goatsms.
+// Returns ErrSchemaNotRecognized if the database does not have the correct
+// schema version.
+func Open(driver, dbname string) (*DB, error) {
+	sqldb, err := sql.Open(driver, dbname)
+	if err != nil {
+		return nil, err
+	}
+	if v := version(sqldb); v != schemaVersion {
+		sqldb.Close()
+		if v == "" {
+			return nil, ErrSchemaNotRecognized
+		}
+		return nil, fmt.Errorf("%w: %s", ErrSchemaNotRecognized, v)
+	}
+	return &DB{DB: sqldb}, nil
+}
+
+// ErrIntegrity indicates the database is corrupt.
+var ErrIntegrity = errors.New("database integrity check failed")
+
+// CheckIntegrity checks the database for corruption, such as can be caused by
+// power loss while writing.
+// If quick is set then the faster, but less thorough, quick_check is used.
+// Returns ErrIntegrity, wrapped with the problems found, if the database is
+// corrupt.
+func CheckIntegrity(driver, dbname string, quick bool) error {
+	sqldb, err := sql.Open(driver, dbname)
+	if err != nil {
+		return err
+	}
+	defer sqldb.Close()
+	pragma := "PRAGMA integrity_check"
+	if quick {
+		pragma = "PRAGMA quick_check"
+	}
+	rows, err := sqldb.Query(pragma)
+	if err != nil {
+		// a file that is not a database fails the check outright.
+		return fmt.Errorf("%w: %v", ErrIntegrity, err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var p string
+		if err = rows.Scan(&p); err != nil {
+			return fmt.Errorf("%w: %v", ErrIntegrity, err)
+		}
+		if p != "ok" {
+			problems = append(problems, p)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrIntegrity, err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrIntegrity, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// version returns the schema version of the database, or an empty string if
+// it cannot be determined.
+func version(sqldb *sql.DB) string {
+	var v string
+	sqldb.QueryRow("SELECT version FROM schema_version ORDER BY id DESC LIMIT 1").Scan(&v)
+	return v
+}
+
 // init initialises the database, creating tables and setting the schema version.
 func (db *DB) init() error {
 	cmds := []string{
@@ -88,9 +376,86 @@ func (db *DB) init() error {
 	                retries INTEGER DEFAULT 0,
 	                device string NULL,
 	                created_at TIMESTAMP default CURRENT_TIMESTAMP,
-	                updated_at TIMESTAMP
+	                updated_at TIMESTAMP,
+	                delivery_report INTEGER DEFAULT 0,
+	                purged INTEGER DEFAULT 0,
+	                batch_id char(36) NULL,
+	                send_at TIMESTAMP NULL,
+	                max_retries INTEGER NULL,
+	                data INTEGER DEFAULT 0,
+	                udh TEXT NULL,
+	                segments INTEGER DEFAULT 0,
+	                cost REAL DEFAULT 0,
+	                error_reason TEXT NULL,
+	                pid INTEGER DEFAULT 0,
+	                class TEXT NULL,
+	                metadata TEXT NULL,
+	                parts_sent INTEGER DEFAULT 0,
+	                concat_ref INTEGER DEFAULT 0,
+	                mrs TEXT NULL,
+	                resent_from TEXT NULL,
+	                message_class INTEGER NULL,
+	                expires_at TIMESTAMP NULL,
+	                raw_length INTEGER DEFAULT 0,
+	                normalized_length INTEGER DEFAULT 0
 	            );`,
 		"CREATE INDEX messages_status ON messages (status)",
+		"CREATE INDEX messages_batch_id ON messages (batch_id)",
+		"CREATE INDEX messages_send_at ON messages (send_at)",
+		`CREATE TABLE blocklist (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		kind char(8) NOT NULL,
+		value TEXT NOT NULL
+		);`,
+		`CREATE TABLE routes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		prefix char(15) UNIQUE NOT NULL,
+		device string NOT NULL
+		);`,
+		`CREATE TABLE templates (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		name char(32) UNIQUE NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE inbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		mobile char(15) NOT NULL,
+		message TEXT NOT NULL,
+		device string NOT NULL,
+		segments INTEGER DEFAULT 1,
+		received_at TIMESTAMP default CURRENT_TIMESTAMP,
+		read INTEGER DEFAULT 0,
+		incomplete INTEGER DEFAULT 0
+		);`,
+		"CREATE INDEX inbox_received_at ON inbox (received_at)",
+		`CREATE TABLE groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		name char(32) UNIQUE NOT NULL,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE group_members (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		group_id INTEGER NOT NULL REFERENCES groups(id),
+		mobile char(15) NOT NULL,
+		UNIQUE(group_id, mobile)
+		);`,
+		`CREATE TABLE modems (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		devid char(32) UNIQUE NOT NULL,
+		port TEXT NOT NULL,
+		baud INTEGER DEFAULT 115200,
+		enabled INTEGER DEFAULT 1,
+		weight INTEGER DEFAULT 1,
+		daily_cap INTEGER DEFAULT 0
+		);`,
+		`CREATE TABLE idempotency_keys (
+		key TEXT PRIMARY KEY NOT NULL,
+		code INTEGER DEFAULT 0,
+		response TEXT NULL,
+		created_at TIMESTAMP NOT NULL
+		);`,
+		"CREATE INDEX idempotency_keys_created_at ON idempotency_keys (created_at)",
 		`CREATE TABLE schema_version (
 		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
 		version char(16) NOT NULL,
@@ -107,51 +472,698 @@ func (db *DB) init() error {
 	return nil
 }
 
+// Close closes the cached prepared statements and the database.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	for _, stmt := range db.stmts {
+		stmt.Close()
+	}
+	db.stmts = nil
+	db.mu.Unlock()
+	return db.DB.Close()
+}
+
+// stmt returns the prepared statement for the query, preparing it on first
+// use.
+func (db *DB) stmt(query string) (*sql.Stmt, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if stmt, ok := db.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if db.stmts == nil {
+		db.stmts = make(map[string]*sql.Stmt)
+	}
+	db.stmts[query] = stmt
+	return stmt, nil
+}
+
 // InsertMessage inserts an SMS into the database.
 func (db *DB) InsertMessage(sms SMS) error {
-	_, err := db.Exec("INSERT INTO messages(uuid, message, mobile) VALUES(?, ?, ?)", sms.UUID, sms.Body, sms.Mobile)
+	stmt, err := db.stmt(`INSERT INTO messages(uuid, message, mobile, delivery_report, batch_id, send_at, max_retries,
+		data, udh, pid, class, metadata, resent_from, message_class, expires_at, raw_length, normalized_length)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	var maxRetries, messageClass sql.NullInt64
+	if sms.MaxRetries != nil {
+		maxRetries = sql.NullInt64{Int64: int64(*sms.MaxRetries), Valid: true}
+	}
+	if sms.MessageClass != nil {
+		messageClass = sql.NullInt64{Int64: int64(*sms.MessageClass), Valid: true}
+	}
+	var metadata sql.NullString
+	if len(sms.Metadata) > 0 {
+		b, err := json.Marshal(sms.Metadata)
+		if err != nil {
+			return err
+		}
+		metadata = sql.NullString{String: string(b), Valid: true}
+	}
+	_, err = stmt.Exec(sms.UUID, sms.Body, sms.Mobile, sms.DeliveryReport, nullString(sms.BatchID), nullString(sms.SendAt),
+		maxRetries, sms.Data, nullString(sms.UDH), sms.PID, nullString(sms.Class), metadata, nullString(sms.ResentFrom),
+		messageClass, nullString(sms.ExpiresAt), sms.RawLength, sms.NormalizedLength)
 	return err
 }
 
+// GetMessage gets the SMS with the UUID.
+// Returns sql.ErrNoRows if there is no such SMS.
+func (db *DB) GetMessage(uuid string) (SMS, error) {
+	rows, err := db.Query("SELECT "+smsColumns+" FROM messages WHERE uuid=?", uuid)
+	if err != nil {
+		return SMS{}, err
+	}
+	smss := scanMessages(rows)
+	if len(smss) != 1 {
+		return SMS{}, sql.ErrNoRows
+	}
+	return smss[0], nil
+}
+
 // UpdateMessageStatus updates the mutable fields of the SMS.
 func (db *DB) UpdateMessageStatus(sms SMS) error {
-	_, err := db.Exec("UPDATE messages SET status=?, retries=?, device=?, updated_at=DATETIME('now') WHERE uuid=?", sms.Status, sms.Retries, sms.Device, sms.UUID)
+	stmt, err := db.stmt(`UPDATE messages SET status=?, retries=?, device=?, segments=?, cost=?,
+		error_reason=?, parts_sent=?, concat_ref=?, mrs=?, updated_at=DATETIME('now') WHERE uuid=?`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(sms.Status, sms.Retries, sms.Device, sms.Segments, sms.Cost, nullString(sms.ErrorReason),
+		sms.PartsSent, sms.ConcatRef, nullString(sms.MRs), sms.UUID)
 	return err
 }
 
-// GetPendingMessages gets the set of SMSs waiting to be sent.
-func (db *DB) GetPendingMessages(limit int) ([]SMS, error) {
-	rows, err := db.Query("SELECT uuid, message, mobile, status, retries FROM messages WHERE status=? LIMIT ?", SMSPending, limit)
+// nullString converts an optional string field to a column value, mapping
+// empty to NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// GetPendingMessages gets the set of SMSs waiting to be sent, and due to be
+// sent by the given time, in the order they were added.
+func (db *DB) GetPendingMessages(limit int, due time.Time) ([]SMS, error) {
+	stmt, err := db.stmt("SELECT " + smsColumns + " FROM messages WHERE status=? AND (send_at IS NULL OR send_at<=?) ORDER BY id LIMIT ?")
 	if err != nil {
 		return nil, err
 	}
-	var messages []SMS
+	rows, err := stmt.Query(SMSPending, due.UTC().Format(TimestampFormat), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows), nil
+}
+
+// GetNextSendTime gets the earliest scheduled send time of the pending SMSs
+// not due to be sent by the given time.
+// Returns the zero time if there are none.
+func (db *DB) GetNextSendTime(due time.Time) (time.Time, error) {
+	var next sql.NullString
+	err := db.QueryRow("SELECT MIN(send_at) FROM messages WHERE status=? AND send_at>?",
+		SMSPending, due.UTC().Format(TimestampFormat)).Scan(&next)
+	if err != nil || !next.Valid {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation(TimestampFormat, next.String, time.UTC)
+}
+
+// GetBlocklist gets the blocked keywords and destination prefixes.
+func (db *DB) GetBlocklist() (keywords, prefixes []string, err error) {
+	rows, err := db.Query("SELECT kind, value FROM blocklist")
+	if err != nil {
+		return nil, nil, err
+	}
+	var kind, value string
 	for rows.Next() {
-		sms := SMS{}
-		rows.Scan(&sms.UUID, &sms.Body, &sms.Mobile, &sms.Status, &sms.Retries)
+		rows.Scan(&kind, &value)
+		switch kind {
+		case BlockKeyword:
+			keywords = append(keywords, value)
+		case BlockPrefix:
+			prefixes = append(prefixes, value)
+		}
+	}
+	rows.Close()
+	return keywords, prefixes, nil
+}
+
+// GetRoutes gets the mapping from destination prefixes to the devices that
+// must send SMSs to those destinations.
+func (db *DB) GetRoutes() (map[string]string, error) {
+	rows, err := db.Query("SELECT prefix, device FROM routes")
+	if err != nil {
+		return nil, err
+	}
+	routes := make(map[string]string)
+	var prefix, device string
+	for rows.Next() {
+		rows.Scan(&prefix, &device)
+		routes[prefix] = device
+	}
+	rows.Close()
+	return routes, nil
+}
+
+// Modem is the definition of a modem stored in the database, used in place of
+// the DEVICE sections of the config.
+type Modem struct {
+	DevID string `json:"devid"`
+	Port  string `json:"comport"`
+	Baud  int    `json:"baudrate"`
+	// Enabled indicates the modem is used, so a modem may be taken out of
+	// service without losing its definition.
+	Enabled bool `json:"enabled"`
+	// Weight is the modem's share of SMSs when balancing across modems.
+	Weight int `json:"weight"`
+	// DailyCap is the maximum number of SMSs the modem should send each day,
+	// or 0 for no limit.
+	DailyCap int `json:"daily_cap"`
+}
+
+// GetModems gets the modem definitions, ordered by devid.
+func (db *DB) GetModems() ([]Modem, error) {
+	rows, err := db.Query("SELECT devid, port, baud, enabled, weight, daily_cap FROM modems ORDER BY devid")
+	if err != nil {
+		return nil, err
+	}
+	var modems []Modem
+	for rows.Next() {
+		var m Modem
+		rows.Scan(&m.DevID, &m.Port, &m.Baud, &m.Enabled, &m.Weight, &m.DailyCap)
+		modems = append(modems, m)
+	}
+	rows.Close()
+	return modems, nil
+}
+
+// SaveModem inserts the modem definition, or replaces the existing definition
+// with the same devid.
+func (db *DB) SaveModem(m Modem) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO modems(devid, port, baud, enabled, weight, daily_cap)
+		VALUES(?, ?, ?, ?, ?, ?)`, m.DevID, m.Port, m.Baud, m.Enabled, m.Weight, m.DailyCap)
+	return err
+}
+
+// DeleteModem deletes the definition of the modem with the devid.
+// Returns sql.ErrNoRows if there is no such modem.
+func (db *DB) DeleteModem(devid string) error {
+	res, err := db.Exec("DELETE FROM modems WHERE devid=?", devid)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// IdempotentResponse is the response to a request, recorded against the
+// idempotency key supplied by the client so that repeats of the request
+// receive the original response rather than being processed again.
+type IdempotentResponse struct {
+	// Code is the HTTP status code, or 0 if the original request is still
+	// being processed.
+	Code int
+	Body []byte
+}
+
+// ReserveIdempotencyKey records the key of a request about to be processed,
+// first removing the keys recorded before the expiry, and the reservations,
+// without a response, made before stale.
+// Stale reservations are those of requests that were interrupted, such as by
+// a restart, before their response was recorded, so removing them allows the
+// request to be repeated.
+// Returns false, and the response recorded against the key, if the key has
+// already been used.
+func (db *DB) ReserveIdempotencyKey(key string, expiry, stale time.Time) (bool, IdempotentResponse, error) {
+	var rsp IdempotentResponse
+	tx, err := db.Begin()
+	if err != nil {
+		return false, rsp, err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("DELETE FROM idempotency_keys WHERE created_at<?", expiry.UTC().Format(TimestampFormat)); err != nil {
+		return false, rsp, err
+	}
+	if _, err = tx.Exec("DELETE FROM idempotency_keys WHERE code=0 AND created_at<?", stale.UTC().Format(TimestampFormat)); err != nil {
+		return false, rsp, err
+	}
+	res, err := tx.Exec("INSERT OR IGNORE INTO idempotency_keys(key, created_at) VALUES(?, ?)",
+		key, time.Now().UTC().Format(TimestampFormat))
+	if err != nil {
+		return false, rsp, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		var body sql.NullString
+		if err = tx.QueryRow("SELECT code, response FROM idempotency_keys WHERE key=?", key).Scan(&rsp.Code, &body); err != nil {
+			return false, rsp, err
+		}
+		rsp.Body = []byte(body.String)
+		return false, rsp, nil
+	}
+	return true, rsp, tx.Commit()
+}
+
+// SaveIdempotentResponse records the response to the request with the
+// reserved key.
+func (db *DB) SaveIdempotentResponse(key string, rsp IdempotentResponse) error {
+	_, err := db.Exec("UPDATE idempotency_keys SET code=?, response=? WHERE key=?", rsp.Code, string(rsp.Body), key)
+	return err
+}
+
+// ReleaseIdempotencyKey removes the reserved key, such as when the request
+// failed, so it may be retried.
+func (db *DB) ReleaseIdempotencyKey(key string) error {
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE key=?", key)
+	return err
+}
+
+// InsertTemplate inserts a named message template into the database.
+func (db *DB) InsertTemplate(name, body string) error {
+	_, err := db.Exec("INSERT INTO templates(name, body) VALUES(?, ?)", name, body)
+	return err
+}
+
+// GetTemplate gets the body of the named message template.
+// Returns sql.ErrNoRows if the template does not exist.
+func (db *DB) GetTemplate(name string) (string, error) {
+	var body string
+	err := db.QueryRow("SELECT body FROM templates WHERE name=?", name).Scan(&body)
+	return body, err
+}
+
+// AddGroupMembers adds the mobiles to the named group of recipients,
+// creating the group if it does not already exist.
+// Mobiles already in the group are ignored.
+func (db *DB) AddGroupMembers(name string, mobiles []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("INSERT OR IGNORE INTO groups(name) VALUES(?)", name); err != nil {
+		return err
+	}
+	for _, mobile := range mobiles {
+		_, err = tx.Exec("INSERT OR IGNORE INTO group_members(group_id, mobile) SELECT id, ? FROM groups WHERE name=?",
+			mobile, name)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RemoveGroupMember removes the mobile from the named group.
+// Returns sql.ErrNoRows if the mobile is not a member of the group.
+func (db *DB) RemoveGroupMember(name, mobile string) error {
+	res, err := db.Exec("DELETE FROM group_members WHERE mobile=? AND group_id=(SELECT id FROM groups WHERE name=?)",
+		mobile, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteGroup deletes the named group and its members.
+// Returns sql.ErrNoRows if the group does not exist.
+func (db *DB) DeleteGroup(name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM group_members WHERE group_id=(SELECT id FROM groups WHERE name=?)", name)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM groups WHERE name=?", name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// GetGroups gets the members of all groups, keyed by group name.
+func (db *DB) GetGroups() (map[string][]string, error) {
+	rows, err := db.Query(`SELECT g.name, m.mobile FROM groups g
+		LEFT JOIN group_members m ON m.group_id = g.id ORDER BY g.name, m.id`)
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string)
+	for rows.Next() {
+		var name string
+		var mobile sql.NullString
+		rows.Scan(&name, &mobile)
+		members := groups[name]
+		if mobile.Valid {
+			members = append(members, mobile.String)
+		}
+		groups[name] = members
+	}
+	rows.Close()
+	return groups, nil
+}
+
+// GetGroupMembers gets the mobiles in the named group.
+// Returns sql.ErrNoRows if the group does not exist.
+func (db *DB) GetGroupMembers(name string) ([]string, error) {
+	var id int64
+	if err := db.QueryRow("SELECT id FROM groups WHERE name=?", name).Scan(&id); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT mobile FROM group_members WHERE group_id=? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	var mobiles []string
+	for rows.Next() {
+		var mobile string
+		rows.Scan(&mobile)
+		mobiles = append(mobiles, mobile)
+	}
+	rows.Close()
+	return mobiles, nil
+}
+
+// InsertInboxMessage inserts a received SMS into the database.
+func (db *DB) InsertInboxMessage(sms InboundSMS) error {
+	_, err := db.Exec("INSERT INTO inbox(mobile, message, device, segments, incomplete) VALUES(?, ?, ?, ?, ?)",
+		sms.Mobile, sms.Body, sms.Device, sms.Segments, sms.Incomplete)
+	return err
+}
+
+// GetInboxMessages gets the set of received SMSs corresponding to the filter,
+// most recent first.
+func (db *DB) GetInboxMessages(filter InboxFilter) ([]InboundSMS, error) {
+	query := "SELECT id, mobile, message, device, segments, received_at, read, incomplete FROM inbox WHERE 1=1"
+	var args []interface{}
+	if filter.Mobile != "" {
+		query += " AND mobile=?"
+		args = append(args, filter.Mobile)
+	}
+	if filter.Device != "" {
+		query += " AND device=?"
+		args = append(args, filter.Device)
+	}
+	if filter.Unread {
+		query += " AND read=0"
+	}
+	if !filter.Since.IsZero() {
+		query += " AND received_at>=?"
+		args = append(args, filter.Since.UTC().Format(TimestampFormat))
+	}
+	if !filter.Until.IsZero() {
+		query += " AND received_at<?"
+		args = append(args, filter.Until.UTC().Format(TimestampFormat))
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, filter.Offset)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var messages []InboundSMS
+	for rows.Next() {
+		sms := InboundSMS{}
+		rows.Scan(&sms.ID, &sms.Mobile, &sms.Body, &sms.Device, &sms.Segments, &sms.ReceivedAt, &sms.Read, &sms.Incomplete)
 		messages = append(messages, sms)
 	}
 	rows.Close()
 	return messages, nil
 }
 
+// MarkInboxMessageRead sets the read state of a received SMS.
+// Returns sql.ErrNoRows if the SMS does not exist.
+func (db *DB) MarkInboxMessageRead(id int64, read bool) error {
+	res, err := db.Exec("UPDATE inbox SET read=? WHERE id=?", read, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RedactedBody replaces the body of SMSs purged without hashing.
+const RedactedBody = "[redacted]"
+
+// PurgeMessageBodies removes the bodies of SMSs, other than those still
+// pending, created before the given time, while retaining the other fields.
+// If hash is set the body is replaced with its SHA-256 hash, so it can still
+// be matched against a known body, else it is replaced with RedactedBody.
+// Returns the number of SMSs purged.
+func (db *DB) PurgeMessageBodies(before time.Time, hash bool) (int64, error) {
+	cutoff := before.UTC().Format(TimestampFormat)
+	if !hash {
+		res, err := db.Exec("UPDATE messages SET message=?, purged=1 WHERE purged=0 AND status!=? AND created_at<?",
+			RedactedBody, SMSPending, cutoff)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id, message FROM messages WHERE purged=0 AND status!=? AND created_at<?",
+		SMSPending, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	hashes := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var body string
+		if err := rows.Scan(&id, &body); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sum := sha256.Sum256([]byte(body))
+		hashes[id] = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	rows.Close()
+	for id, h := range hashes {
+		if _, err := tx.Exec("UPDATE messages SET message=?, purged=1 WHERE id=?", h, id); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(hashes)), tx.Commit()
+}
+
 // GetMessages gets the set of SMSs corresponding to the filter.
 // Expecting filter as empty string or WHERE clauses,
 // simply appended to the query to get desired set from the database
 func (db *DB) GetMessages(filter string) ([]SMS, error) {
-	query := "SELECT uuid, message, mobile, status, retries, device, created_at, updated_at FROM messages " + filter
+	query := "SELECT " + smsColumns + " FROM messages " + filter
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
 	}
+	return scanMessages(rows), nil
+}
+
+// GetMessagesPage gets a page of up to limit SMSs, most recent first, with ids
+// less than the afterID cursor.
+// An afterID of 0 gets the first page.
+// Also returns the cursor for the next page, which is 0 if there are no more.
+// Unlike paging by OFFSET, the cost of retrieving a page does not depend on
+// its depth.
+func (db *DB) GetMessagesPage(afterID int64, limit int) ([]SMS, int64, error) {
+	var rows *sql.Rows
+	var err error
+	if afterID > 0 {
+		rows, err = db.Query("SELECT "+smsColumns+" FROM messages WHERE id<? ORDER BY id DESC LIMIT ?", afterID, limit)
+	} else {
+		rows, err = db.Query("SELECT "+smsColumns+" FROM messages ORDER BY id DESC LIMIT ?", limit)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	messages := scanMessages(rows)
+	var next int64
+	if len(messages) == limit && limit > 0 {
+		next = messages[len(messages)-1].ID
+	}
+	return messages, next, nil
+}
+
+// smsColumns are the columns of the messages table that populate an SMS,
+// in the order expected by scanMessages.
+const smsColumns = `id, uuid, message, mobile, status, retries, COALESCE(device, ''),
+	created_at, COALESCE(updated_at, ''), delivery_report, purged, COALESCE(batch_id, ''),
+	COALESCE(send_at, ''), max_retries, data, COALESCE(udh, ''), segments, cost, COALESCE(error_reason, ''), pid, COALESCE(class, ''),
+	COALESCE(metadata, ''), parts_sent, concat_ref, COALESCE(mrs, ''), COALESCE(resent_from, ''), message_class,
+	COALESCE(expires_at, ''), raw_length, normalized_length`
+
+// scanMessages reads the SMSs from rows selected using smsColumns, and closes
+// the rows.
+func scanMessages(rows *sql.Rows) []SMS {
 	var messages []SMS
 	for rows.Next() {
 		sms := SMS{}
-		rows.Scan(&sms.UUID, &sms.Body, &sms.Mobile, &sms.Status, &sms.Retries, &sms.Device, &sms.CreatedAt, &sms.UpdatedAt)
+		var maxRetries, messageClass sql.NullInt64
+		var metadata string
+		rows.Scan(&sms.ID, &sms.UUID, &sms.Body, &sms.Mobile, &sms.Status, &sms.Retries, &sms.Device,
+			&sms.CreatedAt, &sms.UpdatedAt, &sms.DeliveryReport, &sms.Purged, &sms.BatchID,
+			&sms.SendAt, &maxRetries, &sms.Data, &sms.UDH, &sms.Segments, &sms.Cost, &sms.ErrorReason, &sms.PID, &sms.Class, &metadata,
+			&sms.PartsSent, &sms.ConcatRef, &sms.MRs, &sms.ResentFrom, &messageClass,
+			&sms.ExpiresAt, &sms.RawLength, &sms.NormalizedLength)
+		if maxRetries.Valid {
+			n := int(maxRetries.Int64)
+			sms.MaxRetries = &n
+		}
+		if messageClass.Valid {
+			n := int(messageClass.Int64)
+			sms.MessageClass = &n
+		}
+		if metadata != "" {
+			json.Unmarshal([]byte(metadata), &sms.Metadata)
+		}
 		messages = append(messages, sms)
 	}
 	rows.Close()
-	return messages, nil
+	return messages
+}
+
+// GetErroredMessages gets the SMSs that failed to be sent, most recently
+// failed first, for review.
+func (db *DB) GetErroredMessages(limit, offset int) ([]SMS, error) {
+	rows, err := db.Query("SELECT "+smsColumns+" FROM messages WHERE status=? ORDER BY updated_at DESC, id DESC LIMIT ? OFFSET ?",
+		SMSErrored, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows), nil
+}
+
+// ApplyDeliveryReport applies a delivery report, for the part of an accepted
+// SMS sent by the device with the message reference, to the SMS.
+// The SMS is errored, with the reason, if the part was not delivered, and is
+// sent once all of its parts have been delivered.
+// Returns the updated SMS, or sql.ErrNoRows if there is no accepted SMS
+// awaiting the report, such as if it has already expired.
+func (db *DB) ApplyDeliveryReport(device, mr string, delivered bool, reason string) (SMS, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return SMS{}, err
+	}
+	defer tx.Rollback()
+	// message references wrap at 256, so only the most recent SMSs can be
+	// awaiting a report with a given reference.
+	rows, err := tx.Query("SELECT "+smsColumns+" FROM messages WHERE status=? AND device=? ORDER BY id DESC LIMIT 256",
+		SMSAccepted, device)
+	if err != nil {
+		return SMS{}, err
+	}
+	for _, sms := range scanMessages(rows) {
+		mrs := strings.Split(sms.MRs, ",")
+		i := 0
+		for i < len(mrs) && mrs[i] != mr {
+			i++
+		}
+		if i == len(mrs) {
+			continue
+		}
+		mrs = append(mrs[:i], mrs[i+1:]...)
+		sms.MRs = strings.Join(mrs, ",")
+		switch {
+		case !delivered:
+			sms.Status = SMSErrored
+			sms.ErrorReason = reason
+			sms.MRs = ""
+		case sms.MRs == "":
+			sms.Status = SMSSent
+		}
+		_, err = tx.Exec(`UPDATE messages SET status=?, error_reason=?, mrs=?, updated_at=DATETIME('now') WHERE id=?`,
+			sms.Status, nullString(sms.ErrorReason), nullString(sms.MRs), sms.ID)
+		if err != nil {
+			return SMS{}, err
+		}
+		return sms, tx.Commit()
+	}
+	return SMS{}, sql.ErrNoRows
+}
+
+// ExpireUndelivered errors the accepted SMSs that have been awaiting delivery
+// reports since before the cutoff.
+// Returns the expired SMSs.
+func (db *DB) ExpireUndelivered(cutoff time.Time) ([]SMS, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT "+smsColumns+" FROM messages WHERE status=? AND updated_at<?",
+		SMSAccepted, cutoff.UTC().Format(TimestampFormat))
+	if err != nil {
+		return nil, err
+	}
+	smss := scanMessages(rows)
+	for i := range smss {
+		smss[i].Status = SMSErrored
+		smss[i].ErrorReason = "no delivery report"
+		smss[i].MRs = ""
+		_, err = tx.Exec(`UPDATE messages SET status=?, error_reason=?, mrs=NULL, updated_at=DATETIME('now') WHERE id=?`,
+			SMSErrored, smss[i].ErrorReason, smss[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return smss, tx.Commit()
+}
+
+// ResendMessage returns an errored SMS to pending, so that it is sent again,
+// optionally to a corrected mobile.
+// The error reason is reset, and the SMS is sent in full, even if some parts
+// were sent by an earlier attempt.
+// If resetRetries is set then the retries are reset, so the SMS has its full
+// allotment of retries, else the SMS keeps its retries, so is errored again
+// if the next attempt fails and its retries are exhausted.
+// Returns the updated SMS, or sql.ErrNoRows if there is no errored SMS with
+// the UUID.
+func (db *DB) ResendMessage(uuid, mobile string, resetRetries bool) (SMS, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return SMS{}, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE messages SET status=?, retries=CASE WHEN ? THEN 0 ELSE retries END, error_reason=NULL,
+		device=NULL, parts_sent=0, mobile=COALESCE(NULLIF(?, ''), mobile), updated_at=DATETIME('now')
+		WHERE uuid=? AND status=?`,
+		SMSPending, resetRetries, mobile, uuid, SMSErrored)
+	if err != nil {
+		return SMS{}, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return SMS{}, sql.ErrNoRows
+	}
+	rows, err := tx.Query("SELECT "+smsColumns+" FROM messages WHERE uuid=?", uuid)
+	if err != nil {
+		return SMS{}, err
+	}
+	smss := scanMessages(rows)
+	if len(smss) != 1 {
+		return SMS{}, sql.ErrNoRows
+	}
+	return smss[0], tx.Commit()
 }
 
 // GetLast7DaysMessageCount determines the number of SMSs added on each of the
@@ -177,6 +1189,57 @@ func (db *DB) GetLast7DaysMessageCount() (map[string]int, error) {
 	return dayCount, nil
 }
 
+// GetMessageCountByDay determines the number of SMSs created on each day
+// from the day of from to the day of to, inclusive.
+// Days are UTC, as per GetLast7DaysMessageCount.
+// Days with no SMSs are included, so there is one DayCount for each day in
+// the range.
+func (db *DB) GetMessageCountByDay(from, to time.Time) ([]DayCount, error) {
+	first := time.Date(from.UTC().Year(), from.UTC().Month(), from.UTC().Day(), 0, 0, 0, 0, time.UTC)
+	last := time.Date(to.UTC().Year(), to.UTC().Month(), to.UTC().Day(), 0, 0, 0, 0, time.UTC)
+	var days []DayCount
+	index := make(map[string]int)
+	for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+		day := d.Format("2006-01-02")
+		index[day] = len(days)
+		days = append(days, DayCount{Day: day})
+	}
+	rows, err := db.Query(`SELECT strftime('%Y-%m-%d', created_at) as datestamp, status, COUNT(id)
+		FROM messages WHERE created_at>=? AND created_at<? GROUP BY datestamp, status`,
+		first.Format("2006-01-02"), last.AddDate(0, 0, 1).Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var day string
+	var status SMSStatus
+	var count int
+	for rows.Next() {
+		if err = rows.Scan(&day, &status, &count); err != nil {
+			return nil, err
+		}
+		i, ok := index[day]
+		if !ok {
+			continue
+		}
+		dc := &days[i]
+		switch status {
+		case SMSPending:
+			dc.Pending = count
+		case SMSSent:
+			dc.Sent = count
+		case SMSErrored:
+			dc.Errored = count
+		case SMSCanceled:
+			dc.Canceled = count
+		case SMSAccepted:
+			dc.Accepted = count
+		}
+		dc.Total += count
+	}
+	return days, rows.Err()
+}
+
 // GetStatusSummary determines the number of SMSs in each state.
 func (db *DB) GetStatusSummary() ([]int, error) {
 	rows, err := db.Query(`SELECT status, COUNT(id) as messagecount
@@ -185,7 +1248,7 @@ func (db *DB) GetStatusSummary() ([]int, error) {
 		return nil, err
 	}
 	var status, count int
-	statusSummary := make([]int, 4)
+	statusSummary := make([]int, 5)
 	for rows.Next() {
 		rows.Scan(&status, &count)
 		statusSummary[status] = count
@@ -193,3 +1256,217 @@ func (db *DB) GetStatusSummary() ([]int, error) {
 	rows.Close()
 	return statusSummary, nil
 }
+
+// GetUsage gets the number and cost of the SMSs sent within the period.
+// Zero times do not bound the period.
+func (db *DB) GetUsage(since, until time.Time) (Usage, error) {
+	query := "SELECT COUNT(id), COALESCE(SUM(segments), 0), COALESCE(SUM(cost), 0) FROM messages WHERE status=?"
+	args := []interface{}{SMSSent}
+	if !since.IsZero() {
+		query += " AND updated_at>=?"
+		args = append(args, since.UTC().Format(TimestampFormat))
+	}
+	if !until.IsZero() {
+		query += " AND updated_at<?"
+		args = append(args, until.UTC().Format(TimestampFormat))
+	}
+	var u Usage
+	err := db.QueryRow(query, args...).Scan(&u.Messages, &u.Segments, &u.Cost)
+	return u, err
+}
+
+// GetDeviceSentCounts gets the number of SMSs sent by each device since the
+// time, including those awaiting delivery reports, keyed by device.
+func (db *DB) GetDeviceSentCounts(since time.Time) (map[string]int, error) {
+	rows, err := db.Query("SELECT device, COUNT(id) FROM messages WHERE status IN (?, ?) AND updated_at>=? GROUP BY device",
+		SMSSent, SMSAccepted, since.UTC().Format(TimestampFormat))
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for rows.Next() {
+		var device string
+		var count int
+		rows.Scan(&device, &count)
+		counts[device] = count
+	}
+	rows.Close()
+	return counts, nil
+}
+
+// GetStats gets the number of SMSs in each state, the age of the oldest, and
+// the size of the database.
+func (db *DB) GetStats() (Stats, error) {
+	var st Stats
+	summary, err := db.GetStatusSummary()
+	if err != nil {
+		return st, err
+	}
+	st.Pending = summary[SMSPending]
+	st.Sent = summary[SMSSent]
+	st.Errored = summary[SMSErrored]
+	st.Canceled = summary[SMSCanceled]
+	st.Accepted = summary[SMSAccepted]
+	st.Messages = st.Pending + st.Sent + st.Errored + st.Canceled + st.Accepted
+	err = db.QueryRow("SELECT COALESCE(MIN(created_at), '') FROM messages").Scan(&st.Oldest)
+	if err != nil {
+		return st, err
+	}
+	var pages, pageSize int64
+	if err = db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return st, err
+	}
+	if err = db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return st, err
+	}
+	st.Size = pages * pageSize
+	return st, nil
+}
+
+// Vacuum rebuilds the database to reclaim the space freed by deleted SMSs.
+// The database is locked until the rebuild completes, which may take some
+// time for a large database.
+func (db *DB) Vacuum() error {
+	_, err := db.Exec("VACUUM")
+	return err
+}
+
+const (
+	// backupStep is the number of pages copied by each step of a backup.
+	backupStep = 256
+	// backupPause is the time between the steps of a backup, during which
+	// the database may be written.
+	backupPause = 10 * time.Millisecond
+	// backupRestarts is the number of times a backup may be restarted by
+	// writes before the remainder is copied in a single step.
+	backupRestarts = 3
+)
+
+// Backup writes a consistent copy of the database to the dest file, using the
+// sqlite online backup API.
+// Any existing database in dest is overwritten.
+// The database is copied in steps, so it is not locked for the duration of
+// the backup and SMSs may continue to be sent.
+// A write to the database during the backup restarts the copy, so if the
+// copy is restarted too often, such as by a steady stream of SMSs, the
+// remainder is copied in one step, delaying writes until it completes.
+func (db *DB) Backup(dest string) error {
+	var seq int
+	var name, file string
+	if err := db.QueryRow("PRAGMA database_list").Scan(&seq, &name, &file); err != nil {
+		return err
+	}
+	if file == "" {
+		return errors.New("database has no file to backup")
+	}
+	drv := &sqlite3.SQLiteDriver{}
+	src, err := drv.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := drv.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	b, err := dst.(*sqlite3.SQLiteConn).Backup("main", src.(*sqlite3.SQLiteConn), "main")
+	if err != nil {
+		return err
+	}
+	restarts := 0
+	remaining := -1
+	for {
+		n := backupStep
+		if restarts >= backupRestarts {
+			// copy everything left while holding the read lock, so it
+			// cannot be restarted.
+			n = -1
+		}
+		done, err := b.Step(n)
+		if err != nil {
+			b.Close()
+			return err
+		}
+		if done {
+			break
+		}
+		if remaining >= 0 && b.Remaining() >= remaining {
+			// no progress, as a write restarted the copy.
+			restarts++
+		}
+		remaining = b.Remaining()
+		time.Sleep(backupPause)
+	}
+	return b.Finish()
+}
+
+// CancelBatch cancels the SMSs in the batch that are still pending.
+// SMSs in exclude, such as those currently being sent, are left pending.
+// Returns the number of SMSs canceled, or sql.ErrNoRows if there are no SMSs
+// in the batch.
+func (db *DB) CancelBatch(id string, exclude []string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var total int
+	if err = tx.QueryRow("SELECT COUNT(id) FROM messages WHERE batch_id=?", id).Scan(&total); err != nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, sql.ErrNoRows
+	}
+	query := "UPDATE messages SET status=?, updated_at=DATETIME('now') WHERE batch_id=? AND status=?"
+	args := []interface{}{SMSCanceled, id, SMSPending}
+	if len(exclude) > 0 {
+		query += " AND uuid NOT IN (?" + strings.Repeat(",?", len(exclude)-1) + ")"
+		for _, uuid := range exclude {
+			args = append(args, uuid)
+		}
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// GetBatchStatus gets the number of SMSs in the batch in each state.
+// Returns sql.ErrNoRows if there are no SMSs in the batch.
+func (db *DB) GetBatchStatus(id string) (BatchStatus, error) {
+	bs := BatchStatus{ID: id}
+	rows, err := db.Query("SELECT status, COUNT(id) FROM messages WHERE batch_id=? GROUP BY status", id)
+	if err != nil {
+		return bs, err
+	}
+	var status SMSStatus
+	var count int
+	for rows.Next() {
+		rows.Scan(&status, &count)
+		switch status {
+		case SMSPending:
+			bs.Pending = count
+		case SMSSent:
+			bs.Sent = count
+		case SMSErrored:
+			bs.Errored = count
+		case SMSCanceled:
+			bs.Canceled = count
+		case SMSAccepted:
+			bs.Accepted = count
+		}
+		bs.Total += count
+	}
+	rows.Close()
+	if bs.Total == 0 {
+		return bs, sql.ErrNoRows
+	}
+	bs.Complete = float64(bs.Total-bs.Pending-bs.Accepted) * 100 / float64(bs.Total)
+	return bs, nil
+}
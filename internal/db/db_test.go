@@ -4,8 +4,13 @@
 package db
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -45,6 +50,42 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestOpen(t *testing.T) {
+	os.Remove("testdb")
+	defer os.Remove("testdb")
+
+	// existing - ok
+	db, err := New("sqlite3", "testdb")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	db.Close()
+	db, err = Open("sqlite3", "testdb")
+	if err != nil {
+		t.Error("unexpected error:", err)
+	} else {
+		db.Close()
+	}
+
+	// existing - old schema
+	sqldb, err := sql.Open("sqlite3", "testdb")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	sqldb.Exec("INSERT INTO schema_version(version) VALUES('goatsms v1')")
+	sqldb.Close()
+	db, err = Open("sqlite3", "testdb")
+	if !errors.Is(err, ErrSchemaNotRecognized) {
+		t.Errorf("expected schema not recognized but got %v", err)
+	}
+
+	// existing - not goatsms
+	db, err = Open("sqlite3", "db_test.go")
+	if err != ErrSchemaNotRecognized {
+		t.Errorf("expected schema not recognized but got %v", err)
+	}
+}
+
 func TestInsertMessage(t *testing.T) {
 	db := setup(t)
 	defer teardown(db)
@@ -52,7 +93,7 @@ func TestInsertMessage(t *testing.T) {
 	// new
 	smss := []SMS{
 		SMS{UUID: "one", Mobile: "+1", Body: "a message"},
-		SMS{UUID: "two", Mobile: "+2", Body: "another message"},
+		SMS{UUID: "two", Mobile: "+2", Body: "another message", DeliveryReport: true},
 	}
 	for _, sms := range smss {
 		if err := db.InsertMessage(sms); err != nil {
@@ -70,13 +111,14 @@ func TestInsertMessage(t *testing.T) {
 	for _, sms := range smss {
 		expected[sms.UUID] = sms
 	}
-	rows, err := db.Query("SELECT uuid,mobile,message FROM messages", nil)
+	rows, err := db.Query("SELECT uuid,mobile,message,delivery_report FROM messages", nil)
 	if err != nil {
 		t.Error("unexpected error:", err)
 	}
 	for rows.Next() {
 		var uuid, mobile, body string
-		rows.Scan(&uuid, &mobile, &body)
+		var dr bool
+		rows.Scan(&uuid, &mobile, &body, &dr)
 		if expected[uuid].UUID != uuid {
 			t.Errorf("expected uuid %s but got %s", expected[uuid].UUID, uuid)
 		}
@@ -86,8 +128,27 @@ func TestInsertMessage(t *testing.T) {
 		if expected[uuid].Body != body {
 			t.Errorf("expected body %s but got %s", expected[uuid].Body, body)
 		}
+		if expected[uuid].DeliveryReport != dr {
+			t.Errorf("expected delivery_report %v but got %v", expected[uuid].DeliveryReport, dr)
+		}
 		delete(expected, uuid)
 	}
+
+	// optional retry limit
+	zero := 0
+	if err := db.InsertMessage(SMS{UUID: "three", Mobile: "+3", Body: "no retries", MaxRetries: &zero}); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	msgs, _ := db.GetMessages("ORDER BY id")
+	if len(msgs) != 3 {
+		t.Fatalf("got %d SMSs, expected 3", len(msgs))
+	}
+	if msgs[0].MaxRetries != nil {
+		t.Errorf("unexpected max_retries %d", *msgs[0].MaxRetries)
+	}
+	if msgs[2].MaxRetries == nil || *msgs[2].MaxRetries != 0 {
+		t.Errorf("expected max_retries 0 but got %v", msgs[2].MaxRetries)
+	}
 }
 
 func TestUpdateMessageStatus(t *testing.T) {
@@ -141,12 +202,126 @@ func TestUpdateMessageStatus(t *testing.T) {
 	}
 }
 
+func TestPartsSent(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	sms := SMS{UUID: "multi", Mobile: "+1", Body: "a long message"}
+	if err := db.InsertMessage(sms); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	sms.Retries = 1
+	sms.Device = "phone"
+	sms.PartsSent = 2
+	sms.ConcatRef = 42
+	if err := db.UpdateMessageStatus(sms); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	msgs, err := db.GetPendingMessages(10, time.Now())
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message but got %d", len(msgs))
+	}
+	if msgs[0].PartsSent != 2 || msgs[0].ConcatRef != 42 || msgs[0].Device != "phone" {
+		t.Errorf("expected 2 parts sent by phone with ref 42 but got %d by %s with ref %d",
+			msgs[0].PartsSent, msgs[0].Device, msgs[0].ConcatRef)
+	}
+
+	// a resend starts afresh.
+	sms.Status = SMSErrored
+	if err := db.UpdateMessageStatus(sms); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	resent, err := db.ResendMessage("multi", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if resent.PartsSent != 0 {
+		t.Errorf("expected no parts sent after resend but got %d", resent.PartsSent)
+	}
+}
+
+func TestApplyDeliveryReport(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	for _, uuid := range []string{"one", "two"} {
+		sms := SMS{UUID: uuid, Mobile: "+1", Body: "a long message"}
+		if err := db.InsertMessage(sms); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		sms.Status = SMSAccepted
+		sms.Device = "phone"
+		sms.MRs = "7,8"
+		if uuid == "two" {
+			sms.MRs = "9"
+		}
+		if err := db.UpdateMessageStatus(sms); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	if _, err := db.ApplyDeliveryReport("other", "7", true, ""); err != sql.ErrNoRows {
+		t.Errorf("expected ErrNoRows for another device but got %v", err)
+	}
+	sms, err := db.ApplyDeliveryReport("phone", "7", true, "")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sms.UUID != "one" || sms.Status != SMSAccepted || sms.MRs != "8" {
+		t.Errorf("expected one still accepted awaiting 8 but got %s %d awaiting %s", sms.UUID, sms.Status, sms.MRs)
+	}
+	sms, err = db.ApplyDeliveryReport("phone", "8", true, "")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sms.Status != SMSSent {
+		t.Errorf("expected one sent but got %d", sms.Status)
+	}
+	sms, err = db.ApplyDeliveryReport("phone", "9", false, "rejected")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sms.UUID != "two" || sms.Status != SMSErrored || sms.ErrorReason != "rejected" {
+		t.Errorf("expected two errored but got %s %d %q", sms.UUID, sms.Status, sms.ErrorReason)
+	}
+	if _, err := db.ApplyDeliveryReport("phone", "9", true, ""); err != sql.ErrNoRows {
+		t.Errorf("expected ErrNoRows for a repeated report but got %v", err)
+	}
+
+	// expiry
+	sms = SMS{UUID: "three", Mobile: "+1", Body: "hello"}
+	if err := db.InsertMessage(sms); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	sms.Status = SMSAccepted
+	sms.MRs = "10"
+	if err := db.UpdateMessageStatus(sms); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expired, err := db.ExpireUndelivered(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(expired) != 0 {
+		t.Errorf("expected none expired but got %d", len(expired))
+	}
+	expired, err = db.ExpireUndelivered(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(expired) != 1 || expired[0].UUID != "three" || expired[0].Status != SMSErrored {
+		t.Errorf("expected three expired but got %v", expired)
+	}
+}
+
 func TestGetPendingMessages(t *testing.T) {
 	db := setup2(t)
 	defer teardown(db)
 
 	// limit
-	smss, err := db.GetPendingMessages(10)
+	smss, err := db.GetPendingMessages(10, time.Now())
 	if err != nil {
 		t.Error("unexpected error:", err)
 	}
@@ -160,7 +335,7 @@ func TestGetPendingMessages(t *testing.T) {
 	}
 
 	// less than limit
-	smss, err = db.GetPendingMessages(100)
+	smss, err = db.GetPendingMessages(100, time.Now())
 	if err != nil {
 		t.Error("unexpected error:", err)
 	}
@@ -175,7 +350,7 @@ func TestGetPendingMessages(t *testing.T) {
 
 	// db error
 	db.Close()
-	smss, err = db.GetPendingMessages(100)
+	smss, err = db.GetPendingMessages(100, time.Now())
 	if err == nil {
 		t.Error("unexpected success")
 	}
@@ -184,141 +359,1210 @@ func TestGetPendingMessages(t *testing.T) {
 	}
 }
 
-func TestGetMessages(t *testing.T) {
-	db := setup2(t)
+func TestScheduledMessages(t *testing.T) {
+	db := setup(t)
 	defer teardown(db)
 
-	// unfiltered
-	smss, err := db.GetMessages("")
+	now := time.Now()
+	later := now.Add(time.Hour).UTC().Format(TimestampFormat)
+	smss := []SMS{
+		SMS{UUID: "now", Mobile: "+1", Body: "a message"},
+		SMS{UUID: "later", Mobile: "+2", Body: "another message", SendAt: later},
+	}
+	for _, sms := range smss {
+		if err := db.InsertMessage(sms); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+
+	// not yet due
+	pending, err := db.GetPendingMessages(10, now)
 	if err != nil {
 		t.Error("unexpected error:", err)
 	}
-	if len(smss) != 100 {
-		t.Errorf("got %d SMSs, expected 100", len(smss))
+	if len(pending) != 1 || pending[0].UUID != "now" {
+		t.Errorf("unexpected pending %v", pending)
+	}
+	next, err := db.GetNextSendTime(now)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if next.Format(TimestampFormat) != later {
+		t.Errorf("expected next %s, got %v", later, next)
 	}
 
-	// filtered
-	smss, err = db.GetMessages("WHERE status=1")
+	// due within the lead time
+	pending, err = db.GetPendingMessages(10, now.Add(2*time.Hour))
 	if err != nil {
 		t.Error("unexpected error:", err)
 	}
-	if len(smss) != 28 {
-		t.Errorf("got %d SMSs, expected 28", len(smss))
+	if len(pending) != 2 {
+		t.Errorf("got %d SMSs, expected 2", len(pending))
 	}
-	for _, s := range smss {
-		if s.Status != SMSSent {
-			t.Errorf("unexpected status %d in sms %s", s.Status, s.UUID)
+	for _, sms := range pending {
+		if sms.UUID == "later" && sms.SendTime().Format(TimestampFormat) != later {
+			t.Errorf("expected send time %s, got %v", later, sms.SendTime())
 		}
 	}
-
-	// bad sql
-	smss, err = db.GetMessages("WHERE")
-	if err == nil {
-		t.Error("unexpected success")
+	next, err = db.GetNextSendTime(now.Add(2 * time.Hour))
+	if err != nil {
+		t.Error("unexpected error:", err)
 	}
-	if len(smss) > 0 {
-		t.Error("unexpected smss:", smss)
+	if !next.IsZero() {
+		t.Errorf("unexpected next %v", next)
 	}
-
 }
 
-func TestGetLast7DaysMessageCount(t *testing.T) {
-	db := setup2(t)
+func TestGetBlocklist(t *testing.T) {
+	db := setup(t)
 	defer teardown(db)
 
-	result, err := db.GetLast7DaysMessageCount()
+	// empty
+	keywords, prefixes, err := db.GetBlocklist()
 	if err != nil {
 		t.Error("unexpected error:", err)
 	}
-	// based on distro in setup2
-	expected := []int{12, 8, 6, 5, 4, 4, 3}
-	now := time.Now()
-	for d := 0; d < 7; d++ {
-		dayDate := time.Date(now.Year(), now.Month(), now.Day()-d, 1, 0, 0, 0, time.UTC)
-		day := dayDate.Format("2006-01-02")
-		if expected[d] != result[day] {
-			t.Errorf("unexpected %s to have %d but got %d", day, expected[d], result[day])
-		}
+	if len(keywords) != 0 || len(prefixes) != 0 {
+		t.Errorf("unexpected blocklist %v %v", keywords, prefixes)
+	}
+
+	// populated
+	db.Exec("INSERT INTO blocklist(kind, value) VALUES(?, ?)", BlockKeyword, "spam")
+	db.Exec("INSERT INTO blocklist(kind, value) VALUES(?, ?)", BlockPrefix, "+1900")
+	db.Exec("INSERT INTO blocklist(kind, value) VALUES(?, ?)", "bogus", "ignored")
+	keywords, prefixes, err = db.GetBlocklist()
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(keywords) != 1 || keywords[0] != "spam" {
+		t.Errorf("unexpected keywords %v", keywords)
+	}
+	if len(prefixes) != 1 || prefixes[0] != "+1900" {
+		t.Errorf("unexpected prefixes %v", prefixes)
 	}
 
 	// db error
 	db.Close()
-	result, err = db.GetLast7DaysMessageCount()
+	keywords, prefixes, err = db.GetBlocklist()
 	if err == nil {
 		t.Error("unexpected success")
 	}
-	if result != nil {
-		t.Error("unexpected result:", result)
+	if keywords != nil || prefixes != nil {
+		t.Error("unexpected result:", keywords, prefixes)
 	}
 }
 
-func TestGetStatusSummary(t *testing.T) {
-	db := setup2(t)
+func TestGetRoutes(t *testing.T) {
+	db := setup(t)
 	defer teardown(db)
 
-	summary, err := db.GetStatusSummary()
+	// empty
+	routes, err := db.GetRoutes()
 	if err != nil {
 		t.Error("unexpected error:", err)
 	}
-	expected := []int{37, 28, 14, 21}
-	if len(summary) != len(expected) {
-		t.Fatalf("expected %v but got %v", expected, summary)
+	if len(routes) != 0 {
+		t.Errorf("unexpected routes %v", routes)
 	}
-	for idx, v := range expected {
-		if summary[idx] != v {
-			t.Fatalf("expected %v but got %v", expected, summary)
+
+	// populated
+	db.Exec("INSERT INTO routes(prefix, device) VALUES(?, ?)", "+44", "uk")
+	db.Exec("INSERT INTO routes(prefix, device) VALUES(?, ?)", "+1", "us")
+	routes, err = db.GetRoutes()
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	expected := map[string]string{"+44": "uk", "+1": "us"}
+	if len(routes) != len(expected) {
+		t.Errorf("expected %v but got %v", expected, routes)
+	}
+	for prefix, device := range expected {
+		if routes[prefix] != device {
+			t.Errorf("expected %v but got %v", expected, routes)
 		}
 	}
 
 	// db error
 	db.Close()
-	summary, err = db.GetStatusSummary()
+	routes, err = db.GetRoutes()
 	if err == nil {
 		t.Error("unexpected success")
 	}
-	if summary != nil {
-		t.Error("unexpected result:", summary)
+	if routes != nil {
+		t.Error("unexpected result:", routes)
 	}
 }
 
-func setup(t *testing.T) *DB {
-	db, err := New("sqlite3", "testdb")
+func TestTemplates(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	// new
+	if err := db.InsertTemplate("otp", "Your code is {{.code}}"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// existing
+	if err := db.InsertTemplate("otp", "Your code is {{.code}}"); err == nil {
+		t.Error("unexpected success")
+	}
+
+	// get existing
+	body, err := db.GetTemplate("otp")
 	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if body != "Your code is {{.code}}" {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	// get non-existent
+	_, err = db.GetTemplate("nosuch")
+	if err != sql.ErrNoRows {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	expiry := time.Now().Add(-time.Hour)
+	ok, _, err := db.ReserveIdempotencyKey("k1", expiry, expiry)
+	if err != nil || !ok {
+		t.Fatalf("expected reservation, got %v, err %v", ok, err)
+	}
+	// in progress
+	ok, rsp, err := db.ReserveIdempotencyKey("k1", expiry, expiry)
+	if err != nil || ok || rsp.Code != 0 {
+		t.Errorf("expected in progress, got %v %+v, err %v", ok, rsp, err)
+	}
+	// completed
+	if err = db.SaveIdempotentResponse("k1", IdempotentResponse{Code: 200, Body: []byte(`{"status":200}`)}); err != nil {
 		t.Fatal("unexpected error:", err)
 	}
-	return db
+	ok, rsp, err = db.ReserveIdempotencyKey("k1", expiry, expiry)
+	if err != nil || ok || rsp.Code != 200 || string(rsp.Body) != `{"status":200}` {
+		t.Errorf("expected replay, got %v %+v, err %v", ok, rsp, err)
+	}
+	// released
+	if err = db.ReleaseIdempotencyKey("k1"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if ok, _, err = db.ReserveIdempotencyKey("k1", expiry, expiry); err != nil || !ok {
+		t.Errorf("expected reservation, got %v, err %v", ok, err)
+	}
+	// expired
+	if ok, _, err = db.ReserveIdempotencyKey("k1", time.Now().Add(time.Hour), expiry); err != nil || !ok {
+		t.Errorf("expected reservation, got %v, err %v", ok, err)
+	}
+	// stale reservation
+	later := time.Now().Add(time.Hour)
+	if ok, _, err = db.ReserveIdempotencyKey("k2", expiry, expiry); err != nil || !ok {
+		t.Errorf("expected reservation, got %v, err %v", ok, err)
+	}
+	if ok, _, err = db.ReserveIdempotencyKey("k2", expiry, later); err != nil || !ok {
+		t.Errorf("expected stale reservation to be replaced, got %v, err %v", ok, err)
+	}
+	// completed responses are not stale
+	if err = db.SaveIdempotentResponse("k2", IdempotentResponse{Code: 200, Body: []byte(`{"status":200}`)}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	ok, rsp, err = db.ReserveIdempotencyKey("k2", expiry, later)
+	if err != nil || ok || rsp.Code != 200 {
+		t.Errorf("expected replay, got %v %+v, err %v", ok, rsp, err)
+	}
 }
 
-func setup2(t *testing.T) *DB {
+func TestModems(t *testing.T) {
 	db := setup(t)
-	tx, err := db.Begin()
-	if err != nil {
-		t.Fatal("Begin err:", err)
+	defer teardown(db)
+
+	// new
+	m := Modem{DevID: "phone", Port: "/dev/ttyUSB0", Baud: 115200, Enabled: true, Weight: 1}
+	if err := db.SaveModem(m); err != nil {
+		t.Error("unexpected error:", err)
 	}
-	stmt, err := tx.Prepare("INSERT INTO messages(uuid,message,mobile,status,retries,device,created_at) VALUES(?,?,?,?,?,?,?)")
+	if err := db.SaveModem(Modem{DevID: "backup", Port: "/dev/ttyUSB1", Baud: 9600, Weight: 2, DailyCap: 100}); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// replace existing
+	m.Port = "/dev/ttyUSB2"
+	if err := db.SaveModem(m); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	modems, err := db.GetModems()
 	if err != nil {
-		t.Fatal("Prepare err:", err)
+		t.Error("unexpected error:", err)
 	}
-	now := time.Now()
-	// This creates status distribution [37 28 14 21]
-	for idx := 0; idx < 100; idx++ {
-		createdDate := time.Date(now.Year(), now.Month(), now.Day(), 11-(idx*idx/11), 0, 0, 0, time.UTC)
-		created := createdDate.Format("2006-01-02")
-		stmt.Exec(
-			fmt.Sprintf("i%04d", idx),
-			fmt.Sprintf("message%03d", idx),
-			fmt.Sprintf("+1%04d", idx),
-			(idx*idx/7)%4,
-			idx,
-			"cell",
-			created)
+	expected := []Modem{
+		{DevID: "backup", Port: "/dev/ttyUSB1", Baud: 9600, Weight: 2, DailyCap: 100},
+		{DevID: "phone", Port: "/dev/ttyUSB2", Baud: 115200, Enabled: true, Weight: 1},
+	}
+	if !reflect.DeepEqual(modems, expected) {
+		t.Errorf("expected %v, got %v", expected, modems)
+	}
+
+	// delete
+	if err := db.DeleteModem("backup"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err := db.DeleteModem("backup"); err != sql.ErrNoRows {
+		t.Error("unexpected error:", err)
+	}
+	modems, _ = db.GetModems()
+	if len(modems) != 1 {
+		t.Errorf("expected 1 modem, got %d", len(modems))
 	}
-	tx.Commit()
-	stmt.Close()
-	return db
 }
 
-func teardown(db *DB) {
-	db.Close()
-	os.Remove("testdb")
+func TestGroups(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	// new, with duplicate
+	if err := db.AddGroupMembers("oncall", []string{"+1", "+2", "+1"}); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	// existing
+	if err := db.AddGroupMembers("oncall", []string{"+3"}); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	// empty
+	if err := db.AddGroupMembers("empty", nil); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	mobiles, err := db.GetGroupMembers("oncall")
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if fmt.Sprint(mobiles) != "[+1 +2 +3]" {
+		t.Errorf("unexpected members %v", mobiles)
+	}
+	if _, err = db.GetGroupMembers("nosuch"); err != sql.ErrNoRows {
+		t.Error("unexpected error:", err)
+	}
+
+	// remove
+	if err = db.RemoveGroupMember("oncall", "+2"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err = db.RemoveGroupMember("oncall", "+2"); err != sql.ErrNoRows {
+		t.Error("unexpected error:", err)
+	}
+
+	groups, err := db.GetGroups()
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if fmt.Sprint(groups) != "map[empty:[] oncall:[+1 +3]]" {
+		t.Errorf("unexpected groups %v", groups)
+	}
+
+	// delete
+	if err = db.DeleteGroup("oncall"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err = db.DeleteGroup("oncall"); err != sql.ErrNoRows {
+		t.Error("unexpected error:", err)
+	}
+
+	// batch id
+	if err = db.InsertMessage(SMS{UUID: "one", Mobile: "+1", Body: "a message", BatchID: "batch"}); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	smss, _ := db.GetMessages("")
+	if len(smss) != 1 || smss[0].BatchID != "batch" {
+		t.Errorf("unexpected smss: %v", smss)
+	}
+}
+
+func TestGetBatchStatus(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	for i, status := range []SMSStatus{SMSPending, SMSSent, SMSSent, SMSErrored} {
+		sms := SMS{UUID: fmt.Sprintf("b%d", i), Mobile: "+1", Body: "a message", BatchID: "batch", Status: status}
+		db.InsertMessage(sms)
+		db.UpdateMessageStatus(sms)
+	}
+	db.InsertMessage(SMS{UUID: "other", Mobile: "+1", Body: "a message"})
+
+	bs, err := db.GetBatchStatus("batch")
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	expected := BatchStatus{ID: "batch", Total: 4, Pending: 1, Sent: 2, Errored: 1, Complete: 75}
+	if bs != expected {
+		t.Errorf("expected %v, got %v", expected, bs)
+	}
+
+	// non-existent
+	if _, err = db.GetBatchStatus("nosuch"); err != sql.ErrNoRows {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestCancelBatch(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	for i, status := range []SMSStatus{SMSPending, SMSPending, SMSPending, SMSSent} {
+		sms := SMS{UUID: fmt.Sprintf("b%d", i), Mobile: "+1", Body: "a message", BatchID: "batch", Status: status}
+		db.InsertMessage(sms)
+		db.UpdateMessageStatus(sms)
+	}
+	db.InsertMessage(SMS{UUID: "other", Mobile: "+1", Body: "a message"})
+
+	n, err := db.CancelBatch("batch", []string{"b1"})
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 canceled, got %d", n)
+	}
+	bs, _ := db.GetBatchStatus("batch")
+	expected := BatchStatus{ID: "batch", Total: 4, Pending: 1, Sent: 1, Canceled: 2, Complete: 75}
+	if bs != expected {
+		t.Errorf("expected %v, got %v", expected, bs)
+	}
+	pending, _ := db.GetPendingMessages(10, time.Now())
+	if len(pending) != 2 {
+		t.Errorf("expected 2 pending, got %d", len(pending))
+	}
+
+	// the remainder
+	if n, err = db.CancelBatch("batch", nil); err != nil || n != 1 {
+		t.Errorf("expected 1 canceled, got %d, err %v", n, err)
+	}
+
+	// non-existent
+	if _, err = db.CancelBatch("nosuch", nil); err != sql.ErrNoRows {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	db := setup(t)
+	db.Close()
+	defer os.Remove("testdb")
+
+	if err := CheckIntegrity("sqlite3", "testdb", false); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err := CheckIntegrity("sqlite3", "testdb", true); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// not a database
+	ioutil.WriteFile("testdb.bad", []byte(strings.Repeat("not a database ", 100)), 0644)
+	defer os.Remove("testdb.bad")
+	if err := CheckIntegrity("sqlite3", "testdb.bad", true); !errors.Is(err, ErrIntegrity) {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestGetMessage(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	if err := db.InsertMessage(SMS{UUID: "copy", Mobile: "+2", Body: "a message", ResentFrom: "original"}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	sms, err := db.GetMessage("copy")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sms.Mobile != "+2" || sms.Body != "a message" || sms.ResentFrom != "original" || sms.MessageClass != nil {
+		t.Errorf("unexpected sms: %+v", sms)
+	}
+	// message class
+	class := 2
+	if err := db.InsertMessage(SMS{UUID: "sim", Mobile: "+2", Body: "a message", MessageClass: &class}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sms, err = db.GetMessage("sim"); err != nil || sms.MessageClass == nil || *sms.MessageClass != 2 {
+		t.Errorf("unexpected sms: %+v, err %v", sms, err)
+	}
+	// expiry
+	expiry := time.Now().Add(time.Hour).UTC().Format(TimestampFormat)
+	if err := db.InsertMessage(SMS{UUID: "ttl", Mobile: "+2", Body: "a message", ExpiresAt: expiry}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sms, err = db.GetMessage("ttl"); err != nil || sms.ExpiresAt != expiry {
+		t.Errorf("unexpected sms: %+v, err %v", sms, err)
+	}
+	if at := sms.ExpiryTime(); at.Format(TimestampFormat) != expiry {
+		t.Errorf("unexpected expiry: %v", at)
+	}
+	if sms.Expired() {
+		t.Errorf("unexpected expired: %+v", sms)
+	}
+	sms.Status = SMSErrored
+	sms.ErrorReason = ExpiredReason
+	if !sms.Expired() {
+		t.Errorf("expected expired: %+v", sms)
+	}
+	if sms.Rejected() {
+		t.Errorf("unexpected rejected: %+v", sms)
+	}
+	// rejected
+	rejected := SMS{UUID: "blocked", Mobile: "+1900", Body: "a message", Status: SMSErrored,
+		ErrorReason: RejectedPrefix + "destination matches blocked prefix '+1900'"}
+	db.InsertMessage(rejected)
+	if err := db.UpdateMessageStatus(rejected); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sms, err = db.GetMessage("blocked"); err != nil || !sms.Rejected() || sms.Expired() {
+		t.Errorf("expected rejected: %+v, err %v", sms, err)
+	}
+	// normalized
+	if err := db.InsertMessage(SMS{UUID: "norm", Mobile: "+2", Body: "a message", RawLength: 12, NormalizedLength: 9}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sms, err = db.GetMessage("norm"); err != nil || sms.RawLength != 12 || sms.NormalizedLength != 9 {
+		t.Errorf("unexpected sms: %+v, err %v", sms, err)
+	}
+	// non-existent
+	if _, err = db.GetMessage("nosuch"); err != sql.ErrNoRows {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestResendMessage(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	for i, status := range []SMSStatus{SMSErrored, SMSSent, SMSErrored} {
+		sms := SMS{UUID: fmt.Sprintf("r%d", i), Mobile: "+1", Body: "a message", Status: status, Retries: 3}
+		if status == SMSErrored {
+			sms.ErrorReason = "CMS Error: 38"
+		}
+		db.InsertMessage(sms)
+		db.UpdateMessageStatus(sms)
+	}
+
+	errored, err := db.GetErroredMessages(10, 0)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(errored) != 2 {
+		t.Fatalf("expected 2 errored, got %d", len(errored))
+	}
+	for _, sms := range errored {
+		if sms.ErrorReason != "CMS Error: 38" {
+			t.Errorf("unexpected error reason: %q", sms.ErrorReason)
+		}
+	}
+
+	sms, err := db.ResendMessage("r0", "+2", true)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if sms.Status != SMSPending || sms.Mobile != "+2" || sms.Retries != 0 || sms.ErrorReason != "" {
+		t.Errorf("unexpected resent sms: %+v", sms)
+	}
+	// mobile unchanged
+	if sms, err = db.ResendMessage("r2", "", true); err != nil || sms.Mobile != "+1" {
+		t.Errorf("unexpected resent sms: %+v, err %v", sms, err)
+	}
+	errored, _ = db.GetErroredMessages(10, 0)
+	if len(errored) != 0 {
+		t.Errorf("expected 0 errored, got %d", len(errored))
+	}
+
+	// retries kept
+	sms = SMS{UUID: "r3", Mobile: "+1", Body: "a message", Status: SMSErrored, Retries: 3}
+	db.InsertMessage(sms)
+	db.UpdateMessageStatus(sms)
+	if sms, err = db.ResendMessage("r3", "", false); err != nil || sms.Status != SMSPending || sms.Retries != 3 {
+		t.Errorf("unexpected resent sms: %+v, err %v", sms, err)
+	}
+
+	// not errored
+	if _, err = db.ResendMessage("r1", "+2", true); err != sql.ErrNoRows {
+		t.Error("unexpected error:", err)
+	}
+	// non-existent
+	if _, err = db.ResendMessage("nosuch", "", true); err != sql.ErrNoRows {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestInbox(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	smss := []InboundSMS{
+		{Mobile: "+1", Body: "a reply", Device: "cell", Segments: 1},
+		{Mobile: "+2", Body: "a long reply", Device: "phone", Segments: 2, Incomplete: true},
+		{Mobile: "+1", Body: "another reply", Device: "phone", Segments: 1},
+	}
+	for _, sms := range smss {
+		if err := db.InsertInboxMessage(sms); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+
+	// unfiltered - most recent first
+	messages, err := db.GetInboxMessages(InboxFilter{})
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("got %d SMSs, expected 3", len(messages))
+	}
+	if messages[0].Body != "another reply" || messages[1].Segments != 2 ||
+		messages[0].Incomplete || !messages[1].Incomplete {
+		t.Errorf("unexpected messages %v", messages)
+	}
+
+	// filtered by mobile
+	messages, err = db.GetInboxMessages(InboxFilter{Mobile: "+1"})
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("got %d SMSs, expected 2", len(messages))
+	}
+
+	// filtered by device
+	messages, err = db.GetInboxMessages(InboxFilter{Device: "cell"})
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("got %d SMSs, expected 1", len(messages))
+	}
+
+	// filtered by date
+	messages, err = db.GetInboxMessages(InboxFilter{Since: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("got %d SMSs, expected 0", len(messages))
+	}
+	messages, err = db.GetInboxMessages(InboxFilter{Since: time.Now().Add(-time.Hour), Until: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(messages) != 3 {
+		t.Errorf("got %d SMSs, expected 3", len(messages))
+	}
+
+	// paged
+	messages, err = db.GetInboxMessages(InboxFilter{Limit: 2, Offset: 2})
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(messages) != 1 || messages[0].Body != "a reply" {
+		t.Errorf("unexpected messages %v", messages)
+	}
+
+	// mark read
+	if err := db.MarkInboxMessageRead(messages[0].ID, true); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err := db.MarkInboxMessageRead(1234, true); err != sql.ErrNoRows {
+		t.Error("unexpected error:", err)
+	}
+	messages, err = db.GetInboxMessages(InboxFilter{Unread: true})
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("got %d SMSs, expected 2", len(messages))
+	}
+	for _, m := range messages {
+		if m.Read {
+			t.Errorf("unexpected read SMS %v", m)
+		}
+	}
+
+	// db error
+	db.Close()
+	messages, err = db.GetInboxMessages(InboxFilter{})
+	if err == nil {
+		t.Error("unexpected success")
+	}
+	if messages != nil {
+		t.Error("unexpected result:", messages)
+	}
+}
+
+func TestGetMessages(t *testing.T) {
+	db := setup2(t)
+	defer teardown(db)
+
+	// unfiltered
+	smss, err := db.GetMessages("")
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(smss) != 100 {
+		t.Errorf("got %d SMSs, expected 100", len(smss))
+	}
+
+	// filtered
+	smss, err = db.GetMessages("WHERE status=1")
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(smss) != 28 {
+		t.Errorf("got %d SMSs, expected 28", len(smss))
+	}
+	for _, s := range smss {
+		if s.Status != SMSSent {
+			t.Errorf("unexpected status %d in sms %s", s.Status, s.UUID)
+		}
+	}
+
+	// bad sql
+	smss, err = db.GetMessages("WHERE")
+	if err == nil {
+		t.Error("unexpected success")
+	}
+	if len(smss) > 0 {
+		t.Error("unexpected smss:", smss)
+	}
+
+}
+
+func TestGetMessagesPage(t *testing.T) {
+	db := setup2(t)
+	defer teardown(db)
+
+	var cursor int64
+	count := 0
+	for page := 0; page < 10; page++ {
+		smss, next, err := db.GetMessagesPage(cursor, 30)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		for _, s := range smss {
+			if cursor != 0 && s.ID >= cursor {
+				t.Errorf("id %d not less than cursor %d", s.ID, cursor)
+			}
+		}
+		count += len(smss)
+		if next == 0 {
+			if len(smss) != 10 {
+				t.Errorf("got %d SMSs in last page, expected 10", len(smss))
+			}
+			break
+		}
+		if len(smss) != 30 {
+			t.Errorf("got %d SMSs, expected 30", len(smss))
+		}
+		cursor = next
+	}
+	if count != 100 {
+		t.Errorf("got %d SMSs, expected 100", count)
+	}
+}
+
+func TestPurgeMessageBodies(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	for _, sms := range []SMS{
+		SMS{UUID: "pending", Mobile: "+1", Body: "a message"},
+		SMS{UUID: "sent", Mobile: "+2", Body: "another message", Status: SMSSent},
+	} {
+		if err := db.InsertMessage(sms); err != nil {
+			t.Error("unexpected error:", err)
+		}
+		if err := db.UpdateMessageStatus(sms); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+
+	// none old enough
+	n, err := db.PurgeMessageBodies(time.Now().Add(-time.Hour), false)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if n != 0 {
+		t.Errorf("purged %d SMSs, expected 0", n)
+	}
+
+	// hashed
+	n, err = db.PurgeMessageBodies(time.Now().Add(time.Hour), true)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if n != 1 {
+		t.Errorf("purged %d SMSs, expected 1", n)
+	}
+	smss, _ := db.GetMessages("WHERE uuid='sent'")
+	if len(smss) != 1 || !smss[0].Purged || smss[0].Body != "sha256:28ea0f231192a65711a644003b0cb3a049bfaf43397b36c8beed63137374ed97" {
+		t.Errorf("unexpected smss: %v", smss)
+	}
+
+	// already purged, and pending retained
+	n, err = db.PurgeMessageBodies(time.Now().Add(time.Hour), false)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if n != 0 {
+		t.Errorf("purged %d SMSs, expected 0", n)
+	}
+	smss, _ = db.GetMessages("WHERE uuid='pending'")
+	if len(smss) != 1 || smss[0].Purged || smss[0].Body != "a message" {
+		t.Errorf("unexpected smss: %v", smss)
+	}
+
+	// redacted
+	db.UpdateMessageStatus(SMS{UUID: "pending", Status: SMSErrored})
+	n, err = db.PurgeMessageBodies(time.Now().Add(time.Hour), false)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if n != 1 {
+		t.Errorf("purged %d SMSs, expected 1", n)
+	}
+	smss, _ = db.GetMessages("WHERE uuid='pending'")
+	if len(smss) != 1 || !smss[0].Purged || smss[0].Body != RedactedBody {
+		t.Errorf("unexpected smss: %v", smss)
+	}
+}
+
+func TestGetLast7DaysMessageCount(t *testing.T) {
+	db := setup2(t)
+	defer teardown(db)
+
+	result, err := db.GetLast7DaysMessageCount()
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	// based on distro in setup2
+	expected := []int{12, 8, 6, 5, 4, 4, 3}
+	now := time.Now()
+	for d := 0; d < 7; d++ {
+		dayDate := time.Date(now.Year(), now.Month(), now.Day()-d, 1, 0, 0, 0, time.UTC)
+		day := dayDate.Format("2006-01-02")
+		if expected[d] != result[day] {
+			t.Errorf("unexpected %s to have %d but got %d", day, expected[d], result[day])
+		}
+	}
+
+	// db error
+	db.Close()
+	result, err = db.GetLast7DaysMessageCount()
+	if err == nil {
+		t.Error("unexpected success")
+	}
+	if result != nil {
+		t.Error("unexpected result:", result)
+	}
+}
+
+func TestGetMessageCountByDay(t *testing.T) {
+	db := setup2(t)
+	defer teardown(db)
+
+	now := time.Now()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 1, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, 0, -6)
+	result, err := db.GetMessageCountByDay(from, to)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	// based on distro in setup2, most recent last
+	expected := []int{3, 4, 4, 5, 6, 8, 12}
+	if len(result) != len(expected) {
+		t.Fatalf("expected %d days but got %d", len(expected), len(result))
+	}
+	for d, dc := range result {
+		day := from.AddDate(0, 0, d).Format("2006-01-02")
+		if dc.Day != day {
+			t.Errorf("expected day %s but got %s", day, dc.Day)
+		}
+		if dc.Total != dc.Pending+dc.Sent+dc.Errored+dc.Canceled {
+			t.Errorf("%s: total %d does not match states %v", dc.Day, dc.Total, dc)
+		}
+		if dc.Total != expected[d] {
+			t.Errorf("expected %s to have %d but got %d", dc.Day, expected[d], dc.Total)
+		}
+	}
+
+	// one bucket per day, including those with no messages
+	result, err = db.GetMessageCountByDay(to.AddDate(1, 0, -29), to.AddDate(1, 0, 0))
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(result) != 30 {
+		t.Errorf("expected 30 days but got %d", len(result))
+	}
+	for _, dc := range result {
+		if dc.Total != 0 {
+			t.Errorf("expected %s to have 0 but got %d", dc.Day, dc.Total)
+		}
+	}
+
+	// db error
+	db.Close()
+	if _, err = db.GetMessageCountByDay(from, to); err == nil {
+		t.Error("unexpected success")
+	}
+}
+
+func TestGetStatusSummary(t *testing.T) {
+	db := setup2(t)
+	defer teardown(db)
+
+	summary, err := db.GetStatusSummary()
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	expected := []int{37, 28, 14, 21, 0}
+	if len(summary) != len(expected) {
+		t.Fatalf("expected %v but got %v", expected, summary)
+	}
+	for idx, v := range expected {
+		if summary[idx] != v {
+			t.Fatalf("expected %v but got %v", expected, summary)
+		}
+	}
+
+	// db error
+	db.Close()
+	summary, err = db.GetStatusSummary()
+	if err == nil {
+		t.Error("unexpected success")
+	}
+	if summary != nil {
+		t.Error("unexpected result:", summary)
+	}
+}
+
+func BenchmarkInsertMessage(b *testing.B) {
+	os.Remove("testdb")
+	db, err := New("sqlite3", "testdb")
+	if err != nil {
+		b.Fatal("unexpected error:", err)
+	}
+	defer teardown(db)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sms := SMS{UUID: fmt.Sprintf("b%08d", i), Mobile: "+1", Body: "a message"}
+		if err := db.InsertMessage(sms); err != nil {
+			b.Fatal("unexpected error:", err)
+		}
+		sms.Status = SMSSent
+		if err := db.UpdateMessageStatus(sms); err != nil {
+			b.Fatal("unexpected error:", err)
+		}
+	}
+}
+
+func setup(t *testing.T) *DB {
+	db, err := New("sqlite3", "testdb")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return db
+}
+
+func setup2(t *testing.T) *DB {
+	db := setup(t)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal("Begin err:", err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO messages(uuid,message,mobile,status,retries,device,created_at) VALUES(?,?,?,?,?,?,?)")
+	if err != nil {
+		t.Fatal("Prepare err:", err)
+	}
+	now := time.Now()
+	// This creates status distribution [37 28 14 21]
+	for idx := 0; idx < 100; idx++ {
+		createdDate := time.Date(now.Year(), now.Month(), now.Day(), 11-(idx*idx/11), 0, 0, 0, time.UTC)
+		created := createdDate.Format("2006-01-02")
+		stmt.Exec(
+			fmt.Sprintf("i%04d", idx),
+			fmt.Sprintf("message%03d", idx),
+			fmt.Sprintf("+1%04d", idx),
+			(idx*idx/7)%4,
+			idx,
+			"cell",
+			created)
+	}
+	tx.Commit()
+	stmt.Close()
+	return db
+}
+
+func teardown(db *DB) {
+	db.Close()
+	os.Remove("testdb")
+}
+
+func TestDataMessage(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	smss := []SMS{
+		SMS{UUID: "text", Mobile: "+1", Body: "a message"},
+		SMS{UUID: "data", Mobile: "+2", Body: "C634", Data: true, UDH: "0605040B8423F0"},
+	}
+	for _, sms := range smss {
+		if err := db.InsertMessage(sms); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	messages, err := db.GetPendingMessages(10, time.Now())
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(messages) != len(smss) {
+		t.Fatalf("expected %d messages but got %d", len(smss), len(messages))
+	}
+	for i, sms := range messages {
+		if sms.Data != smss[i].Data {
+			t.Errorf("%s: expected data %v but got %v", sms.UUID, smss[i].Data, sms.Data)
+		}
+		if sms.UDH != smss[i].UDH {
+			t.Errorf("%s: expected udh %s but got %s", sms.UUID, smss[i].UDH, sms.UDH)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	smss := []SMS{
+		SMS{UUID: "plain", Mobile: "+1", Body: "a message"},
+		SMS{UUID: "meta", Mobile: "+2", Body: "an order", Metadata: map[string]string{"order": "123", "campaign": "spring"}},
+	}
+	for _, sms := range smss {
+		if err := db.InsertMessage(sms); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	messages, err := db.GetPendingMessages(10, time.Now())
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(messages) != len(smss) {
+		t.Fatalf("expected %d messages but got %d", len(smss), len(messages))
+	}
+	if messages[0].Metadata != nil {
+		t.Errorf("plain: unexpected metadata %v", messages[0].Metadata)
+	}
+	if !reflect.DeepEqual(messages[1].Metadata, smss[1].Metadata) {
+		t.Errorf("meta: expected metadata %v but got %v", smss[1].Metadata, messages[1].Metadata)
+	}
+	var metadata sql.NullString
+	db.QueryRow("SELECT metadata FROM messages WHERE uuid='plain'").Scan(&metadata)
+	if metadata.Valid {
+		t.Errorf("plain: expected NULL metadata but got %s", metadata.String)
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	smss := []SMS{
+		SMS{UUID: "one", Mobile: "+1", Body: "a message", Status: SMSSent, Segments: 1, Cost: 0.5},
+		SMS{UUID: "two", Mobile: "+2", Body: "a long message", Status: SMSSent, Segments: 3, Cost: 1.5},
+		SMS{UUID: "three", Mobile: "+3", Body: "an errored message", Status: SMSErrored},
+		SMS{UUID: "four", Mobile: "+4", Body: "a pending message"},
+	}
+	for _, sms := range smss {
+		db.InsertMessage(sms)
+		if err := db.UpdateMessageStatus(sms); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	u, err := db.GetUsage(time.Time{}, time.Time{})
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	expected := Usage{Messages: 2, Segments: 4, Cost: 2}
+	if u != expected {
+		t.Errorf("expected %v, got %v", expected, u)
+	}
+
+	// outside period
+	u, err = db.GetUsage(time.Now().Add(time.Hour), time.Time{})
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if u != (Usage{}) {
+		t.Errorf("expected no usage, got %v", u)
+	}
+}
+
+func TestGetDeviceSentCounts(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	smss := []SMS{
+		SMS{UUID: "one", Mobile: "+1", Body: "a message", Status: SMSSent, Device: "a"},
+		SMS{UUID: "two", Mobile: "+2", Body: "a message", Status: SMSAccepted, Device: "a"},
+		SMS{UUID: "three", Mobile: "+3", Body: "a message", Status: SMSSent, Device: "b"},
+		SMS{UUID: "four", Mobile: "+4", Body: "an errored message", Status: SMSErrored, Device: "b"},
+	}
+	for _, sms := range smss {
+		db.InsertMessage(sms)
+		if err := db.UpdateMessageStatus(sms); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	counts, err := db.GetDeviceSentCounts(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(counts) != 2 || counts["a"] != 2 || counts["b"] != 1 {
+		t.Errorf("unexpected counts: %v", counts)
+	}
+
+	// outside period
+	counts, err = db.GetDeviceSentCounts(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(counts) != 0 {
+		t.Errorf("expected no counts, got %v", counts)
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	st, err := db.GetStats()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if st.Messages != 0 || st.Oldest != "" || st.Size == 0 {
+		t.Errorf("unexpected empty stats %v", st)
+	}
+	size := st.Size
+
+	for i, status := range []SMSStatus{SMSPending, SMSSent, SMSSent, SMSErrored} {
+		sms := SMS{UUID: fmt.Sprintf("s%d", i), Mobile: "+1", Body: "a message", Status: status}
+		db.InsertMessage(sms)
+		db.UpdateMessageStatus(sms)
+	}
+	for i := 0; i < 100; i++ {
+		db.InsertMessage(SMS{UUID: fmt.Sprintf("p%d", i), Mobile: "+1", Body: fmt.Sprintf("message %0200d", i)})
+	}
+	st, err = db.GetStats()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if st.Messages != 104 || st.Pending != 101 || st.Sent != 2 || st.Errored != 1 || st.Canceled != 0 {
+		t.Errorf("unexpected counts %v", st)
+	}
+	if st.Oldest == "" {
+		t.Error("expected oldest")
+	}
+	if st.Size <= size {
+		t.Errorf("expected size to grow from %d, got %d", size, st.Size)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	for i := 0; i < 100; i++ {
+		db.InsertMessage(SMS{UUID: fmt.Sprintf("b%d", i), Mobile: "+1", Body: fmt.Sprintf("message %0200d", i)})
+	}
+	os.Remove("testdb.bak")
+	defer os.Remove("testdb.bak")
+	if err := db.Backup("testdb.bak"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	bak, err := Open("sqlite3", "testdb.bak")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer bak.Close()
+	sms, err := bak.GetMessage("b42")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sms.Body != fmt.Sprintf("message %0200d", 42) {
+		t.Errorf("unexpected body: %s", sms.Body)
+	}
+	if err := CheckIntegrity("sqlite3", "testdb.bak", false); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestBackupConcurrentWrites(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	// large enough to take many steps, so writes restart the copy.
+	db.InsertMessage(SMS{UUID: "big", Mobile: "+1", Body: strings.Repeat("x", 8<<20)})
+	os.Remove("testdb.bak")
+	defer os.Remove("testdb.bak")
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			db.InsertMessage(SMS{UUID: fmt.Sprintf("w%d", i), Mobile: "+1", Body: "write"})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	result := make(chan error, 1)
+	go func() {
+		result <- db.Backup("testdb.bak")
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Error("unexpected error:", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Error("backup not completed")
+	}
+	close(stop)
+	<-stopped
+	if err := CheckIntegrity("sqlite3", "testdb.bak", false); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	db := setup(t)
+	defer teardown(db)
+
+	for i := 0; i < 100; i++ {
+		db.InsertMessage(SMS{UUID: fmt.Sprintf("p%d", i), Mobile: "+1", Body: fmt.Sprintf("message %0200d", i)})
+	}
+	if _, err := db.Exec("DELETE FROM messages"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	before, err := db.GetStats()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := db.Vacuum(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	after, err := db.GetStats()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if after.Size >= before.Size {
+		t.Errorf("expected size to shrink from %d, got %d", before.Size, after.Size)
+	}
 }
@@ -0,0 +1,63 @@
+// Package filter provides screening of SMSs before they are queued for sending.
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Blocklist identifies SMSs that must not be sent, either because they
+// contain a blocked keyword or are addressed to a blocked destination.
+type Blocklist struct {
+	keywords []string
+	prefixes []string
+}
+
+// NewBlocklist creates a Blocklist from the set of blocked keywords and
+// destination prefixes.
+// Keywords are matched case insensitively anywhere in the message body.
+// Prefixes are matched against the start of the destination number.
+func NewBlocklist(keywords, prefixes []string) *Blocklist {
+	b := &Blocklist{}
+	b.AddKeywords(keywords...)
+	b.AddPrefixes(prefixes...)
+	return b
+}
+
+// AddKeywords adds keywords to the blocklist.
+func (b *Blocklist) AddKeywords(keywords ...string) {
+	for _, k := range keywords {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k != "" {
+			b.keywords = append(b.keywords, k)
+		}
+	}
+}
+
+// AddPrefixes adds destination prefixes to the blocklist.
+func (b *Blocklist) AddPrefixes(prefixes ...string) {
+	for _, p := range prefixes {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			b.prefixes = append(b.prefixes, p)
+		}
+	}
+}
+
+// Check determines if an SMS may be sent.
+// Returns an error describing the reason the SMS is blocked, or nil if it
+// is not blocked.
+func (b *Blocklist) Check(mobile, body string) error {
+	for _, p := range b.prefixes {
+		if strings.HasPrefix(mobile, p) {
+			return fmt.Errorf("destination matches blocked prefix '%s'", p)
+		}
+	}
+	lbody := strings.ToLower(body)
+	for _, k := range b.keywords {
+		if strings.Contains(lbody, k) {
+			return fmt.Errorf("message contains blocked keyword '%s'", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package filter
+
+import "testing"
+
+func TestBlocklist(t *testing.T) {
+	b := NewBlocklist([]string{"Casino", " win big ", ""}, []string{"+1900", " +44909 ", ""})
+	b.AddKeywords("lottery")
+	b.AddPrefixes("+61190")
+	patterns := []struct {
+		name   string
+		mobile string
+		body   string
+		reason string
+	}{
+		{"clean", "+447700900123", "see you at 6", ""},
+		{"keyword", "+447700900123", "visit our casino", "message contains blocked keyword 'casino'"},
+		{"keyword case", "+447700900123", "CASINO night", "message contains blocked keyword 'casino'"},
+		{"keyword within word", "+447700900123", "casinos", "message contains blocked keyword 'casino'"},
+		{"keyword trimmed", "+447700900123", "you could WIN BIG today", "message contains blocked keyword 'win big'"},
+		{"keyword added", "+447700900123", "lottery results", "message contains blocked keyword 'lottery'"},
+		{"keyword split", "+447700900123", "win, big", ""},
+		{"prefix", "+19005550123", "hello", "destination matches blocked prefix '+1900'"},
+		{"prefix trimmed", "+44909123456", "hello", "destination matches blocked prefix '+44909'"},
+		{"prefix added", "+61190123456", "hello", "destination matches blocked prefix '+61190'"},
+		{"prefix elsewhere", "+12025551900", "hello", ""},
+		{"prefix before keyword", "+19005550123", "casino", "destination matches blocked prefix '+1900'"},
+		{"empty body", "+447700900123", "", ""},
+	}
+	for _, p := range patterns {
+		t.Run(p.name, func(t *testing.T) {
+			err := b.Check(p.mobile, p.body)
+			if p.reason == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != p.reason {
+				t.Errorf("expected %q, got %v", p.reason, err)
+			}
+		})
+	}
+}
+
+func TestBlocklistEmpty(t *testing.T) {
+	b := NewBlocklist(nil, []string{"", "  "})
+	if err := b.Check("+19005550123", "casino"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
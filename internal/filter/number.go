@@ -0,0 +1,137 @@
+package filter
+
+import (
+	"strings"
+	"sync"
+)
+
+// Rule expands a national number, one without a country code, into E.164
+// format using the country code.
+// Returns false if the number is not in a national format recognised by the
+// rule.
+type Rule func(national, cc string) (string, bool)
+
+var (
+	rulesMu sync.Mutex
+	rules   = map[string]Rule{
+		"trunk0": Trunk0,
+		"nanp":   NANP,
+	}
+)
+
+// RegisterRule adds a rule that may be selected by name, replacing any
+// existing rule with that name.
+func RegisterRule(name string, r Rule) {
+	rulesMu.Lock()
+	rules[name] = r
+	rulesMu.Unlock()
+}
+
+// LookupRule returns the rule registered with the name.
+func LookupRule(name string) (Rule, bool) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	r, ok := rules[name]
+	return r, ok
+}
+
+// DefaultRule returns the name of the rule used by most countries with the
+// country code, "nanp" for 1, else "trunk0".
+func DefaultRule(cc string) string {
+	if cc == "1" {
+		return "nanp"
+	}
+	return "trunk0"
+}
+
+// Trunk0 expands numbers in countries where national numbers start with a
+// trunk prefix of 0, which is dropped, such as 07700900123 in the UK.
+// Numbers starting with the international prefix, 00, are already
+// international so the prefix is replaced with '+'.
+func Trunk0(national, cc string) (string, bool) {
+	switch {
+	case strings.HasPrefix(national, "00"):
+		return "+" + national[2:], true
+	case strings.HasPrefix(national, "0") && len(national) > 1:
+		return "+" + cc + national[1:], true
+	}
+	return "", false
+}
+
+// NANP expands numbers in the North American Numbering Plan, which are 10
+// digits, optionally preceded by the trunk prefix 1.
+// Numbers starting with the international prefix, 011, are already
+// international so the prefix is replaced with '+'.
+func NANP(national, cc string) (string, bool) {
+	switch {
+	case strings.HasPrefix(national, "011"):
+		return "+" + national[3:], true
+	case len(national) == 10 && national[0] != '0' && national[0] != '1':
+		return "+" + cc + national, true
+	case len(national) == 11 && national[0] == '1':
+		return "+" + national, true
+	}
+	return "", false
+}
+
+// Normalizer converts destination numbers into E.164 format, so they are
+// stored, routed and screened consistently, and optionally validates them.
+type Normalizer struct {
+	cc   string
+	rule Rule
+	// validate indicates numbers are checked against the numbering plan of
+	// their country.
+	validate bool
+}
+
+// NewNormalizer creates a Normalizer that expands national numbers using the
+// rule and country code.
+// If the country code is empty then numbers are not expanded.
+// If validate is set then Check validates numbers using ValidateNumber.
+func NewNormalizer(cc string, rule Rule, validate bool) *Normalizer {
+	return &Normalizer{cc: strings.TrimPrefix(cc, "+"), rule: rule, validate: validate}
+}
+
+// Check determines if an SMS may be sent to the normalized number.
+// Numbers not in international format, such as short codes and alphanumeric
+// addresses, cannot be validated so are accepted.
+// Returns an error describing the reason the number is invalid, or nil if it
+// is valid or is not being validated.
+// A nil Normalizer accepts all numbers.
+func (n *Normalizer) Check(mobile string) error {
+	if n == nil || !n.validate || !strings.HasPrefix(mobile, "+") {
+		return nil
+	}
+	return ValidateNumber(mobile)
+}
+
+// Normalize strips formatting, such as spaces and dashes, from the number
+// and, if it lacks a country code, expands it into E.164 format.
+// Numbers not recognised by the rule, such as short codes, are only stripped
+// of formatting.
+// A nil Normalizer returns the number unchanged.
+func (n *Normalizer) Normalize(mobile string) string {
+	if n == nil {
+		return mobile
+	}
+	mobile = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, mobile)
+	if strings.HasPrefix(mobile, "+") || n.rule == nil || n.cc == "" {
+		return mobile
+	}
+	for _, r := range mobile {
+		if r < '0' || r > '9' {
+			// not a number, such as an alphanumeric address.
+			return mobile
+		}
+	}
+	if e164, ok := n.rule(mobile, n.cc); ok {
+		return e164
+	}
+	return mobile
+}
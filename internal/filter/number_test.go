@@ -0,0 +1,111 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateNumber(t *testing.T) {
+	patterns := []struct {
+		cc      string
+		valid   []string
+		invalid []string
+	}{
+		{"1", []string{"+12025550123", "+14165550123"},
+			[]string{"+1202555012", "+120255501234", "+11025550123", "+10255501234"}},
+		{"7", []string{"+79161234567", "+74951234567"},
+			[]string{"+7916123456", "+791612345678", "+75161234567"}},
+		{"27", []string{"+27821234567"},
+			[]string{"+2782123456", "+278212345678", "+27082123456"}},
+		{"31", []string{"+31612345678"},
+			[]string{"+3161234567", "+316123456789", "+31061234567"}},
+		{"32", []string{"+32470123456", "+3221234567"},
+			[]string{"+322123456", "+324701234567"}},
+		{"33", []string{"+33612345678"},
+			[]string{"+3361234567", "+336123456789", "+33061234567"}},
+		{"34", []string{"+34612345678", "+34912345678"},
+			[]string{"+3461234567", "+34512345678"}},
+		{"39", []string{"+393123456789", "+39061234567", "+39312345"},
+			[]string{"+3931234", "+39312345678901"}},
+		{"41", []string{"+41791234567"},
+			[]string{"+4179123456", "+41079123456"}},
+		{"44", []string{"+447700900123", "+442071234567", "+44800123456"},
+			[]string{"+4477009001", "+4477009001234", "+4407700900123", "+446700900123"}},
+		{"45", []string{"+4520123456"},
+			[]string{"+452012345", "+45201234567"}},
+		{"46", []string{"+46701234567", "+4681234567"},
+			[]string{"+46812345", "+467012345678"}},
+		{"47", []string{"+4741234567"},
+			[]string{"+474123456", "+47412345678"}},
+		{"48", []string{"+48512345678"},
+			[]string{"+4851234567", "+485123456789"}},
+		{"49", []string{"+4915123456789", "+49301234"},
+			[]string{"+4930123", "+4915123456789012", "+49015123456789"}},
+		{"55", []string{"+5511912345678", "+551123456789"},
+			[]string{"+55119123456", "+55119123456789"}},
+		{"61", []string{"+61412345678", "+61212345678"},
+			[]string{"+6141234567", "+614123456789", "+61041234567", "+61512345678"}},
+		{"64", []string{"+6421123456", "+64211234567"},
+			[]string{"+642112345", "+64211234567890"}},
+		{"65", []string{"+6591234567", "+6561234567"},
+			[]string{"+659123456", "+65912345678", "+6551234567"}},
+		{"81", []string{"+819012345678", "+81312345678"},
+			[]string{"+8131234567", "+8109012345678"}},
+		{"86", []string{"+8613812345678", "+861012345678"},
+			[]string{"+8613812345", "+86138123456789"}},
+		{"91", []string{"+919812345678"},
+			[]string{"+91981234567", "+9198123456789", "+910812345678"}},
+		{"353", []string{"+353861234567", "+3531234567"},
+			[]string{"+353123456", "+3538612345678", "+3530861234567"}},
+		{"unlisted", []string{"+2348031234567", "+999123456789012"},
+			[]string{"+99912345678901234"}},
+		{"general", nil,
+			[]string{"447700900123", "+44 7700 900123", "+44770090012a", "+123456", "+0447700900123", "+"}},
+	}
+	covered := make(map[string]bool)
+	for _, p := range patterns {
+		covered[p.cc] = true
+		t.Run(p.cc, func(t *testing.T) {
+			for _, n := range p.valid {
+				if err := ValidateNumber(n); err != nil {
+					t.Errorf("%s: unexpected error: %v", n, err)
+				}
+			}
+			for _, n := range p.invalid {
+				if err := ValidateNumber(n); err == nil {
+					t.Errorf("%s: expected an error", n)
+				}
+			}
+		})
+	}
+	for cc := range plans {
+		if !covered[cc] {
+			t.Errorf("no numbers tested for country code %s", cc)
+		}
+	}
+}
+
+func TestValidateNumberReason(t *testing.T) {
+	patterns := []struct {
+		mobile string
+		reason string
+	}{
+		{"447700900123", "not in international format"},
+		{"+44770090012a", "non-digits"},
+		{"+123456", "too short"},
+		{"+1234567890123456", "too long"},
+		{"+0447700900123", "must not start with 0"},
+		{"+4477009001", "too short for country code 44"},
+		{"+4477009001234", "too long for country code 44"},
+		{"+440700900123", "trunk prefix 0"},
+		{"+446700900123", "nonexistent prefix 6"},
+	}
+	for _, p := range patterns {
+		t.Run(p.mobile, func(t *testing.T) {
+			err := ValidateNumber(p.mobile)
+			if err == nil || !strings.Contains(err.Error(), p.reason) {
+				t.Errorf("expected error containing %q, got %v", p.reason, err)
+			}
+		})
+	}
+}
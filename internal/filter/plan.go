@@ -0,0 +1,96 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// plan describes the numbering plan of a country, as needed to validate
+// numbers in E.164 format.
+type plan struct {
+	// min and max are the lengths of the national significant number, the
+	// number following the country code.
+	min, max int
+	// prefixes, if set, are the valid leading digits of the national
+	// significant number.
+	prefixes string
+	// leadingZero indicates the national significant number may start with
+	// 0, as in Italy, rather than 0 being a trunk prefix that must be
+	// dropped.
+	leadingZero bool
+}
+
+// plans are the numbering plans of common countries, keyed by country code.
+// Numbers for countries not listed are only checked against the general
+// E.164 rules.
+var plans = map[string]plan{
+	"1":   {min: 10, max: 10, prefixes: "23456789"},
+	"7":   {min: 10, max: 10, prefixes: "34789"},
+	"27":  {min: 9, max: 9},
+	"31":  {min: 9, max: 9},
+	"32":  {min: 8, max: 9},
+	"33":  {min: 9, max: 9},
+	"34":  {min: 9, max: 9, prefixes: "6789"},
+	"39":  {min: 6, max: 11, leadingZero: true},
+	"41":  {min: 9, max: 9},
+	"44":  {min: 9, max: 10, prefixes: "1235789"},
+	"45":  {min: 8, max: 8},
+	"46":  {min: 7, max: 9},
+	"47":  {min: 8, max: 8},
+	"48":  {min: 9, max: 9},
+	"49":  {min: 6, max: 13},
+	"55":  {min: 10, max: 11},
+	"61":  {min: 9, max: 9, prefixes: "23478"},
+	"64":  {min: 8, max: 10},
+	"65":  {min: 8, max: 8, prefixes: "3689"},
+	"81":  {min: 9, max: 10},
+	"86":  {min: 9, max: 11},
+	"91":  {min: 10, max: 10},
+	"353": {min: 7, max: 9},
+}
+
+// ValidateNumber checks a number in E.164 format, such as +447700900123,
+// against the numbering plan of its country.
+// Returns an error describing the reason the number is invalid, or nil if it
+// is valid.
+func ValidateNumber(mobile string) error {
+	digits := strings.TrimPrefix(mobile, "+")
+	if len(digits) == len(mobile) {
+		return errors.New("number is not in international format")
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return errors.New("number contains non-digits")
+		}
+	}
+	if len(digits) < 7 {
+		return errors.New("number is too short")
+	}
+	if len(digits) > 15 {
+		return errors.New("number is too long")
+	}
+	if digits[0] == '0' {
+		return errors.New("country code must not start with 0")
+	}
+	// country codes are prefix free, so at most one matches.
+	for n := 1; n <= 3; n++ {
+		p, ok := plans[digits[:n]]
+		if !ok {
+			continue
+		}
+		cc, nsn := digits[:n], digits[n:]
+		switch {
+		case len(nsn) < p.min:
+			return fmt.Errorf("number is too short for country code %s: expected at least %d digits after the country code, got %d", cc, p.min, len(nsn))
+		case len(nsn) > p.max:
+			return fmt.Errorf("number is too long for country code %s: expected at most %d digits after the country code, got %d", cc, p.max, len(nsn))
+		case nsn[0] == '0' && !p.leadingZero:
+			return fmt.Errorf("number for country code %s must not include the trunk prefix 0", cc)
+		case p.prefixes != "" && !strings.ContainsRune(p.prefixes, rune(nsn[0])):
+			return fmt.Errorf("number for country code %s has a nonexistent prefix %c", cc, nsn[0])
+		}
+		return nil
+	}
+	return nil
+}
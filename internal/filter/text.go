@@ -0,0 +1,44 @@
+package filter
+
+import (
+	"strings"
+	"unicode"
+)
+
+// zwj is the zero width joiner, which is retained as it joins emoji
+// sequences.
+const zwj = '\u200d'
+
+// NormalizeText cleans up message text, such as that copied from web forms,
+// that would otherwise waste space or force the UCS2 encoding.
+// Control characters, and invisible formatting characters such as zero width
+// spaces, are removed.
+// Runs of whitespace are collapsed to a single line break, if the run
+// contains one, else a single space, and leading and trailing whitespace is
+// removed.
+func NormalizeText(s string) string {
+	var b strings.Builder
+	space := false
+	newline := false
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			space = true
+			newline = newline || r == '\n'
+			continue
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r) && r != zwj:
+			continue
+		}
+		if space && b.Len() > 0 {
+			if newline {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(' ')
+			}
+		}
+		space = false
+		newline = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
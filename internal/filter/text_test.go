@@ -0,0 +1,37 @@
+package filter
+
+import "testing"
+
+func TestNormalizeText(t *testing.T) {
+	patterns := []struct {
+		name   string
+		in     string
+		expect string
+	}{
+		{"empty", "", ""},
+		{"plain", "hello world", "hello world"},
+		{"trailing newline", "hello\n", "hello"},
+		{"trailing crlf", "hello\r\n\r\n", "hello"},
+		{"trailing whitespace", "hello \t ", "hello"},
+		{"leading whitespace", "\n\t hello", "hello"},
+		{"collapse spaces", "hello   \t world", "hello world"},
+		{"collapse lines", "hello\r\n\r\n\r\nworld", "hello\nworld"},
+		{"newline in run", "hello  \n  world", "hello\nworld"},
+		{"nbsp", "hello\u00a0world", "hello world"},
+		{"zwsp", "hel\u200blo\u200b", "hello"},
+		{"bom", "\ufeffhello", "hello"},
+		{"soft hyphen", "hel\u00adlo", "hello"},
+		{"controls", "hel\x00lo\x1b", "hello"},
+		{"zwj emoji", "\U0001f468\u200d\U0001f469\u200d\U0001f467", "\U0001f468\u200d\U0001f469\u200d\U0001f467"},
+		{"zwj emoji trimmed", " \U0001f3f3\ufe0f\u200d\U0001f308\n", "\U0001f3f3\ufe0f\u200d\U0001f308"},
+		{"only whitespace", " \r\n\t\u200b", ""},
+	}
+	for _, p := range patterns {
+		t.Run(p.name, func(t *testing.T) {
+			v := NormalizeText(p.in)
+			if v != p.expect {
+				t.Errorf("expected %q, got %q", p.expect, v)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+// Package hook runs an external executable to notify other systems of
+// changes in the status of SMSs.
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/warthog618/goatsms/internal/db"
+	"github.com/warthog618/goatsms/internal/logger"
+)
+
+// Exec runs an executable each time an SMS changes status.
+// The SMS is passed to the executable as JSON on stdin, and its UUID and
+// status, one of "pending", "sent", "errored" or "canceled", as arguments.
+// SMSs errored as they expired before they could be sent, or were rejected by
+// the blocklist, are passed with a third argument, and a reason field in the
+// JSON, of "expired" or "rejected", so clients can distinguish them from SMSs
+// that failed to send.
+// The executions are performed by a fixed pool of workers, fed from a
+// bounded queue, so a burst of notifications cannot spawn an unbounded number
+// of executions.
+type Exec struct {
+	path    string
+	timeout time.Duration
+	queue   chan db.SMS
+	// block indicates Notify waits, for up to wait, for space in a full
+	// queue, rather than dropping the oldest queued notification.
+	block bool
+	wait  time.Duration
+}
+
+// defaultTimeout is the timeout used if none is specified.
+const defaultTimeout = 10 * time.Second
+
+// defaultQueueSize is the number of notifications queued awaiting a worker, if
+// not specified.
+const defaultQueueSize = 100
+
+// Option modifies the behaviour of an Exec.
+type Option func(*Exec)
+
+// WithQueueSize sets the number of notifications that may be queued awaiting
+// a worker.
+func WithQueueSize(n int) Option {
+	return func(e *Exec) {
+		if n < 1 {
+			n = 1
+		}
+		e.queue = make(chan db.SMS, n)
+	}
+}
+
+// WithBlock specifies that Notify waits, for at most wait, for space in a
+// full queue, and drops the notification if none becomes available.
+// A zero wait drops the notification immediately.
+// By default the oldest queued notification is dropped to make space, so
+// Notify never waits.
+func WithBlock(wait time.Duration) Option {
+	return func(e *Exec) {
+		e.block = true
+		e.wait = wait
+	}
+}
+
+// New creates an Exec that runs the executable at path, for at most timeout,
+// with a pool of workers performing the executions.
+func New(path string, timeout time.Duration, workers int, options ...Option) *Exec {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	e := &Exec{
+		path:    path,
+		timeout: timeout,
+		queue:   make(chan db.SMS, defaultQueueSize),
+	}
+	for _, option := range options {
+		option(e)
+	}
+	for i := 0; i < workers; i++ {
+		go e.work()
+	}
+	return e
+}
+
+// Notify queues the SMS for the executable to be run in the background.
+// If the queue is full then either the oldest queued notification is dropped,
+// or Notify waits for space, depending on the WithBlock option, so a slow
+// executable cannot stall the caller indefinitely.
+func (e *Exec) Notify(sms db.SMS) {
+	select {
+	case e.queue <- sms:
+		return
+	default:
+	}
+	if e.block {
+		t := time.NewTimer(e.wait)
+		defer t.Stop()
+		select {
+		case e.queue <- sms:
+		case <-t.C:
+			logger.Warn("hook queue full, notification dropped", "uuid", sms.UUID, "status", statusName(sms.Status))
+		}
+		return
+	}
+	for {
+		select {
+		case old := <-e.queue:
+			logger.Warn("hook queue full, oldest notification dropped", "uuid", old.UUID, "status", statusName(old.Status))
+		default:
+		}
+		select {
+		case e.queue <- sms:
+			return
+		default:
+		}
+	}
+}
+
+// work runs the executable for each notification taken from the queue.
+func (e *Exec) work() {
+	for sms := range e.queue {
+		if err := e.run(sms); err != nil {
+			logger.Warn("hook failed", "uuid", sms.UUID, "err", err)
+		}
+	}
+}
+
+// run executes the executable for the SMS and waits for it to complete.
+func (e *Exec) run(sms db.SMS) error {
+	p := payload{SMS: sms}
+	args := []string{sms.UUID, statusName(sms.Status)}
+	switch {
+	case sms.Expired():
+		p.Reason = ReasonExpired
+	case sms.Rejected():
+		p.Reason = ReasonRejected
+	}
+	if p.Reason != "" {
+		args = append(args, p.Reason)
+	}
+	in, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, e.path, args...)
+	cmd.Stdin = bytes.NewReader(in)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		logger.Debug("hook output", "uuid", sms.UUID, "output", string(out))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return ctx.Err()
+	}
+	return err
+}
+
+// The reasons passed for errored SMSs that were never sent.
+const (
+	// ReasonExpired is the reason passed for SMSs that expired before they
+	// could be sent.
+	ReasonExpired = "expired"
+	// ReasonRejected is the reason passed for SMSs rejected by the
+	// blocklist.
+	ReasonRejected = "rejected"
+)
+
+// payload is the JSON passed to the executable.
+type payload struct {
+	db.SMS
+	// Reason qualifies the status, such as ReasonExpired or ReasonRejected.
+	Reason string `json:"reason,omitempty"`
+}
+
+var statusNames = []string{"pending", "sent", "errored", "canceled", "accepted"}
+
+// statusName returns the name of the status passed to the executable.
+func statusName(status db.SMSStatus) string {
+	if status < 0 || int(status) >= len(statusNames) {
+		return strconv.Itoa(int(status))
+	}
+	return statusNames[status]
+}
@@ -0,0 +1,145 @@
+package hook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warthog618/goatsms/internal/db"
+)
+
+// script creates an executable that runs the body, in a temporary directory
+// that is removed by the returned cleanup.
+func script(t *testing.T, body string) (string, string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "hook")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	path := filepath.Join(dir, "hook.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal("unexpected error:", err)
+	}
+	return path, dir, func() { os.RemoveAll(dir) }
+}
+
+func TestRunExpired(t *testing.T) {
+	path, dir, cleanup := script(t, `echo "$@" > "$(dirname "$0")/args"; cat > "$(dirname "$0")/in"`)
+	defer cleanup()
+	e := New(path, time.Second, 1)
+	patterns := []struct {
+		name   string
+		sms    db.SMS
+		args   string
+		reason string
+	}{
+		{"sent", db.SMS{UUID: "u1", Status: db.SMSSent}, "u1 sent", ""},
+		{"errored", db.SMS{UUID: "u2", Status: db.SMSErrored, ErrorReason: "CMS ERROR: 21"}, "u2 errored", ""},
+		{"expired", db.SMS{UUID: "u3", Status: db.SMSErrored, ErrorReason: db.ExpiredReason}, "u3 errored expired", "expired"},
+		{"rejected", db.SMS{UUID: "u4", Status: db.SMSErrored, ErrorReason: db.RejectedPrefix + "message contains blocked keyword 'spam'"}, "u4 errored rejected", "rejected"},
+	}
+	for _, p := range patterns {
+		t.Run(p.name, func(t *testing.T) {
+			if err := e.run(p.sms); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+			if strings.TrimSpace(string(args)) != p.args {
+				t.Errorf("expected args %q, got %q", p.args, args)
+			}
+			in, _ := ioutil.ReadFile(filepath.Join(dir, "in"))
+			var v struct {
+				UUID   string `json:"uuid"`
+				Reason string `json:"reason"`
+			}
+			if err := json.Unmarshal(in, &v); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if v.UUID != p.sms.UUID || v.Reason != p.reason {
+				t.Errorf("unexpected payload: %s", in)
+			}
+		})
+	}
+}
+
+// queued returns the UUIDs of the notifications in the queue, emptying it.
+func queued(e *Exec) []string {
+	var uuids []string
+	for {
+		select {
+		case sms := <-e.queue:
+			uuids = append(uuids, sms.UUID)
+		default:
+			return uuids
+		}
+	}
+}
+
+func TestNotifyFull(t *testing.T) {
+	patterns := []struct {
+		name    string
+		options []Option
+		expect  []string
+	}{
+		{"dropoldest", nil, []string{"u3", "u4"}},
+		{"block", []Option{WithBlock(10 * time.Millisecond)}, []string{"u1", "u2"}},
+		{"block no wait", []Option{WithBlock(0)}, []string{"u1", "u2"}},
+	}
+	for _, p := range patterns {
+		t.Run(p.name, func(t *testing.T) {
+			// no workers, so the queue is not drained.
+			e := &Exec{queue: make(chan db.SMS, 2)}
+			for _, option := range append([]Option{WithQueueSize(2)}, p.options...) {
+				option(e)
+			}
+			start := time.Now()
+			for _, uuid := range []string{"u1", "u2", "u3", "u4"} {
+				e.Notify(db.SMS{UUID: uuid})
+			}
+			if e.block && time.Since(start) < 2*e.wait {
+				t.Errorf("expected to wait %v per notification, took %v", e.wait, time.Since(start))
+			}
+			uuids := queued(e)
+			if strings.Join(uuids, " ") != strings.Join(p.expect, " ") {
+				t.Errorf("expected %v, got %v", p.expect, uuids)
+			}
+		})
+	}
+}
+
+func TestNotifyBlockWaits(t *testing.T) {
+	e := &Exec{queue: make(chan db.SMS, 1)}
+	WithBlock(time.Second)(e)
+	e.Notify(db.SMS{UUID: "u1"})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-e.queue
+	}()
+	// waits for space rather than dropping the notification.
+	e.Notify(db.SMS{UUID: "u2"})
+	uuids := queued(e)
+	if len(uuids) != 1 || uuids[0] != "u2" {
+		t.Errorf("expected [u2], got %v", uuids)
+	}
+}
+
+func TestNotifyRuns(t *testing.T) {
+	path, dir, cleanup := script(t, `echo "$1" >> "$(dirname "$0")/uuids"; sleep 0.1`)
+	defer cleanup()
+	// a single worker and queue slot, so some of a burst must be dropped.
+	e := New(path, time.Second, 1, WithQueueSize(1))
+	for _, uuid := range []string{"u1", "u2", "u3", "u4"} {
+		e.Notify(db.SMS{UUID: uuid})
+	}
+	time.Sleep(500 * time.Millisecond)
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "uuids"))
+	uuids := strings.Fields(string(b))
+	if len(uuids) == 0 || len(uuids) > 2 || uuids[len(uuids)-1] != "u4" {
+		t.Errorf("expected the newest notification run, got %v", uuids)
+	}
+}
@@ -0,0 +1,322 @@
+// Package logger provides levelled logging of messages with optional fields,
+// in either human readable text or JSON.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	// LevelDebug entries are only of interest when debugging.
+	LevelDebug Level = iota
+	// LevelInfo entries report normal operation.
+	LevelInfo
+	// LevelWarn entries report unexpected conditions that do not prevent operation.
+	LevelWarn
+	// LevelError entries report failures.
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts a level name, such as "debug", into a Level.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", name)
+}
+
+// Format is the format of the log output.
+type Format int
+
+const (
+	// Text formats entries as human readable text.
+	Text Format = iota
+	// JSON formats each entry as a JSON object.
+	JSON
+)
+
+// ParseFormat converts a format name, "text" or "json", into a Format.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return Text, nil
+	case "json":
+		return JSON, nil
+	}
+	return Text, fmt.Errorf("unknown log format '%s'", name)
+}
+
+// Logger writes log entries to an io.Writer.
+type Logger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+	level  Level
+	// repeatInterval, if non-zero, is the period over which repeats of an
+	// entry are suppressed.
+	repeatInterval time.Duration
+	// repeats are the entries recently written, keyed by their content.
+	repeats map[string]*repeat
+	// flush, if set, writes the summaries of suppressed entries once their
+	// period expires.
+	flush *time.Timer
+}
+
+// repeat tracks the repeats of an entry suppressed since it was written.
+type repeat struct {
+	since  time.Time
+	count  int
+	level  Level
+	msg    string
+	fields []interface{}
+}
+
+// maxRepeats bounds the number of distinct entries tracked for suppression.
+const maxRepeats = 1000
+
+// New creates a Logger that writes entries at or above the level to w.
+func New(w io.Writer, format Format, level Level) *Logger {
+	return &Logger{w: w, format: format, level: level}
+}
+
+// Enabled returns true if entries at the level are logged.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// SetRepeatInterval suppresses entries identical to one written within the
+// interval, such as from a modem that is failing permanently, so the log is
+// not flooded with them.
+// Once the interval has passed a summary of the number of entries suppressed
+// is written in their place.
+// Zero disables suppression.
+func (l *Logger) SetRepeatInterval(interval time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushRepeats(time.Now(), true)
+	l.repeatInterval = interval
+	l.repeats = make(map[string]*repeat)
+}
+
+// Log writes an entry, if the level is enabled.
+// The fields are alternating keys and values, e.g. "device", "modem1".
+func (l *Logger) Log(level Level, msg string, fields ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.repeatInterval > 0 && l.suppress(now, level, msg, fields) {
+		return
+	}
+	l.write(now, level, msg, fields)
+}
+
+// suppress determines if the entry repeats one written within the repeat
+// interval, in which case it is counted rather than written.
+// The caller must hold the lock.
+func (l *Logger) suppress(now time.Time, level Level, msg string, fields []interface{}) bool {
+	l.flushRepeats(now, false)
+	key := fmt.Sprintf("%d\x00%s\x00%v", level, msg, fields)
+	if r, ok := l.repeats[key]; ok {
+		r.count++
+		if l.flush == nil {
+			l.flush = time.AfterFunc(r.since.Add(l.repeatInterval).Sub(now), l.flushExpired)
+		}
+		return true
+	}
+	if len(l.repeats) >= maxRepeats {
+		l.flushRepeats(now, true)
+	}
+	l.repeats[key] = &repeat{since: now, level: level, msg: msg, fields: fields}
+	return false
+}
+
+// flushExpired writes the summaries of the suppressed entries whose period
+// has expired, and rearms the timer for those yet to expire.
+func (l *Logger) flushExpired() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.flush = nil
+	l.flushRepeats(now, false)
+	var next time.Time
+	for _, r := range l.repeats {
+		if r.count > 0 && (next.IsZero() || r.since.Before(next)) {
+			next = r.since
+		}
+	}
+	if !next.IsZero() {
+		l.flush = time.AfterFunc(next.Add(l.repeatInterval).Sub(now), l.flushExpired)
+	}
+}
+
+// flushRepeats forgets the entries whose repeat interval has expired, or all
+// entries if all is set, writing a summary for those that were repeated.
+// The caller must hold the lock.
+func (l *Logger) flushRepeats(now time.Time, all bool) {
+	for key, r := range l.repeats {
+		if !all && now.Sub(r.since) < l.repeatInterval {
+			continue
+		}
+		if r.count > 0 {
+			fields := append([]interface{}{"message", r.msg}, r.fields...)
+			l.write(now, r.level,
+				fmt.Sprintf("last message repeated %d times in %v", r.count, now.Sub(r.since).Round(time.Second)),
+				fields)
+		}
+		delete(l.repeats, key)
+	}
+}
+
+// write formats and writes an entry.
+// The caller must hold the lock.
+func (l *Logger) write(now time.Time, level Level, msg string, fields []interface{}) {
+	var b bytes.Buffer
+	if l.format == JSON {
+		b.WriteString(`{"time":`)
+		writeJSONValue(&b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSONValue(&b, level.String())
+		b.WriteString(`,"msg":`)
+		writeJSONValue(&b, msg)
+		for i := 0; i < len(fields); i += 2 {
+			b.WriteByte(',')
+			writeJSONValue(&b, fieldKey(fields[i]))
+			b.WriteByte(':')
+			writeJSONValue(&b, fieldValue(fields, i))
+		}
+		b.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&b, "%s %s %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), msg)
+		for i := 0; i < len(fields); i += 2 {
+			fmt.Fprintf(&b, " %s=%v", fieldKey(fields[i]), fieldValue(fields, i))
+		}
+		b.WriteByte('\n')
+	}
+	l.w.Write(b.Bytes())
+}
+
+// Debug logs an entry at LevelDebug.
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.Log(LevelDebug, msg, fields...)
+}
+
+// Info logs an entry at LevelInfo.
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.Log(LevelInfo, msg, fields...)
+}
+
+// Warn logs an entry at LevelWarn.
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.Log(LevelWarn, msg, fields...)
+}
+
+// Error logs an entry at LevelError.
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.Log(LevelError, msg, fields...)
+}
+
+// Writer returns an io.Writer that logs each line written to it as an entry
+// at the given level.
+// This allows the output of the standard log package to be redirected to the
+// Logger, in which case the log flags should be cleared.
+func (l *Logger) Writer(level Level) io.Writer {
+	return writer{l, level}
+}
+
+type writer struct {
+	l     *Logger
+	level Level
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.l.Log(w.level, line)
+	}
+	return len(p), nil
+}
+
+func fieldKey(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
+
+func fieldValue(fields []interface{}, i int) interface{} {
+	if i+1 < len(fields) {
+		if err, ok := fields[i+1].(error); ok {
+			return err.Error()
+		}
+		return fields[i+1]
+	}
+	return "(missing)"
+}
+
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(j)
+}
+
+var std = New(os.Stderr, Text, LevelInfo)
+
+// SetDefault sets the Logger used by the package level logging functions.
+func SetDefault(l *Logger) {
+	std = l
+}
+
+// Default returns the Logger used by the package level logging functions.
+func Default() *Logger {
+	return std
+}
+
+// DebugEnabled returns true if the default Logger logs LevelDebug entries.
+func DebugEnabled() bool {
+	return std.Enabled(LevelDebug)
+}
+
+// Debug logs an entry at LevelDebug, using the default Logger.
+func Debug(msg string, fields ...interface{}) {
+	std.Log(LevelDebug, msg, fields...)
+}
+
+// Info logs an entry at LevelInfo, using the default Logger.
+func Info(msg string, fields ...interface{}) {
+	std.Log(LevelInfo, msg, fields...)
+}
+
+// Warn logs an entry at LevelWarn, using the default Logger.
+func Warn(msg string, fields ...interface{}) {
+	std.Log(LevelWarn, msg, fields...)
+}
+
+// Error logs an entry at LevelError, using the default Logger.
+func Error(msg string, fields ...interface{}) {
+	std.Log(LevelError, msg, fields...)
+}
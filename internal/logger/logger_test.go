@@ -0,0 +1,250 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// buffer is a bytes.Buffer that may be written by the flush timer while
+// being read by the test.
+type buffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+// lines returns the lines written so far.
+func (b *buffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := strings.TrimRight(b.b.String(), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// waitLines waits for at least n lines to be written, returning those
+// written.
+func (b *buffer) waitLines(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		lines := b.lines()
+		if len(lines) >= n || time.Now().After(deadline) {
+			return lines
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for i, name := range []string{"debug", "INFO", "Warn", "error"} {
+		if l, err := ParseLevel(name); err != nil || l != Level(i) {
+			t.Errorf("%s: expected %v, got %v, %v", name, Level(i), l, err)
+		}
+	}
+	if _, err := ParseLevel("trace"); err == nil {
+		t.Error("expected error")
+	}
+	if s := Level(7).String(); s != "level(7)" {
+		t.Errorf("unexpected level name: %s", s)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if f, err := ParseFormat("JSON"); err != nil || f != JSON {
+		t.Errorf("expected JSON, got %v, %v", f, err)
+	}
+	if f, err := ParseFormat("text"); err != nil || f != Text {
+		t.Errorf("expected Text, got %v, %v", f, err)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestText(t *testing.T) {
+	var b buffer
+	l := New(&b, Text, LevelInfo)
+	l.Debug("hidden")
+	l.Info("sent", "uuid", "u1", "device", "modem1")
+	l.Warn("failed", "err", errors.New("no carrier"), "dangling")
+	lines := b.lines()
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", lines)
+	}
+	if !strings.HasSuffix(lines[0], " INFO sent uuid=u1 device=modem1") {
+		t.Errorf("unexpected line: %s", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], " WARN failed err=no carrier dangling=(missing)") {
+		t.Errorf("unexpected line: %s", lines[1])
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var b buffer
+	l := New(&b, JSON, LevelDebug)
+	l.Debug("sent", "uuid", "u1", "segments", 2, "err", errors.New("no carrier"), 42, true, "dangling")
+	l.Error("quote \" and\nnewline")
+	lines := b.lines()
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", lines)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", lines[0], err)
+	}
+	expect := map[string]interface{}{
+		"level":    "debug",
+		"msg":      "sent",
+		"uuid":     "u1",
+		"segments": float64(2),
+		"err":      "no carrier",
+		"42":       true,
+		"dangling": "(missing)",
+	}
+	for k, ev := range expect {
+		if v[k] != ev {
+			t.Errorf("%s: expected %v, got %v", k, ev, v[k])
+		}
+	}
+	if ts, ok := v["time"].(string); !ok {
+		t.Errorf("missing time: %s", lines[0])
+	} else if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+		t.Errorf("invalid time: %v", err)
+	}
+	v = nil
+	if err := json.Unmarshal([]byte(lines[1]), &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", lines[1], err)
+	}
+	if v["msg"] != "quote \" and\nnewline" || v["level"] != "error" {
+		t.Errorf("unexpected entry: %s", lines[1])
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var b buffer
+	l := New(&b, Text, LevelInfo)
+	fmt.Fprint(l.Writer(LevelWarn), "one\ntwo\n")
+	lines := b.lines()
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "WARN one") || !strings.HasSuffix(lines[1], "WARN two") {
+		t.Errorf("unexpected lines: %q", lines)
+	}
+}
+
+func TestRepeatSummary(t *testing.T) {
+	var b buffer
+	l := New(&b, JSON, LevelInfo)
+	l.SetRepeatInterval(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		l.Warn("modem failed", "device", "modem1")
+	}
+	// differing fields are not repeats.
+	l.Warn("modem failed", "device", "modem2")
+	if lines := b.lines(); len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", lines)
+	}
+	lines := b.waitLines(t, 3)
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %q", lines)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[2]), &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", lines[2], err)
+	}
+	if !strings.HasPrefix(v["msg"].(string), "last message repeated 2 times") ||
+		v["message"] != "modem failed" || v["device"] != "modem1" || v["level"] != "warn" {
+		t.Errorf("unexpected summary: %s", lines[2])
+	}
+	// the period has expired, so the entry is written again.
+	l.Warn("modem failed", "device", "modem1")
+	if lines := b.lines(); len(lines) != 4 {
+		t.Errorf("expected 4 lines, got %q", lines)
+	}
+}
+
+func TestRepeatRearm(t *testing.T) {
+	var b buffer
+	l := New(&b, Text, LevelInfo)
+	l.SetRepeatInterval(50 * time.Millisecond)
+	l.Info("a")
+	l.Info("a")
+	time.Sleep(30 * time.Millisecond)
+	l.Info("b")
+	l.Info("b")
+	l.Info("b")
+	// the timer armed for a must be rearmed for b once a is flushed.
+	lines := b.waitLines(t, 4)
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %q", lines)
+	}
+	if !strings.Contains(lines[2], "last message repeated 1 times") || !strings.HasSuffix(lines[2], "message=a") {
+		t.Errorf("unexpected summary: %s", lines[2])
+	}
+	if !strings.Contains(lines[3], "last message repeated 2 times") || !strings.HasSuffix(lines[3], "message=b") {
+		t.Errorf("unexpected summary: %s", lines[3])
+	}
+}
+
+func TestRepeatLimit(t *testing.T) {
+	var b buffer
+	l := New(&b, Text, LevelInfo)
+	l.SetRepeatInterval(time.Hour)
+	l.Info("first")
+	l.Info("first")
+	for i := 1; i < maxRepeats; i++ {
+		l.Info("entry", "n", i)
+	}
+	if lines := b.lines(); len(lines) != maxRepeats {
+		t.Fatalf("expected %d lines, got %d", maxRepeats, len(lines))
+	}
+	// one too many distinct entries flushes those tracked.
+	l.Info("last")
+	lines := b.lines()
+	if len(lines) != maxRepeats+2 {
+		t.Fatalf("expected %d lines, got %d", maxRepeats+2, len(lines))
+	}
+	if !strings.Contains(lines[maxRepeats], "last message repeated 1 times") {
+		t.Errorf("unexpected summary: %s", lines[maxRepeats])
+	}
+	if !strings.HasSuffix(lines[maxRepeats+1], "INFO last") {
+		t.Errorf("unexpected line: %s", lines[maxRepeats+1])
+	}
+	// and forgets them.
+	l.Info("first")
+	if lines := b.lines(); len(lines) != maxRepeats+3 {
+		t.Errorf("expected %d lines, got %d", maxRepeats+3, len(lines))
+	}
+}
+
+func TestSetRepeatIntervalFlushes(t *testing.T) {
+	var b buffer
+	l := New(&b, Text, LevelInfo)
+	l.SetRepeatInterval(time.Hour)
+	for i := 0; i < 4; i++ {
+		l.Info("a")
+	}
+	l.SetRepeatInterval(0)
+	lines := b.lines()
+	if len(lines) != 2 || !strings.Contains(lines[1], "last message repeated 3 times") {
+		t.Fatalf("unexpected lines: %q", lines)
+	}
+	// suppression disabled.
+	l.Info("a")
+	l.Info("a")
+	if lines := b.lines(); len(lines) != 4 {
+		t.Errorf("expected 4 lines, got %q", lines)
+	}
+}
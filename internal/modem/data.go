@@ -0,0 +1,106 @@
+package modem
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/warthog618/goatsms/internal/db"
+	"github.com/warthog618/sms/encoding/tpdu"
+)
+
+// maxSegments is the maximum number of parts in a multi-part SMS, as limited
+// by the concatenation information element.
+const maxSegments = 255
+
+// concatIELen is the encoded length of the largest concatenation information
+// element, i.e. one with a 16-bit reference number.
+const concatIELen = 6
+
+// ParseData decodes and validates the hex encoded payload and user data
+// header of a data SMS.
+// Returns the number of PDUs required to send the payload.
+func ParseData(payload, udh string) (int, error) {
+	d, h, err := decodeData(payload, udh)
+	if err != nil {
+		return 0, err
+	}
+	t, err := dataTemplate("", h)
+	if err != nil {
+		return 0, err
+	}
+	if len(d) <= t.UDBlockSize() {
+		return 1, nil
+	}
+	// multi-part payloads must also allow for the concatenation IE in each part.
+	t.SetUDH(append(h[:len(h):len(h)], tpdu.InformationElement{ID: 8, Data: make([]byte, concatIELen-2)}))
+	bs := t.UDBlockSize()
+	if bs <= 0 {
+		return 0, errors.New("udh too long")
+	}
+	segments := (len(d) + bs - 1) / bs
+	if segments > maxSegments {
+		return 0, errors.New("payload too long")
+	}
+	return segments, nil
+}
+
+// decodeData decodes the payload and UDH of a data SMS.
+func decodeData(payload, udh string) ([]byte, tpdu.UserDataHeader, error) {
+	d, err := hex.DecodeString(payload)
+	if err != nil {
+		return nil, nil, errors.New("invalid payload: " + err.Error())
+	}
+	if len(d) == 0 {
+		return nil, nil, errors.New("payload is required")
+	}
+	if udh == "" {
+		return d, nil, nil
+	}
+	b, err := hex.DecodeString(udh)
+	if err != nil {
+		return nil, nil, errors.New("invalid udh: " + err.Error())
+	}
+	var h tpdu.UserDataHeader
+	n, err := h.UnmarshalBinary(b)
+	if err != nil {
+		return nil, nil, errors.New("invalid udh: " + err.Error())
+	}
+	if n != len(b) {
+		return nil, nil, errors.New("invalid udh: length does not match udhl")
+	}
+	for _, ie := range h {
+		// concatenation IEs are added when the payload is segmented.
+		if ie.ID == 0 || ie.ID == 8 {
+			return nil, nil, errors.New("invalid udh: contains concatenation IE")
+		}
+	}
+	return d, h, nil
+}
+
+// dataTemplate returns the template SMS-SUBMIT TPDU for the segments of a
+// data SMS.
+func dataTemplate(mobile string, udh tpdu.UserDataHeader) (*tpdu.TPDU, error) {
+	t, err := tpdu.NewSubmit(tpdu.WithDA(tpdu.NewAddress(tpdu.FromNumber(mobile))))
+	if err != nil {
+		return nil, err
+	}
+	t.SetDCS(byte(tpdu.Dcs8BitData))
+	if len(udh) > 0 {
+		t.SetUDH(udh)
+	}
+	return t, nil
+}
+
+// encodeData builds the set of SMS-SUBMIT TPDUs containing the payload of a
+// data SMS, which is sent as is using 8-bit encoding.
+func (m *GSMModem) encodeData(msg db.SMS, sopts []tpdu.SegmentationOption) ([]tpdu.TPDU, error) {
+	d, udh, err := decodeData(msg.Body, msg.UDH)
+	if err != nil {
+		return nil, err
+	}
+	t, err := dataTemplate(msg.Mobile, udh)
+	if err != nil {
+		return nil, err
+	}
+	return t.Segment(d, sopts...), nil
+}
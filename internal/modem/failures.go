@@ -0,0 +1,119 @@
+package modem
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/warthog618/modem/at"
+)
+
+// WithFailureLimit specifies the number of consecutive failed sends after
+// which the modem is disabled, so a modem that fails every SMS it is given
+// does not continue to take SMSs from the modems that can send them.
+// Only failures attributable to the modem or network, as determined by
+// isModemFailure, are counted, so SMSs rejected for their content or
+// destination do not disable a healthy modem.
+// A disabled modem is passed no SMSs until re-enabled by Enable.
+// By default, or if the limit is 0, modems are never disabled.
+func WithFailureLimit(limit int) Option {
+	return func(m *GSMModem) {
+		m.failureLimit = limit
+	}
+}
+
+// sent records a successful send, ending any run of failures.
+func (m *GSMModem) sent() {
+	m.mu.Lock()
+	m.status.Failures = 0
+	m.mu.Unlock()
+}
+
+// modemErrors are the CMS errors that indicate a problem with the modem or
+// its SIM, rather than with the SMS.
+var modemErrors = map[string]bool{
+	"300": true, // ME failure
+	"301": true, // SMS service of ME reserved
+	"302": true, // operation not allowed
+	"310": true, // SIM not inserted
+	"311": true, // SIM PIN required
+	"313": true, // SIM failure
+	"314": true, // SIM busy
+	"315": true, // SIM wrong
+	"320": true, // memory failure
+	"500": true, // unknown error
+}
+
+// isModemFailure indicates if the error returned by a send is due to the
+// modem, its SIM, or the network, rather than the SMS, such as a CME error,
+// a lost network, or the modem failing to respond.
+func isModemFailure(err error) bool {
+	if err == context.DeadlineExceeded || isNetworkError(err) {
+		return true
+	}
+	switch e := err.(type) {
+	case at.CMEError:
+		return true
+	case at.CMSError:
+		return modemErrors[strings.TrimSpace(string(e))]
+	}
+	return false
+}
+
+// failed records a failed send, disabling the modem, and detaching it from
+// the SMSDispatcher, if the failure limit is reached.
+// Failures that are not isModemFailure are ignored.
+// Returns true if the modem was disabled by the failure.
+func (m *GSMModem) failed(ss SMSDispatcher, err error) bool {
+	if !isModemFailure(err) {
+		return false
+	}
+	m.mu.Lock()
+	m.status.Failures++
+	failures := m.status.Failures
+	if m.failureLimit <= 0 || failures < m.failureLimit || m.status.Disabled {
+		m.mu.Unlock()
+		return false
+	}
+	m.status.Disabled = true
+	m.status.DisabledReason = err.Error()
+	m.mu.Unlock()
+	log.Printf("modem %s disabled after %d consecutive send failures: %v\n",
+		m.deviceID, failures, err)
+	// detached without holding the lock, as the SMSDispatcher may call back
+	// into the modem.
+	ss.Detach(m.deviceID)
+	return true
+}
+
+// disabled indicates the modem has been disabled by repeated send failures.
+func (m *GSMModem) disabled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status.Disabled
+}
+
+// Enable re-enables a modem disabled by repeated send failures, such as once
+// an operator has resolved the cause.
+// If the modem is connected it is immediately available to send SMSs.
+// Returns false if the modem was not disabled.
+func (m *GSMModem) Enable() bool {
+	m.mu.Lock()
+	if !m.status.Disabled {
+		m.mu.Unlock()
+		return false
+	}
+	m.status.Disabled = false
+	m.status.DisabledReason = ""
+	m.status.Failures = 0
+	ss := m.ss
+	// a sleeping modem remains attached, and is woken when next sent an SMS.
+	attach := ss != nil && m.status.Connected && (m.status.Registered || m.status.Asleep)
+	m.mu.Unlock()
+	log.Println("modem enabled:", m.deviceID)
+	// attached without holding the lock, as per failed.
+	if attach {
+		ss.Attach(m.deviceID)
+	}
+	return true
+}
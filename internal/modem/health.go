@@ -0,0 +1,198 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warthog618/modem/gsm"
+)
+
+// HealthCommands are the vendor specific commands that report the health of
+// modems whose model, as reported by +CGMM, contains Model.
+// A Model of "*" matches any modem.
+type HealthCommands struct {
+	Model string
+	// Voltage is the command that reports the supply or battery voltage, in
+	// millivolts, such as "+CBC", or empty if not supported.
+	// The last number in the response is the voltage.
+	Voltage string
+	// Temperature is the command that reports the temperature, in degrees
+	// Celsius, such as "+QTEMP" for Quectel modems, or empty if not
+	// supported.
+	// Where the response contains several sensors the hottest is used.
+	Temperature string
+	// TemperatureScale divides the reported temperature, such as 10 for
+	// modems that report tenths of a degree, or 0 if not scaled.
+	TemperatureScale float64
+}
+
+// ParseHealthCommands parses the health commands for a model from a list of
+// readings separated by ';', each in the form reading:command, where reading
+// is "voltage" or "temperature".
+// The temperature command may be followed by /scale, such as
+// "temperature:^CHIPTEMP?/10".
+func ParseHealthCommands(model, spec string) (HealthCommands, error) {
+	hc := HealthCommands{Model: model}
+	for _, r := range strings.Split(spec, ";") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		kv := strings.SplitN(r, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[1]) == "" {
+			return hc, errors.New("malformed reading: " + r)
+		}
+		cmd := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "voltage":
+			hc.Voltage = cmd
+		case "temperature":
+			if i := strings.LastIndex(cmd, "/"); i >= 0 {
+				scale, err := strconv.ParseFloat(cmd[i+1:], 64)
+				if err != nil || scale <= 0 {
+					return hc, errors.New("invalid temperature scale: " + r)
+				}
+				cmd, hc.TemperatureScale = cmd[:i], scale
+			}
+			hc.Temperature = cmd
+		default:
+			return hc, errors.New("unknown reading: " + r)
+		}
+	}
+	return hc, nil
+}
+
+// WithHealth specifies the commands polled, with the period, to report the
+// health of the modem, so overheating or power problems can be spotted in
+// the field.
+// The commands are selected by the model of the modem, with the longest
+// matching Model used.
+// Modems not matching any Model are not polled.
+func WithHealth(cmds []HealthCommands, period time.Duration) Option {
+	return func(m *GSMModem) {
+		m.healthCmds = append(m.healthCmds, cmds...)
+		m.healthPeriod = period
+	}
+}
+
+// healthCommands returns the health commands for the model, or false if the
+// model does not match any.
+func (m *GSMModem) healthCommands(model string) (HealthCommands, bool) {
+	var hc HealthCommands
+	found := false
+	lm := strings.ToLower(model)
+	for _, c := range m.healthCmds {
+		if c.Model != "*" && !strings.Contains(lm, strings.ToLower(c.Model)) {
+			continue
+		}
+		if !found || (c.Model != "*" && (hc.Model == "*" || len(c.Model) > len(hc.Model))) {
+			hc, found = c, true
+		}
+	}
+	return hc, found
+}
+
+// health identifies the model of the modem and, if it has health commands,
+// periodically polls them.
+func (m *GSMModem) health(ctx context.Context, modem *gsm.GSM) {
+	model, err := query(ctx, modem, "+CGMM")
+	if err != nil {
+		log.Println("modem model query failed:", m.deviceID, err)
+		return
+	}
+	model = strings.TrimSpace(strings.TrimPrefix(model, "+CGMM:"))
+	m.mu.Lock()
+	m.status.Model = model
+	// readings from an earlier connection may be stale.
+	m.status.Voltage = nil
+	m.status.Temperature = nil
+	m.mu.Unlock()
+	hc, ok := m.healthCommands(model)
+	if !ok || m.healthPeriod <= 0 {
+		return
+	}
+	poll := time.NewTimer(0) // for an immediate reading
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-modem.Closed():
+			return
+		case <-poll.C:
+			if !m.asleep() {
+				m.readHealth(ctx, modem, hc)
+			}
+			poll.Reset(m.healthPeriod)
+		}
+	}
+}
+
+// readHealth polls the health commands and records the readings in the
+// status.
+// Readings that fail are logged and cleared, rather than left stale.
+func (m *GSMModem) readHealth(ctx context.Context, modem *gsm.GSM, hc HealthCommands) {
+	var voltage, temperature *float64
+	if hc.Voltage != "" {
+		if v, err := queryReading(ctx, modem, hc.Voltage, false); err != nil {
+			log.Println("modem voltage reading failed:", m.deviceID, err)
+		} else {
+			v /= 1000
+			voltage = &v
+		}
+	}
+	if hc.Temperature != "" {
+		if t, err := queryReading(ctx, modem, hc.Temperature, true); err != nil {
+			log.Println("modem temperature reading failed:", m.deviceID, err)
+		} else {
+			if hc.TemperatureScale > 0 {
+				t /= hc.TemperatureScale
+			}
+			temperature = &t
+		}
+	}
+	m.mu.Lock()
+	m.status.Voltage = voltage
+	m.status.Temperature = temperature
+	m.mu.Unlock()
+}
+
+// queryReading issues the command and returns the number it reports, either
+// the last in the response or, if max is set, the largest.
+func queryReading(ctx context.Context, modem *gsm.GSM, cmd string, max bool) (float64, error) {
+	info, err := query(ctx, modem, cmd)
+	if err != nil {
+		return 0, err
+	}
+	return parseReading(info, max)
+}
+
+// parseReading extracts the number reported by a health command, such as
+// the voltage from +CBC: 0,85,3950, or the hottest sensor from
+// +QTEMP: 35,36,37.
+// Fields that are not numbers, such as sensor names, are ignored.
+func parseReading(info string, max bool) (float64, error) {
+	if i := strings.Index(info, ":"); i >= 0 {
+		info = info[i+1:]
+	}
+	var reading float64
+	found := false
+	for _, f := range strings.Split(info, ",") {
+		v, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(f), "\""), 64)
+		if err != nil {
+			continue
+		}
+		if !found || !max || v > reading {
+			reading = v
+		}
+		found = true
+	}
+	if !found {
+		return 0, errors.New("no reading in response: " + info)
+	}
+	return reading, nil
+}
@@ -0,0 +1,63 @@
+package modem
+
+import (
+	"context"
+	"strings"
+
+	"github.com/warthog618/modem/gsm"
+)
+
+// identify records the identity of a newly connected modem, its SIM and
+// SMSC, and its network, for the status.
+// The identity is informational, so queries the modem does not support are
+// left empty.
+func (m *GSMModem) identify(ctx context.Context, modem *gsm.GSM) {
+	var imei, imsi, smsc string
+	if info, err := query(ctx, modem, "+CGSN"); err == nil {
+		imei = responseField(info, "+CGSN:", 0)
+	}
+	if info, err := query(ctx, modem, "+CIMI"); err == nil {
+		imsi = responseField(info, "+CIMI:", 0)
+	}
+	if info, err := query(ctx, modem, "+CSCA?"); err == nil {
+		smsc = responseField(info, "+CSCA:", 0)
+	}
+	m.mu.Lock()
+	m.status.IMEI = imei
+	m.status.IMSI = imsi
+	m.status.SMSC = smsc
+	m.mu.Unlock()
+	m.refreshNetwork(ctx, modem)
+}
+
+// refreshNetwork records the operator and signal strength of the modem, for
+// the status.
+func (m *GSMModem) refreshNetwork(ctx context.Context, modem *gsm.GSM) {
+	var operator string
+	var signal *int
+	if info, err := query(ctx, modem, "+COPS?"); err == nil {
+		operator = responseField(info, "+COPS:", 2)
+	}
+	if info, err := query(ctx, modem, "+CSQ"); err == nil {
+		if rssi, err := parseCSQ(info); err == nil {
+			signal = &rssi
+		}
+	}
+	m.mu.Lock()
+	m.status.Operator = operator
+	m.status.Signal = signal
+	m.mu.Unlock()
+}
+
+// responseField returns the unquoted field at the index of a response, such
+// as the operator from +COPS: 0,0,"Telstra",7, or empty if the response does
+// not contain it.
+// The prefix is optional, as some modems omit it from responses to
+// identification commands.
+func responseField(info, prefix string, index int) string {
+	fields := strings.Split(strings.TrimPrefix(info, prefix), ",")
+	if index >= len(fields) {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(fields[index]), `"`)
+}
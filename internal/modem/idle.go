@@ -0,0 +1,93 @@
+package modem
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/warthog618/modem/gsm"
+)
+
+// WithIdleSleep specifies that the modem is put into a low power state, using
+// the sleep command, such as "+CFUN=0", once it has been idle for the period,
+// and is woken, using the wake command, such as "+CFUN=1", when next passed
+// an SMS to send, so battery or solar powered gateways do not waste energy
+// while there is nothing to send.
+// The modem remains available to the SMSDispatcher while asleep, and the SMS
+// is sent once the modem has woken and re-registered with the network.
+// SMSs are not received while the modem is asleep.
+func WithIdleSleep(idle time.Duration, sleepCmd, wakeCmd string) Option {
+	return func(m *GSMModem) {
+		m.idleSleep = idle
+		m.sleepCmd = sleepCmd
+		m.wakeCmd = wakeCmd
+	}
+}
+
+// wakeTimeout is the maximum time to wait for a woken modem to re-register
+// with the network.
+const wakeTimeout = 60 * time.Second
+
+// sleep puts the modem into the low power state.
+// A deregistered modem is not passed SMSs, so would never be woken, and is
+// left awake so the registration check can find it registered.
+// Returns false if the modem was not put to sleep.
+func (m *GSMModem) sleep(ctx context.Context, modem *gsm.GSM) bool {
+	if !m.Status().Registered {
+		return false
+	}
+	cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	_, err := modem.Command(cctx, m.sleepCmd)
+	cancel()
+	if err != nil {
+		log.Println("modem sleep failed:", m.deviceID, err)
+		return false
+	}
+	log.Println("modem asleep:", m.deviceID)
+	m.setAsleep(true)
+	return true
+}
+
+// wake restores the modem from the low power state, and waits for it to
+// re-register with the network.
+// A modem that is not asleep is woken anyway, as it may have been left
+// asleep by an earlier connection.
+func (m *GSMModem) wake(ctx context.Context, modem *gsm.GSM) error {
+	cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	_, err := modem.Command(cctx, m.wakeCmd)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if m.asleep() {
+		log.Println("modem awake:", m.deviceID)
+	}
+	m.setAsleep(false)
+	wctx, cancel := context.WithTimeout(ctx, wakeTimeout)
+	defer cancel()
+	for {
+		if registered, err := isRegistered(wctx, modem); err == nil && registered {
+			return nil
+		}
+		select {
+		case <-wctx.Done():
+			// leave the send, or the self-test, to report the cause.
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// asleep indicates the modem is in the low power state.
+func (m *GSMModem) asleep() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status.Asleep
+}
+
+// setAsleep records a change in the power state of the modem.
+func (m *GSMModem) setAsleep(asleep bool) {
+	m.mu.Lock()
+	m.status.Asleep = asleep
+	m.mu.Unlock()
+}
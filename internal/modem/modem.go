@@ -2,16 +2,26 @@ package modem
 
 import (
 	"context"
+	"errors"
+	"io"
 	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jpillora/backoff"
 	"github.com/warthog618/goatsms/internal/db"
+	"github.com/warthog618/goatsms/internal/translit"
 	"github.com/warthog618/modem/at"
 	"github.com/warthog618/modem/gsm"
-	"github.com/warthog618/modem/serial"
 	"github.com/warthog618/modem/trace"
 	"github.com/warthog618/sms"
+	"github.com/warthog618/sms/encoding/tpdu"
+	"github.com/warthog618/sms/encoding/ucs2"
 )
 
 // GSMModem represents a physical GSM modem.
@@ -20,32 +30,383 @@ type GSMModem struct {
 	baudrate int
 	deviceID string
 	trace    *log.Logger
+	inbox    Inbox
+	// statusReports indicates delivery reports are received and passed to the
+	// SMSDispatcher.
+	statusReports bool
+	// mr and concatRef are retained across messages so that message and
+	// concatenation reference numbers are allocated sequentially.
+	mr, concatRef sms.Counter
+	// segOpts control the segmentation of multi-part SMSs.
+	segOpts []tpdu.SegmentationOption
+	// encodings force the encoding of text SMSs to particular destinations,
+	// longest prefix first.
+	encodings []Encoding
+	// altSMSCs are the SMSCs tried when the default SMSC fails.
+	altSMSCs []string
+	// gsm7Replace indicates characters are replaced, rather than
+	// transliterated, when forcing GSM7.
+	gsm7Replace bool
+	// table is used to transliterate characters when forcing GSM7 and, if
+	// transliterate is set, before encoding any SMS.
+	table         translit.Table
+	transliterate bool
+	// deleteReceived indicates received SMSs are deleted from modem storage.
+	deleteReceived bool
+	// importStored indicates SMSs left in modem storage are imported on
+	// connection.
+	importStored bool
+	// textMode indicates the modem is driven in text mode rather than PDU
+	// mode.
+	textMode bool
+	// collector reassembles received multi-part SMSs.
+	collector *sms.Collector
+	// reassemblyTimeout is the time allowed for the remaining parts of a
+	// multi-part SMS to arrive, or 0 to wait indefinitely, after which the
+	// parts received are stored, marked incomplete, or, if
+	// discardIncomplete is set, discarded.
+	reassemblyTimeout time.Duration
+	discardIncomplete bool
+	// minSignal is the minimum RSSI required to pass the self-test.
+	minSignal int
+	// retryLimit is the number of times sending an SMS is retried, unless
+	// overridden by the SMS.
+	retryLimit int
+	// partDelay is the delay between sending the parts of multi-part SMSs.
+	partDelay time.Duration
+	// simSelect is the command that selects the SIM slot, if any.
+	simSelect string
+	// simSlice is the time the device holds a port shared with other SIM
+	// slots before yielding.
+	simSlice time.Duration
+	// port arbitrates the use of a port shared with other SIM slots, or is
+	// nil if not shared.
+	port *sharedPort
+	// sendLimit bounds the number of PDUs being sent concurrently across the
+	// modems, or is nil if not limited.
+	sendLimit *SendLimit
+	// idleSleep is the idle period after which the modem is put into a low
+	// power state using sleepCmd, and woken using wakeCmd, or 0 if the modem
+	// is kept fully powered.
+	idleSleep         time.Duration
+	sleepCmd, wakeCmd string
+	// healthCmds are the commands polled every healthPeriod to report the
+	// health of the modem, selected by model.
+	healthCmds   []HealthCommands
+	healthPeriod time.Duration
+	// failureLimit is the number of consecutive failed sends after which
+	// the modem is disabled, or 0 if never disabled.
+	failureLimit int
+	// stopped is closed when the connection started by Connect ends.
+	stopped chan struct{}
+
+	mu     sync.Mutex
+	status Status
+	// g is the current connection to the modem, or nil if not connected.
+	g *gsm.GSM
+	// ss is the SMSDispatcher passed to Connect, or nil if not connected.
+	ss SMSDispatcher
+}
+
+// Status is a snapshot of the state of a GSMModem.
+type Status struct {
+	DeviceID       string    `json:"device"`
+	Port           string    `json:"port"`
+	Connected      bool      `json:"connected"`
+	ConnectedSince time.Time `json:"connected_since"`
+	// Reconnects is the number of times the modem has reconnected after
+	// being disconnected.
+	Reconnects int `json:"reconnects"`
+	// SIMFull indicates the storage for received SMSs is full.
+	SIMFull bool `json:"sim_full"`
+	// StorageCleanups is the number of times stored outgoing SMSs were
+	// deleted as a full storage blocked sending.
+	StorageCleanups int `json:"storage_cleanups"`
+	// Registered indicates the modem is registered with the network, and so
+	// able to send SMSs.
+	Registered bool `json:"registered"`
+	// Asleep indicates the modem is in the low power state entered when
+	// idle.
+	Asleep bool `json:"asleep"`
+	// Failures is the number of consecutive failed sends.
+	Failures int `json:"failures"`
+	// Disabled indicates the modem has been disabled, and is passed no SMSs,
+	// after reaching the limit on consecutive failed sends, and
+	// DisabledReason is the error of the last failure.
+	Disabled       bool   `json:"disabled"`
+	DisabledReason string `json:"disabled_reason,omitempty"`
+	// State summarises the connection and registration state, and is one of
+	// "disconnected", "disabled", "asleep", "deregistered" or "connected".
+	State string `json:"state"`
+	// PortError describes why the serial port could not be opened, if it
+	// could not.
+	PortError string `json:"port_error,omitempty"`
+	// InFlight is the number of SMSs passed to the modem and not yet
+	// returned.
+	// It is maintained by the sender, so is not set by GSMModem.Status.
+	InFlight int `json:"in_flight"`
+	// IMEI identifies the modem, and IMSI its SIM, as reported on
+	// connection.
+	IMEI string `json:"imei,omitempty"`
+	IMSI string `json:"imsi,omitempty"`
+	// SMSC is the address of the SMSC configured in the modem, as reported on
+	// connection.
+	SMSC string `json:"smsc,omitempty"`
+	// Operator is the network the modem is registered with, and Signal the
+	// RSSI, from 0 to 31 or 99 if unknown, as of the latest registration
+	// check.
+	Operator string `json:"operator,omitempty"`
+	Signal   *int   `json:"signal,omitempty"`
+	// Model is the model of the modem, as reported by +CGMM.
+	Model string `json:"model,omitempty"`
+	// Voltage is the supply or battery voltage, in volts, for modems with
+	// health commands.
+	Voltage *float64 `json:"voltage,omitempty"`
+	// Temperature is the temperature of the modem, in degrees Celsius, for
+	// modems with health commands.
+	Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// Option modifies the configuration of a GSMModem.
+type Option func(*GSMModem)
+
+// WithConcatRef16 specifies that multi-part messages use 16-bit concatenation
+// reference numbers, rather than the default 8-bit.
+// This reduces the likelihood of reference numbers being reused while the
+// parts of an earlier message are still being reassembled by the recipient,
+// as can occur when sending high volumes of multi-part messages.
+func WithConcatRef16(m *GSMModem) {
+	m.segOpts = append(m.segOpts, tpdu.With16BitConcatRef)
+}
+
+// Charset identifies the character encoding of a text SMS.
+type Charset int
+
+const (
+	// CharsetAuto encodes as GSM7 if possible, else UCS2.
+	CharsetAuto Charset = iota
+	// CharsetGSM7 encodes as GSM7, converting any characters not in the GSM7
+	// default alphabet.
+	CharsetGSM7
+	// CharsetUCS2 encodes as UCS2.
+	CharsetUCS2
+)
+
+// Encoding forces the encoding of text SMSs to destinations matching the
+// Prefix, for carriers that mishandle the automatically selected encoding.
+type Encoding struct {
+	Prefix  string
+	Charset Charset
+}
+
+// WithEncodings specifies the encodings forced for particular destinations.
+func WithEncodings(encodings []Encoding) Option {
+	return func(m *GSMModem) {
+		m.encodings = append(m.encodings, encodings...)
+	}
+}
+
+// WithGSM7Replace specifies that, when forcing GSM7, characters not in the
+// GSM7 default alphabet are replaced with '?' rather than being
+// transliterated.
+func WithGSM7Replace(m *GSMModem) {
+	m.gsm7Replace = true
+}
+
+// WithTransliteration specifies that characters not in the GSM7 default
+// alphabet are transliterated, using the table, before any SMS is encoded, so
+// that SMSs containing only transliterable characters, such as curly quotes,
+// may be sent as GSM7 rather than UCS2.
+// Characters not in the table are left unchanged.
+// The table is also used when forcing GSM7.
+// If the table is nil then the default table, translit.DefaultTable, is used.
+func WithTransliteration(t translit.Table) Option {
+	return func(m *GSMModem) {
+		if t != nil {
+			m.table = t
+		}
+		m.transliterate = true
+	}
+}
+
+// WithGSM7Table specifies the table used to transliterate characters not in
+// the GSM7 default alphabet when forcing GSM7.
+func WithGSM7Table(t translit.Table) Option {
+	return func(m *GSMModem) {
+		m.table = t
+	}
+}
+
+// WithRetryLimit specifies the number of times sending an SMS is retried
+// before it is marked as errored, for SMSs that do not specify their own
+// limit.
+func WithRetryLimit(retries int) Option {
+	return func(m *GSMModem) {
+		m.retryLimit = retries
+	}
+}
+
+// ValidPID indicates if the pid is a TP-PID that SMSs may be sent with.
+// These are the default, 0, the telematic interworking types, 0x20 to 0x3f,
+// short message type 0, 0x40, the replace short message types, 0x41 to 0x47,
+// and return call message, 0x5f.
+// Others, such as SIM data download, are not intended for sending to
+// handsets so are not valid.
+func ValidPID(pid int) bool {
+	switch {
+	case pid == 0, pid >= 0x20 && pid <= 0x47, pid == 0x5f:
+		return true
+	}
+	return false
+}
+
+// WithPartDelay specifies the delay between sending the parts of multi-part
+// SMSs, for networks that otherwise deliver the parts out of order.
+func WithPartDelay(d time.Duration) Option {
+	return func(m *GSMModem) {
+		m.partDelay = d
+	}
 }
 
 // New creates a new GSMModem.
-func New(comPort string, baudrate int, deviceID string) (modem *GSMModem) {
-	return &GSMModem{comPort: comPort, baudrate: baudrate, deviceID: deviceID}
+func New(comPort string, baudrate int, deviceID string, options ...Option) (modem *GSMModem) {
+	m := &GSMModem{
+		comPort:    comPort,
+		baudrate:   baudrate,
+		deviceID:   deviceID,
+		retryLimit: db.SMSRetryLimit,
+		table:      translit.DefaultTable(),
+		status:     Status{DeviceID: deviceID, Port: comPort},
+		stopped:    make(chan struct{}),
+	}
+	for _, option := range options {
+		option(m)
+	}
+	var copts []sms.CollectorOption
+	if m.reassemblyTimeout > 0 {
+		copts = append(copts, sms.WithReassemblyTimeout(m.reassemblyTimeout, m.expired))
+	}
+	m.collector = sms.NewCollector(copts...)
+	if m.simSelect != "" {
+		m.port = sharePort(comPort)
+	}
+	// longest prefix first, so the most specific encoding matches.
+	sort.SliceStable(m.encodings, func(i, j int) bool {
+		return len(m.encodings[i].Prefix) > len(m.encodings[j].Prefix)
+	})
+	return m
+}
+
+// Status returns a snapshot of the current state of the modem.
+func (m *GSMModem) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.status
+	switch {
+	case !s.Connected:
+		s.State = "disconnected"
+	case s.Disabled:
+		s.State = "disabled"
+	case s.Asleep:
+		s.State = "asleep"
+	case !s.Registered:
+		s.State = "deregistered"
+	default:
+		s.State = "connected"
+	}
+	return s
+}
+
+// setConnected records a change in the connection state of the modem.
+func (m *GSMModem) setConnected(connected bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if connected {
+		if !m.status.ConnectedSince.IsZero() {
+			m.status.Reconnects++
+		}
+		m.status.ConnectedSince = time.Now()
+	}
+	m.status.Connected = connected
+	m.status.Asleep = false
+	// the modem is assumed registered on connection, until checked.
+	m.status.Registered = connected
+}
+
+// conn returns the current connection to the modem, or nil if not connected.
+func (m *GSMModem) conn() *gsm.GSM {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.g
+}
+
+// setConn records the current connection to the modem.
+func (m *GSMModem) setConn(g *gsm.GSM) {
+	m.mu.Lock()
+	m.g = g
+	m.mu.Unlock()
+}
+
+// setPortError records the result of opening the serial port.
+// Changes are logged, so a modem that cannot be opened does not retry
+// silently.
+func (m *GSMModem) setPortError(err error) {
+	msg := ""
+	if err != nil {
+		msg = portError(m.comPort, err)
+	}
+	m.mu.Lock()
+	changed := m.status.PortError != msg
+	m.status.PortError = msg
+	m.mu.Unlock()
+	if changed && msg != "" {
+		log.Println("modem port failed:", m.deviceID, m.comPort, msg)
+	}
 }
 
 // SMSDispatcher represents the source of SMSs to be sent via the modem.
 type SMSDispatcher interface {
-	Req() <-chan db.SMS
+	// Attach indicates the modem is available to send SMSs, and returns the
+	// chan from which the modem receives SMSs to send.
+	Attach(deviceID string) <-chan db.SMS
+	// Detach indicates the modem is no longer available to send SMSs.
+	Detach(deviceID string)
 	Rsp() chan<- db.SMS
+	// Report indicates whether the part of an SMS sent by the device with
+	// the message reference was delivered, and if not, why.
+	Report(ctx context.Context, deviceID, mr string, delivered bool, reason string)
 }
 
 // Connect binds the GSMModem to the SMSDispatcher.
-// The GSMModem will then commence processing the SMSDispatcher Req chan,
-// and return results via the Rsp chan.
+// Whenever it is connected, the GSMModem will attach to the SMSDispatcher and
+// process the SMSs it provides, and return results via the Rsp chan.
 // The connection remains until the modem is closed or the context is Done.
+// Connect must only be called once.
 func (m *GSMModem) Connect(ctx context.Context, ss SMSDispatcher) {
+	m.mu.Lock()
+	m.ss = ss
+	m.mu.Unlock()
 	go m.monitor(ctx, ss)
 }
 
+// Stopped returns a channel that is closed once the connection started by
+// Connect has ended, after the context is done, and any send in progress has
+// completed.
+func (m *GSMModem) Stopped() <-chan struct{} {
+	return m.stopped
+}
+
 func (m *GSMModem) monitor(ctx context.Context, ss SMSDispatcher) {
+	defer close(m.stopped)
 	connect := time.NewTimer(0) // for immediate connection
 	b := backoff.Backoff{       // !!! configurable Min and Max, and Factor??
 		Min: time.Second,
-		Max: 5 * time.Minute,
+		Max: slowRetry,
+	}
+	// fast is the backoff for conditions expected to clear shortly.
+	fast := backoff.Backoff{
+		Min: time.Second,
+		Max: 15 * time.Second,
 	}
 	log.Println("modem created:", m.deviceID)
 	for {
@@ -56,11 +417,19 @@ func (m *GSMModem) monitor(ctx context.Context, ss SMSDispatcher) {
 			}
 			return
 		case <-connect.C:
-			s, err := serial.New(m.comPort, m.baudrate)
+			if !m.port.acquire(ctx) {
+				// only fails once the context is done, and the timer has
+				// already fired, so cannot wait on it again.
+				return
+			}
+			p, err := openPort(m.comPort, m.baudrate)
+			m.setPortError(err)
 			if err != nil {
+				m.port.release()
 				connect.Reset(b.Duration())
 				continue
 			}
+			s := &releaser{p, m.port}
 			var modem *gsm.GSM
 			if m.trace != nil {
 				tr := trace.New(s, m.trace)
@@ -68,58 +437,268 @@ func (m *GSMModem) monitor(ctx context.Context, ss SMSDispatcher) {
 			} else {
 				modem = gsm.New(s)
 			}
-			modem.SetPDUMode()
-			ictx, cancel := context.WithTimeout(ctx, 10*time.Second)
-			err = modem.Init(ictx)
-			cancel()
-			if err != nil {
+			if !m.textMode {
+				modem.SetPDUMode()
+			}
+			if err = initModem(ctx, modem); err != nil {
+				log.Println("modem init failed:", m.deviceID, err)
+				s.Close()
+				connect.Reset(b.Duration())
+				continue
+			}
+			if err = m.selectSIM(ctx, modem); err != nil {
+				log.Println("modem SIM selection failed:", m.deviceID, err)
+				s.Close()
 				connect.Reset(b.Duration())
 				continue
 			}
+			if m.idleSleep > 0 {
+				// the modem may have been left asleep by an earlier
+				// connection.
+				if err = m.wake(ctx, modem); err != nil {
+					log.Println("modem wake failed:", m.deviceID, err)
+				}
+			}
+			if err := m.selfTest(ctx, modem); err != nil {
+				log.Println("modem self-test failed:", m.deviceID, err)
+				s.Close()
+				switch retryClassOf(err) {
+				case retrySoon:
+					connect.Reset(fast.Duration())
+				case retryLater:
+					connect.Reset(slowRetry)
+				default:
+					connect.Reset(b.Duration())
+				}
+				continue
+			}
 			log.Println("modem connected:", m.deviceID)
+			m.identify(ctx, modem)
+			m.setConnected(true)
+			m.setConn(modem)
 			b.Reset()
+			fast.Reset()
 
-			go m.sender(ctx, modem, ss.Req(), ss.Rsp())
+			// the connection context bounds the lifetime of the goroutines
+			// serving this connection, so exactly one sender is active per
+			// modem at a time.
+			cctx, ccancel := context.WithCancel(ctx)
+			done := make(chan struct{})
+			req := ss.Attach(m.deviceID)
+			if m.disabled() {
+				// remains disabled across reconnections until re-enabled.
+				ss.Detach(m.deviceID)
+			}
+			go m.sender(cctx, modem, ss, req, done)
+			if err := m.startReceiver(cctx, modem, ss); err != nil {
+				log.Println("modem receiver failed to start:", m.deviceID, err)
+			}
+			go m.registration(cctx, modem, ss)
+			if len(m.healthCmds) > 0 {
+				go m.health(cctx, modem)
+			}
 			// !!! Add other status monitors, such as signal strength
 
+			// slice expires when the device must yield a shared port to the
+			// other SIM slots.
+			var slice <-chan time.Time
+			var st *time.Timer
+			if m.port.shared() && m.simSlice > 0 {
+				st = time.NewTimer(m.simSlice)
+				slice = st.C
+			}
 			select {
 			case <-ctx.Done():
+				// mark disconnected before detaching, so the registration
+				// check cannot re-attach.
+				m.setConnected(false)
+				m.setConn(nil)
+				ss.Detach(m.deviceID)
+				// allow the sender to complete the PDU in progress before
+				// releasing the port.
+				select {
+				case <-done:
+				case <-time.After(drainTimeout):
+					log.Println("modem sender failed to drain:", m.deviceID)
+				}
+				ccancel()
+				s.Close()
+				log.Println("modem closed:", m.deviceID)
 				return
 			case <-modem.Closed():
 				log.Println("modem disconnected:", m.deviceID)
+				if st != nil {
+					st.Stop()
+				}
+				m.setConnected(false)
+				m.setConn(nil)
+				ss.Detach(m.deviceID)
+				ccancel()
+				// the sender must exit before a reconnection can start
+				// another.
+				<-done
+				s.Close()
+				connect.Reset(b.Duration())
+			case <-done:
+				// the sender exits early when the connection fails, or
+				// when the modem is being closed.
+				if st != nil {
+					st.Stop()
+				}
+				m.setConnected(false)
+				m.setConn(nil)
+				ss.Detach(m.deviceID)
+				ccancel()
+				s.Close()
+				if ctx.Err() != nil {
+					log.Println("modem closed:", m.deviceID)
+					return
+				}
+				log.Println("modem connection lost:", m.deviceID)
 				connect.Reset(b.Duration())
+			case <-slice:
+				log.Println("modem yielding to other SIM slots:", m.deviceID)
+				m.setConnected(false)
+				m.setConn(nil)
+				ss.Detach(m.deviceID)
+				// a send in progress is returned to be retried, once the
+				// PDU in progress completes.
+				ccancel()
+				<-done
+				s.Close()
+				// give the other slots the chance to acquire the port.
+				connect.Reset(b.Min)
 			}
 		}
 	}
 }
 
+// releaser closes the serial port and releases the shared port, if any.
+type releaser struct {
+	*port
+	shared *sharedPort
+}
+
+// Close closes the serial port and yields it to the other SIM slots.
+func (r *releaser) Close() error {
+	err := r.port.Close()
+	r.shared.release()
+	return err
+}
+
+// slowRetry is the delay before retrying a connection that failed due to a
+// condition requiring intervention, such as a missing SIM.
+const slowRetry = 5 * time.Minute
+
+// initAttempts is the number of times initialisation is attempted before the
+// connection is abandoned.
+const initAttempts = 3
+
+// initModem initialises the modem, including disabling command echo and
+// enabling numeric error codes, so responses are parsed consistently
+// regardless of modem model.
+// Some modems respond to the first commands after opening the port with echo
+// or garbage, so the sequence is retried from the start on failure.
+func initModem(ctx context.Context, modem *gsm.GSM) (err error) {
+	for i := 0; i < initAttempts; i++ {
+		ictx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err = modem.Init(ictx)
+		for _, cmd := range []string{"E0", "+CMEE=1"} {
+			if err != nil {
+				break
+			}
+			_, err = modem.Command(ictx, cmd)
+		}
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// drainTimeout is the maximum time to wait for a send in progress to
+// complete when shutting down.
+const drainTimeout = 20 * time.Second
+
 // Sender is responsible for taking SMSs from the req channel, sending them
-// via the modem, and returning the updated SMS to the response channel.
-// The SMS is sent using PDU mode to support UTF-8 and large messages.
+// via the modem, and returning the updated SMS to the response channel of the
+// SMSDispatcher.
+// The SMS is sent using PDU mode to support UTF-8 and large messages, unless
+// the modem is in text mode.
 // If the SMS is too large to fit in one PDU then it will be sent in several,
 // using the same modem.
-func (m *GSMModem) sender(ctx context.Context, modem *gsm.GSM, req <-chan db.SMS, rsp chan<- db.SMS) {
+// The sender exits when the connection context is done or the modem is
+// closed, and closes the done channel on exit.
+func (m *GSMModem) sender(ctx context.Context, modem *gsm.GSM, ss SMSDispatcher, req <-chan db.SMS, done chan<- struct{}) {
+	defer close(done)
+	rsp := ss.Rsp()
+	// idle fires when the modem has been idle long enough to sleep.
+	var idle <-chan time.Time
+	var it *time.Timer
+	if m.idleSleep > 0 {
+		it = time.NewTimer(m.idleSleep)
+		defer it.Stop()
+		idle = it.C
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-modem.Closed():
 			return
+		case <-idle:
+			if !m.sleep(ctx, modem) {
+				it.Reset(m.idleSleep)
+			}
 		case sms, ok := <-req:
 			if !ok {
 				return
 			}
+			if m.asleep() {
+				if err := m.wake(ctx, modem); err != nil {
+					log.Println("modem wake failed:", m.deviceID, err)
+				}
+			}
 			log.Println("sending: ", sms.UUID, m.deviceID)
-			err := sendSMS(ctx, modem, sms.Mobile, sms.Body)
+			segments, err := m.sendSMS(ctx, modem, &sms)
 			// a bit leary about handling SMS state here - would prefer to do that in sender.go
 			// but then the response sent to the sender becomes more complex.
+			if isTransportError(err) {
+				// the failure lies with the connection, not the SMS, so
+				// return it to be retried without counting against it, and
+				// exit so the monitor reconnects.
+				log.Println("modem connection failed while sending:", m.deviceID, err)
+				rsp <- sms
+				return
+			}
+			if isMemoryFull(err) && m.freeStorage(ctx, modem) > 0 {
+				// the storage, rather than the SMS, was at fault, so the
+				// SMS is retried without counting against it.
+				sms.ErrorReason = err.Error()
+				rsp <- sms
+				continue
+			}
+			if isNetworkError(err) {
+				// as for a lost registration, the SMS is returned to be
+				// retried without counting against it, and the modem is
+				// passed no more SMSs until the registration check finds it
+				// registered again.
+				log.Println("modem network failed while sending:", m.deviceID, err)
+				sms.ErrorReason = err.Error()
+				m.failed(ss, err)
+				m.setRegistered(false, ss)
+				rsp <- sms
+				continue
+			}
 			switch err {
 			case nil:
 				sms.Status = db.SMSSent
 				sms.Device = m.deviceID
-			case at.ErrClosed:
-				rsp <- sms
-				return
+				sms.Segments = segments
+				sms.ErrorReason = ""
+				sms.PartsSent = 0
+				m.sent()
 			case context.Canceled:
 				// !!! handle other errors that indicate a problem with the modem or network, NOT the SMS itself.
 				// such as different CMS or CME errors.
@@ -127,36 +706,317 @@ func (m *GSMModem) sender(ctx context.Context, modem *gsm.GSM, req <-chan db.SMS
 				// Assume modem is dead???
 				// !!! How to signal that to everyone else??
 				// Need to, or just wait to see what happens elsewhere???
+				m.failed(ss, err)
 			default:
-				if sms.Retries >= db.SMSRetryLimit {
+				sms.ErrorReason = err.Error()
+				limit := m.retryLimit
+				if sms.MaxRetries != nil {
+					limit = *sms.MaxRetries
+				}
+				var te textModeError
+				switch {
+				case errors.As(err, &te) || err == ErrExpired:
+					// SMSs that cannot be sent in text mode, or have
+					// expired, are not retried.
+					sms.Status = db.SMSErrored
+				case m.failed(ss, err):
+					// the modem, rather than the SMS, is deemed at fault, so
+					// the SMS is retried by the other modems without
+					// counting against it.
+				case sms.Retries >= limit:
 					sms.Status = db.SMSErrored
-				} else {
+				default:
 					sms.Retries++
 				}
 			}
+			if it != nil {
+				if !it.Stop() {
+					select {
+					case <-it.C:
+					default:
+					}
+				}
+				it.Reset(m.idleSleep)
+			}
 			rsp <- sms
 		}
 	}
 }
 
-func sendSMS(ctx context.Context, g *gsm.GSM, number string, msg string) error {
-	pdus, err := sms.Encode([]byte(msg), sms.To(number), sms.WithAllCharsets)
+// ErrExpired indicates the SMS expired before it could be sent.
+var ErrExpired = errors.New(db.ExpiredReason)
+
+// validityPeriod returns the validity period of an SMS that expires at the
+// expiry.
+// The absolute format is used, as the relative format is limited to steps of
+// at least 5 minutes, so could allow delivery after the expiry.
+// The expiry is rounded down to the second.
+func validityPeriod(expiry time.Time) tpdu.ValidityPeriod {
+	var vp tpdu.ValidityPeriod
+	vp.SetAbsolute(tpdu.Timestamp{Time: expiry.UTC().Truncate(time.Second)})
+	return vp
+}
+
+// isTransportError determines if the error is due to the serial connection
+// to the modem, such as a USB glitch, rather than the modem failing to send
+// the SMS.
+func isTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, at.ErrClosed) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) {
+		return true
+	}
+	var pe *os.PathError
+	var se *os.SyscallError
+	var errno syscall.Errno
+	return errors.As(err, &pe) || errors.As(err, &se) || errors.As(err, &errno)
+}
+
+// encode builds the set of SMS-SUBMIT TPDUs containing the SMS, encoding the
+// body of text SMSs as GSM7, or failing that UCS2, unless the encoding is
+// forced for the destination.
+// The sopts are added to the segmentation options of the modem.
+func (m *GSMModem) encode(msg db.SMS, sopts ...tpdu.SegmentationOption) ([]tpdu.TPDU, error) {
+	sopts = append(m.segOpts[:len(m.segOpts):len(m.segOpts)], sopts...)
+	if msg.Data {
+		return m.encodeData(msg, sopts)
+	}
+	t, err := tpdu.NewSubmit(tpdu.WithDA(tpdu.NewAddress(tpdu.FromNumber(msg.Mobile))))
+	if err != nil {
+		return nil, err
+	}
+	body := msg.Body
+	cs := m.charset(msg.Mobile)
+	if m.transliterate && cs != CharsetUCS2 {
+		body = m.table.Transliterate(body)
+	}
+	switch cs {
+	case CharsetGSM7:
+		if m.gsm7Replace {
+			body = translit.ReplaceGSM7(body)
+		} else {
+			body = m.table.ToGSM7(body)
+		}
+	case CharsetUCS2:
+		dcs, err := t.DCS.WithAlphabet(tpdu.AlphaUCS2)
+		if err != nil {
+			return nil, err
+		}
+		t.SetDCS(byte(dcs))
+		return t.Segment(ucs2.Encode([]rune(body)), sopts...), nil
+	}
+	d, udh, alpha := tpdu.EncodeUserData([]byte(body), tpdu.WithAllCharsets)
+	dcs, err := t.DCS.WithAlphabet(alpha)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	t.SetDCS(byte(dcs))
+	if udh != nil {
+		t.SetUDH(udh)
 	}
-	for i, p := range pdus {
+	return t.Segment(d, sopts...), nil
+}
+
+// Quote describes how an SMS would be sent.
+type Quote struct {
+	// Encoding is one of "gsm7", "ucs2" or "8bit".
+	Encoding string `json:"encoding"`
+	// Segments is the number of PDUs the SMS would be sent in.
+	Segments int `json:"segments"`
+	// UCS2Trigger identifies the character that forces a text SMS to be
+	// sent as UCS2, if it is not forced by the encodings.
+	UCS2Trigger *UCS2Trigger `json:"ucs2_trigger,omitempty"`
+}
+
+// UCS2Trigger is the first character of a text SMS that cannot be encoded
+// in GSM7, so forces the whole SMS to UCS2.
+type UCS2Trigger struct {
+	Char string `json:"char"`
+	// Index is the position of the character in the SMS, counted in
+	// characters from 0.
+	Index int `json:"index"`
+}
+
+// Quote determines the encoding and number of segments the SMS would be sent
+// with, without sending it.
+// It is safe to call concurrently with sending.
+func (m *GSMModem) Quote(msg db.SMS) (Quote, error) {
+	pdus, err := m.encode(msg)
+	if err != nil || len(pdus) == 0 {
+		return Quote{}, err
+	}
+	q := Quote{Encoding: "gsm7", Segments: len(pdus)}
+	switch alpha, _ := pdus[0].Alphabet(); alpha {
+	case tpdu.AlphaUCS2:
+		q.Encoding = "ucs2"
+		if !msg.Data && m.charset(msg.Mobile) == CharsetAuto {
+			q.UCS2Trigger = m.ucs2Trigger(msg.Body)
+		}
+	case tpdu.Alpha8Bit:
+		q.Encoding = "8bit"
+	}
+	return q, nil
+}
+
+// ucs2Trigger finds the first character of the text that forces it to UCS2,
+// using the same charset selection as encode, so characters covered by the
+// national language tables, or by transliteration, are not reported.
+// Returns nil if the text can be encoded in GSM7.
+func (m *GSMModem) ucs2Trigger(text string) *UCS2Trigger {
+	rs := []rune(text)
+	for i := range rs {
+		prefix := string(rs[:i+1])
+		if m.transliterate {
+			prefix = m.table.Transliterate(prefix)
+		}
+		if _, _, alpha := tpdu.EncodeUserData([]byte(prefix), tpdu.WithAllCharsets); alpha == tpdu.AlphaUCS2 {
+			return &UCS2Trigger{Char: string(rs[i]), Index: i}
+		}
+	}
+	return nil
+}
+
+// charset returns the encoding forced for SMSs to the mobile, if any.
+func (m *GSMModem) charset(mobile string) Charset {
+	for _, e := range m.encodings {
+		if strings.HasPrefix(mobile, e.Prefix) {
+			return e.Charset
+		}
+	}
+	return CharsetAuto
+}
+
+// sendSMS sends the SMS, returning the number of parts it was sent in.
+// If sending a multi-part SMS fails part way then the parts sent are recorded
+// in the SMS, so that a retry by the same device sends only the remaining
+// parts, with the same concatenation reference, rather than duplicating the
+// parts already received by the handset.
+func (m *GSMModem) sendSMS(ctx context.Context, g *gsm.GSM, msg *db.SMS) (int, error) {
+	expiry := msg.ExpiryTime()
+	if !expiry.IsZero() && !time.Now().Before(expiry) {
+		return 0, ErrExpired
+	}
+	if m.textMode {
+		return m.sendText(ctx, g, msg)
+	}
+	var cr tpdu.Counter = &m.concatRef
+	start := 0
+	if msg.PartsSent > 0 && msg.Device == m.deviceID {
+		// the handset can only reassemble the parts if they are all sent
+		// from the same number, so other devices start afresh.
+		cr = fixedRef(msg.ConcatRef)
+		start = msg.PartsSent
+	}
+	rec := &recordingRef{c: cr}
+	pdus, err := m.encode(*msg, tpdu.WithMR(&m.mr), tpdu.WithConcatRef(rec))
+	if err != nil {
+		return 0, err
+	}
+	if start >= len(pdus) {
+		// the encoding has changed, so the parts no longer correspond.
+		start = 0
+	}
+	msg.PartsSent = start
+	for i := start; i < len(pdus); i++ {
+		p := pdus[i]
+		if i > start && m.partDelay > 0 {
+			t := time.NewTimer(m.partDelay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+			case <-t.C:
+			}
+		}
+		// a PDU in progress is allowed to complete, but don't start any
+		// more once shutdown has been requested.
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if msg.DeliveryReport {
+			p.FirstOctet |= tpdu.FoSRR
+		}
+		if i == 0 {
+			msg.MRs = ""
+		}
+		p.PID = byte(msg.PID)
+		if !expiry.IsZero() {
+			// so the network does not deliver the SMS after it expires.
+			p.SetVP(validityPeriod(expiry))
+		}
+		if msg.MessageClass != nil {
+			dcs, err := p.DCS.WithClass(tpdu.MessageClass(*msg.MessageClass))
+			if err != nil {
+				return 0, errors.New("message class not supported by the encoding")
+			}
+			p.SetDCS(byte(dcs))
+		}
 		tp, err := p.MarshalBinary()
 		if err != nil {
-			return err
+			return 0, err
+		}
+		if !m.sendLimit.acquire(ctx) {
+			return 0, ctx.Err()
 		}
-		tctx, cancel := context.WithTimeout(ctx, 15*time.Second) // !!! make configurable
+		tctx, cancel := context.WithTimeout(context.Background(), 15*time.Second) // !!! make configurable
 		mr, err := g.SendSMSPDU(tctx, tp)
 		cancel()
+		for _, smsc := range m.altSMSCs {
+			if err == nil || !isSMSCError(err) {
+				break
+			}
+			log.Println("retrying via SMSC", smsc, m.deviceID, err)
+			tctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			mr, err = sendViaSMSC(tctx, g, smsc, tp)
+			cancel()
+		}
+		m.sendLimit.release()
 		if err != nil {
 			// !!! check CPIN?? on failure to determine root cause??  If ERROR 302
-			return err
+			return 0, err
 		}
 		log.Printf("PDU %d: %v\n", i+1, mr) // !!! use GSMModem trace??
+		if msg.DeliveryReport && m.statusReports {
+			// the MR identifies the part in its delivery report.
+			if n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(mr, ":"))); err == nil {
+				msg.MRs = appendMR(msg.MRs, strconv.Itoa(n))
+			}
+		}
+		if len(pdus) > 1 {
+			msg.PartsSent = i + 1
+			msg.ConcatRef = rec.ref
+			msg.Device = m.deviceID
+		}
 	}
-	return nil
+	return len(pdus), nil
+}
+
+// appendMR adds the MR to the comma separated list of MRs.
+func appendMR(mrs, mr string) string {
+	if mrs == "" {
+		return mr
+	}
+	return mrs + "," + mr
+}
+
+// fixedRef is a tpdu.Counter that always provides the same reference, so the
+// remaining parts of a partially sent SMS share the reference of those
+// already sent.
+type fixedRef int
+
+func (r fixedRef) Count() int {
+	return int(r)
+}
+
+// recordingRef is a tpdu.Counter that records the reference provided by the
+// wrapped Counter, so it can be reused when sending the remaining parts.
+type recordingRef struct {
+	c   tpdu.Counter
+	ref int
+}
+
+func (r *recordingRef) Count() int {
+	r.ref = r.c.Count()
+	return r.ref
 }
@@ -0,0 +1,46 @@
+package modem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/warthog618/sms/encoding/tpdu"
+)
+
+func TestValidityPeriod(t *testing.T) {
+	now := time.Date(2026, 3, 14, 15, 9, 26, 535000000, time.UTC)
+	patterns := []struct {
+		name   string
+		ttl    time.Duration
+		expect []byte
+	}{
+		{"seconds", 30 * time.Second, []byte{0x62, 0x30, 0x41, 0x51, 0x90, 0x65, 0x00}},
+		{"two minutes", 2 * time.Minute, []byte{0x62, 0x30, 0x41, 0x51, 0x11, 0x62, 0x00}},
+		{"under five minutes", 4*time.Minute + 59*time.Second, []byte{0x62, 0x30, 0x41, 0x51, 0x41, 0x52, 0x00}},
+		{"day", 24 * time.Hour, []byte{0x62, 0x30, 0x51, 0x51, 0x90, 0x62, 0x00}},
+	}
+	for _, p := range patterns {
+		t.Run(p.name, func(t *testing.T) {
+			vp := validityPeriod(now.Add(p.ttl))
+			if vp.Format != tpdu.VpfAbsolute {
+				t.Fatalf("unexpected format: %v", vp.Format)
+			}
+			b, err := vp.MarshalBinary()
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if string(b) != string(p.expect) {
+				t.Errorf("expected % x, got % x", p.expect, b)
+			}
+			// rounded down, so never later than the expiry.
+			var ts tpdu.Timestamp
+			if err := ts.UnmarshalBinary(b); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			expiry := now.Add(p.ttl)
+			if ts.After(expiry) || expiry.Sub(ts.Time) >= time.Second {
+				t.Errorf("expected %v, got %v", expiry, ts.Time)
+			}
+		})
+	}
+}
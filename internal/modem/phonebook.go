@@ -0,0 +1,182 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warthog618/modem/gsm"
+)
+
+// ErrNotConnected indicates the modem is not connected, so cannot be queried.
+var ErrNotConnected = errors.New("modem not connected")
+
+// Contact is an entry in a modem phonebook.
+type Contact struct {
+	Index  int    `json:"index"`
+	Number string `json:"number"`
+	Name   string `json:"name"`
+}
+
+// Phonebook is the set of contacts in a phonebook storage.
+type Phonebook struct {
+	// Storage is the phonebook storage, such as "SM" for the SIM.
+	Storage string `json:"storage"`
+	// Used and Total are the number of entries used and available in the
+	// storage.
+	Used     int       `json:"used"`
+	Total    int       `json:"total"`
+	Contacts []Contact `json:"contacts"`
+}
+
+// storageName matches the names of phonebook storages, such as "SM" or "ME".
+var storageName = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// ListContacts reads the contacts from the phonebook storage, such as "SM"
+// for the SIM or "ME" for the modem itself, or from the currently selected
+// storage if empty.
+// The storage selection is restored afterwards.
+// Returns ErrNotConnected if the modem is not connected.
+func (m *GSMModem) ListContacts(ctx context.Context, storage string) (Phonebook, error) {
+	var pb Phonebook
+	if storage != "" && !storageName.MatchString(storage) {
+		return pb, errors.New("invalid phonebook storage: " + storage)
+	}
+	g := m.conn()
+	if g == nil {
+		return pb, ErrNotConnected
+	}
+	info, err := query(ctx, g, "+CPBS?")
+	if err != nil {
+		return pb, err
+	}
+	prev, _, _, err := parseCPBS(info)
+	if err != nil {
+		return pb, err
+	}
+	if storage != "" && storage != prev {
+		if err = selectPhonebook(ctx, g, storage); err != nil {
+			return pb, err
+		}
+		defer selectPhonebook(context.Background(), g, prev)
+		if info, err = query(ctx, g, "+CPBS?"); err != nil {
+			return pb, err
+		}
+	}
+	if pb.Storage, pb.Used, pb.Total, err = parseCPBS(info); err != nil {
+		return pb, err
+	}
+	pb.Contacts = []Contact{}
+	if pb.Used == 0 {
+		return pb, nil
+	}
+	info, err = query(ctx, g, "+CPBR=?")
+	if err != nil {
+		return pb, err
+	}
+	first, last, err := parseCPBRRange(info)
+	if err != nil {
+		return pb, err
+	}
+	// reading a full phonebook can take a while.
+	rctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	lines, err := g.Command(rctx, fmt.Sprintf("+CPBR=%d,%d", first, last))
+	if err != nil {
+		return pb, err
+	}
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "+CPBR:") {
+			continue
+		}
+		c, err := parseCPBR(l)
+		if err != nil {
+			return pb, err
+		}
+		pb.Contacts = append(pb.Contacts, c)
+	}
+	return pb, nil
+}
+
+// selectPhonebook selects the phonebook storage used by subsequent phonebook
+// commands.
+func selectPhonebook(ctx context.Context, g *gsm.GSM, storage string) error {
+	cctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, err := g.Command(cctx, `+CPBS="`+storage+`"`)
+	return err
+}
+
+// parseCPBS extracts the storage and its usage from a +CPBS response.
+// e.g. +CPBS: "SM",10,250
+func parseCPBS(info string) (storage string, used, total int, err error) {
+	fields := splitQuoted(strings.TrimPrefix(info, "+CPBS:"))
+	if len(fields) < 3 {
+		return "", 0, 0, errors.New("malformed +CPBS response: " + info)
+	}
+	if used, err = strconv.Atoi(fields[1]); err != nil {
+		return "", 0, 0, err
+	}
+	if total, err = strconv.Atoi(fields[2]); err != nil {
+		return "", 0, 0, err
+	}
+	return fields[0], used, total, nil
+}
+
+// parseCPBRRange extracts the range of indices from a +CPBR test response.
+// e.g. +CPBR: (1-250),40,18
+func parseCPBRRange(info string) (first, last int, err error) {
+	info = strings.TrimSpace(strings.TrimPrefix(info, "+CPBR:"))
+	end := strings.Index(info, ")")
+	if !strings.HasPrefix(info, "(") || end < 0 {
+		return 0, 0, errors.New("malformed +CPBR response: " + info)
+	}
+	bounds := strings.SplitN(info[1:end], "-", 2)
+	if first, err = strconv.Atoi(bounds[0]); err != nil {
+		return 0, 0, err
+	}
+	last = first
+	if len(bounds) == 2 {
+		last, err = strconv.Atoi(bounds[1])
+	}
+	return first, last, err
+}
+
+// parseCPBR extracts the contact from a +CPBR response.
+// e.g. +CPBR: 1,"+61412345678",145,"Bob"
+func parseCPBR(info string) (Contact, error) {
+	fields := splitQuoted(strings.TrimPrefix(info, "+CPBR:"))
+	if len(fields) < 4 {
+		return Contact{}, errors.New("malformed +CPBR response: " + info)
+	}
+	index, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Contact{}, err
+	}
+	return Contact{Index: index, Number: fields[1], Name: fields[3]}, nil
+}
+
+// splitQuoted splits a comma separated response into its fields, which are
+// trimmed of whitespace and quotes.
+// Commas within quoted fields, such as names, do not split the field.
+func splitQuoted(info string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted := false
+	for _, r := range info {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			fields = append(fields, strings.TrimSpace(field.String()))
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, strings.TrimSpace(field.String()))
+}
@@ -0,0 +1,61 @@
+package modem
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/warthog618/modem/serial"
+)
+
+// errPortBusy indicates the serial port is held by another process.
+var errPortBusy = errors.New("port busy")
+
+// port is a serial port to the modem, locked for the exclusive use of this
+// process.
+type port struct {
+	io.ReadWriteCloser
+	lock io.Closer
+}
+
+// Close closes the serial port and releases the lock.
+func (p *port) Close() error {
+	err := p.ReadWriteCloser.Close()
+	p.lock.Close()
+	return err
+}
+
+// openPort locks and opens the serial port.
+// The serial driver does not prevent several processes opening the same port,
+// in which case they would compete for the modem responses, so the port is
+// locked first.
+func openPort(name string, baudrate int) (*port, error) {
+	lock, err := lockPort(name)
+	if err != nil {
+		return nil, err
+	}
+	s, err := serial.New(name, baudrate)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return &port{ReadWriteCloser: s, lock: lock}, nil
+}
+
+// portError describes the failure to open the serial port, with a hint as to
+// how it may be resolved.
+func portError(name string, err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return "port not found - check the modem is plugged in and COMPORT is correct"
+	case errors.Is(err, os.ErrPermission):
+		return "permission denied - check the user has access to the port"
+	case errors.Is(err, errPortBusy):
+		if pids := portHolders(name); len(pids) > 0 {
+			return fmt.Sprintf("port held by another process (pid %v)", pids)
+		}
+		return "port held by another process"
+	}
+	return err.Error()
+}
@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package modem
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// lockPort takes an advisory lock on the serial port, so that other processes
+// using the same locking, such as other goatsms instances, do not open it.
+// Returns errPortBusy if the port is already locked.
+func lockPort(name string) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errPortBusy
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// portHolders returns the ids of the other processes that have the serial port
+// open.
+// Processes that cannot be inspected, such as those belonging to other users
+// when not running as root, are not reported.
+func portHolders(name string) []int {
+	target, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return nil
+	}
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	self := os.Getpid()
+	var pids []int
+	seen := map[int]bool{}
+	for _, fd := range fds {
+		if link, err := os.Readlink(fd); err != nil || link != target {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(filepath.Dir(fd))))
+		if err != nil || pid == self || seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		pids = append(pids, pid)
+	}
+	return pids
+}
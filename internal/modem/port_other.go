@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package modem
+
+import "io"
+
+// nopCloser is the lock for platforms where ports are not locked.
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// lockPort is a stub, as ports are only locked on Linux.
+func lockPort(name string) (io.Closer, error) {
+	return nopCloser{}, nil
+}
+
+// portHolders is a stub, as holders are only identified on Linux.
+func portHolders(name string) []int {
+	return nil
+}
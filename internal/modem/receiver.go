@@ -0,0 +1,443 @@
+package modem
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warthog618/goatsms/internal/db"
+	"github.com/warthog618/modem/gsm"
+	"github.com/warthog618/sms"
+	"github.com/warthog618/sms/encoding/tpdu"
+)
+
+// Inbox represents the destination of SMSs received by the modem.
+type Inbox interface {
+	InsertInboxMessage(sms db.InboundSMS) error
+}
+
+// WithInbox enables the reception of SMSs, which are passed to the inbox.
+func WithInbox(ib Inbox) Option {
+	return func(m *GSMModem) {
+		m.inbox = ib
+	}
+}
+
+// WithReassemblyTimeout specifies the time allowed for the remaining parts of
+// a received multi-part SMS to arrive, after the latest part, so parts that
+// never arrive do not hold the SMS in memory forever.
+// Once the time has passed the parts received are passed to the inbox,
+// marked incomplete, or, if discard is set, are discarded.
+func WithReassemblyTimeout(timeout time.Duration, discard bool) Option {
+	return func(m *GSMModem) {
+		m.reassemblyTimeout = timeout
+		m.discardIncomplete = discard
+	}
+}
+
+// WithStatusReports enables the reception of the delivery reports of SMSs
+// requesting them, which are passed to the SMSDispatcher.
+// The message references of the parts of such SMSs are recorded in the SMS,
+// so the reports can be matched to the SMS.
+func WithStatusReports(m *GSMModem) {
+	m.statusReports = true
+}
+
+// WithDeleteReceived specifies that received SMSs are deleted from the modem
+// storage once they have been collected, so the storage does not fill and
+// block further reception.
+// Parts of multi-part SMSs are held in memory until the SMS is complete, or
+// the reassembly timeout expires.
+func WithDeleteReceived(m *GSMModem) {
+	m.deleteReceived = true
+}
+
+// WithImportStored specifies that SMSs left in the modem storage, such as
+// those received while goatsms was not running, are imported into the inbox
+// and deleted from the storage when the modem connects, so the storage starts
+// clean and nothing is lost.
+// Both the SIM and modem storages are imported.
+// Stored outgoing SMSs are deleted without being sent.
+func WithImportStored(m *GSMModem) {
+	m.importStored = true
+}
+
+// storages are the SMS storages imported by importStored, the SIM and the
+// modem itself.
+var storages = []string{"SM", "ME"}
+
+// startReceiver configures the modem to indicate the arrival of new SMSs,
+// and of delivery reports, and starts the receiver to process them.
+func (m *GSMModem) startReceiver(ctx context.Context, modem *gsm.GSM, ss SMSDispatcher) error {
+	if m.inbox == nil && !m.statusReports {
+		return nil
+	}
+	if m.textMode {
+		log.Println("receiver: SMSs are not received in text mode:", m.deviceID)
+		return nil
+	}
+	var ind, cds <-chan []string
+	mt, ds := 0, 0
+	var err error
+	if m.inbox != nil {
+		// store received SMSs and indicate their arrival with +CMTI
+		if ind, err = modem.AddIndication("+CMTI:", 0); err != nil {
+			return err
+		}
+		mt = 1
+	}
+	if m.statusReports {
+		// pass delivery reports directly with +CDS, followed by the PDU
+		if cds, err = modem.AddIndication("+CDS:", 1); err != nil {
+			return err
+		}
+		ds = 1
+	}
+	cctx, cancel := context.WithTimeout(ctx, time.Second)
+	_, err = modem.Command(cctx, fmt.Sprintf("+CNMI=2,%d,0,%d,0", mt, ds))
+	cancel()
+	if err != nil {
+		return err
+	}
+	if m.inbox != nil && m.importStored {
+		for _, storage := range storages {
+			if err := m.importStorage(ctx, modem, storage); err != nil {
+				log.Println("receiver: import failed", m.deviceID, storage, err)
+			}
+		}
+	}
+	indexes := make(chan int, maxPendingReceipts)
+	go m.receiver(ctx, ss, ind, cds, indexes)
+	go m.reader(ctx, modem, indexes)
+	if m.inbox != nil {
+		m.checkStorage(ctx, modem)
+	}
+	return nil
+}
+
+// maxPendingReceipts bounds the number of arrived SMSs queued awaiting the
+// reader, so a burst of arrivals does not block the modem.
+const maxPendingReceipts = 256
+
+// receiver takes the indications of newly arrived SMSs, and of delivery
+// reports, from the modem.
+// The storage indexes of arrived SMSs are queued for the reader, rather than
+// read here, so the indications are always taken promptly and never block
+// the modem, which would stall concurrent commands, such as sends.
+// Delivery reports are passed to the SMSDispatcher.
+func (m *GSMModem) receiver(ctx context.Context, ss SMSDispatcher, ind, cds <-chan []string, indexes chan<- int) {
+	defer close(indexes)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case info, ok := <-cds:
+			if !ok {
+				return
+			}
+			if len(info) < 2 {
+				log.Println("receiver: malformed +CDS indication", m.deviceID)
+				continue
+			}
+			if err := m.report(ctx, ss, info[1]); err != nil {
+				log.Println("receiver: status report", m.deviceID, err)
+			}
+		case info, ok := <-ind:
+			if !ok {
+				// the indication chan is closed when the modem is closed.
+				return
+			}
+			i, err := parseCMTI(info[0])
+			if err != nil {
+				log.Println("receiver:", m.deviceID, err)
+				continue
+			}
+			select {
+			case indexes <- i:
+			default:
+				log.Println("receiver: too many pending SMSs, left in storage:", m.deviceID, i)
+			}
+		}
+	}
+}
+
+// reader reads the newly arrived SMSs queued by the receiver from the modem
+// storage and, once all the parts of an SMS have been collected, passes it
+// to the inbox.
+func (m *GSMModem) reader(ctx context.Context, modem *gsm.GSM, indexes <-chan int) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case i, ok := <-indexes:
+			if !ok {
+				return
+			}
+			if err := m.receive(ctx, modem, i); err != nil {
+				log.Println("receiver:", m.deviceID, i, err)
+				continue
+			}
+			if m.deleteReceived {
+				cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				_, err := modem.Command(cctx, "+CMGD="+strconv.Itoa(i))
+				cancel()
+				if err != nil {
+					log.Println("receiver: delete failed", m.deviceID, i, err)
+				}
+			}
+			m.checkStorage(ctx, modem)
+		}
+	}
+}
+
+// receive reads the SMS PDU from the indexed storage location.
+func (m *GSMModem) receive(ctx context.Context, modem *gsm.GSM, i int) error {
+	cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	info, err := modem.Command(cctx, "+CMGR="+strconv.Itoa(i))
+	cancel()
+	if err != nil {
+		return err
+	}
+	if len(info) < 2 {
+		return errors.New("malformed +CMGR response")
+	}
+	return m.collect(info[1])
+}
+
+// collect decodes a received PDU and adds it to the set of PDUs being
+// reassembled.
+// Completed SMSs are passed to the inbox.
+func (m *GSMModem) collect(hexPDU string) error {
+	b, err := hex.DecodeString(hexPDU)
+	if err != nil {
+		return err
+	}
+	// strip the SMSC address
+	if len(b) < 1 || len(b) < int(b[0])+1 {
+		return errors.New("malformed PDU")
+	}
+	t, err := sms.Unmarshal(b[int(b[0])+1:])
+	if err != nil {
+		return err
+	}
+	segments, err := m.collector.Collect(*t)
+	if err != nil || segments == nil {
+		return err
+	}
+	msg, err := sms.Decode(segments)
+	if err != nil {
+		return err
+	}
+	return m.inbox.InsertInboxMessage(db.InboundSMS{
+		Mobile:   t.OA.Number(),
+		Body:     string(msg),
+		Device:   m.deviceID,
+		Segments: len(segments),
+	})
+}
+
+// expired handles the parts of a multi-part SMS whose remaining parts did not
+// arrive within the reassembly timeout.
+// Parts are missing from the slice, so are nil, in place of those that did
+// not arrive.
+func (m *GSMModem) expired(segments []*tpdu.TPDU) {
+	var received []*tpdu.TPDU
+	for _, s := range segments {
+		if s != nil {
+			received = append(received, s)
+		}
+	}
+	if len(received) == 0 {
+		return
+	}
+	mobile := received[0].OA.Number()
+	if m.discardIncomplete || m.inbox == nil {
+		log.Println("receiver: discarding incomplete SMS:", m.deviceID, mobile, len(received), "of", len(segments), "parts")
+		return
+	}
+	// each part is decoded separately, as the parts are not contiguous.
+	var body strings.Builder
+	for _, s := range received {
+		msg, err := sms.Decode([]*tpdu.TPDU{s})
+		if err != nil {
+			log.Println("receiver: undecodable part of incomplete SMS:", m.deviceID, mobile, err)
+			continue
+		}
+		body.Write(msg)
+	}
+	log.Println("receiver: storing incomplete SMS:", m.deviceID, mobile, len(received), "of", len(segments), "parts")
+	err := m.inbox.InsertInboxMessage(db.InboundSMS{
+		Mobile:     mobile,
+		Body:       body.String(),
+		Device:     m.deviceID,
+		Segments:   len(received),
+		Incomplete: true,
+	})
+	if err != nil {
+		log.Println("receiver:", m.deviceID, err)
+	}
+}
+
+// report decodes a status report PDU and passes the outcome to the
+// SMSDispatcher.
+// Reports of SMSs the SMSC is still trying to deliver are ignored, as only
+// the final outcome is of interest.
+func (m *GSMModem) report(ctx context.Context, ss SMSDispatcher, hexPDU string) error {
+	b, err := hex.DecodeString(hexPDU)
+	if err != nil {
+		return err
+	}
+	// strip the SMSC address
+	if len(b) < 1 || len(b) < int(b[0])+1 {
+		return errors.New("malformed PDU")
+	}
+	t, err := sms.Unmarshal(b[int(b[0])+1:])
+	if err != nil {
+		return err
+	}
+	if t.SmsType() != tpdu.SmsStatusReport {
+		return errors.New("unexpected PDU type")
+	}
+	mr := strconv.Itoa(int(t.MR))
+	switch {
+	case t.ST < 0x20:
+		ss.Report(ctx, m.deviceID, mr, true, "")
+	case t.ST < 0x30:
+		// temporary error, SMSC still trying to deliver.
+	default:
+		ss.Report(ctx, m.deviceID, mr, false, fmt.Sprintf("delivery failed: status 0x%02x", t.ST))
+	}
+	return nil
+}
+
+// importStorage imports the received SMSs in the storage into the inbox, and
+// deletes them, and any stored outgoing SMSs, from the storage.
+// SMSs that cannot be decoded are left in the storage.
+// The storage used for reading and deleting SMSs is restored afterwards.
+func (m *GSMModem) importStorage(ctx context.Context, modem *gsm.GSM, storage string) error {
+	info, err := query(ctx, modem, "+CPMS?")
+	if err != nil {
+		return err
+	}
+	prev := splitQuoted(strings.TrimPrefix(info, "+CPMS:"))[0]
+	if prev != storage {
+		if _, err = query(ctx, modem, `+CPMS="`+storage+`"`); err != nil {
+			return err
+		}
+		defer query(context.Background(), modem, `+CPMS="`+prev+`"`)
+	}
+	// a full storage can take a while to list.
+	cctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	lines, err := modem.Command(cctx, "+CMGL=4")
+	cancel()
+	if err != nil {
+		return err
+	}
+	imported, discarded := 0, 0
+	for i := 0; i+1 < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "+CMGL:") {
+			continue
+		}
+		index, stat, err := parseCMGL(lines[i])
+		if err != nil {
+			log.Println("receiver:", m.deviceID, err)
+			continue
+		}
+		i++ // the PDU follows the header
+		switch stat {
+		case cmglReceivedUnread, cmglReceivedRead:
+			if err := m.collect(lines[i]); err != nil {
+				log.Println("receiver: import", m.deviceID, storage, index, err)
+				continue
+			}
+			imported++
+		default:
+			discarded++
+		}
+		cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err = modem.Command(cctx, "+CMGD="+strconv.Itoa(index))
+		cancel()
+		if err != nil {
+			log.Println("receiver: delete failed", m.deviceID, storage, index, err)
+		}
+	}
+	if imported > 0 || discarded > 0 {
+		log.Printf("receiver: %s imported %d and discarded %d stored SMSs from %s\n",
+			m.deviceID, imported, discarded, storage)
+	}
+	return nil
+}
+
+// The status of SMSs listed by +CMGL in PDU mode.
+const (
+	cmglReceivedUnread = 0
+	cmglReceivedRead   = 1
+)
+
+// parseCMGL extracts the storage index and status from a +CMGL header.
+// e.g. +CMGL: 3,1,,24
+func parseCMGL(info string) (index, stat int, err error) {
+	fields := strings.Split(strings.TrimPrefix(info, "+CMGL:"), ",")
+	if len(fields) < 2 {
+		return 0, 0, errors.New("malformed +CMGL response: " + info)
+	}
+	if index, err = strconv.Atoi(strings.TrimSpace(fields[0])); err != nil {
+		return 0, 0, err
+	}
+	stat, err = strconv.Atoi(strings.TrimSpace(fields[1]))
+	return index, stat, err
+}
+
+// checkStorage determines if the modem storage for received SMSs is full, in
+// which case further SMSs cannot be received.
+func (m *GSMModem) checkStorage(ctx context.Context, modem *gsm.GSM) {
+	cctx, cancel := context.WithTimeout(ctx, time.Second)
+	info, err := modem.Command(cctx, "+CPMS?")
+	cancel()
+	if err != nil || len(info) < 1 {
+		return
+	}
+	used, total, err := parseCPMS(info[0])
+	if err != nil {
+		log.Println("receiver:", m.deviceID, err)
+		return
+	}
+	full := used >= total
+	m.mu.Lock()
+	wasFull := m.status.SIMFull
+	m.status.SIMFull = full
+	m.mu.Unlock()
+	if full && !wasFull {
+		log.Printf("receiver: %s SIM storage full (%d/%d) - unable to receive SMSs\n", m.deviceID, used, total)
+	}
+}
+
+// parseCPMS extracts the number of used and total locations in the first
+// SMS storage reported by +CPMS?.
+// e.g. +CPMS: "SM",12,30,"SM",12,30,"SM",12,30
+func parseCPMS(info string) (used, total int, err error) {
+	fields := strings.Split(strings.TrimPrefix(info, "+CPMS:"), ",")
+	if len(fields) < 3 {
+		return 0, 0, errors.New("malformed +CPMS response: " + info)
+	}
+	if used, err = strconv.Atoi(strings.TrimSpace(fields[1])); err != nil {
+		return 0, 0, err
+	}
+	total, err = strconv.Atoi(strings.TrimSpace(fields[2]))
+	return used, total, err
+}
+
+// parseCMTI extracts the storage index from a +CMTI indication.
+// e.g. +CMTI: "SM",3
+func parseCMTI(info string) (int, error) {
+	fields := strings.Split(strings.TrimPrefix(info, "+CMTI:"), ",")
+	if len(fields) != 2 {
+		return 0, errors.New("malformed +CMTI indication: " + info)
+	}
+	return strconv.Atoi(strings.TrimSpace(fields[1]))
+}
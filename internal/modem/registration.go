@@ -0,0 +1,132 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warthog618/modem/at"
+	"github.com/warthog618/modem/gsm"
+)
+
+// registrationPollPeriod is the period between checks of the network
+// registration state of a connected modem.
+const registrationPollPeriod = 30 * time.Second
+
+// registration periodically checks the network registration state of the
+// modem.
+// While the modem is not registered it is detached from the SMSDispatcher, so
+// it is not passed SMSs that it cannot send.
+func (m *GSMModem) registration(ctx context.Context, modem *gsm.GSM, ss SMSDispatcher) {
+	poll := time.NewTimer(0) // for an immediate check
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-modem.Closed():
+			return
+		case <-poll.C:
+			if m.asleep() {
+				// deregistered by design, and woken before sending.
+				poll.Reset(registrationPollPeriod)
+				continue
+			}
+			registered, err := isRegistered(ctx, modem)
+			if err != nil {
+				log.Println("modem registration check failed:", m.deviceID, err)
+			} else {
+				m.setRegistered(registered, ss)
+			}
+			m.refreshNetwork(ctx, modem)
+			poll.Reset(registrationPollPeriod)
+		}
+	}
+}
+
+// setRegistered records a change in the network registration state of the
+// modem, attaching or detaching the modem from the SMSDispatcher accordingly.
+func (m *GSMModem) setRegistered(registered bool, ss SMSDispatcher) {
+	m.mu.Lock()
+	// the monitor detaches the modem when it disconnects, and a sleeping
+	// modem is deregistered by design.
+	if !m.status.Connected || m.status.Asleep || m.status.Registered == registered {
+		m.mu.Unlock()
+		return
+	}
+	m.status.Registered = registered
+	disabled := m.status.Disabled
+	m.mu.Unlock()
+	// attached and detached without holding the lock, as the SMSDispatcher
+	// may call back into the modem.
+	if registered {
+		log.Println("modem registered:", m.deviceID)
+		if !disabled {
+			ss.Attach(m.deviceID)
+		}
+	} else {
+		log.Println("modem deregistered:", m.deviceID)
+		ss.Detach(m.deviceID)
+	}
+}
+
+// networkErrors are the CMS errors that indicate the modem has lost the
+// network, rather than there being a problem with the SMS.
+var networkErrors = map[string]bool{
+	"38":  true, // network out of order
+	"331": true, // no network service
+	"332": true, // network timeout
+}
+
+// isNetworkError indicates if the error returned by a send is due to the
+// modem having lost the network.
+func isNetworkError(err error) bool {
+	cms, ok := err.(at.CMSError)
+	return ok && networkErrors[strings.TrimSpace(string(cms))]
+}
+
+// isRegistered returns true if the modem is registered with the network,
+// either circuit switched (+CREG) or packet switched (+CGREG), both of which
+// are capable of carrying SMSs.
+func isRegistered(ctx context.Context, modem *gsm.GSM) (bool, error) {
+	registered, err := queryRegistration(ctx, modem, "+CREG")
+	if err != nil || registered {
+		return registered, err
+	}
+	// not all modems support +CGREG, so treat an error as not registered.
+	registered, _ = queryRegistration(ctx, modem, "+CGREG")
+	return registered, nil
+}
+
+func queryRegistration(ctx context.Context, modem *gsm.GSM, cmd string) (bool, error) {
+	cctx, cancel := context.WithTimeout(ctx, time.Second)
+	info, err := modem.Command(cctx, cmd+"?")
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	for _, l := range info {
+		if strings.HasPrefix(l, cmd+":") {
+			return parseRegistration(l)
+		}
+	}
+	return false, errors.New("missing " + cmd + " response")
+}
+
+// parseRegistration determines if a +CREG or +CGREG response indicates the
+// modem is registered, either on the home network or roaming.
+// e.g. +CREG: 0,1
+func parseRegistration(info string) (bool, error) {
+	fields := strings.Split(info[strings.Index(info, ":")+1:], ",")
+	if len(fields) < 2 {
+		return false, errors.New("malformed registration response: " + info)
+	}
+	stat, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return false, err
+	}
+	return stat == 1 || stat == 5, nil
+}
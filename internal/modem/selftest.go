@@ -0,0 +1,128 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warthog618/modem/gsm"
+)
+
+// WithMinSignal specifies the minimum signal strength, as the RSSI reported
+// by +CSQ (0-31), required for the modem to pass its self-test and be used
+// to send SMSs.
+func WithMinSignal(rssi int) Option {
+	return func(m *GSMModem) {
+		m.minSignal = rssi
+	}
+}
+
+// retryClass indicates how soon a failed connection should be retried.
+type retryClass int
+
+const (
+	// retryDefault retries with the usual backoff.
+	retryDefault retryClass = iota
+	// retrySoon retries quickly, as the condition is expected to clear
+	// shortly, such as while the modem registers with the network.
+	retrySoon
+	// retryLater retries slowly, as the condition requires intervention,
+	// such as inserting a SIM.
+	retryLater
+)
+
+// checkError is a self-test failure.
+type checkError struct {
+	msg   string
+	retry retryClass
+}
+
+func (e *checkError) Error() string {
+	return e.msg
+}
+
+// retryClassOf returns the class of retry appropriate to the error.
+func retryClassOf(err error) retryClass {
+	var ce *checkError
+	if errors.As(err, &ce) {
+		return ce.retry
+	}
+	return retryDefault
+}
+
+// selfTest checks that a newly connected modem is fit to send SMSs.
+// The returned error identifies the first check that failed, and how soon the
+// connection should be retried.
+func (m *GSMModem) selfTest(ctx context.Context, modem *gsm.GSM) error {
+	info, err := query(ctx, modem, "+CPIN?")
+	if err != nil {
+		// typically the SIM is not present.
+		return &checkError{fmt.Sprintf("SIM check failed: %v", err), retryLater}
+	}
+	if !strings.Contains(info, "READY") {
+		return &checkError{fmt.Sprintf("SIM not ready: %s", info), retryLater}
+	}
+	registered, err := isRegistered(ctx, modem)
+	if err != nil {
+		return fmt.Errorf("registration check failed: %v", err)
+	}
+	if !registered {
+		return &checkError{"not registered with network", retrySoon}
+	}
+	if m.minSignal > 0 {
+		info, err = query(ctx, modem, "+CSQ")
+		if err != nil {
+			return fmt.Errorf("signal check failed: %v", err)
+		}
+		rssi, err := parseCSQ(info)
+		if err != nil {
+			return fmt.Errorf("signal check failed: %v", err)
+		}
+		// 99 indicates the signal strength is unknown.
+		if rssi == 99 || rssi < m.minSignal {
+			return &checkError{fmt.Sprintf("signal too weak: rssi %d, require %d", rssi, m.minSignal), retrySoon}
+		}
+	}
+	info, err = query(ctx, modem, "+CSCA?")
+	if err != nil {
+		return fmt.Errorf("SMSC check failed: %v", err)
+	}
+	if !hasSMSC(info) {
+		return &checkError{fmt.Sprintf("SMSC not configured: %s", info), retryLater}
+	}
+	return nil
+}
+
+// query issues the command and returns the first line of the response.
+func query(ctx context.Context, modem *gsm.GSM, cmd string) (string, error) {
+	cctx, cancel := context.WithTimeout(ctx, time.Second)
+	info, err := modem.Command(cctx, cmd)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+	if len(info) < 1 {
+		return "", errors.New("missing " + cmd + " response")
+	}
+	return info[0], nil
+}
+
+// parseCSQ extracts the RSSI from a +CSQ response.
+// e.g. +CSQ: 18,99
+func parseCSQ(info string) (int, error) {
+	fields := strings.Split(strings.TrimPrefix(info, "+CSQ:"), ",")
+	if len(fields) != 2 {
+		return 0, errors.New("malformed +CSQ response: " + info)
+	}
+	return strconv.Atoi(strings.TrimSpace(fields[0]))
+}
+
+// hasSMSC determines if a +CSCA response contains an SMSC address.
+// e.g. +CSCA: "+61418706700",145
+func hasSMSC(info string) bool {
+	fields := strings.Split(strings.TrimPrefix(info, "+CSCA:"), ",")
+	return len(strings.Trim(strings.TrimSpace(fields[0]), `"`)) > 0
+}
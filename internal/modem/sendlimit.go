@@ -0,0 +1,51 @@
+package modem
+
+import "context"
+
+// SendLimit bounds the number of PDUs being sent concurrently across the
+// modems sharing it, such as to comply with a carrier agreement limiting
+// simultaneous submissions.
+type SendLimit struct {
+	sem chan struct{}
+}
+
+// NewSendLimit creates a SendLimit allowing up to n concurrent sends.
+// Returns nil, which does not limit sends, if n is not positive.
+func NewSendLimit(n int) *SendLimit {
+	if n <= 0 {
+		return nil
+	}
+	return &SendLimit{sem: make(chan struct{}, n)}
+}
+
+// WithSendLimit specifies the limit shared with other modems on the number of
+// PDUs being sent concurrently.
+// Each PDU of a multi-part SMS is sent separately, so the parts of SMSs sent
+// by different modems may be interleaved.
+func WithSendLimit(l *SendLimit) Option {
+	return func(m *GSMModem) {
+		m.sendLimit = l
+	}
+}
+
+// acquire waits for a send to be allowed.
+// A nil SendLimit does not limit sends, so is acquired immediately.
+// Returns false if the context is done first.
+func (l *SendLimit) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release allows another send.
+func (l *SendLimit) release() {
+	if l != nil {
+		<-l.sem
+	}
+}
@@ -0,0 +1,138 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrDuplicateDevice indicates a modem with the device ID is already in the
+// Set.
+var ErrDuplicateDevice = errors.New("duplicate device")
+
+// ErrUnknownDevice indicates there is no modem with the device ID in the Set.
+var ErrUnknownDevice = errors.New("unknown device")
+
+// Set is the collection of modems in use, to which modems may be added, or
+// from which they may be removed, while running, such as when USB modems are
+// plugged in or unplugged.
+type Set struct {
+	// opts are the options applied to modems created by Add.
+	opts []Option
+
+	mu     sync.Mutex
+	modems []*GSMModem
+	// cancels stops the connection of each connected modem.
+	cancels map[*GSMModem]context.CancelFunc
+	// ctx and ss are those passed to Connect, or nil if not yet connected.
+	ctx context.Context
+	ss  SMSDispatcher
+}
+
+// NewSet creates a Set containing the modems.
+// The options are applied to modems subsequently created by Add.
+func NewSet(modems []*GSMModem, opts ...Option) *Set {
+	return &Set{
+		opts:    opts,
+		modems:  append([]*GSMModem(nil), modems...),
+		cancels: make(map[*GSMModem]context.CancelFunc),
+	}
+}
+
+// Connect connects the modems in the Set, and any added later, to the
+// SMSDispatcher.
+// The connections remain until the context is done or the modem is removed.
+func (s *Set) Connect(ctx context.Context, ss SMSDispatcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx, s.ss = ctx, ss
+	for _, m := range s.modems {
+		s.connect(m)
+	}
+}
+
+// connect connects a modem with its own context, so it may be removed
+// independently of the others.
+// The caller must hold the lock.
+func (s *Set) connect(m *GSMModem) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.cancels[m] = cancel
+	m.Connect(ctx, s.ss)
+}
+
+// List returns the modems currently in the Set.
+func (s *Set) List() []*GSMModem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*GSMModem(nil), s.modems...)
+}
+
+// Lookup returns the modem with the device ID, or nil if there is none.
+func (s *Set) Lookup(deviceID string) *GSMModem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.modems {
+		if m.deviceID == deviceID {
+			return m
+		}
+	}
+	return nil
+}
+
+// Add creates a modem on the port, with the options of the Set, and adds it
+// to the Set.
+// If the Set is connected then the modem is connected and, once it passes its
+// self-test, starts sending SMSs.
+// Returns ErrDuplicateDevice if the device ID is already in use.
+func (s *Set) Add(comPort string, baudrate int, deviceID string) (*GSMModem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.modems {
+		if m.deviceID == deviceID {
+			return nil, ErrDuplicateDevice
+		}
+	}
+	m := New(comPort, baudrate, deviceID, s.opts...)
+	s.modems = append(s.modems, m)
+	if s.ss != nil {
+		s.connect(m)
+	}
+	return m, nil
+}
+
+// Remove removes the modem with the device ID from the Set.
+// The modem stops accepting SMSs, and any waiting to be sent by it are
+// returned to the dispatcher for other modems to send.
+// Remove waits for any send in progress to complete, and the port to be
+// closed, or for the context to be done.
+// Modems sharing the port, through other SIM slots, no longer yield to the
+// removed modem.
+// Returns ErrUnknownDevice if there is no modem with the device ID.
+func (s *Set) Remove(ctx context.Context, deviceID string) error {
+	s.mu.Lock()
+	var m *GSMModem
+	for i, mm := range s.modems {
+		if mm.deviceID == deviceID {
+			m = mm
+			s.modems = append(s.modems[:i:i], s.modems[i+1:]...)
+			break
+		}
+	}
+	cancel, connected := s.cancels[m]
+	delete(s.cancels, m)
+	s.mu.Unlock()
+	if m == nil {
+		return ErrUnknownDevice
+	}
+	m.port.unshare()
+	if !connected {
+		return nil
+	}
+	cancel()
+	select {
+	case <-m.Stopped():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,44 @@
+package modem
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRemoveSharedPort(t *testing.T) {
+	port := "/dev/goatsms-test-simslot"
+	m1 := New(port, 115200, "slot1", WithSIMSlot("+QDSIM=0", time.Minute))
+	m2 := New(port, 115200, "slot2", WithSIMSlot("+QDSIM=1", time.Minute))
+	if !m1.port.shared() || m1.port != m2.port {
+		t.Fatal("expected the slots to share the port")
+	}
+	// hold the port, so both modems wait to acquire it.
+	m1.port.sem <- struct{}{}
+	defer func() { <-m1.port.sem }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewSet([]*GSMModem{m1, m2})
+	s.Connect(ctx, nil)
+
+	rctx, rcancel := context.WithTimeout(ctx, time.Second)
+	defer rcancel()
+	if err := s.Remove(rctx, "slot2"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if m1.port.shared() {
+		t.Error("expected the port to no longer be shared")
+	}
+	if err := s.Remove(rctx, "slot1"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	sharedPortsMu.Lock()
+	_, ok := sharedPorts[port]
+	sharedPortsMu.Unlock()
+	if ok {
+		t.Error("expected the port to be released")
+	}
+	if err := s.Remove(rctx, "slot1"); err != ErrUnknownDevice {
+		t.Errorf("expected %v, got %v", ErrUnknownDevice, err)
+	}
+}
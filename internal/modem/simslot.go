@@ -0,0 +1,136 @@
+package modem
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/warthog618/modem/gsm"
+)
+
+// WithSIMSlot specifies the command that selects the SIM slot used by the
+// device, such as "+QDSIM=1" for the second SIM of a Quectel modem, so that
+// one physical dual-SIM modem may be configured as several devices, each
+// with its own SIM.
+// The command is issued each time the modem connects.
+// As only one SIM may be active at a time, devices sharing a port take turns
+// to use it, each holding the port for the slice before yielding to the
+// others.
+// A device that does not share its port holds it indefinitely.
+func WithSIMSlot(selectCmd string, slice time.Duration) Option {
+	return func(m *GSMModem) {
+		m.simSelect = selectCmd
+		m.simSlice = slice
+	}
+}
+
+// sharedPort arbitrates between the devices using different SIM slots of the
+// same modem.
+type sharedPort struct {
+	name string
+	// users is the number of devices sharing the port.
+	users int
+	// sem is held by the device currently using the port.
+	sem chan struct{}
+}
+
+var (
+	sharedPortsMu sync.Mutex
+	sharedPorts   = make(map[string]*sharedPort)
+)
+
+// sharePort registers a device as a user of the port.
+func sharePort(name string) *sharedPort {
+	sharedPortsMu.Lock()
+	defer sharedPortsMu.Unlock()
+	p, ok := sharedPorts[name]
+	if !ok {
+		p = &sharedPort{name: name, sem: make(chan struct{}, 1)}
+		sharedPorts[name] = p
+	}
+	p.users++
+	return p
+}
+
+// unshare deregisters a device as a user of the port, such as when it is
+// removed, so the remaining devices no longer yield to it.
+// A nil sharedPort is not shared, so is ignored.
+func (p *sharedPort) unshare() {
+	if p == nil {
+		return
+	}
+	sharedPortsMu.Lock()
+	defer sharedPortsMu.Unlock()
+	p.users--
+	if p.users == 0 {
+		delete(sharedPorts, p.name)
+	}
+}
+
+// acquire waits for the exclusive use of the port.
+// A nil sharedPort is not shared, so is acquired immediately.
+// Returns false if the context is done first.
+func (p *sharedPort) acquire(ctx context.Context) bool {
+	if p == nil {
+		return true
+	}
+	select {
+	case p.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release yields the port to the other devices.
+func (p *sharedPort) release() {
+	if p != nil {
+		<-p.sem
+	}
+}
+
+// shared indicates the port is used by several devices, so must be
+// time-multiplexed.
+func (p *sharedPort) shared() bool {
+	if p == nil {
+		return false
+	}
+	sharedPortsMu.Lock()
+	defer sharedPortsMu.Unlock()
+	return p.users > 1
+}
+
+// simSettle is the maximum time to wait for a newly selected SIM to become
+// ready and register with the network.
+const simSettle = 60 * time.Second
+
+// selectSIM selects the SIM slot, if configured, and waits for the SIM to be
+// ready and registered, so the self-test is not failed while the modem
+// switches SIMs.
+func (m *GSMModem) selectSIM(ctx context.Context, modem *gsm.GSM) error {
+	if m.simSelect == "" {
+		return nil
+	}
+	cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	_, err := modem.Command(cctx, m.simSelect)
+	cancel()
+	if err != nil {
+		return err
+	}
+	sctx, cancel := context.WithTimeout(ctx, simSettle)
+	defer cancel()
+	for {
+		if info, err := query(sctx, modem, "+CPIN?"); err == nil && strings.Contains(info, "READY") {
+			if registered, err := isRegistered(sctx, modem); err == nil && registered {
+				return nil
+			}
+		}
+		select {
+		case <-sctx.Done():
+			// leave the self-test to report the cause.
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
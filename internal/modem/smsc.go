@@ -0,0 +1,64 @@
+package modem
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/warthog618/modem/at"
+	"github.com/warthog618/modem/gsm"
+	"github.com/warthog618/sms/encoding/pdumode"
+	"github.com/warthog618/sms/encoding/tpdu"
+)
+
+// WithAltSMSCs specifies the SMSCs to try, in order, when sending via the
+// default SMSC of the SIM fails due to an SMSC or network problem.
+func WithAltSMSCs(smscs []string) Option {
+	return func(m *GSMModem) {
+		m.altSMSCs = append(m.altSMSCs, smscs...)
+	}
+}
+
+// smscErrors are the CMS errors that indicate a problem with the SMSC, or the
+// network path to it, rather than with the SMS itself, and so may succeed via
+// another SMSC.
+var smscErrors = map[string]bool{
+	"21":  true, // short message transfer rejected
+	"38":  true, // network out of order
+	"41":  true, // temporary failure
+	"42":  true, // congestion
+	"47":  true, // resources unavailable
+	"330": true, // SMSC address unknown
+	"332": true, // network timeout
+}
+
+// isSMSCError indicates if the error returned by a send is due to a problem
+// with the SMSC.
+func isSMSCError(err error) bool {
+	cms, ok := err.(at.CMSError)
+	return ok && smscErrors[strings.TrimSpace(string(cms))]
+}
+
+// sendViaSMSC sends the TPDU via the given SMSC, rather than the default
+// SMSC of the SIM.
+// Returns the message reference assigned by the SMSC.
+func sendViaSMSC(ctx context.Context, g *gsm.GSM, smsc string, tp []byte) (string, error) {
+	pdu := pdumode.PDU{
+		SMSC: pdumode.SMSCAddress{Address: tpdu.NewAddress(tpdu.FromNumber(smsc))},
+		TPDU: tp,
+	}
+	s, err := pdu.MarshalHexString()
+	if err != nil {
+		return "", err
+	}
+	info, err := g.SMSCommand(ctx, fmt.Sprintf("+CMGS=%d", len(tp)), s)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range info {
+		if strings.HasPrefix(l, "+CMGS:") {
+			return strings.TrimSpace(strings.TrimPrefix(l, "+CMGS:")), nil
+		}
+	}
+	return "", gsm.ErrMalformedResponse
+}
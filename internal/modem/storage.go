@@ -0,0 +1,78 @@
+package modem
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warthog618/modem/at"
+	"github.com/warthog618/modem/gsm"
+)
+
+// isMemoryFull indicates if the error returned by a send is due to the SMS
+// storage of the modem being full, which blocks sending on modems that store
+// the SMSs they send.
+func isMemoryFull(err error) bool {
+	cms, ok := err.(at.CMSError)
+	return ok && strings.TrimSpace(string(cms)) == "322"
+}
+
+// The status of stored outgoing SMSs listed by +CMGL, in PDU and text mode.
+const (
+	cmglStoredUnsent = 2
+	cmglStoredSent   = 3
+)
+
+// freeStorage deletes the stored outgoing SMSs, sent or not, from the modem
+// storage, so the storage no longer blocks sending.
+// Received SMSs are left for the receiver.
+// Returns the number of SMSs deleted.
+func (m *GSMModem) freeStorage(ctx context.Context, modem *gsm.GSM) int {
+	list := "+CMGL=4"
+	if m.textMode {
+		list = `+CMGL="ALL"`
+	}
+	// a full storage can take a while to list.
+	cctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	lines, err := modem.Command(cctx, list)
+	cancel()
+	if err != nil {
+		log.Println("modem storage cleanup failed:", m.deviceID, err)
+		return 0
+	}
+	deleted := 0
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "+CMGL:") {
+			continue
+		}
+		fields := strings.Split(strings.TrimPrefix(l, "+CMGL:"), ",")
+		if len(fields) < 2 {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			continue
+		}
+		switch strings.Trim(strings.TrimSpace(fields[1]), `"`) {
+		case strconv.Itoa(cmglStoredUnsent), strconv.Itoa(cmglStoredSent), "STO UNSENT", "STO SENT":
+		default:
+			continue
+		}
+		cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err = modem.Command(cctx, "+CMGD="+strconv.Itoa(index))
+		cancel()
+		if err != nil {
+			log.Println("modem storage cleanup delete failed:", m.deviceID, index, err)
+			continue
+		}
+		deleted++
+	}
+	log.Printf("modem %s storage full - deleted %d stored outgoing SMSs\n", m.deviceID, deleted)
+	m.mu.Lock()
+	m.status.StorageCleanups++
+	m.mu.Unlock()
+	m.checkStorage(ctx, modem)
+	return deleted
+}
@@ -0,0 +1,71 @@
+package modem
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/warthog618/goatsms/internal/db"
+	"github.com/warthog618/modem/gsm"
+)
+
+// WithTextMode specifies that the modem is driven in text mode, rather than
+// PDU mode, for simple deployments and for debugging modems whose PDU mode
+// misbehaves.
+// Only single part SMSs of printable ASCII can be sent in text mode, and
+// SMSs are neither received nor have their delivery reported.
+func WithTextMode(m *GSMModem) {
+	m.textMode = true
+}
+
+// maxTextLength is the maximum length of an SMS sent in text mode, as
+// concatenation requires PDU mode.
+const maxTextLength = 160
+
+// textModeError indicates an SMS cannot be sent in text mode, so would fail
+// however often it is retried.
+type textModeError string
+
+func (e textModeError) Error() string {
+	return string(e)
+}
+
+// checkText determines if the SMS can be sent in text mode.
+func checkText(msg db.SMS) error {
+	if msg.Data {
+		return textModeError("data SMSs cannot be sent in text mode")
+	}
+	if len(msg.Body) > maxTextLength {
+		return textModeError(fmt.Sprintf("SMS too long for text mode: %d characters, limit %d", len(msg.Body), maxTextLength))
+	}
+	for _, r := range msg.Body {
+		if (r < ' ' || r > '~') && r != '\n' && r != '\r' {
+			return textModeError(fmt.Sprintf("character %q cannot be sent in text mode", r))
+		}
+	}
+	return nil
+}
+
+// sendText sends the SMS in text mode.
+// Returns the number of segments sent, which is always 1.
+func (m *GSMModem) sendText(ctx context.Context, g *gsm.GSM, msg *db.SMS) (int, error) {
+	if err := checkText(*msg); err != nil {
+		return 0, err
+	}
+	// delivery reports are not received in text mode, so there are no
+	// references to match.
+	msg.MRs = ""
+	if !m.sendLimit.acquire(ctx) {
+		return 0, ctx.Err()
+	}
+	tctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	mr, err := g.SendSMS(tctx, msg.Mobile, msg.Body)
+	cancel()
+	m.sendLimit.release()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("SMS: %v\n", mr)
+	return 1, nil
+}
@@ -0,0 +1,43 @@
+package sender
+
+import (
+	"time"
+
+	store "github.com/warthog618/goatsms/internal/db"
+	"github.com/warthog618/goatsms/internal/logger"
+)
+
+// expireTTL errors the SMSs awaiting dispatch whose ttl has passed, so the
+// client is notified promptly, rather than the SMSs being held until a device
+// is available to find they have expired.
+// Returns the time the next of the remaining SMSs expires, or the zero time if
+// none do.
+func (s *Sender) expireTTL(db *store.DB, now time.Time) time.Time {
+	var expired []store.SMS
+	var next time.Time
+	s.mu.Lock()
+	remaining := s.queue[:0]
+	for _, sms := range s.queue {
+		at := sms.ExpiryTime()
+		if at.IsZero() || now.Before(at) {
+			if !at.IsZero() && (next.IsZero() || at.Before(next)) {
+				next = at
+			}
+			remaining = append(remaining, sms)
+			continue
+		}
+		expired = append(expired, sms)
+	}
+	s.queue = remaining
+	s.mu.Unlock()
+	for _, sms := range expired {
+		logger.Debug("sender erroring expired sms", "uuid", sms.UUID)
+		sms.Status = store.SMSErrored
+		sms.ErrorReason = store.ExpiredReason
+		db.UpdateMessageStatus(sms)
+		s.notify(sms)
+		s.count(sms)
+		delete(s.pool, sms.UUID)
+	}
+	return next
+}
@@ -0,0 +1,79 @@
+package sender
+
+import (
+	"time"
+
+	store "github.com/warthog618/goatsms/internal/db"
+	"github.com/warthog618/goatsms/internal/logger"
+)
+
+// WithOutageGrace specifies that, once no device has been available for the
+// grace period, the SMSs awaiting dispatch are errored, so clients learn of
+// the outage, rather than being held pending until a device is available.
+// SMSs scheduled to be sent later are held regardless.
+// By default SMSs are held pending for the duration of an outage.
+func WithOutageGrace(grace time.Duration) Option {
+	return func(s *Sender) {
+		s.outageGrace = grace
+	}
+}
+
+// updateOutage records the start and end of periods during which no device
+// is available.
+// Must be called with the mutex held.
+func (s *Sender) updateOutage(now time.Time) {
+	for _, d := range s.devices {
+		if d.online {
+			if !s.outageSince.IsZero() {
+				logger.Info("sender devices available", "outage", now.Sub(s.outageSince).String())
+				s.outageSince = time.Time{}
+			}
+			return
+		}
+	}
+	if s.outageSince.IsZero() {
+		logger.Warn("sender has no devices available, holding sms pending")
+		s.outageSince = now
+	}
+}
+
+// outageExpiry returns the time the grace period of the current outage
+// expires, or the zero time if there is no outage or no grace period.
+func (s *Sender) outageExpiry() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.outageGrace <= 0 || s.outageSince.IsZero() {
+		return time.Time{}
+	}
+	return s.outageSince.Add(s.outageGrace)
+}
+
+// expireOutage errors the SMSs that are due and awaiting dispatch once the
+// grace period of the current outage has expired.
+func (s *Sender) expireOutage(db *store.DB, now time.Time) {
+	at := s.outageExpiry()
+	if at.IsZero() || now.Before(at) {
+		return
+	}
+	var expired []store.SMS
+	s.mu.Lock()
+	remaining := s.queue[:0]
+	for _, sms := range s.queue {
+		if s.dueTime(sms, now).After(now) {
+			remaining = append(remaining, sms)
+			continue
+		}
+		expired = append(expired, sms)
+	}
+	s.queue = remaining
+	s.mu.Unlock()
+	for _, sms := range expired {
+		logger.Debug("sender erroring sms as no device available", "uuid", sms.UUID)
+		sms.Status = store.SMSErrored
+		sms.ErrorReason = "no devices available"
+		db.UpdateMessageStatus(sms)
+		s.notify(sms)
+		s.count(sms)
+		delete(s.pool, sms.UUID)
+	}
+}
@@ -2,32 +2,377 @@ package sender
 
 import (
 	"context"
+	"database/sql"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	store "github.com/warthog618/goatsms/internal/db"
+	"github.com/warthog618/goatsms/internal/logger"
 )
 
 // Sender represents a dispatcher responsible for pulling pending SMSs from
 // the database and farming them out to the modems that physically send them.
 type Sender struct {
-	add      chan store.SMS
-	req      chan store.SMS
-	rsp      chan store.SMS
-	pool     map[string]bool
+	// counts is first to ensure 64-bit alignment for atomic access on 32-bit
+	// platforms.
+	counts counters
+	// backlog is set, atomically, while there are more SMSs pending than fit
+	// in the pool.
+	backlog uint32
+	// paused is set, atomically, while sending is paused.
+	paused uint32
+	add    chan store.SMS
+	rsp    chan store.SMS
+	// pool maps the UUIDs of the SMSs in the pool to their batch ID.
+	pool map[string]string
+	// poolSize is the maximum number of SMSs passed to the devices and not
+	// yet returned.
 	poolSize int
 	poolLow  int
+	// fetchBatch is the number of pending SMSs read from the database at a
+	// time, and the maximum number held in the pool.
+	fetchBatch int
+	// routes maps destination prefixes to devices, longest prefix first.
+	routes []Route
+	// prices maps destination prefixes to the price per segment, longest
+	// prefix first.
+	prices []Price
+	// kick signals Run that the set of available devices has changed.
+	kick chan struct{}
+	// refill signals Run to refill the pool from the database.
+	refill chan struct{}
+	// canceled contains the UUIDs of SMSs from canceled batches that were being
+	// sent when the batch was canceled, and are not to be retried.
+	canceled map[string]bool
+	// excl passes functions to Run to be executed while the Sender is paused.
+	excl chan exclusive
+	// lead is the time ahead of their scheduled send time that SMSs are
+	// pulled into the pool.
+	lead time.Duration
+	// nextScheduled is the earliest send time of the scheduled SMSs not yet
+	// pulled into the pool.
+	nextScheduled time.Time
+	// strict indicates SMSs to the same destination are sent one at a time,
+	// in order.
+	strict bool
+	// jitter is the fraction of the poll period by which each poll is randomly
+	// advanced or delayed.
+	jitter float64
+	rnd    *rand.Rand
+	// lastFill is the time the pool was last filled from the database.
+	lastFill time.Time
+	// hook is called when an SMS returned by a device has changed status.
+	hook func(store.SMS)
+	// maxInFlight is the maximum number of SMSs passed to a device and not yet
+	// returned, or 0 for no limit.
+	maxInFlight int
+	// window, if set, is the time of day SMSs of the windowClasses may be
+	// sent, or of all SMSs if windowClasses is nil.
+	window        *Window
+	windowClasses map[string]bool
+	// weights maps device IDs to their share of the SMSs not matching a
+	// route, if SMSs are to be balanced across devices.
+	weights map[string]int
+	// fireAndForget indicates all SMSs are passed to a device before being
+	// recorded in the database.
+	fireAndForget bool
+	// reportTimeout, if set, indicates SMSs are only considered sent once
+	// delivered, and is the time to wait for their delivery reports.
+	reportTimeout time.Duration
+	// reports passes delivery reports from the devices to Run.
+	reports chan deliveryReport
+	// outageGrace, if set, is the time SMSs are held pending while no device
+	// is available, before they are errored.
+	outageGrace time.Duration
+
+	mu sync.Mutex
+	// queue contains the SMSs in the pool that are awaiting dispatch to a device.
+	queue []store.SMS
+	// devices contains the devices that have attached to the Sender.
+	devices map[string]*device
+	// inflight contains the destinations with an SMS passed to a device, when
+	// ordering is strict.
+	inflight map[string]bool
+	// assigned maps the UUIDs of SMSs passed to a device to the device ID.
+	assigned map[string]string
+	// wait accumulates the time SMSs waited to be passed to a device.
+	wait waitStats
+	// outageSince is the time since which no device has been available, or
+	// zero if a device is available.
+	outageSince time.Time
+}
+
+// waitStats accumulates the time SMSs waited to be passed to a device, from
+// when they were added, or became due if scheduled, until dispatch.
+type waitStats struct {
+	count uint64
+	total time.Duration
+	last  time.Duration
+	max   time.Duration
+}
+
+// exclusive is a function to be executed by Run, and the channel to return
+// its result.
+type exclusive struct {
+	f   func() error
+	rsp chan error
+}
+
+// deliveryReport is the outcome of the delivery of a part of an SMS, as
+// reported by the network.
+type deliveryReport struct {
+	deviceID  string
+	mr        string
+	delivered bool
+	reason    string
+}
+
+// device is the Sender's view of a device sending SMSs.
+type device struct {
+	req    chan store.SMS
+	online bool
+	// depth is the number of SMSs passed to the device and not yet returned.
+	depth int
+	// weight is the device's share of SMSs, and current its progress towards
+	// its next turn, when SMSs are balanced across devices.
+	weight  int
+	current int
+}
+
+// counters are the counts of SMSs processed, updated atomically by Run.
+type counters struct {
+	added    uint64
+	sent     uint64
+	errored  uint64
+	canceled uint64
+	retried  uint64
+}
+
+// Stats contains the counts of SMSs processed since the Sender started.
+type Stats struct {
+	Added    uint64 `json:"added"`
+	Sent     uint64 `json:"sent"`
+	Errored  uint64 `json:"errored"`
+	Canceled uint64 `json:"canceled"`
+	// Retried is the number of failed attempts that will be retried.
+	Retried uint64 `json:"retried"`
+	// InFlight is the number of SMSs passed to each device and not yet
+	// returned, keyed by device ID.
+	InFlight map[string]int `json:"in_flight"`
+	// QueueWait is the time SMSs wait to be passed to a device.
+	QueueWait QueueWait `json:"queue_wait"`
+}
+
+// QueueWait describes the time, in seconds, SMSs wait to be passed to a
+// device, from when they are added, or become due if scheduled.
+// Only the first attempt to send each SMS is included, not retries.
+type QueueWait struct {
+	// Current is the time the longest waiting SMS in the pool has been
+	// waiting, or 0 if none are waiting.
+	Current float64 `json:"current"`
+	// Last is the wait of the most recently dispatched SMS.
+	Last float64 `json:"last"`
+	// Average and Max are the average and maximum waits of the SMSs
+	// dispatched since the Sender started, and Count the number of them.
+	Average float64 `json:"average"`
+	Max     float64 `json:"max"`
+	Count   uint64  `json:"count"`
+}
+
+// Route directs SMSs with destinations matching the Prefix to the Device.
+type Route struct {
+	Prefix string
+	Device string
+}
+
+// Price is the price per segment of SMSs with destinations matching the
+// Prefix.
+// An empty Prefix matches all destinations.
+type Price struct {
+	Prefix     string
+	PerSegment float64
+}
+
+// Option modifies the configuration of a Sender.
+type Option func(*Sender)
+
+// WithRoutes specifies the routes used to direct SMSs to particular devices.
+// SMSs matching a route are only sent by the corresponding device, and are held
+// while that device is unavailable.
+// SMSs not matching any route may be sent by any device.
+func WithRoutes(routes []Route) Option {
+	return func(s *Sender) {
+		s.routes = append(s.routes, routes...)
+	}
+}
+
+// WithPrices specifies the prices used to determine the cost of sent SMSs.
+// SMSs not matching any price have no cost.
+func WithPrices(prices []Price) Option {
+	return func(s *Sender) {
+		s.prices = append(s.prices, prices...)
+	}
+}
+
+// WithLeadTime specifies how far ahead of their scheduled send time SMSs are
+// pulled into the pool, so they are ready to be sent on time.
+// SMSs are held in the pool until they are due.
+func WithLeadTime(lead time.Duration) Option {
+	return func(s *Sender) {
+		s.lead = lead
+	}
+}
+
+// WithStrictOrdering specifies that SMSs to the same destination are sent in
+// the order they were added, and are not sent concurrently by different
+// devices.
+// This reduces throughput to any one destination, so by default ordering is
+// best-effort.
+func WithStrictOrdering(s *Sender) {
+	s.strict = true
+}
+
+// WithPollJitter specifies the fraction, from 0 to 1, of the poll period by
+// which each poll of the database is randomly advanced or delayed, so that
+// polls by several Senders sharing a database do not coincide.
+func WithPollJitter(fraction float64) Option {
+	if fraction > 1 {
+		fraction = 1
+	}
+	return func(s *Sender) {
+		s.jitter = fraction
+	}
+}
+
+// WithStatusHook specifies a function called each time an SMS returned by a
+// device is sent, errored or canceled, or is accepted pending delivery
+// confirmation.
+// The function is called from Run, so must not block for long.
+func WithStatusHook(hook func(store.SMS)) Option {
+	return func(s *Sender) {
+		s.hook = hook
+	}
+}
+
+// WithMaxInFlight limits the number of SMSs passed to a device and not yet
+// returned.
+// SMSs are passed to other devices while a device is at the limit, or are
+// held if there are none, so a slow device does not hold SMSs that others
+// could send.
+func WithMaxInFlight(n int) Option {
+	return func(s *Sender) {
+		s.maxInFlight = n
+	}
+}
+
+// WithWeights specifies that SMSs not matching a route are balanced across the
+// devices in proportion to their weights, keyed by device ID, using a weighted
+// round-robin, so a device with weight 3 sends three times as many SMSs as a
+// device with weight 1.
+// Devices not in weights have weight 1.
+// Each SMS is held for the device whose turn it is, even if other devices are
+// able to accept it, so the slowest device may limit throughput.
+// By default SMSs are passed to whichever device is able to accept them.
+func WithWeights(weights map[string]int) Option {
+	return func(s *Sender) {
+		s.weights = weights
+	}
+}
+
+// WithSendWindow specifies the time of day during which SMSs of the classes,
+// or all SMSs if classes is empty, may be sent.
+// SMSs added outside the window are scheduled to be sent when it next opens,
+// and SMSs being retried when it closes are held until it reopens.
+func WithSendWindow(w Window, classes []string) Option {
+	return func(s *Sender) {
+		s.window = &w
+		if len(classes) > 0 {
+			s.windowClasses = make(map[string]bool)
+			for _, c := range classes {
+				s.windowClasses[c] = true
+			}
+		}
+	}
+}
+
+// WithFetchBatch specifies the number of pending SMSs read from the database
+// at a time, and so held in the pool, independent of the number passed to the
+// devices at a time.
+// This allows large batches to be read while limiting the number being sent,
+// or vice versa.
+// By default this is the pool size.
+func WithFetchBatch(n int) Option {
+	return func(s *Sender) {
+		if n > 0 {
+			s.fetchBatch = n
+		}
+	}
+}
+
+// WithFireAndForget passes SMSs that may be sent immediately to a device
+// before recording them in the database, rather than after, so sending is not
+// delayed by the database.
+// The tradeoff is durability, as an SMS is lost, and may or may not have been
+// sent, if goatsms exits before it is recorded.
+// Without this option, individual SMSs may still request it.
+func WithFireAndForget(s *Sender) {
+	s.fireAndForget = true
+}
+
+// WithDeliveryConfirmation specifies that SMSs are only considered sent once
+// the network reports they have been delivered, rather than when accepted by
+// the network.
+// Delivery reports are requested for all SMSs, and SMSs remain accepted
+// until all their parts are reported delivered, or are errored if any part
+// fails, or if the reports do not arrive within the timeout.
+// SMSs sent by devices not providing delivery reports are considered sent
+// when accepted.
+func WithDeliveryConfirmation(timeout time.Duration) Option {
+	return func(s *Sender) {
+		s.reportTimeout = timeout
+	}
 }
 
 // New creates a new Sender.
-func New(poolSize, poolLow int) *Sender {
-	return &Sender{
-		add:      make(chan store.SMS),
-		req:      make(chan store.SMS),
-		rsp:      make(chan store.SMS),
-		pool:     make(map[string]bool),
-		poolSize: poolSize,
-		poolLow:  poolLow,
+// The poolSize is the maximum number of SMSs passed to the devices at a time
+// and, unless overridden by WithFetchBatch, the number read from the database
+// at a time.
+// The pool is refilled from the database when it falls below poolLow.
+func New(poolSize, poolLow int, options ...Option) *Sender {
+	s := &Sender{
+		add:        make(chan store.SMS),
+		rsp:        make(chan store.SMS),
+		pool:       make(map[string]string),
+		poolSize:   poolSize,
+		poolLow:    poolLow,
+		fetchBatch: poolSize,
+		kick:       make(chan struct{}, 1),
+		refill:     make(chan struct{}, 1),
+		reports:    make(chan deliveryReport, 16),
+		excl:       make(chan exclusive),
+		canceled:   make(map[string]bool),
+		devices:    make(map[string]*device),
+		inflight:   make(map[string]bool),
+		assigned:   make(map[string]string),
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		// no device is available until one attaches.
+		outageSince: time.Now(),
+	}
+	for _, option := range options {
+		option(s)
 	}
+	// longest prefix first, so the most specific route matches.
+	sort.SliceStable(s.routes, func(i, j int) bool {
+		return len(s.routes[i].Prefix) > len(s.routes[j].Prefix)
+	})
+	sort.SliceStable(s.prices, func(i, j int) bool {
+		return len(s.prices[i].Prefix) > len(s.prices[j].Prefix)
+	})
+	return s
 }
 
 // AddMessage adds an SMS to be sent.
@@ -35,9 +380,265 @@ func (s *Sender) AddMessage(sms store.SMS) {
 	s.add <- sms
 }
 
-// Req returns the channel on which modems should receive messages to be sent.
-func (s *Sender) Req() <-chan store.SMS {
-	return s.req
+// RejectMessage records an SMS that was rejected, such as by the blocklist,
+// as errored with the reason, without sending it.
+func (s *Sender) RejectMessage(sms store.SMS, reason string) {
+	sms.Status = store.SMSErrored
+	sms.ErrorReason = store.RejectedPrefix + reason
+	s.add <- sms
+}
+
+// Exclusive calls f while the Sender is paused, so the Sender does not write
+// to the database while f is executing.
+// Returns the error returned by f, or the context error if the Sender is not
+// running.
+func (s *Sender) Exclusive(ctx context.Context, f func() error) error {
+	e := exclusive{f: f, rsp: make(chan error, 1)}
+	select {
+	case s.excl <- e:
+		return <-e.rsp
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CancelBatch cancels the SMSs in the batch that are yet to be sent.
+// SMSs being sent by a device when the batch is canceled are allowed to
+// complete, but are not retried.
+// Returns the number of SMSs canceled, or sql.ErrNoRows if there are no SMSs
+// in the batch.
+func (s *Sender) CancelBatch(ctx context.Context, db *store.DB, batchID string) (int, error) {
+	if batchID == "" {
+		// SMSs not in a batch have an empty batch ID.
+		return 0, sql.ErrNoRows
+	}
+	var n int
+	err := s.Exclusive(ctx, func() error {
+		s.withdraw(batchID)
+		var sending []string
+		for uuid, id := range s.pool {
+			if id == batchID {
+				sending = append(sending, uuid)
+			}
+		}
+		var err error
+		if n, err = db.CancelBatch(batchID, sending); err != nil {
+			return err
+		}
+		for _, uuid := range sending {
+			s.canceled[uuid] = true
+		}
+		atomic.AddUint64(&s.counts.canceled, uint64(n))
+		return nil
+	})
+	return n, err
+}
+
+// Resend returns an errored SMS to pending, optionally correcting its mobile
+// and resetting its retries, and adds it to the pool to be sent again.
+// Returns the updated SMS, or sql.ErrNoRows if there is no errored SMS with
+// the UUID.
+func (s *Sender) Resend(ctx context.Context, db *store.DB, uuid, mobile string, resetRetries bool) (store.SMS, error) {
+	var sms store.SMS
+	err := s.Exclusive(ctx, func() error {
+		var err error
+		if sms, err = db.ResendMessage(uuid, mobile, resetRetries); err != nil {
+			return err
+		}
+		// otherwise left in the db until the pool is next refilled.
+		if _, ok := s.pool[sms.UUID]; !ok && len(s.pool) < s.fetchBatch && sms.SendTime().Before(time.Now().Add(s.lead)) {
+			s.pool[sms.UUID] = sms.BatchID
+			s.enqueue(sms)
+		}
+		return nil
+	})
+	return sms, err
+}
+
+// Attach indicates the device is available to send SMSs.
+// Returns the channel on which the device should receive messages to be sent.
+func (s *Sender) Attach(deviceID string) <-chan store.SMS {
+	s.mu.Lock()
+	d, ok := s.devices[deviceID]
+	if !ok {
+		d = &device{req: make(chan store.SMS, 1), weight: 1}
+		if w, ok := s.weights[deviceID]; ok && w > 0 {
+			d.weight = w
+		}
+		s.devices[deviceID] = d
+	}
+	d.online = true
+	s.updateOutage(time.Now())
+	s.mu.Unlock()
+	s.signal()
+	return d.req
+}
+
+// Detach indicates the device is no longer available to send SMSs.
+// Any SMSs waiting to be sent by the device are returned to the head of the
+// queue.
+func (s *Sender) Detach(deviceID string) {
+	s.mu.Lock()
+	if d, ok := s.devices[deviceID]; ok {
+		d.online = false
+		smss := drain(d.req)
+		for _, sms := range smss {
+			delete(s.inflight, sms.Mobile)
+			s.release(sms.UUID)
+		}
+		s.queue = append(smss, s.queue...)
+		s.updateOutage(time.Now())
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+// Stats returns the counts of SMSs processed.
+// It is safe to call concurrently with Run.
+func (s *Sender) Stats() Stats {
+	st := Stats{
+		Added:    atomic.LoadUint64(&s.counts.added),
+		Sent:     atomic.LoadUint64(&s.counts.sent),
+		Errored:  atomic.LoadUint64(&s.counts.errored),
+		Canceled: atomic.LoadUint64(&s.counts.canceled),
+		Retried:  atomic.LoadUint64(&s.counts.retried),
+		InFlight: make(map[string]int),
+	}
+	now := time.Now()
+	s.mu.Lock()
+	for id, d := range s.devices {
+		st.InFlight[id] = d.depth
+	}
+	for _, sms := range s.queue {
+		if sms.Retries == 0 {
+			if w := waitSince(sms, now).Seconds(); w > st.QueueWait.Current {
+				st.QueueWait.Current = w
+			}
+		}
+	}
+	w := s.wait
+	s.mu.Unlock()
+	st.QueueWait.Last = w.last.Seconds()
+	st.QueueWait.Max = w.max.Seconds()
+	st.QueueWait.Count = w.count
+	if w.count > 0 {
+		st.QueueWait.Average = w.total.Seconds() / float64(w.count)
+	}
+	return st
+}
+
+// Pause stops SMSs being passed to the devices until Resume is called.
+// SMSs continue to be added, and remain pending, while paused.
+// SMSs already passed to a device are not affected.
+// It is safe to call concurrently with Run.
+func (s *Sender) Pause() {
+	atomic.StoreUint32(&s.paused, 1)
+}
+
+// Resume restarts the sending of SMSs stopped by Pause.
+// It is safe to call concurrently with Run.
+func (s *Sender) Resume() {
+	atomic.StoreUint32(&s.paused, 0)
+	s.signal()
+}
+
+// Refill requests Run refill the pool from the database immediately, rather
+// than at the next poll, so SMSs inserted into the database by another
+// process are sent promptly.
+// It is safe to call concurrently with Run.
+func (s *Sender) Refill() {
+	select {
+	case s.refill <- struct{}{}:
+	default:
+	}
+}
+
+// Report passes the delivery report for the part of an SMS sent by the
+// device with the message reference to Run, to update the status of the SMS.
+// Reports are ignored unless delivery confirmation is enabled.
+// It is safe to call concurrently with Run.
+func (s *Sender) Report(ctx context.Context, deviceID, mr string, delivered bool, reason string) {
+	if s.reportTimeout == 0 {
+		return
+	}
+	select {
+	case s.reports <- deliveryReport{deviceID, mr, delivered, reason}:
+	case <-ctx.Done():
+	}
+}
+
+// Paused indicates sending has been paused.
+// It is safe to call concurrently with Run.
+func (s *Sender) Paused() bool {
+	return atomic.LoadUint32(&s.paused) != 0
+}
+
+// Backlogged indicates there are more SMSs pending than the Sender can
+// currently hold in its pool, so SMSs being added will not be sent promptly.
+// It is safe to call concurrently with Run.
+func (s *Sender) Backlogged() bool {
+	return atomic.LoadUint32(&s.backlog) != 0
+}
+
+// notify calls the status hook, if any, for an SMS that has changed status.
+func (s *Sender) notify(sms store.SMS) {
+	if s.hook != nil && sms.Status != store.SMSPending {
+		s.hook(sms)
+	}
+}
+
+// accept holds an SMS accepted by the network as accepted, rather than sent,
+// until its delivery reports arrive, if delivery is being confirmed and the
+// device recorded the references of its parts.
+func (s *Sender) accept(sms *store.SMS) {
+	if s.reportTimeout > 0 && sms.Status == store.SMSSent && sms.MRs != "" {
+		sms.Status = store.SMSAccepted
+	}
+}
+
+// applyReport updates the SMS with the delivery report.
+func (s *Sender) applyReport(db *store.DB, r deliveryReport) {
+	sms, err := db.ApplyDeliveryReport(r.deviceID, r.mr, r.delivered, r.reason)
+	if err != nil {
+		// such as a report for an SMS that has already expired.
+		logger.Debug("sender ignoring delivery report", "device", r.deviceID, "mr", r.mr, "err", err)
+		return
+	}
+	if sms.Status != store.SMSAccepted {
+		s.notify(sms)
+		s.count(sms)
+	}
+}
+
+// expireReports errors the accepted SMSs whose delivery reports have not
+// arrived within the timeout.
+func (s *Sender) expireReports(db *store.DB) {
+	if s.reportTimeout == 0 {
+		return
+	}
+	smss, err := db.ExpireUndelivered(time.Now().Add(-s.reportTimeout))
+	if err != nil {
+		logger.Error("sender failed to expire undelivered sms", "err", err)
+		return
+	}
+	for _, sms := range smss {
+		s.notify(sms)
+		s.count(sms)
+	}
+}
+
+// count updates the counters to reflect a processed SMS.
+func (s *Sender) count(sms store.SMS) {
+	switch sms.Status {
+	case store.SMSPending:
+		atomic.AddUint64(&s.counts.retried, 1)
+	case store.SMSSent:
+		atomic.AddUint64(&s.counts.sent, 1)
+	case store.SMSErrored:
+		atomic.AddUint64(&s.counts.errored, 1)
+	case store.SMSCanceled:
+		atomic.AddUint64(&s.counts.canceled, 1)
+	}
 }
 
 // Rsp returns the channel on which modems should send processed messages.
@@ -46,89 +647,579 @@ func (s *Sender) Rsp() chan<- store.SMS {
 }
 
 // Run peforms the core functionality of the Sender.
-// It pulls messages from the database and passes them out to modems, via the req channel.
-// The modems return processed messages via the rsp channel.
+// It pulls messages from the database and passes them out to the attached
+// devices, via their req channels.
+// The devices return processed messages via the rsp channel.
 // It adds messages to be sent, to both the database and the pool, via the add channel.
 func (s *Sender) Run(ctx context.Context, db *store.DB, pollPeriod time.Duration) {
-	t := time.NewTimer(pollPeriod)
+	t := time.NewTimer(s.pollInterval(pollPeriod))
 	defer func() {
 		if !t.Stop() {
 			<-t.C
 		}
 	}()
 
+	// wake fires when a scheduled SMS becomes due, either for dispatch or to
+	// be pulled into the pool.
+	wake := time.NewTimer(pollPeriod)
+	defer wake.Stop()
+
 	backlogged := s.fillPool(db)
 	for {
+		now := time.Now()
+		var next time.Time
+		if s.Paused() {
+			// recall SMSs not yet accepted by the devices.
+			s.recall()
+			logger.Debug("sender paused", "queue", s.queued())
+		} else {
+			s.expireOutage(db, now)
+			expiry := s.expireTTL(db, now)
+			next = s.dispatch(now)
+			if !expiry.IsZero() && (next.IsZero() || expiry.Before(next)) {
+				next = expiry
+			}
+			if at := s.outageExpiry(); at.After(now) && (next.IsZero() || at.Before(next)) {
+				next = at
+			}
+		}
+		if !s.nextScheduled.IsZero() {
+			// an overdue SMS is pulled in by the next refill of the pool.
+			if at := s.nextScheduled.Add(-s.lead); at.After(now) && (next.IsZero() || at.Before(next)) {
+				next = at
+			}
+		}
+		stopTimer(wake)
+		if !next.IsZero() {
+			wake.Reset(time.Until(next))
+		}
 		select {
 		case <-ctx.Done():
 			// perform a controlled shutdown
-			close(s.req)
 			s.drainReq()
+			logger.Debug("sender draining", "inflight", len(s.pool))
 			for len(s.pool) > 0 {
 				sms := <-s.rsp
+				s.uncancel(&sms)
+				s.charge(&sms)
+				s.accept(&sms)
 				db.UpdateMessageStatus(sms)
+				s.notify(sms)
+				s.count(sms)
 				delete(s.pool, sms.UUID)
 			}
 			return
 		case sms := <-s.add:
+			if sms.Rejected() {
+				logger.Debug("sender recording rejected sms", "uuid", sms.UUID)
+				db.InsertMessage(sms)
+				db.UpdateMessageStatus(sms)
+				s.notify(sms)
+				s.count(sms)
+				break
+			}
+			s.applyWindow(&sms, time.Now())
+			if s.reportTimeout > 0 {
+				sms.DeliveryReport = true
+			}
+			if (s.fireAndForget || sms.FireAndForget) && !s.Paused() &&
+				!sms.SendTime().After(time.Now()) && len(s.pool) < s.fetchBatch && !backlogged {
+				// pass to a device before recording the SMS, so sending is not
+				// delayed by the database.
+				// The SMS is recorded before any response from the device is
+				// processed, but is lost if goatsms exits in the meantime.
+				sms.CreatedAt = time.Now().UTC().Format(store.TimestampFormat)
+				logger.Debug("sender dispatching fire and forget sms", "uuid", sms.UUID)
+				s.pool[sms.UUID] = sms.BatchID
+				s.enqueue(sms)
+				s.dispatch(time.Now())
+				db.InsertMessage(sms)
+				atomic.AddUint64(&s.counts.added, 1)
+				break
+			}
 			db.InsertMessage(sms)
-			if len(s.pool) < s.poolSize && !backlogged {
-				s.pool[sms.UUID] = true
-				s.req <- sms
+			if sms.CreatedAt == "" {
+				// as set by the database.
+				sms.CreatedAt = time.Now().UTC().Format(store.TimestampFormat)
+			}
+			atomic.AddUint64(&s.counts.added, 1)
+			if at := sms.SendTime(); at.After(time.Now().Add(s.lead)) {
+				// leave in the db until it is nearly due.
+				logger.Debug("sender holding scheduled sms in db", "uuid", sms.UUID, "send_at", at)
+				if s.nextScheduled.IsZero() || at.Before(s.nextScheduled) {
+					s.nextScheduled = at
+				}
+			} else if len(s.pool) < s.fetchBatch && !backlogged {
+				logger.Debug("sender added sms to pool", "uuid", sms.UUID, "pool", len(s.pool)+1)
+				s.pool[sms.UUID] = sms.BatchID
+				s.enqueue(sms)
+			} else {
+				logger.Debug("sender leaving sms in db", "uuid", sms.UUID,
+					"pool", len(s.pool), "backlogged", backlogged)
 			}
 		case sms := <-s.rsp:
+			s.uncancel(&sms)
+			s.charge(&sms)
+			s.accept(&sms)
 			db.UpdateMessageStatus(sms)
+			s.notify(sms)
+			s.count(sms)
+			s.mu.Lock()
+			delete(s.inflight, sms.Mobile)
+			s.release(sms.UUID)
+			s.mu.Unlock()
 			if sms.Status == store.SMSPending {
-				s.req <- sms
+				logger.Debug("sender requeuing sms for retry", "uuid", sms.UUID, "retries", sms.Retries)
+				if s.strict {
+					// retry before any later SMSs to the same destination.
+					s.requeue(sms)
+				} else {
+					s.enqueue(sms)
+				}
 			} else {
 				delete(s.pool, sms.UUID)
 				// refill the pool if we're backlogged and below the low threshold
 				// or if we're about to go idle (to double check we really are idle).
-				if len(s.pool) == 0 || (len(s.pool) < s.poolLow && backlogged) {
+				if len(s.pool) == 0 {
+					if since := time.Since(s.lastFill); since < minRefillInterval {
+						// the db was only just found empty, so check again
+						// shortly rather than hammering it.
+						logger.Debug("sender deferring refill of empty pool", "delay", minRefillInterval-since)
+						stopTimer(t)
+						t.Reset(minRefillInterval - since)
+					} else {
+						logger.Debug("sender refilling pool as it is empty")
+						backlogged = s.fillPool(db)
+					}
+				} else if len(s.pool) < s.poolLow && backlogged {
+					logger.Debug("sender refilling pool as below low threshold",
+						"pool", len(s.pool), "low", s.poolLow)
 					backlogged = s.fillPool(db)
 				}
 			}
+		case r := <-s.reports:
+			s.applyReport(db, r)
+		case <-s.kick:
+			// device availability has changed, so redispatch
+		case e := <-s.excl:
+			e.rsp <- e.f()
+		case <-wake.C:
+			// a held SMS is now due, or a scheduled SMS has entered the lead window.
+			logger.Debug("sender refilling pool as scheduled sms due")
+			backlogged = s.fillPool(db)
+		case <-s.refill:
+			logger.Debug("sender refilling pool on request")
+			backlogged = s.fillPool(db)
 		case <-t.C:
 			// periodically refill the pool in case SMSs have been injected into the DB behind our back.
-			t.Reset(pollPeriod)
+			t.Reset(s.pollInterval(pollPeriod))
+			logger.Debug("sender refilling pool on poll")
 			backlogged = s.fillPool(db)
+			s.expireReports(db)
+		}
+	}
+}
+
+// minRefillInterval is the minimum time between refills of the pool triggered
+// by the pool emptying.
+const minRefillInterval = 250 * time.Millisecond
+
+// pollInterval returns the time until the next poll of the database, being
+// the poll period randomly adjusted by the jitter.
+func (s *Sender) pollInterval(pollPeriod time.Duration) time.Duration {
+	if s.jitter <= 0 {
+		return pollPeriod
+	}
+	return pollPeriod + time.Duration(float64(pollPeriod)*s.jitter*(2*s.rnd.Float64()-1))
+}
+
+// signal wakes Run to redispatch the queue.
+func (s *Sender) signal() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue adds an SMS to the queue awaiting dispatch.
+func (s *Sender) enqueue(sms store.SMS) {
+	s.mu.Lock()
+	s.queue = append(s.queue, sms)
+	s.mu.Unlock()
+}
+
+// stopTimer stops the timer and drains its channel, so it may be safely Reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// recall returns any SMSs waiting to be accepted by the devices to the head
+// of the queue.
+func (s *Sender) recall() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var smss []store.SMS
+	for _, d := range s.devices {
+		for _, sms := range drain(d.req) {
+			delete(s.inflight, sms.Mobile)
+			s.release(sms.UUID)
+			smss = append(smss, sms)
+		}
+	}
+	if len(smss) > 0 {
+		s.queue = append(smss, s.queue...)
+	}
+}
+
+// queued returns the number of SMSs awaiting dispatch.
+func (s *Sender) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// requeue returns an SMS to the head of the queue awaiting dispatch.
+func (s *Sender) requeue(sms store.SMS) {
+	s.mu.Lock()
+	s.queue = append([]store.SMS{sms}, s.queue...)
+	s.mu.Unlock()
+}
+
+// dispatch passes as many SMSs from the queue to the devices as they will
+// accept.
+// SMSs scheduled to be sent after now are held in the queue.
+// If ordering is strict, an SMS is held while an earlier SMS to the same
+// destination is in flight or remains in the queue.
+// Returns the earliest send time of the held SMSs, or the zero time if none
+// are held.
+func (s *Sender) dispatch(now time.Time) (held time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remaining := s.queue[:0]
+	// waiting contains the destinations of SMSs remaining in the queue.
+	waiting := make(map[string]bool)
+	for _, sms := range s.queue {
+		if s.strict && (s.inflight[sms.Mobile] || waiting[sms.Mobile]) {
+			logger.Debug("sender holding sms behind earlier sms to destination", "uuid", sms.UUID)
+			remaining = append(remaining, sms)
+			continue
+		}
+		if at := s.dueTime(sms, now); at.After(now) {
+			logger.Debug("sender holding sms until due", "uuid", sms.UUID, "send_at", at)
+			if held.IsZero() || at.Before(held) {
+				held = at
+			}
+			remaining = append(remaining, sms)
+			waiting[sms.Mobile] = true
+			continue
+		}
+		if !s.offer(sms) {
+			logger.Debug("sender holding sms as no device available", "uuid", sms.UUID)
+			remaining = append(remaining, sms)
+			waiting[sms.Mobile] = true
+		} else {
+			logger.Debug("sender dispatched sms", "uuid", sms.UUID)
+			if sms.Retries == 0 {
+				s.recordWait(waitSince(sms, now))
+			}
+			if s.strict {
+				s.inflight[sms.Mobile] = true
+			}
+		}
+	}
+	s.queue = remaining
+	return held
+}
+
+// windowed indicates the SMS may only be sent within the send window.
+func (s *Sender) windowed(sms store.SMS) bool {
+	return s.window != nil && (s.windowClasses == nil || s.windowClasses[sms.Class])
+}
+
+// applyWindow schedules the SMS to be sent when the send window next opens,
+// if it would otherwise be sent outside the window.
+func (s *Sender) applyWindow(sms *store.SMS, now time.Time) {
+	if !s.windowed(*sms) {
+		return
+	}
+	at := sms.SendTime()
+	if at.Before(now) {
+		at = now
+	}
+	if open := s.window.Next(at); open.After(at) {
+		logger.Debug("sender scheduling sms for send window", "uuid", sms.UUID, "send_at", open)
+		sms.SendAt = open.UTC().Format(store.TimestampFormat)
+	}
+}
+
+// dueTime returns the time the SMS may be sent, which is the later of its
+// scheduled send time and, if windowed, the next opening of the send window.
+func (s *Sender) dueTime(sms store.SMS, now time.Time) time.Time {
+	at := sms.SendTime()
+	if s.windowed(sms) {
+		if open := s.window.Next(now); open.After(at) {
+			at = open
+		}
+	}
+	return at
+}
+
+// waitSince returns the time the SMS has been waiting to be dispatched, from
+// when it was added, or became due if scheduled.
+func waitSince(sms store.SMS, now time.Time) time.Duration {
+	start := sms.CreateTime()
+	if at := sms.SendTime(); at.After(start) {
+		start = at
+	}
+	if start.IsZero() || start.After(now) {
+		return 0
+	}
+	return now.Sub(start)
+}
+
+// recordWait adds the wait of a dispatched SMS to the wait stats.
+// Must be called with the mutex held.
+func (s *Sender) recordWait(w time.Duration) {
+	s.wait.count++
+	s.wait.total += w
+	s.wait.last = w
+	if w > s.wait.max {
+		s.wait.max = w
+	}
+}
+
+// offer attempts to pass the SMS to a device able to send it.
+// Returns true if a device accepted the SMS.
+// Must be called with the mutex held.
+func (s *Sender) offer(sms store.SMS) bool {
+	if deviceID, ok := s.route(sms.Mobile); ok {
+		d := s.devices[deviceID]
+		if d == nil || !d.online {
+			return false
+		}
+		return s.offerTo(deviceID, d, sms)
+	}
+	if sms.PartsSent > 0 {
+		// prefer the device that sent the first parts, as it need only send
+		// the rest, but fall back to any device sending it afresh.
+		if d := s.devices[sms.Device]; d != nil && d.online && s.offerTo(sms.Device, d, sms) {
+			return true
+		}
+	}
+	if s.weights != nil {
+		return s.offerWeighted(sms)
+	}
+	for id, d := range s.devices {
+		if d.online && s.offerTo(id, d, sms) {
+			return true
+		}
+	}
+	return false
+}
+
+// offerWeighted passes the SMS to the online device whose turn it is, using a
+// smooth weighted round-robin, so the turns of each device are spread evenly.
+// Turns are only taken when the device accepts the SMS.
+// Must be called with the mutex held.
+func (s *Sender) offerWeighted(sms store.SMS) bool {
+	var next *device
+	var nextID string
+	total := 0
+	for id, d := range s.devices {
+		if !d.online {
+			continue
+		}
+		total += d.weight
+		// ties are broken by ID so the order is deterministic.
+		if next == nil || d.current+d.weight > next.current+next.weight ||
+			(d.current+d.weight == next.current+next.weight && id < nextID) {
+			next, nextID = d, id
+		}
+	}
+	if next == nil {
+		return false
+	}
+	if !s.offerTo(nextID, next, sms) {
+		logger.Debug("sender holding sms for device whose turn it is", "uuid", sms.UUID, "device", nextID)
+		return false
+	}
+	for _, d := range s.devices {
+		if d.online {
+			d.current += d.weight
+		}
+	}
+	next.current -= total
+	return true
+}
+
+// offerTo passes the SMS to the device if the device has capacity to accept
+// it, and is below the in-flight limit.
+// Must be called with the mutex held.
+func (s *Sender) offerTo(deviceID string, d *device, sms store.SMS) bool {
+	if s.maxInFlight > 0 && d.depth >= s.maxInFlight {
+		logger.Debug("sender skipping device at in-flight limit", "device", deviceID, "depth", d.depth)
+		return false
+	}
+	if len(s.assigned) >= s.poolSize {
+		logger.Debug("sender holding sms as pool size reached", "uuid", sms.UUID, "in_flight", len(s.assigned))
+		return false
+	}
+	select {
+	case d.req <- sms:
+		d.depth++
+		s.assigned[sms.UUID] = deviceID
+		return true
+	default:
+		return false
+	}
+}
+
+// release records that an SMS passed to a device has been returned.
+// Must be called with the mutex held.
+func (s *Sender) release(uuid string) {
+	deviceID, ok := s.assigned[uuid]
+	if !ok {
+		return
+	}
+	delete(s.assigned, uuid)
+	if d := s.devices[deviceID]; d != nil && d.depth > 0 {
+		d.depth--
+	}
+}
+
+// route returns the device the SMS must be sent by, if any.
+func (s *Sender) route(mobile string) (string, bool) {
+	for _, r := range s.routes {
+		if strings.HasPrefix(mobile, r.Prefix) {
+			return r.Device, true
+		}
+	}
+	return "", false
+}
+
+// charge sets the cost of a sent SMS.
+func (s *Sender) charge(sms *store.SMS) {
+	if sms.Status == store.SMSSent {
+		sms.Cost = s.Price(sms.Mobile) * float64(sms.Segments)
+	}
+}
+
+// Price returns the price per segment of SMSs to the mobile.
+func (s *Sender) Price(mobile string) float64 {
+	for _, p := range s.prices {
+		if strings.HasPrefix(mobile, p.Prefix) {
+			return p.PerSegment
 		}
 	}
+	return 0
 }
 
 // fillPool fills the pending set (the pool) with messages from the db.
 // Returns true if there are more messages pending than we can currently
 // fit in the pool (i.e. backlogged).
+// SMSs scheduled to be sent within the lead time are included.
 func (s *Sender) fillPool(db *store.DB) (backlogged bool) {
-	pendingMsgs, err := db.GetPendingMessages(s.poolSize)
+	s.lastFill = time.Now()
+	due := s.lastFill.Add(s.lead)
+	pendingMsgs, err := db.GetPendingMessages(s.fetchBatch, due)
 	if err != nil {
+		logger.Debug("sender fill failed", "err", err)
 		// !!! not sure what to do in this case - assume it is transient and
 		return false
 	}
-	if len(pendingMsgs) >= s.poolSize {
+	if next, err := db.GetNextSendTime(due); err == nil {
+		s.nextScheduled = next
+	}
+	if len(pendingMsgs) >= s.fetchBatch {
 		backlogged = true
+		atomic.StoreUint32(&s.backlog, 1)
+	} else {
+		atomic.StoreUint32(&s.backlog, 0)
 	}
+	filled := 0
 	for _, sms := range pendingMsgs {
-		if !s.pool[sms.UUID] {
-			s.pool[sms.UUID] = true
-			s.req <- sms
+		if _, ok := s.pool[sms.UUID]; !ok {
+			s.pool[sms.UUID] = sms.BatchID
+			s.enqueue(sms)
+			filled++
 			// the set from db is not necessarily a superset of pool,
 			// so prevent the pending pool overflowing...
-			if len(s.pool) >= s.poolSize {
+			if len(s.pool) >= s.fetchBatch {
 				break
 			}
 		}
 	}
+	logger.Debug("sender filled pool", "pending", len(pendingMsgs), "filled", filled,
+		"pool", len(s.pool), "backlogged", backlogged, "next_scheduled", s.nextScheduled)
 	return backlogged
 }
 
-// drainReq removes pending requests from the req channel to expidite a controlled shutdown.
+// uncancel marks an SMS returned by a device as canceled, rather than pending
+// a retry, if its batch was canceled while it was being sent.
+func (s *Sender) uncancel(sms *store.SMS) {
+	if !s.canceled[sms.UUID] {
+		return
+	}
+	delete(s.canceled, sms.UUID)
+	if sms.Status == store.SMSPending {
+		sms.Status = store.SMSCanceled
+	}
+}
+
+// withdraw removes the SMSs in the batch from the pool, including those
+// awaiting dispatch and those waiting to be accepted by a device.
+func (s *Sender) withdraw(batchID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var queue []store.SMS
+	for _, d := range s.devices {
+		smss := drain(d.req)
+		for _, sms := range smss {
+			delete(s.inflight, sms.Mobile)
+			s.release(sms.UUID)
+		}
+		queue = append(queue, smss...)
+	}
+	queue = append(queue, s.queue...)
+	s.queue = s.queue[:0]
+	for _, sms := range queue {
+		if sms.BatchID == batchID {
+			delete(s.pool, sms.UUID)
+			continue
+		}
+		s.queue = append(s.queue, sms)
+	}
+}
+
+// drainReq removes pending requests from the queue and devices to expidite a
+// controlled shutdown.
 func (s *Sender) drainReq() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		s.queue = append(s.queue, drain(d.req)...)
+	}
+	for _, sms := range s.queue {
+		delete(s.pool, sms.UUID)
+		s.release(sms.UUID)
+	}
+	s.queue = nil
+}
+
+// drain removes any SMSs waiting in the channel.
+func drain(req chan store.SMS) []store.SMS {
+	var smss []store.SMS
 	for {
-		sms, ok := <-s.req
-		if !ok {
-			return
+		select {
+		case sms := <-req:
+			smss = append(smss, sms)
+		default:
+			return smss
 		}
-		delete(s.pool, sms.UUID)
 	}
 }
@@ -0,0 +1,76 @@
+package sender
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is the time of day during which SMSs may be sent, such as to comply
+// with regulations forbidding marketing SMSs at night.
+type Window struct {
+	// Start and End are the times since midnight the window opens and
+	// closes.
+	// If End is before Start the window spans midnight.
+	Start, End time.Duration
+	// Location is the timezone of the window.
+	Location *time.Location
+}
+
+// ParseWindow parses a window in the form "08:00-21:00" in the named timezone,
+// such as "Europe/London", or the local timezone if empty.
+func ParseWindow(spec, tz string) (Window, error) {
+	w := Window{Location: time.Local}
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return w, fmt.Errorf("invalid timezone %q: %v", tz, err)
+		}
+		w.Location = loc
+	}
+	times := strings.Split(spec, "-")
+	if len(times) != 2 {
+		return w, fmt.Errorf("invalid window %q: expected start-end, for ex. 08:00-21:00", spec)
+	}
+	for i, d := range []*time.Duration{&w.Start, &w.End} {
+		t, err := time.Parse("15:04", strings.TrimSpace(times[i]))
+		if err != nil {
+			return w, fmt.Errorf("invalid window %q: %v", spec, err)
+		}
+		*d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("invalid window %q: start and end are the same", spec)
+	}
+	return w, nil
+}
+
+// Next returns the earliest time, no earlier than t, that is within the window.
+func (w Window) Next(t time.Time) time.Time {
+	lt := t.In(w.Location)
+	midnight := time.Date(lt.Year(), lt.Month(), lt.Day(), 0, 0, 0, 0, w.Location)
+	tod := time.Duration(lt.Hour())*time.Hour + time.Duration(lt.Minute())*time.Minute +
+		time.Duration(lt.Second())*time.Second
+	if w.Start < w.End {
+		switch {
+		case tod < w.Start:
+			return opening(midnight, w.Start)
+		case tod >= w.End:
+			return opening(midnight.AddDate(0, 0, 1), w.Start)
+		}
+		return t
+	}
+	// spans midnight, so only closed between End and Start.
+	if tod >= w.End && tod < w.Start {
+		return opening(midnight, w.Start)
+	}
+	return t
+}
+
+// opening returns the time the window opens on the day starting at midnight.
+// The clock time is used, rather than the elapsed time, so the window opens
+// at the same time of day across daylight saving changes.
+func opening(midnight time.Time, start time.Duration) time.Time {
+	return time.Date(midnight.Year(), midnight.Month(), midnight.Day(),
+		int(start/time.Hour), int(start%time.Hour/time.Minute), 0, 0, midnight.Location())
+}
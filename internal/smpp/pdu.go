@@ -0,0 +1,245 @@
+package smpp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The SMPP v3.4 command IDs used by the client.
+const (
+	cmdGenericNack        uint32 = 0x80000000
+	cmdBindTransceiver    uint32 = 0x00000009
+	cmdBindTransceiverRsp uint32 = 0x80000009
+	cmdSubmitSM           uint32 = 0x00000004
+	cmdSubmitSMRsp        uint32 = 0x80000004
+	cmdDeliverSM          uint32 = 0x00000005
+	cmdDeliverSMRsp       uint32 = 0x80000005
+	cmdUnbind             uint32 = 0x00000006
+	cmdUnbindRsp          uint32 = 0x80000006
+	cmdEnquireLink        uint32 = 0x00000015
+	cmdEnquireLinkRsp     uint32 = 0x80000015
+)
+
+// The command statuses that indicate the SMSC is temporarily unable to accept
+// SMSs, rather than there being a problem with the SMS.
+const (
+	statusMsgQueueFull uint32 = 0x00000014
+	statusThrottled    uint32 = 0x00000058
+)
+
+// The optional parameter tags used by the client.
+const (
+	tagReceiptedMessageID uint16 = 0x001e
+	tagMessagePayload     uint16 = 0x0424
+	tagMessageState       uint16 = 0x0427
+)
+
+// maxPDULength bounds the length of PDUs read from the SMSC, so a corrupt
+// length cannot exhaust memory.
+const maxPDULength = 64 * 1024
+
+// pdu is an SMPP protocol data unit.
+type pdu struct {
+	id     uint32
+	status uint32
+	seq    uint32
+	body   []byte
+}
+
+// isResponse indicates the PDU is a response to an earlier request.
+func (p pdu) isResponse() bool {
+	return p.id&cmdGenericNack != 0
+}
+
+// writePDU writes the PDU, with its header, to w.
+func writePDU(w io.Writer, p pdu) error {
+	b := make([]byte, 16, 16+len(p.body))
+	binary.BigEndian.PutUint32(b[0:], uint32(16+len(p.body)))
+	binary.BigEndian.PutUint32(b[4:], p.id)
+	binary.BigEndian.PutUint32(b[8:], p.status)
+	binary.BigEndian.PutUint32(b[12:], p.seq)
+	_, err := w.Write(append(b, p.body...))
+	return err
+}
+
+// readPDU reads a PDU from r.
+func readPDU(r io.Reader) (pdu, error) {
+	var h [16]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return pdu{}, err
+	}
+	l := binary.BigEndian.Uint32(h[0:])
+	if l < 16 || l > maxPDULength {
+		return pdu{}, fmt.Errorf("invalid pdu length %d", l)
+	}
+	p := pdu{
+		id:     binary.BigEndian.Uint32(h[4:]),
+		status: binary.BigEndian.Uint32(h[8:]),
+		seq:    binary.BigEndian.Uint32(h[12:]),
+		body:   make([]byte, l-16),
+	}
+	_, err := io.ReadFull(r, p.body)
+	return p, err
+}
+
+// builder accumulates the fields of a PDU body.
+type builder struct {
+	bytes.Buffer
+}
+
+// cstring appends a NULL terminated string.
+func (b *builder) cstring(s string) {
+	b.WriteString(s)
+	b.WriteByte(0)
+}
+
+// tlv appends an optional parameter.
+func (b *builder) tlv(tag uint16, v []byte) {
+	var h [4]byte
+	binary.BigEndian.PutUint16(h[0:], tag)
+	binary.BigEndian.PutUint16(h[2:], uint16(len(v)))
+	b.Write(h[:])
+	b.Write(v)
+}
+
+// errTruncated indicates a PDU body ended before all its fields were read.
+var errTruncated = errors.New("truncated pdu")
+
+// parser extracts the fields from a PDU body.
+type parser struct {
+	b   []byte
+	err error
+}
+
+// cstring extracts a NULL terminated string.
+func (p *parser) cstring() string {
+	if p.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(p.b, 0)
+	if i < 0 {
+		p.err = errTruncated
+		return ""
+	}
+	s := string(p.b[:i])
+	p.b = p.b[i+1:]
+	return s
+}
+
+// byte extracts a single octet.
+func (p *parser) byte() byte {
+	v := p.bytes(1)
+	if len(v) == 0 {
+		return 0
+	}
+	return v[0]
+}
+
+// bytes extracts n octets.
+func (p *parser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n > len(p.b) {
+		p.err = errTruncated
+		return nil
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+// tlvs extracts the optional parameters remaining in the body.
+func (p *parser) tlvs() map[uint16][]byte {
+	tlvs := make(map[uint16][]byte)
+	for p.err == nil && len(p.b) >= 4 {
+		tag := binary.BigEndian.Uint16(p.b[0:])
+		l := int(binary.BigEndian.Uint16(p.b[2:]))
+		p.b = p.b[4:]
+		tlvs[tag] = p.bytes(l)
+	}
+	return tlvs
+}
+
+// sm is the body of a submit_sm or deliver_sm PDU.
+type sm struct {
+	sourceTON, sourceNPI byte
+	source               string
+	destTON, destNPI     byte
+	dest                 string
+	esmClass             byte
+	protocolID           byte
+	registeredDelivery   byte
+	dataCoding           byte
+	// validityPeriod is the time the SMSC may attempt delivery, or empty
+	// for the SMSC default.
+	validityPeriod string
+	// message is the short message, or, if too long for it, is passed in
+	// the message_payload parameter.
+	message []byte
+	tlvs    map[uint16][]byte
+}
+
+// maxShortMessage is the longest message carried in the short_message field,
+// longer messages being carried in the message_payload parameter.
+const maxShortMessage = 254
+
+// marshal encodes the body of a submit_sm PDU.
+func (s sm) marshal() []byte {
+	var b builder
+	b.cstring("") // service_type
+	b.WriteByte(s.sourceTON)
+	b.WriteByte(s.sourceNPI)
+	b.cstring(s.source)
+	b.WriteByte(s.destTON)
+	b.WriteByte(s.destNPI)
+	b.cstring(s.dest)
+	b.WriteByte(s.esmClass)
+	b.WriteByte(s.protocolID)
+	b.WriteByte(0) // priority_flag
+	b.cstring("")  // schedule_delivery_time
+	b.cstring(s.validityPeriod)
+	b.WriteByte(s.registeredDelivery)
+	b.WriteByte(0) // replace_if_present_flag
+	b.WriteByte(s.dataCoding)
+	b.WriteByte(0) // sm_default_msg_id
+	if len(s.message) > maxShortMessage {
+		b.WriteByte(0)
+		b.tlv(tagMessagePayload, s.message)
+	} else {
+		b.WriteByte(byte(len(s.message)))
+		b.Write(s.message)
+	}
+	return b.Bytes()
+}
+
+// unmarshalSM decodes the body of a deliver_sm PDU.
+func unmarshalSM(body []byte) (sm, error) {
+	p := parser{b: body}
+	var s sm
+	p.cstring() // service_type
+	s.sourceTON = p.byte()
+	s.sourceNPI = p.byte()
+	s.source = p.cstring()
+	s.destTON = p.byte()
+	s.destNPI = p.byte()
+	s.dest = p.cstring()
+	s.esmClass = p.byte()
+	s.protocolID = p.byte()
+	p.byte()    // priority_flag
+	p.cstring() // schedule_delivery_time
+	p.cstring() // validity_period
+	s.registeredDelivery = p.byte()
+	p.byte() // replace_if_present_flag
+	s.dataCoding = p.byte()
+	p.byte() // sm_default_msg_id
+	s.message = p.bytes(int(p.byte()))
+	s.tlvs = p.tlvs()
+	if v, ok := s.tlvs[tagMessagePayload]; ok && len(s.message) == 0 {
+		s.message = v
+	}
+	return s, p.err
+}
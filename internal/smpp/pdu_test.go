@@ -0,0 +1,96 @@
+package smpp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSMRoundTrip(t *testing.T) {
+	long := bytes.Repeat([]byte{'a'}, maxShortMessage+1)
+	patterns := []struct {
+		name string
+		sm   sm
+	}{
+		{"submit", sm{
+			sourceTON: 5, source: "goatsms",
+			destTON: 1, destNPI: 1, dest: "61412345678",
+			registeredDelivery: 1,
+			dataCoding:         0x01,
+			validityPeriod:     "000000000230000R",
+			message:            []byte("hello"),
+		}},
+		{"ucs2", sm{
+			destTON: 1, destNPI: 1, dest: "61412345678",
+			dataCoding: 0x08,
+			message:    []byte{0x00, 0x68, 0x00, 0xe9},
+		}},
+		{"udh", sm{
+			destTON: 1, destNPI: 1, dest: "61412345678",
+			esmClass:   0x40,
+			dataCoding: 0x04,
+			message:    []byte{0x05, 0x00, 0x03, 0x2a, 0x02, 0x01, 0xde, 0xad},
+		}},
+		{"receipt", sm{
+			sourceTON: 1, sourceNPI: 1, source: "61412345678",
+			dest:     "goatsms",
+			esmClass: 0x04,
+			message:  []byte("id:1a2b3c sub:001 dlvrd:001 stat:DELIVRD err:000"),
+		}},
+		{"payload", sm{
+			dest:       "61412345678",
+			dataCoding: 0x01,
+			message:    long,
+		}},
+		{"empty", sm{}},
+	}
+	for _, p := range patterns {
+		t.Run(p.name, func(t *testing.T) {
+			s, err := unmarshalSM(p.sm.marshal())
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			// the validity period is only sent, so is not decoded.
+			expect := p.sm
+			expect.validityPeriod = ""
+			expect.tlvs = s.tlvs
+			if len(expect.message) == 0 {
+				expect.message = s.message
+			}
+			if !reflect.DeepEqual(s, expect) {
+				t.Errorf("expected %+v, got %+v", expect, s)
+			}
+			_, payload := s.tlvs[tagMessagePayload]
+			if payload != (len(p.sm.message) > maxShortMessage) {
+				t.Errorf("unexpected message_payload: %v", payload)
+			}
+		})
+	}
+}
+
+func TestUnmarshalSMTruncated(t *testing.T) {
+	b := sm{dest: "61412345678", message: []byte("hello")}.marshal()
+	for _, n := range []int{0, 1, 10, len(b) - 1} {
+		if _, err := unmarshalSM(b[:n]); err != errTruncated {
+			t.Errorf("length %d: expected %v, got %v", n, errTruncated, err)
+		}
+	}
+}
+
+func TestPDURoundTrip(t *testing.T) {
+	p := pdu{id: cmdSubmitSM, status: 0, seq: 42, body: []byte{1, 2, 3}}
+	var b bytes.Buffer
+	if err := writePDU(&b, p); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if b.Len() != 19 {
+		t.Errorf("expected 19 octets, got %d", b.Len())
+	}
+	r, err := readPDU(&b)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(r, p) {
+		t.Errorf("expected %+v, got %+v", p, r)
+	}
+}
@@ -0,0 +1,586 @@
+// Package smpp provides an upstream that sends SMSs via an SMSC, using SMPP
+// v3.4, as an alternative, or in addition, to the modems.
+package smpp
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/jpillora/backoff"
+	"github.com/warthog618/goatsms/internal/db"
+	"github.com/warthog618/goatsms/internal/modem"
+)
+
+// Config contains the settings used to bind to the SMSC.
+type Config struct {
+	// Address is the host and port of the SMSC, such as "smsc.example.com:2775".
+	Address    string
+	SystemID   string
+	Password   string
+	SystemType string
+	// Source is the address SMSs are sent from, either a number, in
+	// international format if prefixed with '+', or an alphanumeric sender
+	// ID, or empty to leave it to the SMSC.
+	Source string
+	// EnquireLink is the period between checks that the link to the SMSC is
+	// alive, or 0 for the default.
+	EnquireLink time.Duration
+}
+
+// defaultEnquireLink is the period between checks of the link, if not
+// configured.
+const defaultEnquireLink = 30 * time.Second
+
+// responseTimeout is the time allowed for the SMSC to respond to a request.
+const responseTimeout = 15 * time.Second
+
+// throttlePause is the time sending is paused after the SMSC indicates it
+// is temporarily unable to accept SMSs.
+const throttlePause = time.Second
+
+// Upstream sends SMSs via an SMSC.
+// It consumes SMSs from an SMSDispatcher in the same way as a modem, so the
+// dispatcher need not know the difference.
+type Upstream struct {
+	cfg      Config
+	deviceID string
+	// retryLimit is the number of times sending an SMS is retried, unless
+	// overridden by the SMS.
+	retryLimit int
+	// stopped is closed when the connection started by Connect ends.
+	stopped chan struct{}
+}
+
+// Option modifies the configuration of an Upstream.
+type Option func(*Upstream)
+
+// WithRetryLimit specifies the number of times sending an SMS that is
+// rejected by the SMSC is retried, unless overridden by the SMS.
+func WithRetryLimit(retries int) Option {
+	return func(u *Upstream) {
+		u.retryLimit = retries
+	}
+}
+
+// New creates an Upstream that sends SMSs as the device.
+func New(deviceID string, cfg Config, options ...Option) *Upstream {
+	if cfg.EnquireLink <= 0 {
+		cfg.EnquireLink = defaultEnquireLink
+	}
+	u := &Upstream{
+		cfg:        cfg,
+		deviceID:   deviceID,
+		retryLimit: db.SMSRetryLimit,
+		stopped:    make(chan struct{}),
+	}
+	for _, option := range options {
+		option(u)
+	}
+	return u
+}
+
+// Connect binds the Upstream to the SMSDispatcher.
+// Whenever it is bound to the SMSC, the Upstream attaches to the
+// SMSDispatcher and sends the SMSs it provides, returning the results via
+// the Rsp chan.
+// The connection remains until the context is done.
+// Connect must only be called once.
+func (u *Upstream) Connect(ctx context.Context, ss modem.SMSDispatcher) {
+	go u.monitor(ctx, ss)
+}
+
+// Stopped returns a channel that is closed once the connection started by
+// Connect has ended, after the context is done, and any send in progress has
+// completed.
+func (u *Upstream) Stopped() <-chan struct{} {
+	return u.stopped
+}
+
+func (u *Upstream) monitor(ctx context.Context, ss modem.SMSDispatcher) {
+	defer close(u.stopped)
+	connect := time.NewTimer(0) // for immediate connection
+	b := backoff.Backoff{
+		Min: time.Second,
+		Max: 5 * time.Minute,
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			if !connect.Stop() {
+				<-connect.C
+			}
+			return
+		case <-connect.C:
+			s, err := u.bind(ctx)
+			if err != nil {
+				log.Println("smpp bind failed:", u.deviceID, u.cfg.Address, err)
+				connect.Reset(b.Duration())
+				continue
+			}
+			log.Println("smpp bound:", u.deviceID, u.cfg.Address)
+			b.Reset()
+			go s.read(func(p pdu) { u.handle(ctx, s, ss, p) })
+			done := make(chan struct{})
+			go u.sender(ctx, s, ss, ss.Attach(u.deviceID), done)
+			select {
+			case <-ctx.Done():
+				ss.Detach(u.deviceID)
+				// allow the send in progress to complete before unbinding.
+				<-done
+				s.unbind()
+				log.Println("smpp closed:", u.deviceID)
+				return
+			case <-s.closed:
+				log.Println("smpp connection lost:", u.deviceID, s.err)
+				ss.Detach(u.deviceID)
+				<-done
+				connect.Reset(b.Duration())
+			}
+		}
+	}
+}
+
+// bind connects to the SMSC and binds as a transceiver, so delivery receipts
+// may be received on the same connection as SMSs are sent.
+func (u *Upstream) bind(ctx context.Context) (*session, error) {
+	d := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", u.cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	var b builder
+	b.cstring(u.cfg.SystemID)
+	b.cstring(u.cfg.Password)
+	b.cstring(u.cfg.SystemType)
+	b.WriteByte(0x34) // interface_version
+	b.WriteByte(0)    // addr_ton
+	b.WriteByte(0)    // addr_npi
+	b.cstring("")     // address_range
+	s := newSession(conn)
+	conn.SetDeadline(time.Now().Add(responseTimeout))
+	if err = writePDU(conn, pdu{id: cmdBindTransceiver, seq: s.nextSeq(), body: b.Bytes()}); err == nil {
+		var p pdu
+		if p, err = readPDU(conn); err == nil {
+			switch {
+			case p.id != cmdBindTransceiverRsp:
+				err = fmt.Errorf("unexpected response 0x%08x", p.id)
+			case p.status != 0:
+				err = statusError(p.status)
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return s, nil
+}
+
+// sender takes SMSs from the req channel, submits them to the SMSC, and
+// returns the updated SMS to the response channel of the SMSDispatcher.
+// The link is checked while idle, and the sender exits when the context is
+// done or the link fails, closing the done channel on exit.
+func (u *Upstream) sender(ctx context.Context, s *session, ss modem.SMSDispatcher, req <-chan db.SMS, done chan<- struct{}) {
+	defer close(done)
+	rsp := ss.Rsp()
+	enquire := time.NewTicker(u.cfg.EnquireLink)
+	defer enquire.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.closed:
+			return
+		case <-enquire.C:
+			if _, err := s.request(cmdEnquireLink, nil); err != nil {
+				log.Println("smpp enquire link failed:", u.deviceID, err)
+				s.close(err)
+				return
+			}
+		case sms, ok := <-req:
+			if !ok {
+				return
+			}
+			log.Println("sending: ", sms.UUID, u.deviceID)
+			segments, id, err := u.submit(s, sms)
+			var se statusError
+			switch {
+			case err == nil:
+				sms.Status = db.SMSSent
+				sms.Device = u.deviceID
+				sms.Segments = segments
+				sms.ErrorReason = ""
+				sms.PartsSent = 0
+				sms.MRs = ""
+				if sms.DeliveryReport {
+					// the message ID identifies the SMS in its delivery
+					// receipt.
+					sms.MRs = id
+				}
+			case errors.As(err, &se) && se.temporary():
+				// the SMSC, rather than the SMS, is at fault, so the SMS is
+				// returned to be retried without counting against it.
+				log.Println("smpp throttled:", u.deviceID, err)
+				sms.ErrorReason = err.Error()
+				rsp <- sms
+				select {
+				case <-ctx.Done():
+				case <-time.After(throttlePause):
+				}
+				continue
+			case errors.As(err, &se) || isPermanentError(err):
+				sms.ErrorReason = err.Error()
+				limit := u.retryLimit
+				if sms.MaxRetries != nil {
+					limit = *sms.MaxRetries
+				}
+				if sms.Retries >= limit || isPermanentError(err) {
+					sms.Status = db.SMSErrored
+				} else {
+					sms.Retries++
+				}
+			default:
+				// the link failed, so the SMS is returned to be retried
+				// without counting against it, and the link re-established.
+				log.Println("smpp connection failed while sending:", u.deviceID, err)
+				rsp <- sms
+				s.close(err)
+				return
+			}
+			rsp <- sms
+		}
+	}
+}
+
+// submit sends the SMS to the SMSC, returning the number of segments it is
+// expected to be delivered in, and the message ID assigned by the SMSC.
+func (u *Upstream) submit(s *session, msg db.SMS) (int, string, error) {
+	m, segments, err := encode(msg)
+	if err != nil {
+		return 0, "", err
+	}
+	m.sourceTON, m.sourceNPI, m.source = address(u.cfg.Source)
+	m.destTON, m.destNPI, m.dest = address(msg.Mobile)
+	m.protocolID = byte(msg.PID)
+	if expiry := msg.ExpiryTime(); !expiry.IsZero() {
+		ttl := time.Until(expiry)
+		if ttl <= 0 {
+			return 0, "", permanentError{modem.ErrExpired}
+		}
+		// so the SMSC does not deliver the SMS after it expires.
+		m.validityPeriod = relativeTime(ttl)
+	}
+	if msg.DeliveryReport {
+		m.registeredDelivery = 1
+	}
+	p, err := s.request(cmdSubmitSM, m.marshal())
+	if err != nil {
+		return 0, "", err
+	}
+	rp := parser{b: p.body}
+	id := rp.cstring()
+	return segments, id, nil
+}
+
+// handle processes a request from the SMSC, being a delivery receipt, a
+// check of the link, or the SMSC ending the session.
+func (u *Upstream) handle(ctx context.Context, s *session, ss modem.SMSDispatcher, p pdu) {
+	switch p.id {
+	case cmdDeliverSM:
+		s.respond(p, cmdDeliverSMRsp, []byte{0})
+		m, err := unmarshalSM(p.body)
+		if err != nil {
+			log.Println("smpp malformed deliver_sm:", u.deviceID, err)
+			return
+		}
+		if m.esmClass&0x3c != 0x04 {
+			log.Println("smpp ignoring mobile originated sms:", u.deviceID, m.source)
+			return
+		}
+		if id, delivered, reason, final := parseReceipt(m); final {
+			ss.Report(ctx, u.deviceID, id, delivered, reason)
+		}
+	case cmdEnquireLink:
+		s.respond(p, cmdEnquireLinkRsp, nil)
+	case cmdUnbind:
+		s.respond(p, cmdUnbindRsp, nil)
+		s.close(errors.New("unbound by SMSC"))
+	default:
+		s.respond(p, cmdGenericNack, nil)
+	}
+}
+
+// receiptStates maps the final message states reported in delivery
+// receipts, in both the message_state parameter and the receipt text, to
+// the reason reported for SMSs that were not delivered.
+var receiptStates = map[string]string{
+	"2": "", "DELIVRD": "",
+	"3": "EXPIRED", "EXPIRED": "EXPIRED",
+	"4": "DELETED", "DELETED": "DELETED",
+	"5": "UNDELIV", "UNDELIV": "UNDELIV",
+	"7": "UNKNOWN", "UNKNOWN": "UNKNOWN",
+	"8": "REJECTD", "REJECTD": "REJECTD",
+}
+
+// parseReceipt extracts the message ID and outcome from a delivery receipt,
+// such as "id:1a2b3c sub:001 dlvrd:001 submit date:... stat:DELIVRD err:000".
+// The receipted_message_id and message_state parameters take precedence
+// over the receipt text, if present.
+// Receipts reporting an intermediate state, such as ENROUTE, are not final.
+func parseReceipt(m sm) (id string, delivered bool, reason string, final bool) {
+	var state string
+	for _, f := range strings.Fields(string(m.message)) {
+		switch {
+		case strings.HasPrefix(f, "id:"):
+			id = strings.TrimPrefix(f, "id:")
+		case strings.HasPrefix(f, "stat:"):
+			state = strings.TrimPrefix(f, "stat:")
+		}
+	}
+	if v, ok := m.tlvs[tagReceiptedMessageID]; ok {
+		id = strings.TrimRight(string(v), "\x00")
+	}
+	if v, ok := m.tlvs[tagMessageState]; ok && len(v) == 1 {
+		state = fmt.Sprint(v[0])
+	}
+	reason, final = receiptStates[strings.ToUpper(state)]
+	return id, final && reason == "", reason, final && id != ""
+}
+
+// permanentError indicates the SMS cannot be sent by any retry, such as it
+// being malformed or expired.
+type permanentError struct {
+	error
+}
+
+func isPermanentError(err error) bool {
+	var ee permanentError
+	return errors.As(err, &ee)
+}
+
+// encode converts the SMS to a short message, returning it and the number of
+// segments it is expected to be delivered in.
+// Text is sent as ASCII, if possible, else UCS2, with messages too long for
+// one segment left to the SMSC to split.
+func encode(msg db.SMS) (sm, int, error) {
+	var m sm
+	// the single segment length, and the segment length when split.
+	single, split := 140, 134
+	switch {
+	case msg.Data:
+		payload, err := hex.DecodeString(msg.Body)
+		if err != nil {
+			return m, 0, permanentError{fmt.Errorf("invalid data: %v", err)}
+		}
+		udh, err := hex.DecodeString(msg.UDH)
+		if err != nil {
+			return m, 0, permanentError{fmt.Errorf("invalid udh: %v", err)}
+		}
+		m.dataCoding = 0x04
+		if len(udh) > 0 {
+			m.esmClass = 0x40 // UDHI
+			payload = append(append([]byte{byte(len(udh))}, udh...), payload...)
+		}
+		m.message = payload
+	case isASCII(msg.Body):
+		m.dataCoding = 0x01 // IA5
+		m.message = []byte(msg.Body)
+		single, split = 160, 153
+	default:
+		m.dataCoding = 0x08 // UCS2
+		for _, c := range utf16.Encode([]rune(msg.Body)) {
+			m.message = append(m.message, byte(c>>8), byte(c))
+		}
+	}
+	segments := 1
+	if len(m.message) > single {
+		segments = (len(m.message) + split - 1) / split
+	}
+	return m, segments, nil
+}
+
+// relativeTime formats a duration as an SMPP relative time, as used for the
+// validity period, such as "000000000230000R" for 2 minutes 30 seconds.
+// Durations longer than can be represented are capped at 99 days.
+func relativeTime(d time.Duration) string {
+	secs := int64(d / time.Second)
+	if max := int64(99*24*60*60 + 23*60*60 + 59*60 + 59); secs > max {
+		secs = max
+	}
+	return fmt.Sprintf("0000%02d%02d%02d%02d000R", secs/86400, secs/3600%24, secs/60%60, secs%60)
+}
+
+// isASCII indicates the text contains only printable ASCII, and line breaks.
+func isASCII(s string) bool {
+	for _, c := range s {
+		if (c < 0x20 || c > 0x7e) && c != '\n' && c != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// address returns the type of number, numbering plan indicator and digits
+// of an address, which is international if prefixed with '+', alphanumeric
+// if it contains anything other than digits, and otherwise of unknown type.
+func address(a string) (ton, npi byte, addr string) {
+	switch {
+	case a == "":
+		return 0, 0, ""
+	case strings.HasPrefix(a, "+"):
+		return 1, 1, a[1:]
+	case strings.Trim(a, "0123456789") == "":
+		return 0, 1, a
+	default:
+		return 5, 0, a
+	}
+}
+
+// statusError is the command status of a request rejected by the SMSC.
+type statusError uint32
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("smpp command status 0x%08x", uint32(e))
+}
+
+// temporary indicates the SMSC is temporarily unable to accept the request.
+func (e statusError) temporary() bool {
+	return uint32(e) == statusThrottled || uint32(e) == statusMsgQueueFull
+}
+
+// session is a bound connection to the SMSC, over which requests and their
+// responses are multiplexed.
+type session struct {
+	conn net.Conn
+	// wmu serialises writes to the connection.
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	seq     uint32
+	pending map[uint32]chan pdu
+	// closed is closed when the session ends, and err is the cause.
+	closed chan struct{}
+	err    error
+}
+
+func newSession(conn net.Conn) *session {
+	return &session{
+		conn:    conn,
+		pending: make(map[uint32]chan pdu),
+		closed:  make(chan struct{}),
+	}
+}
+
+// nextSeq returns the sequence number for the next request.
+func (s *session) nextSeq() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	if s.seq > 0x7fffffff {
+		s.seq = 1
+	}
+	return s.seq
+}
+
+// write sends a PDU to the SMSC.
+func (s *session) write(p pdu) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(responseTimeout))
+	return writePDU(s.conn, p)
+}
+
+// request sends a request to the SMSC and waits for its response.
+// Returns a statusError if the SMSC rejects the request.
+func (s *session) request(id uint32, body []byte) (pdu, error) {
+	seq := s.nextSeq()
+	rc := make(chan pdu, 1)
+	s.mu.Lock()
+	s.pending[seq] = rc
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, seq)
+		s.mu.Unlock()
+	}()
+	if err := s.write(pdu{id: id, seq: seq, body: body}); err != nil {
+		s.close(err)
+		return pdu{}, err
+	}
+	t := time.NewTimer(responseTimeout)
+	defer t.Stop()
+	select {
+	case p := <-rc:
+		if p.status != 0 {
+			return p, statusError(p.status)
+		}
+		if p.id != id|cmdGenericNack {
+			return p, fmt.Errorf("unexpected response 0x%08x", p.id)
+		}
+		return p, nil
+	case <-s.closed:
+		return pdu{}, s.err
+	case <-t.C:
+		return pdu{}, errors.New("smpp response timeout")
+	}
+}
+
+// respond sends the response to a request from the SMSC.
+func (s *session) respond(req pdu, id uint32, body []byte) {
+	if err := s.write(pdu{id: id, seq: req.seq, body: body}); err != nil {
+		s.close(err)
+	}
+}
+
+// read reads PDUs from the SMSC until the session ends, passing responses
+// to the pending requests, and requests to the handler.
+func (s *session) read(handler func(pdu)) {
+	for {
+		p, err := readPDU(s.conn)
+		if err != nil {
+			s.close(err)
+			return
+		}
+		if !p.isResponse() {
+			handler(p)
+			continue
+		}
+		s.mu.Lock()
+		rc, ok := s.pending[p.seq]
+		s.mu.Unlock()
+		if ok {
+			rc <- p
+		}
+	}
+}
+
+// close ends the session, recording the cause.
+func (s *session) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	s.err = err
+	close(s.closed)
+	s.conn.Close()
+}
+
+// unbind ends the session cleanly, such as on shutdown.
+func (s *session) unbind() {
+	if _, err := s.request(cmdUnbind, nil); err != nil {
+		log.Println("smpp unbind failed:", err)
+	}
+	s.close(errors.New("unbound"))
+}
@@ -0,0 +1,135 @@
+package smpp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warthog618/goatsms/internal/db"
+)
+
+func TestParseReceipt(t *testing.T) {
+	patterns := []struct {
+		name      string
+		text      string
+		tlvs      map[uint16][]byte
+		id        string
+		delivered bool
+		reason    string
+		final     bool
+	}{
+		{"delivered", "id:1a2b3c sub:001 dlvrd:001 submit date:2603141509 done date:2603141510 stat:DELIVRD err:000",
+			nil, "1a2b3c", true, "", true},
+		{"expired", "id:1a2b3c sub:001 dlvrd:000 stat:EXPIRED err:000",
+			nil, "1a2b3c", false, "EXPIRED", true},
+		{"undeliverable", "id:1a2b3c stat:UNDELIV",
+			nil, "1a2b3c", false, "UNDELIV", true},
+		{"lower case", "id:1a2b3c stat:rejectd",
+			nil, "1a2b3c", false, "REJECTD", true},
+		{"enroute", "id:1a2b3c stat:ENROUTE",
+			nil, "1a2b3c", false, "", false},
+		{"no id", "stat:DELIVRD",
+			nil, "", true, "", false},
+		{"tlvs", "",
+			map[uint16][]byte{tagReceiptedMessageID: []byte("4d5e\x00"), tagMessageState: {2}},
+			"4d5e", true, "", true},
+		{"tlvs override text", "id:1a2b3c stat:DELIVRD",
+			map[uint16][]byte{tagReceiptedMessageID: []byte("4d5e"), tagMessageState: {5}},
+			"4d5e", false, "UNDELIV", true},
+		{"tlv accepted", "",
+			map[uint16][]byte{tagReceiptedMessageID: []byte("4d5e"), tagMessageState: {6}},
+			"4d5e", false, "", false},
+	}
+	for _, p := range patterns {
+		t.Run(p.name, func(t *testing.T) {
+			id, delivered, reason, final := parseReceipt(sm{message: []byte(p.text), tlvs: p.tlvs})
+			if id != p.id {
+				t.Errorf("expected id %q, got %q", p.id, id)
+			}
+			if delivered != p.delivered {
+				t.Errorf("expected delivered %v, got %v", p.delivered, delivered)
+			}
+			if reason != p.reason {
+				t.Errorf("expected reason %q, got %q", p.reason, reason)
+			}
+			if final != p.final {
+				t.Errorf("expected final %v, got %v", p.final, final)
+			}
+		})
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+	patterns := []struct {
+		d      time.Duration
+		expect string
+	}{
+		{0, "000000000000000R"},
+		{30 * time.Second, "000000000030000R"},
+		{2*time.Minute + 30*time.Second, "000000000230000R"},
+		{4*time.Minute + 59*time.Second + 900*time.Millisecond, "000000000459000R"},
+		{25 * time.Hour, "000001010000000R"},
+		{99*24*time.Hour + 23*time.Hour + 59*time.Minute + 59*time.Second, "000099235959000R"},
+		{365 * 24 * time.Hour, "000099235959000R"},
+	}
+	for _, p := range patterns {
+		t.Run(p.d.String(), func(t *testing.T) {
+			v := relativeTime(p.d)
+			if v != p.expect {
+				t.Errorf("expected %s, got %s", p.expect, v)
+			}
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	patterns := []struct {
+		name       string
+		msg        db.SMS
+		dataCoding byte
+		esmClass   byte
+		message    []byte
+		segments   int
+		err        bool
+	}{
+		{"ascii", db.SMS{Body: "hello\nworld"}, 0x01, 0, []byte("hello\nworld"), 1, false},
+		{"ascii full", db.SMS{Body: strings.Repeat("a", 160)}, 0x01, 0, bytes.Repeat([]byte{'a'}, 160), 1, false},
+		{"ascii split", db.SMS{Body: strings.Repeat("a", 161)}, 0x01, 0, bytes.Repeat([]byte{'a'}, 161), 2, false},
+		{"ucs2", db.SMS{Body: "héllo"}, 0x08, 0,
+			[]byte{0x00, 0x68, 0x00, 0xe9, 0x00, 0x6c, 0x00, 0x6c, 0x00, 0x6f}, 1, false},
+		{"ucs2 surrogates", db.SMS{Body: "😀"}, 0x08, 0, []byte{0xd8, 0x3d, 0xde, 0x00}, 1, false},
+		{"ucs2 split", db.SMS{Body: strings.Repeat("é", 71)}, 0x08, 0, bytes.Repeat([]byte{0x00, 0xe9}, 71), 2, false},
+		{"data", db.SMS{Data: true, Body: "deadbeef"}, 0x04, 0, []byte{0xde, 0xad, 0xbe, 0xef}, 1, false},
+		{"data udh", db.SMS{Data: true, Body: "dead", UDH: "00032a0201"}, 0x04, 0x40,
+			[]byte{0x05, 0x00, 0x03, 0x2a, 0x02, 0x01, 0xde, 0xad}, 1, false},
+		{"invalid data", db.SMS{Data: true, Body: "xyz"}, 0, 0, nil, 0, true},
+		{"invalid udh", db.SMS{Data: true, Body: "dead", UDH: "0"}, 0, 0, nil, 0, true},
+	}
+	for _, p := range patterns {
+		t.Run(p.name, func(t *testing.T) {
+			m, segments, err := encode(p.msg)
+			if p.err {
+				if !isPermanentError(err) {
+					t.Fatalf("expected permanent error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if m.dataCoding != p.dataCoding {
+				t.Errorf("expected data_coding 0x%02x, got 0x%02x", p.dataCoding, m.dataCoding)
+			}
+			if m.esmClass != p.esmClass {
+				t.Errorf("expected esm_class 0x%02x, got 0x%02x", p.esmClass, m.esmClass)
+			}
+			if !bytes.Equal(m.message, p.message) {
+				t.Errorf("expected % x, got % x", p.message, m.message)
+			}
+			if segments != p.segments {
+				t.Errorf("expected %d segments, got %d", p.segments, segments)
+			}
+		})
+	}
+}
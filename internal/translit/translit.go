@@ -0,0 +1,138 @@
+// Package translit converts text to the characters representable in the
+// GSM 7-bit default alphabet.
+package translit
+
+import (
+	"strings"
+
+	"github.com/warthog618/sms/encoding/gsm7/charset"
+)
+
+// Replacement is the character substituted for characters that cannot be
+// represented in the GSM 7-bit default alphabet.
+const Replacement = '?'
+
+var (
+	gsm7    = charset.DefaultEncoder()
+	gsm7Ext = charset.DefaultExtEncoder()
+)
+
+// Table maps characters outside the GSM 7-bit default alphabet to their
+// nearest representable equivalent.
+type Table map[rune]string
+
+// table is the default transliteration table.
+// Accented characters that are in the alphabet, such as é, are not included.
+var table = Table{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ā': "A", 'Ă': "A", 'Ą': "A",
+	'á': "a", 'â': "a", 'ã': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'Ć': "C", 'Ĉ': "C", 'Č': "C",
+	'ç': "c", 'ć': "c", 'ĉ': "c", 'č': "c",
+	'Ď': "D", 'Đ': "D", 'ď': "d", 'đ': "d",
+	'È': "E", 'Ê': "E", 'Ë': "E", 'Ē': "E", 'Ė': "E", 'Ę': "E", 'Ě': "E",
+	'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'Ğ': "G", 'ğ': "g",
+	'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I", 'Ī': "I", 'İ': "I",
+	'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'ı': "i",
+	'Ł': "L", 'Ľ': "L", 'ł': "l", 'ľ': "l",
+	'Ń': "N", 'Ň': "N", 'ń': "n", 'ň': "n",
+	'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ō': "O", 'Ő': "O",
+	'ó': "o", 'ô': "o", 'õ': "o", 'ō': "o", 'ő': "o",
+	'Œ': "OE", 'œ': "oe",
+	'Ř': "R", 'ř': "r",
+	'Ś': "S", 'Ş': "S", 'Š': "S", 'ś': "s", 'ş': "s", 'š': "s",
+	'Ţ': "T", 'Ť': "T", 'ţ': "t", 'ť': "t",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ū': "U", 'Ů': "U", 'Ű': "U",
+	'ú': "u", 'û': "u", 'ū': "u", 'ů': "u", 'ű': "u",
+	'Ý': "Y", 'Ÿ': "Y", 'ý': "y", 'ÿ': "y",
+	'Ź': "Z", 'Ż': "Z", 'Ž': "Z", 'ź': "z", 'ż': "z", 'ž': "z",
+	'‘': "'", '’': "'", '‚': "'", '′': "'",
+	'“': "\"", '”': "\"", '„': "\"", '«': "\"", '»': "\"", '″': "\"",
+	'‐': "-", '‑': "-", '–': "-", '—': "-", '−': "-",
+	'…': "...", '•': "*", '·': ".",
+	'\u00a0': " ", '\u202f': " ", '\u200b': "",
+	'\t': " ",
+	'¢':  "c", '©': "(c)", '®': "(R)", '™': "TM",
+}
+
+// DefaultTable returns a copy of the default transliteration table, which may
+// be modified to suit particular needs.
+func DefaultTable() Table {
+	t := make(Table, len(table))
+	for r, s := range table {
+		t[r] = s
+	}
+	return t
+}
+
+// ToGSM7 returns the text with characters that are not in the GSM 7-bit
+// default alphabet transliterated to their nearest equivalent, or replaced
+// with the Replacement if there is none.
+func ToGSM7(text string) string {
+	return table.ToGSM7(text)
+}
+
+// ReplaceGSM7 returns the text with characters that are not in the GSM 7-bit
+// default alphabet replaced with the Replacement.
+func ReplaceGSM7(text string) string {
+	return convert(text, nil, true)
+}
+
+// ToGSM7 returns the text with characters that are not in the GSM 7-bit
+// default alphabet transliterated to their equivalent in the table, or
+// replaced with the Replacement if there is none.
+func (t Table) ToGSM7(text string) string {
+	return convert(text, t, true)
+}
+
+// Transliterate returns the text with characters that are not in the GSM
+// 7-bit default alphabet transliterated to their equivalent in the table.
+// Characters with no equivalent are left unchanged.
+func (t Table) Transliterate(text string) string {
+	return convert(text, t, false)
+}
+
+// IsGSM7 indicates if the text only contains characters in the GSM 7-bit
+// default alphabet.
+func IsGSM7(text string) bool {
+	for _, r := range text {
+		if !representable(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// convert transliterates the characters of the text not in the GSM 7-bit
+// default alphabet using the table, and replaces those with no equivalent
+// if replace is set.
+func convert(text string, t Table, replace bool) string {
+	if IsGSM7(text) {
+		return text
+	}
+	var b strings.Builder
+	for _, r := range text {
+		if representable(r) {
+			b.WriteRune(r)
+			continue
+		}
+		if s, ok := t[r]; ok {
+			b.WriteString(s)
+			continue
+		}
+		if replace {
+			b.WriteRune(Replacement)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func representable(r rune) bool {
+	if _, ok := gsm7[r]; ok {
+		return true
+	}
+	_, ok := gsm7Ext[r]
+	return ok
+}